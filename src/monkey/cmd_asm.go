@@ -0,0 +1,53 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monkey/gen_x64"
+	"os"
+)
+
+func asmCommand(args []string) int {
+	fs := newFlagSet("asm", "[-o file.s] file.mk")
+	output := fs.String("o", "", "output file (default: stdout)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	filename, src, err := readSource(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+
+	// compile(to bytecode)
+	comp, status := compile(filename, src)
+	if comp == nil {
+		return status
+	}
+
+	// compile(x86 code generation)
+	g := gen_x64.New(comp.Bytecode())
+	err = g.Genx64()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "code generation error: %s\n", err)
+		return exitCompileError
+	}
+
+	if *output == "" || *output == "-" {
+		fmt.Print(g.Assembly().String())
+		return exitOK
+	}
+
+	err = ioutil.WriteFile(*output, g.Assembly().Bytes(), 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+
+	return exitOK
+}
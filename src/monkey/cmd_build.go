@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"monkey/compiler"
+	"monkey/gen_x64"
+	"os"
+	"strings"
+)
+
+// build targets
+const (
+	targetBytecode = "bytecode"
+	targetX64      = "x64"
+)
+
+func buildCommand(args []string) int {
+	fs := newFlagSet("build", "[-target bytecode|x64] [-toolchain system|go] [-o file] file.mk")
+	output := fs.String("o", "", "output file (default: input with .mkc extension, stdout for stdin; input without .mk for x64)")
+	target := fs.String("target", "", "bytecode or x64 (default: x64 when -o names a file without .mkc extension)")
+	toolchain := fs.String("toolchain", gen_x64.ToolchainSystem, "assembler and linker for x64: system (as and ld) or go (built in)")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	if *target == "" {
+		*target = targetBytecode
+		if *output != "" && *output != "-" && !strings.HasSuffix(*output, ".mkc") {
+			*target = targetX64
+		}
+	}
+	if *target != targetBytecode && *target != targetX64 {
+		fmt.Fprintf(os.Stderr, "build: unknown target %q\n", *target)
+		return exitUsage
+	}
+	if *toolchain != gen_x64.ToolchainSystem && *toolchain != gen_x64.ToolchainGo {
+		fmt.Fprintf(os.Stderr, "build: unknown toolchain %q\n", *toolchain)
+		return exitUsage
+	}
+
+	filename, src, err := readSource(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+
+	comp, status := compile(filename, src)
+	if comp == nil {
+		return status
+	}
+
+	if *target == targetX64 {
+		return buildExecutable(filename, comp.Bytecode(), *output, *toolchain)
+	}
+
+	var buf bytes.Buffer
+	err = compiler.Encode(&buf, comp.Bytecode())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compile error: %s\n", err)
+		return exitCompileError
+	}
+
+	out := *output
+	if out == "" && filename != stdinName {
+		out = strings.TrimSuffix(filename, ".mk") + ".mkc"
+	}
+	if out == "" || out == "-" {
+		os.Stdout.Write(buf.Bytes())
+		return exitOK
+	}
+
+	err = ioutil.WriteFile(out, buf.Bytes(), 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+
+	return exitOK
+}
+
+// buildExecutable writes a static x64 executable, which runs without monkey and libc.
+func buildExecutable(filename string, bytecode *compiler.Bytecode, output, toolchain string) int {
+	out := output
+	if out == "" && filename != stdinName {
+		out = strings.TrimSuffix(filename, ".mk")
+		if out == filename {
+			out += ".out"
+		}
+	}
+	// 実行ファイルはstdoutに書かない
+	if out == "" || out == "-" {
+		fmt.Fprintln(os.Stderr, "build: an executable needs an output file (-o)")
+		return exitUsage
+	}
+
+	g := gen_x64.New(bytecode)
+	err := g.Genx64()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "code generation error: %s\n", err)
+		return exitCompileError
+	}
+
+	err = gen_x64.Link(g.Executable().Bytes(), out, toolchain)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "link error: %s\n", err)
+		return exitCompileError
+	}
+
+	return exitOK
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"monkey/compiler"
+	"os"
+)
+
+func disasmCommand(args []string) int {
+	fs := newFlagSet("disasm", "file.mk | file.mkc")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	filename, src, err := readSource(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+
+	bytecode, symbolTable, status := loadBytecode(filename, src)
+	if bytecode == nil {
+		return status
+	}
+
+	compiler.Disassemble(os.Stdout, bytecode, symbolTable)
+
+	return exitOK
+}
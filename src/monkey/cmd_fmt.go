@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"monkey/format"
+	"os"
+)
+
+func fmtCommand(args []string) int {
+	fs := newFlagSet("fmt", "[-w] [file.mk ...]")
+	write := fs.Bool("w", false, "write result to the source file instead of stdout")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	if fs.NArg() == 0 {
+		if *write {
+			fmt.Fprintln(os.Stderr, "fmt: cannot use -w with stdin")
+			return exitUsage
+		}
+		return formatFile(nil, false)
+	}
+
+	status := exitOK
+	for _, filename := range fs.Args() {
+		if s := formatFile([]string{filename}, *write); s != exitOK {
+			status = s
+		}
+	}
+	return status
+}
+
+func formatFile(args []string, write bool) int {
+	filename, src, err := readSource(args)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+
+	out, err := format.Source(filename, src)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitParseError
+	}
+
+	if !write {
+		os.Stdout.Write(out)
+		return exitOK
+	}
+
+	err = ioutil.WriteFile(filename, out, 0644)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+	return exitOK
+}
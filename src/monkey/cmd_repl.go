@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"monkey/repl"
+	"os"
+	"os/user"
+)
+
+func replCommand(args []string) int {
+	fs := newFlagSet("repl", "[-engine eval|vm]")
+	engine := fs.String("engine", "eval", "use 'eval' or 'vm'")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+
+	name := "there"
+	if u, err := user.Current(); err == nil {
+		name = u.Username
+	}
+
+	switch *engine {
+	case "eval":
+		fmt.Printf("Hello %s\n", name)
+		fmt.Printf("This is interpreter mode. Feel free to type in commands\n")
+		repl.StartInterpreter(os.Stdin, os.Stdout)
+	case "vm":
+		fmt.Printf("Hello %s\n", name)
+		fmt.Printf("This is compiler mode. Feel free to type in commands\n")
+		repl.StartVm(os.Stdin, os.Stdout)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown engine %q: use 'eval' or 'vm'\n", *engine)
+		return exitUsage
+	}
+
+	return exitOK
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"monkey/code"
+	"monkey/evaluator"
+	"monkey/object"
+	"monkey/vm"
+	"os"
+	"strings"
+)
+
+func runCommand(args []string) int {
+	fs := newFlagSet("run", "[-engine eval|vm] [file.mk | file.mkc | -]")
+	engine := fs.String("engine", "eval", "use 'eval' or 'vm'")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() > 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	filename, src, err := readSource(fs.Args())
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+
+	// bytecodeはvmでしか動かない
+	if strings.HasSuffix(filename, ".mkc") {
+		*engine = "vm"
+	}
+
+	switch *engine {
+	case "eval":
+		return runEval(filename, src)
+	case "vm":
+		return runVm(filename, src)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown engine %q: use 'eval' or 'vm'\n", *engine)
+		return exitUsage
+	}
+}
+
+func runEval(filename string, src []byte) int {
+	program, ok := parse(filename, src)
+	if !ok {
+		return exitParseError
+	}
+
+	env := object.NewEnvironment()
+	evaluated := evaluator.Eval(program, env)
+	if err, ok := evaluated.(*object.Error); ok {
+		io.WriteString(os.Stderr, err.RuntimeError().StackTrace())
+		return exitRuntimeError
+	}
+	if evaluated != nil {
+		fmt.Println(evaluated.Inspect())
+	}
+
+	return exitOK
+}
+
+func runVm(filename string, src []byte) int {
+	bytecode, _, status := loadBytecode(filename, src)
+	if bytecode == nil {
+		return status
+	}
+
+	machine := vm.New(bytecode)
+	err := machine.Run()
+	if rerr, ok := err.(*object.RuntimeError); ok {
+		io.WriteString(os.Stderr, rerr.StackTrace())
+		return exitRuntimeError
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitRuntimeError
+	}
+
+	// evalと同じく、最後の文が式のときだけその値を表示する
+	ins := bytecode.Instructions
+	if len(ins) > 0 && code.Opcode(ins[len(ins)-1]) == code.OpPop {
+		fmt.Println(machine.LastPoppedStackElem().Inspect())
+	}
+
+	return exitOK
+}
@@ -4,10 +4,26 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"monkey/token"
 )
 
 type Instructions []byte
 
+// SourceMap maps the offset of an instruction to the source position
+// of the node it was compiled from.
+type SourceMap map[int]token.Position
+
+// Lookup returns the position of the instruction containing offset.
+// offset may point into the operands of an instruction.
+func (sm SourceMap) Lookup(offset int) token.Position {
+	for o := offset; o >= 0; o-- {
+		if pos, ok := sm[o]; ok {
+			return pos
+		}
+	}
+	return token.Position{}
+}
+
 type Opcode byte
 
 const (
@@ -40,6 +56,19 @@ const (
 	OpGetBuiltin
 	OpClosure
 	OpGetFree
+	OpSetFree
+	OpMod
+	OpLessThan
+	OpLessEqual
+	OpGreaterEqual
+	OpSlice
+	OpCurrentClosure
+	OpTailCall
+	OpImport
+	OpMakeCell
+	OpGetLocalCell
+	OpSetLocalCell
+	OpGetFreeCell
 )
 
 type Definition struct {
@@ -80,6 +109,57 @@ var definitions = map[Opcode]*Definition{
 	OpGetBuiltin: {"OpGetBuiltin", []int{1}},
 	OpClosure:    {"OpClosure", []int{2, 1}}, // arg: index of constantpool(2byte), size of free variables(1byte)
 	OpGetFree:    {"OpGetFree", []int{1}},
+	// code.OpSetFree assigns to a free variable of the current closure.
+	// A free variable which is assigned is a cell shared with the function that defined it
+	// and the other closures, so OpSetFree sets the value of the cell and all of them see it.
+	OpSetFree: {"OpSetFree", []int{1}},
+	// the operands of comparisons are evaluated left to right, so < is not compiled as a swapped >.
+	OpMod:          {"OpMod", []int{}},
+	OpLessThan:     {"OpLessThan", []int{}},
+	OpLessEqual:    {"OpLessEqual", []int{}},
+	OpGreaterEqual: {"OpGreaterEqual", []int{}},
+	// code.OpSlice takes left, low and high from the stack. An omitted bound is null.
+	OpSlice: {"OpSlice", []int{}},
+	// code.OpCurrentClosure pushes the closure being executed, for functions that call themselves.
+	OpCurrentClosure: {"OpCurrentClosure", []int{}},
+	// code.OpTailCall is an OpCall followed by OpReturnValue. A closure is run in the frame
+	// of the caller. The OpReturnValue after it is still executed when a builtin is called.
+	OpTailCall: {"OpTailCall", []int{1}},
+	// code.OpImport pushes an imported module. Operands are the constant index of the function
+	// that runs the module and the global that keeps the module once it has run.
+	OpImport: {"OpImport", []int{2, 2}},
+	// Locals captured by closures and assigned are cells (see object.Cell).
+	// code.OpMakeCell pops a value and puts a new cell holding it in the local.
+	// It is run when the function starts, for the parameters and the lets.
+	OpMakeCell: {"OpMakeCell", []int{1}},
+	// code.OpGetLocalCell and code.OpSetLocalCell get and set the value of the cell in the local.
+	OpGetLocalCell: {"OpGetLocalCell", []int{1}},
+	OpSetLocalCell: {"OpSetLocalCell", []int{1}},
+	// code.OpGetFreeCell pushes the value of the cell in the free variable.
+	// OpGetFree pushes the cell itself, to pass it on to an inner closure.
+	OpGetFreeCell: {"OpGetFreeCell", []int{1}},
+}
+
+// operators are the infix operators of the source compiled into each opcode.
+var operators = map[Opcode]string{
+	OpAdd:          "+",
+	OpSub:          "-",
+	OpMul:          "*",
+	OpDiv:          "/",
+	OpMod:          "%",
+	OpEqual:        "==",
+	OpNotEqual:     "!=",
+	OpGreaterThan:  ">",
+	OpLessThan:     "<",
+	OpGreaterEqual: ">=",
+	OpLessEqual:    "<=",
+}
+
+// Operator returns the infix operator of the source compiled into op,
+// so that errors of the vm name operators like the evaluator.
+func Operator(op Opcode) (string, bool) {
+	operator, ok := operators[op]
+	return operator, ok
 }
 
 // Lookup returns *Definition of opcode
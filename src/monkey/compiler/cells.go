@@ -0,0 +1,119 @@
+package compiler
+
+import (
+	"monkey/ast"
+	"sort"
+)
+
+// cellNames returns the names of the locals of fn which have to be cells:
+// the locals captured by a closure inside fn and assigned, by fn or by a closure.
+// A let run in a loop, or of a name defined before, assigns the same local again.
+//
+// It looks at names only, so a name shadowed inside a closure may make a cell
+// which isn't needed. That is slower, but still right.
+func cellNames(fn *ast.FunctionLiteral) []string {
+	f := &cellFinder{
+		defines:  map[string]int{},
+		captured: map[string]bool{},
+		assigned: map[string]bool{},
+	}
+	for _, p := range fn.Parameters {
+		f.defines[p.Value]++
+	}
+	f.walk(fn.Body)
+
+	names := []string{}
+	for name, n := range f.defines {
+		if f.captured[name] && (f.assigned[name] || n > 1) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+type cellFinder struct {
+	// parameters and lets of the function
+	defines map[string]int
+	// names used inside closures
+	captured map[string]bool
+	assigned map[string]bool
+
+	// closures and loops of the function around the node
+	closures int
+	loops    int
+}
+
+func (f *cellFinder) walk(node ast.Node) {
+	switch node := node.(type) {
+	case *ast.BlockStatement:
+		for _, s := range node.Statements {
+			f.walk(s)
+		}
+	case *ast.ExpressionStatement:
+		f.walk(node.Expression)
+	case *ast.ReturnStatement:
+		f.walk(node.ReturnValue)
+	case *ast.LetStatement:
+		if f.closures == 0 {
+			f.defines[node.Name.Value]++
+			if f.loops > 0 {
+				f.assigned[node.Name.Value] = true
+			}
+		}
+		f.walk(node.Value)
+	case *ast.WhileStatement:
+		f.walk(node.Condition)
+		f.loops++
+		f.walk(node.Body)
+		f.loops--
+	case *ast.Identifier:
+		if f.closures > 0 {
+			f.captured[node.Value] = true
+		}
+	case *ast.AssignExpression:
+		f.walk(node.Name)
+		f.assigned[node.Name.Value] = true
+		f.walk(node.Value)
+	case *ast.FunctionLiteral:
+		// closureの中のloopはこの関数のletを繰り返さない
+		loops := f.loops
+		f.closures++
+		f.loops = 0
+		f.walk(node.Body)
+		f.closures--
+		f.loops = loops
+	case *ast.PrefixExpression:
+		f.walk(node.Right)
+	case *ast.InfixExpression:
+		f.walk(node.Left)
+		f.walk(node.Right)
+	case *ast.IfExpression:
+		f.walk(node.Condition)
+		f.walk(node.Consequence)
+		if node.Alternative != nil {
+			f.walk(node.Alternative)
+		}
+	case *ast.CallExpression:
+		f.walk(node.Function)
+		for _, a := range node.Arguments {
+			f.walk(a)
+		}
+	case *ast.ArrayLiteral:
+		for _, el := range node.Elements {
+			f.walk(el)
+		}
+	case *ast.HashLiteral:
+		for k, v := range node.Pairs {
+			f.walk(k)
+			f.walk(v)
+		}
+	case *ast.IndexExpression:
+		f.walk(node.Left)
+		f.walk(node.Index)
+	case *ast.SliceExpression:
+		f.walk(node.Left)
+		f.walk(node.Low)
+		f.walk(node.High)
+	}
+}
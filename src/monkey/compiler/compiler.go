@@ -4,8 +4,12 @@ import (
 	"fmt"
 	"monkey/ast"
 	"monkey/code"
+	"monkey/lexer"
 	"monkey/object"
+	"monkey/parser"
+	"monkey/token"
 	"sort"
+	"strings"
 )
 
 type Compiler struct {
@@ -15,12 +19,51 @@ type Compiler struct {
 
 	scopes     []CompilationScope
 	scopeIndex int
+
+	// position of the node being compiled
+	pos token.Position
+
+	// whether the node being compiled is a statement of a loop body,
+	// directly or through if statements, where break and continue can jump
+	// without leaving values on the stack
+	loopControl bool
+
+	// imported modules by path, the paths of the modules being compiled,
+	// and the module being compiled (nil for the main program)
+	modules   map[string]compiledModule
+	importing []string
+	module    *moduleScope
+
+	// reads the imported files (nil for object.FileLoader)
+	loader object.Loader
+}
+
+// compiledModule is a module compiled into a function run by OpImport.
+type compiledModule struct {
+	constIndex  int
+	globalIndex int
+}
+
+// moduleScope holds the top-level returns of a module, which jump to the end of the module.
+type moduleScope struct {
+	scopeIndex int
+	returns    []int
 }
 
 type CompilationScope struct {
 	instructions        code.Instructions
+	sourceMap           code.SourceMap
 	lastInstruction     EmittedInstruction
 	previousInstruction EmittedInstruction
+
+	// while loops being compiled, innermost last
+	loops []*loop
+}
+
+// loop holds the jump targets of a while loop.
+type loop struct {
+	start  int   // the condition, where continue jumps to
+	breaks []int // OpJump of each break, patched to after the loop
 }
 
 type EmittedInstruction struct {
@@ -32,6 +75,7 @@ type EmittedInstruction struct {
 func New() *Compiler {
 	mainScope := CompilationScope{
 		instructions:        code.Instructions{},
+		sourceMap:           code.SourceMap{},
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
 	}
@@ -46,12 +90,14 @@ func New() *Compiler {
 		symbolTable: symbolTable,
 		scopes:      []CompilationScope{mainScope},
 		scopeIndex:  0,
+		modules:     map[string]compiledModule{},
 	}
 }
 
 func (c *Compiler) enterScope() {
 	scope := CompilationScope{
 		instructions:        code.Instructions{},
+		sourceMap:           code.SourceMap{},
 		lastInstruction:     EmittedInstruction{},
 		previousInstruction: EmittedInstruction{},
 	}
@@ -71,10 +117,40 @@ func (c *Compiler) leaveScope() code.Instructions {
 	return instructions
 }
 
+func (c *Compiler) enterLoop(start int) {
+	scope := &c.scopes[c.scopeIndex]
+	scope.loops = append(scope.loops, &loop{start: start})
+}
+
+func (c *Compiler) leaveLoop() *loop {
+	scope := &c.scopes[c.scopeIndex]
+	l := scope.loops[len(scope.loops)-1]
+	scope.loops = scope.loops[:len(scope.loops)-1]
+	return l
+}
+
+// currentLoop returns the innermost loop in the current function, or nil.
+func (c *Compiler) currentLoop() *loop {
+	loops := c.scopes[c.scopeIndex].loops
+	if len(loops) == 0 {
+		return nil
+	}
+	return loops[len(loops)-1]
+}
+
+// SymbolTable returns the symbol table of the scope being compiled.
+func (c *Compiler) SymbolTable() *SymbolTable {
+	return c.symbolTable
+}
+
 func (c *Compiler) currentInstruction() code.Instructions {
 	return c.scopes[c.scopeIndex].instructions
 }
 
+func (c *Compiler) currentSourceMap() code.SourceMap {
+	return c.scopes[c.scopeIndex].sourceMap
+}
+
 // NewWithState is used in repl.
 //  this can hold old SymbolTable and constants.
 func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
@@ -84,10 +160,109 @@ func NewWithState(s *SymbolTable, constants []object.Object) *Compiler {
 	return compiler
 }
 
+// SetLoader sets the Loader that reads the imported files. A nil loader is object.FileLoader.
+func (c *Compiler) SetLoader(loader object.Loader) {
+	c.loader = loader
+}
+
+// compileImport compiles the imported file the first time it is imported.
+// The module is a function that runs the file with its own global names and returns
+// them as a hash, which it also keeps in a global so that it runs only once.
+func (c *Compiler) compileImport(node *ast.ImportExpression) (compiledModule, error) {
+	path := node.File()
+	if module, ok := c.modules[path]; ok {
+		return module, nil
+	}
+
+	for i, p := range c.importing {
+		if p == path {
+			cycle := append(append([]string{}, c.importing[i:]...), path)
+			return compiledModule{}, fmt.Errorf("%s: %s", node.Pos(), &object.ImportCycleError{Cycle: cycle})
+		}
+	}
+
+	load := c.loader
+	if load == nil {
+		load = object.FileLoader
+	}
+	src, err := load(path)
+	if err != nil {
+		return compiledModule{}, fmt.Errorf("%s: %s", node.Pos(), err)
+	}
+	p := parser.New(lexer.NewWithFilename(path, string(src)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return compiledModule{}, fmt.Errorf("%s: import %s: %s", node.Pos(), path, strings.Join(p.Errors(), "\n"))
+	}
+
+	// importの名前はidentifierにならないので、moduleを置くglobalの名前に使う
+	mainTable := c.symbolTable
+	for mainTable.Outer != nil {
+		mainTable = mainTable.Outer
+	}
+	if mainTable.main != nil {
+		mainTable = mainTable.main
+	}
+	global := mainTable.Define("import " + path)
+
+	outerTable, outerModule := c.symbolTable, c.module
+	c.enterScope()
+	c.symbolTable = NewModuleSymbolTable(mainTable)
+	c.module = &moduleScope{scopeIndex: c.scopeIndex}
+	c.importing = append(c.importing, path)
+
+	err = c.Compile(program)
+	if err == nil {
+		end := len(c.currentInstruction())
+		for _, pos := range c.module.returns {
+			c.changeOperand(pos, end)
+		}
+
+		globals := c.symbolTable.Globals()
+		for _, symbol := range globals {
+			c.emit(code.OpConstant, c.addConstant(&object.String{Value: symbol.Name}))
+			c.emit(code.OpGetGlobal, symbol.Index)
+		}
+		c.emit(code.OpHash, len(globals)*2)
+		c.emit(code.OpSetGlobal, global.Index)
+		c.emit(code.OpGetGlobal, global.Index)
+		c.emit(code.OpReturnValue)
+	}
+
+	sourceMap := c.currentSourceMap()
+	instructions := c.leaveScope()
+	c.symbolTable, c.module = outerTable, outerModule
+	c.importing = c.importing[:len(c.importing)-1]
+	if err != nil {
+		return compiledModule{}, err
+	}
+
+	fn := &object.CompiledFunction{
+		Instructions: instructions,
+		SourceMap:    sourceMap,
+		Name:         path,
+	}
+	module := compiledModule{constIndex: c.addConstant(fn), globalIndex: global.Index}
+	c.modules[path] = module
+	return module, nil
+}
+
 // Memo: instructionsとconstantsを埋めていく？
 //  定数の保存と、バイトコードの生成
 //  evaluatorと似た書き方でastを探索していく
 func (c *Compiler) Compile(node ast.Node) error {
+	// このnodeから生成した命令にはnodeの位置を記録する
+	if pos := node.Pos(); pos.IsValid() {
+		outerPos := c.pos
+		c.pos = pos
+		defer func() { c.pos = outerPos }()
+	}
+
+	// 子のnodeは式の中として扱い、文の位置になるところだけ戻す
+	loopControl := c.loopControl
+	c.loopControl = false
+	defer func() { c.loopControl = loopControl }()
+
 	switch node := node.(type) {
 	case *ast.Program:
 		for _, s := range node.Statements {
@@ -97,25 +272,19 @@ func (c *Compiler) Compile(node ast.Node) error {
 			}
 		}
 	case *ast.ExpressionStatement:
+		// 文としてのifのブロックは、まだ文の位置
+		if _, ok := node.Expression.(*ast.IfExpression); ok {
+			c.loopControl = loopControl
+		}
 		err := c.Compile(node.Expression)
 		if err != nil {
 			return err
 		}
 		c.emit(code.OpPop)
 	case *ast.InfixExpression:
-		// OpCodeが"<"だった場合はOprandsの順番を逆転して">"にする
-		if node.Operator == "<" {
-			err := c.Compile(node.Right)
-			if err != nil {
-				return err
-			}
-
-			err = c.Compile(node.Left)
-			if err != nil {
-				return err
-			}
-			c.emit(code.OpGreaterThan)
-			return nil
+		// && と || は右辺を評価しないことがあるのでjumpにする
+		if node.Operator == "&&" || node.Operator == "||" {
+			return c.compileLogical(node)
 		}
 
 		err := c.Compile(node.Left)
@@ -137,14 +306,22 @@ func (c *Compiler) Compile(node ast.Node) error {
 			c.emit(code.OpMul)
 		case "/":
 			c.emit(code.OpDiv)
+		case "%":
+			c.emit(code.OpMod)
 		case ">":
 			c.emit(code.OpGreaterThan)
+		case "<":
+			c.emit(code.OpLessThan)
+		case ">=":
+			c.emit(code.OpGreaterEqual)
+		case "<=":
+			c.emit(code.OpLessEqual)
 		case "==":
 			c.emit(code.OpEqual)
 		case "!=":
 			c.emit(code.OpNotEqual)
 		default:
-			return fmt.Errorf("unknown oprator %s", node.Operator)
+			return fmt.Errorf("%s: unknown oprator %s", node.Pos(), node.Operator)
 		}
 
 	case *ast.IntegerLiteral:
@@ -152,6 +329,10 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// emitにOpConstantと、OpConstantのindex(addConstatntの戻り値)を渡す
 		c.emit(code.OpConstant, c.addConstant(integer))
 
+	case *ast.FloatLiteral:
+		float := &object.Float{Value: node.Value}
+		c.emit(code.OpConstant, c.addConstant(float))
+
 	case *ast.Boolean:
 		if node.Value {
 			c.emit(code.OpTrue)
@@ -171,7 +352,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		case "-":
 			c.emit(code.OpMinus)
 		default:
-			return fmt.Errorf("unknown operator %s", node.Operator)
+			return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
 		}
 
 	case *ast.IfExpression:
@@ -191,13 +372,17 @@ func (c *Compiler) Compile(node ast.Node) error {
 		//   [Alternative]
 		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
 
+		c.loopControl = loopControl
 		err = c.Compile(node.Consequence)
 		if err != nil {
 			return err
 		}
 
+		// 最後が式文でない(letやbreakで終わる、空の)ブロックは値を積まないのでnullを積む
 		if c.lastInstructionIs(code.OpPop) {
 			c.removeLastPop()
+		} else {
+			c.emit(code.OpNull)
 		}
 
 		// Emit an `OpJump` with a bogus value(else文を飛び越える)
@@ -209,6 +394,7 @@ func (c *Compiler) Compile(node ast.Node) error {
 		if node.Alternative == nil {
 			c.emit(code.OpNull)
 		} else {
+			c.loopControl = loopControl
 			err := c.Compile(node.Alternative)
 			if err != nil {
 				return err
@@ -216,14 +402,70 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 			if c.lastInstructionIs(code.OpPop) {
 				c.removeLastPop()
+			} else {
+				c.emit(code.OpNull)
 			}
 
 		}
 		afterAlternativePos := len(c.currentInstruction())
 		c.changeOperand(jumpPos, afterAlternativePos)
 
+	case *ast.WhileStatement:
+		//  Layout
+		//   [Condition] <- continue
+		//   [OpJumpNotTruthy](to after the loop)
+		//   [Body]
+		//   [OpJump](to [Condition])
+		//   <- break
+		startPos := len(c.currentInstruction())
+
+		err := c.Compile(node.Condition)
+		if err != nil {
+			return err
+		}
+
+		jumpNotTruthyPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+		c.enterLoop(startPos)
+		c.loopControl = true
+		err = c.Compile(node.Body)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpJump, startPos)
+		l := c.leaveLoop()
+
+		afterLoopPos := len(c.currentInstruction())
+		c.changeOperand(jumpNotTruthyPos, afterLoopPos)
+		for _, pos := range l.breaks {
+			c.changeOperand(pos, afterLoopPos)
+		}
+
+	case *ast.BreakStatement:
+		l := c.currentLoop()
+		if l == nil {
+			return fmt.Errorf("%s: break outside loop", node.Pos())
+		}
+		if !loopControl {
+			return fmt.Errorf("%s: break inside an expression", node.Pos())
+		}
+		// jump先はloopの終わりでback-patchingする
+		pos := c.emit(code.OpJump, 9999)
+		l.breaks = append(l.breaks, pos)
+
+	case *ast.ContinueStatement:
+		l := c.currentLoop()
+		if l == nil {
+			return fmt.Errorf("%s: continue outside loop", node.Pos())
+		}
+		if !loopControl {
+			return fmt.Errorf("%s: continue inside an expression", node.Pos())
+		}
+		c.emit(code.OpJump, l.start)
+
 	case *ast.BlockStatement:
 		for _, s := range node.Statements {
+			c.loopControl = loopControl
 			err := c.Compile(s)
 			if err != nil {
 				return err
@@ -238,21 +480,57 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 		// pull variable from stack
-		if symbol.Scope == GlobalScope {
-			c.emit(code.OpSetGlobal, symbol.Index)
-		} else {
-			c.emit(code.OpSetLocal, symbol.Index)
-		}
+		c.storeSymbol(symbol)
 
 	case *ast.Identifier:
 		symbol, ok := c.symbolTable.Resolve(node.Value)
 		if !ok {
 			// Memo: this is compile time error
-			return fmt.Errorf("undefined variable %s", node.Value)
+			return fmt.Errorf("%s: undefined variable %s", node.Pos(), node.Value)
 		}
 
 		c.loadSymbol(symbol)
 
+	case *ast.AssignExpression:
+		symbol, ok := c.symbolTable.Resolve(node.Name.Value)
+		if !ok {
+			return fmt.Errorf("%s: undefined variable %s", node.Pos(), node.Name.Value)
+		}
+		if symbol.Scope == BuiltinScope {
+			return fmt.Errorf("%s: cannot assign to builtin %s", node.Pos(), node.Name.Value)
+		}
+		if symbol.Scope == FunctionScope {
+			return fmt.Errorf("%s: cannot assign to function %s inside itself", node.Pos(), node.Name.Value)
+		}
+
+		// x += 1 は x = x + 1 と同じ命令にする
+		if node.Operator != "=" {
+			c.loadSymbol(symbol)
+		}
+
+		err := c.Compile(node.Value)
+		if err != nil {
+			return err
+		}
+
+		switch node.Operator {
+		case "=":
+		case "+=":
+			c.emit(code.OpAdd)
+		case "-=":
+			c.emit(code.OpSub)
+		case "*=":
+			c.emit(code.OpMul)
+		case "/=":
+			c.emit(code.OpDiv)
+		default:
+			return fmt.Errorf("%s: unknown operator %s", node.Pos(), node.Operator)
+		}
+
+		c.storeSymbol(symbol)
+		// 代入式の値は代入した値
+		c.loadSymbol(symbol)
+
 	case *ast.StringLiteral:
 		str := &object.String{Value: node.Value}
 		c.emit(code.OpConstant, c.addConstant(str))
@@ -299,13 +577,49 @@ func (c *Compiler) Compile(node ast.Node) error {
 
 		c.emit(code.OpIndex)
 
+	case *ast.SliceExpression:
+		err := c.Compile(node.Left)
+		if err != nil {
+			return err
+		}
+
+		// 省略された範囲はnullを積む
+		for _, bound := range []ast.Expression{node.Low, node.High} {
+			if bound == nil {
+				c.emit(code.OpNull)
+				continue
+			}
+			err := c.Compile(bound)
+			if err != nil {
+				return err
+			}
+		}
+
+		c.emit(code.OpSlice)
+
 	case *ast.FunctionLiteral:
 		c.enterScope()
 
+		// let f = fn() { f() } の中のfは自分自身を指す
+		if node.Name != "" {
+			c.symbolTable.DefineFunctionName(node.Name)
+		}
+
 		for _, p := range node.Parameters {
 			c.symbolTable.Define(p.Value)
 		}
 
+		// closureがcaptureして代入する変数は、始めにcellにしておく
+		for _, name := range cellNames(node) {
+			symbol, param := c.symbolTable.DefineCell(name)
+			if param {
+				c.emit(code.OpGetLocal, symbol.Index)
+			} else {
+				c.emit(code.OpNull)
+			}
+			c.emit(code.OpMakeCell, symbol.Index)
+		}
+
 		// OpGetFreeはnode.Bodyの中で*ast.IdentifierをCompileするときなどに呼ばれる
 		err := c.Compile(node.Body)
 		if err != nil {
@@ -324,18 +638,23 @@ func (c *Compiler) Compile(node ast.Node) error {
 		// functionの中のfreesymbolsを記録しておく
 		freeSymbols := c.symbolTable.FreeSymbols
 		numLocals := c.symbolTable.numDefinitions
+		sourceMap := c.currentSourceMap()
 
 		// scopeを抜ける
 		instructions := c.leaveScope()
 
 		// 呼ばれた関数内のfree variableをStackに積む命令を吐いたあと、OpClosureを吐く
+		//  cellは中の値ではなくcellを積んで共有する
 		for _, s := range freeSymbols {
+			s.Cell = false
 			c.loadSymbol(s)
 		}
 		compiledFn := &object.CompiledFunction{
 			Instructions:  instructions,
 			NumLocals:     numLocals,
 			NumParameters: len(node.Parameters),
+			SourceMap:     sourceMap,
+			Name:          node.Name,
 		}
 		fnIndex := c.addConstant(compiledFn)
 		c.emit(code.OpClosure, fnIndex, len(freeSymbols))
@@ -346,8 +665,24 @@ func (c *Compiler) Compile(node ast.Node) error {
 			return err
 		}
 
+		// moduleのtop-levelのreturnはmoduleの残りを飛ばすだけ
+		if c.module != nil && c.module.scopeIndex == c.scopeIndex {
+			c.emit(code.OpPop)
+			pos := c.emit(code.OpJump, 9999)
+			c.module.returns = append(c.module.returns, pos)
+			break
+		}
+
+		c.markTailCall(c.scopes[c.scopeIndex].lastInstruction, len(c.currentInstruction()))
 		c.emit(code.OpReturnValue)
 
+	case *ast.ImportExpression:
+		module, err := c.compileImport(node)
+		if err != nil {
+			return err
+		}
+		c.emit(code.OpImport, module.constIndex, module.globalIndex)
+
 	case *ast.CallExpression:
 		// Layout
 		//  arg 3
@@ -377,6 +712,7 @@ func (c *Compiler) Bytecode() *Bytecode {
 		Instructions: c.currentInstruction(),
 		Constants:    c.constants,
 		SymbolNum:    c.symbolTable.numDefinitions,
+		SourceMap:    c.currentSourceMap(),
 	}
 }
 
@@ -384,6 +720,9 @@ type Bytecode struct {
 	Instructions code.Instructions
 	Constants    []object.Object
 	SymbolNum    int
+	// SourceMap is the source positions of Instructions.
+	// Each CompiledFunction in Constants has its own.
+	SourceMap code.SourceMap
 }
 
 // addConstant add Object to "constants", and return index in the "constants"
@@ -397,6 +736,7 @@ func (c *Compiler) addConstant(obj object.Object) int {
 func (c *Compiler) emit(op code.Opcode, operands ...int) int {
 	ins := code.Make(op, operands...)
 	pos := c.addInstruction(ins)
+	c.currentSourceMap()[pos] = c.pos
 
 	c.setLastInstruction(op, pos)
 	return pos
@@ -436,6 +776,7 @@ func (c *Compiler) removeLastPop() {
 
 	// Memo: previousInstructionは更新しない
 	c.scopes[c.scopeIndex].instructions = new
+	delete(c.currentSourceMap(), last.Position)
 	c.scopes[c.scopeIndex].lastInstruction = previous
 }
 
@@ -449,6 +790,54 @@ func (c *Compiler) replaceInstruction(pos int, newInstruction []byte) {
 	}
 }
 
+// compileLogical compiles && and ||. The result is always true or false.
+//  Layout of a && b
+//   [a]
+//   [OpJumpNotTruthy](to false)
+//   [b]
+//   [OpJumpNotTruthy](to false)
+//   [OpTrue]
+//   [OpJump](to end)
+//   false: [OpFalse]
+//   end:
+//  a || b starts with [a] [OpJumpNotTruthy](to [b]) [OpTrue] [OpJump](to end) instead.
+func (c *Compiler) compileLogical(node *ast.InfixExpression) error {
+	err := c.Compile(node.Left)
+	if err != nil {
+		return err
+	}
+
+	jumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+
+	// jumps to the end with true
+	jumpEnds := []int{}
+	if node.Operator == "||" {
+		c.emit(code.OpTrue)
+		jumpEnds = append(jumpEnds, c.emit(code.OpJump, 9999))
+		c.changeOperand(jumpPos, len(c.currentInstruction()))
+	}
+
+	err = c.Compile(node.Right)
+	if err != nil {
+		return err
+	}
+
+	rightJumpPos := c.emit(code.OpJumpNotTruthy, 9999)
+	c.emit(code.OpTrue)
+	jumpEnds = append(jumpEnds, c.emit(code.OpJump, 9999))
+
+	falsePos := c.emit(code.OpFalse)
+	c.changeOperand(rightJumpPos, falsePos)
+	if node.Operator == "&&" {
+		c.changeOperand(jumpPos, falsePos)
+	}
+
+	for _, pos := range jumpEnds {
+		c.changeOperand(pos, len(c.currentInstruction()))
+	}
+	return nil
+}
+
 // changeOperand can patch previous operand.
 // あとでjump先をback-patchingするときに使用
 // そのまま上書きする。同じopcodeの命令に上書きすることを前提としている
@@ -461,20 +850,70 @@ func (c *Compiler) changeOperand(opPos int, operand int) {
 
 func (c *Compiler) replaceLastPopWithReturn() {
 	lastPos := c.scopes[c.scopeIndex].lastInstruction.Position
+	c.markTailCall(c.scopes[c.scopeIndex].previousInstruction, lastPos)
+
 	c.replaceInstruction(lastPos, code.Make(code.OpReturnValue))
 
 	c.scopes[c.scopeIndex].lastInstruction.Opcode = code.OpReturnValue
 }
 
+// markTailCall turns ins into OpTailCall if it is an OpCall right before
+// the OpReturnValue at returnPos.
+// The vm then reuses the frame of the caller instead of pushing a new one.
+// OpCallと同じ幅なのでそのまま上書きする
+// mainのframeは使い回せないので、関数の中だけ
+func (c *Compiler) markTailCall(ins EmittedInstruction, returnPos int) {
+	if c.scopeIndex == 0 || ins.Opcode != code.OpCall {
+		return
+	}
+	if ins.Position+len(code.Make(code.OpCall, 0)) != returnPos {
+		return
+	}
+	c.currentInstruction()[ins.Position] = byte(code.OpTailCall)
+
+	scope := &c.scopes[c.scopeIndex]
+	if scope.lastInstruction.Position == ins.Position {
+		scope.lastInstruction.Opcode = code.OpTailCall
+	} else if scope.previousInstruction.Position == ins.Position {
+		scope.previousInstruction.Opcode = code.OpTailCall
+	}
+}
+
 func (c *Compiler) loadSymbol(s Symbol) {
 	switch s.Scope {
 	case GlobalScope:
 		c.emit(code.OpGetGlobal, s.Index)
 	case LocalScope:
-		c.emit(code.OpGetLocal, s.Index)
+		if s.Cell {
+			c.emit(code.OpGetLocalCell, s.Index)
+		} else {
+			c.emit(code.OpGetLocal, s.Index)
+		}
 	case BuiltinScope:
 		c.emit(code.OpGetBuiltin, s.Index)
 	case FreeScope:
-		c.emit(code.OpGetFree, s.Index)
+		if s.Cell {
+			c.emit(code.OpGetFreeCell, s.Index)
+		} else {
+			c.emit(code.OpGetFree, s.Index)
+		}
+	case FunctionScope:
+		c.emit(code.OpCurrentClosure)
+	}
+}
+
+func (c *Compiler) storeSymbol(s Symbol) {
+	switch s.Scope {
+	case GlobalScope:
+		c.emit(code.OpSetGlobal, s.Index)
+	case LocalScope:
+		if s.Cell {
+			c.emit(code.OpSetLocalCell, s.Index)
+		} else {
+			c.emit(code.OpSetLocal, s.Index)
+		}
+	case FreeScope:
+		// 代入される自由変数はcellになっている
+		c.emit(code.OpSetFree, s.Index)
 	}
 }
@@ -0,0 +1,146 @@
+package compiler
+
+import (
+	"fmt"
+	"io"
+	"monkey/code"
+	"monkey/object"
+)
+
+// Disassemble writes a listing of the main program and the constant pool of b.
+// Compiled functions in the pool are listed with their bodies.
+// st names the operands of OpGetGlobal and OpSetGlobal. It may be nil.
+func Disassemble(w io.Writer, b *Bytecode, st *SymbolTable) {
+	d := &disassembler{w: w, constants: b.Constants, symbols: st}
+
+	fmt.Fprintf(w, "main (globals %d):\n", b.SymbolNum)
+	d.instructions(b.Instructions, "  ")
+
+	if len(b.Constants) == 0 {
+		return
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "constants:")
+	for i, c := range b.Constants {
+		fmt.Fprintf(w, "  %d: %s\n", i, constantString(c))
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			d.instructions(fn.Instructions, "    ")
+		}
+	}
+}
+
+type disassembler struct {
+	w         io.Writer
+	constants []object.Object
+	symbols   *SymbolTable
+}
+
+// instructions writes one instruction per line. Jump targets get labels.
+func (d *disassembler) instructions(ins code.Instructions, indent string) {
+	labels := jumpLabels(ins)
+
+	for i := 0; i < len(ins); {
+		if l, ok := labels[i]; ok {
+			fmt.Fprintf(d.w, "%s%s:\n", indent, l)
+		}
+
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			fmt.Fprintf(d.w, "%s%04d ERROR: %s\n", indent, i, err)
+			i++
+			continue
+		}
+
+		operands, read := code.ReadOperands(def, ins[i+1:])
+		text := def.Name
+		for _, o := range operands {
+			text += fmt.Sprintf(" %d", o)
+		}
+
+		comment := d.comment(code.Opcode(ins[i]), operands, labels)
+		if comment != "" {
+			fmt.Fprintf(d.w, "%s%04d %-20s ; %s\n", indent, i, text, comment)
+		} else {
+			fmt.Fprintf(d.w, "%s%04d %s\n", indent, i, text)
+		}
+
+		i += 1 + read
+	}
+}
+
+// comment explains the operands of an instruction.
+func (d *disassembler) comment(op code.Opcode, operands []int, labels map[int]string) string {
+	switch op {
+	case code.OpConstant:
+		return d.constant(operands[0])
+	case code.OpClosure:
+		return fmt.Sprintf("%s, %d free", d.constant(operands[0]), operands[1])
+	case code.OpJump, code.OpJumpNotTruthy:
+		return "-> " + labels[operands[0]]
+	case code.OpGetGlobal, code.OpSetGlobal:
+		return d.symbolName(GlobalScope, operands[0])
+	case code.OpGetBuiltin:
+		if operands[0] < len(object.Builtins) {
+			return object.Builtins[operands[0]].Name
+		}
+	}
+	return ""
+}
+
+func (d *disassembler) constant(index int) string {
+	if index >= len(d.constants) {
+		return "<invalid constant>"
+	}
+	return constantString(d.constants[index])
+}
+
+func (d *disassembler) symbolName(scope SymbolScope, index int) string {
+	if d.symbols == nil {
+		return ""
+	}
+	name, _ := d.symbols.NameOf(scope, index)
+	return name
+}
+
+// jumpLabels names the jump targets in ins L1, L2, ... in order.
+func jumpLabels(ins code.Instructions) map[int]string {
+	targets := map[int]bool{}
+
+	for i := 0; i < len(ins); {
+		def, err := code.Lookup(ins[i])
+		if err != nil {
+			i++
+			continue
+		}
+		operands, read := code.ReadOperands(def, ins[i+1:])
+
+		switch code.Opcode(ins[i]) {
+		case code.OpJump, code.OpJumpNotTruthy:
+			targets[operands[0]] = true
+		}
+
+		i += 1 + read
+	}
+
+	labels := map[int]string{}
+	// 出現順にラベルを振るため、offset順に走査する
+	for i := 0; i <= len(ins); i++ {
+		if targets[i] {
+			labels[i] = fmt.Sprintf("L%d", len(labels)+1)
+		}
+	}
+	return labels
+}
+
+func constantString(obj object.Object) string {
+	switch obj := obj.(type) {
+	case *object.String:
+		return fmt.Sprintf("%q", obj.Value)
+	case *object.CompiledFunction:
+		return fmt.Sprintf("fn %s (params %d, locals %d)",
+			object.FunctionName(obj.Name), obj.NumParameters, obj.NumLocals)
+	default:
+		return obj.Inspect()
+	}
+}
@@ -0,0 +1,58 @@
+package compiler
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestDisassemble(t *testing.T) {
+	input := `
+let n = 2;
+let twice = fn(x) {
+	if (x > n) { x } else { len([x]) }
+};
+twice("a");
+`
+	program := parse(input)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var out bytes.Buffer
+	Disassemble(&out, compiler.Bytecode(), compiler.SymbolTable())
+
+	expected := `main (globals 2):
+  0000 OpConstant 0         ; 2
+  0003 OpSetGlobal 0        ; n
+  0006 OpClosure 1 0        ; fn twice (params 1, locals 1), 0 free
+  0010 OpSetGlobal 1        ; twice
+  0013 OpGetGlobal 1        ; twice
+  0016 OpConstant 2         ; "a"
+  0019 OpCall 1
+  0021 OpPop
+
+constants:
+  0: 2
+  1: fn twice (params 1, locals 1)
+    0000 OpGetLocal 0
+    0002 OpGetGlobal 0        ; n
+    0005 OpGreaterThan
+    0006 OpJumpNotTruthy 14   ; -> L1
+    0009 OpGetLocal 0
+    0011 OpJump 23            ; -> L2
+    L1:
+    0014 OpGetBuiltin 0       ; len
+    0016 OpGetLocal 0
+    0018 OpArray 1
+    0021 OpTailCall 1
+    L2:
+    0023 OpReturnValue
+  2: "a"
+`
+
+	if out.String() != expected {
+		t.Errorf("wrong disassembly.\nwant=\n%s\ngot=\n%s", expected, out.String())
+	}
+}
@@ -0,0 +1,338 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+	"monkey/code"
+	"monkey/object"
+	"monkey/token"
+	"sort"
+)
+
+// .mkc file layout (all numbers are big endian, like the operands in code)
+//
+//	magic       "\x7fMKC"
+//	version     uint16
+//	files       uint32 count, then strings (filenames used by the source maps)
+//	symbolNum   uint32
+//	main        instructions, source map
+//	constants   uint32 count, then constants
+//	checksum    uint32, CRC-32 (IEEE) of everything before it
+//
+// A string is a uint32 length followed by the bytes.
+// A constant is a kind byte followed by its value.
+const (
+	BytecodeMagic   = "\x7fMKC"
+	BytecodeVersion = 2
+)
+
+// kinds of constants in .mkc
+const (
+	constInteger byte = iota + 1
+	constString
+	constCompiledFunction
+	constFloat
+)
+
+var ErrBadMagic = errors.New("not a monkey bytecode file")
+var ErrChecksum = errors.New("bytecode checksum mismatch")
+
+// Encode writes b in the .mkc format.
+func Encode(w io.Writer, b *Bytecode) error {
+	e := &encoder{files: map[string]uint32{}}
+
+	// filenameのテーブルは先に作っておく
+	e.collectFiles(b.SourceMap)
+	for _, c := range b.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			e.collectFiles(fn.SourceMap)
+		}
+	}
+
+	e.buf.WriteString(BytecodeMagic)
+	e.uint16(BytecodeVersion)
+
+	e.uint32(uint32(len(e.fileList)))
+	for _, f := range e.fileList {
+		e.string(f)
+	}
+
+	e.uint32(uint32(b.SymbolNum))
+	e.bytes(b.Instructions)
+	e.sourceMap(b.SourceMap)
+
+	e.uint32(uint32(len(b.Constants)))
+	for i, c := range b.Constants {
+		err := e.constant(c)
+		if err != nil {
+			return fmt.Errorf("constant %d: %s", i, err)
+		}
+	}
+
+	e.uint32(crc32.ChecksumIEEE(e.buf.Bytes()))
+
+	_, err := w.Write(e.buf.Bytes())
+	return err
+}
+
+type encoder struct {
+	buf      bytes.Buffer
+	files    map[string]uint32
+	fileList []string
+}
+
+func (e *encoder) collectFiles(sm code.SourceMap) {
+	for _, pos := range sm {
+		if _, ok := e.files[pos.Filename]; !ok {
+			e.files[pos.Filename] = uint32(len(e.fileList))
+			e.fileList = append(e.fileList, pos.Filename)
+		}
+	}
+}
+
+func (e *encoder) uint16(v uint16) {
+	binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *encoder) uint32(v uint32) {
+	binary.Write(&e.buf, binary.BigEndian, v)
+}
+
+func (e *encoder) bytes(b []byte) {
+	e.uint32(uint32(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *encoder) string(s string) {
+	e.bytes([]byte(s))
+}
+
+// sourceMap writes the entries in offset order so that output is deterministic.
+func (e *encoder) sourceMap(sm code.SourceMap) {
+	offsets := make([]int, 0, len(sm))
+	for o := range sm {
+		offsets = append(offsets, o)
+	}
+	sort.Ints(offsets)
+
+	e.uint32(uint32(len(offsets)))
+	for _, o := range offsets {
+		pos := sm[o]
+		e.uint32(uint32(o))
+		e.uint32(e.files[pos.Filename])
+		e.uint32(uint32(pos.Line))
+		e.uint32(uint32(pos.Column))
+	}
+}
+
+func (e *encoder) constant(obj object.Object) error {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		e.buf.WriteByte(constInteger)
+		binary.Write(&e.buf, binary.BigEndian, obj.Value)
+	case *object.Float:
+		e.buf.WriteByte(constFloat)
+		binary.Write(&e.buf, binary.BigEndian, math.Float64bits(obj.Value))
+	case *object.String:
+		e.buf.WriteByte(constString)
+		e.string(obj.Value)
+	case *object.CompiledFunction:
+		e.buf.WriteByte(constCompiledFunction)
+		e.uint32(uint32(obj.NumLocals))
+		e.uint32(uint32(obj.NumParameters))
+		e.string(obj.Name)
+		e.bytes(obj.Instructions)
+		e.sourceMap(obj.SourceMap)
+	default:
+		return fmt.Errorf("unsupported constant type %s", obj.Type())
+	}
+	return nil
+}
+
+// Decode reads bytecode written by Encode, and checks that the vm can run it.
+func Decode(r io.Reader) (*Bytecode, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) < len(BytecodeMagic) || string(data[:len(BytecodeMagic)]) != BytecodeMagic {
+		return nil, ErrBadMagic
+	}
+	if len(data) < len(BytecodeMagic)+2+4 {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	body := data[:len(data)-4]
+	sum := binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, ErrChecksum
+	}
+
+	d := &decoder{data: body, off: len(BytecodeMagic)}
+
+	version := d.uint16()
+	if version != BytecodeVersion {
+		return nil, fmt.Errorf("unsupported bytecode version %d (want %d)", version, BytecodeVersion)
+	}
+
+	numFiles := d.uint32()
+	for i := uint32(0); i < numFiles && d.err == nil; i++ {
+		d.files = append(d.files, d.string())
+	}
+
+	b := &Bytecode{}
+	b.SymbolNum = int(d.uint32())
+	b.Instructions = d.bytes()
+	b.SourceMap = d.sourceMap()
+
+	numConstants := d.uint32()
+	b.Constants = []object.Object{}
+	for i := uint32(0); i < numConstants && d.err == nil; i++ {
+		b.Constants = append(b.Constants, d.constant())
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	if d.off != len(d.data) {
+		return nil, fmt.Errorf("%d bytes of trailing data in bytecode", len(d.data)-d.off)
+	}
+
+	// checksumが合っていても、vmが実行できるとは限らない
+	err = verify(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bytecode: %s", err)
+	}
+
+	return b, nil
+}
+
+// decoder reads from data. The first error sticks in err and
+// every later read returns a zero value.
+type decoder struct {
+	data  []byte
+	off   int
+	files []string
+	err   error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || d.off+n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[d.off : d.off+n]
+	d.off += n
+	return b
+}
+
+func (d *decoder) byte() byte {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (d *decoder) uint16() uint16 {
+	b := d.next(2)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(b)
+}
+
+func (d *decoder) uint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (d *decoder) uint64() uint64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint32()
+	b := d.next(int(n))
+	if b == nil {
+		return nil
+	}
+	// dataを共有しないようにコピーする
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes())
+}
+
+func (d *decoder) sourceMap() code.SourceMap {
+	sm := code.SourceMap{}
+
+	n := d.uint32()
+	for i := uint32(0); i < n && d.err == nil; i++ {
+		offset := d.uint32()
+		file := d.uint32()
+		line := d.uint32()
+		column := d.uint32()
+
+		if d.err != nil {
+			return nil
+		}
+		if int(file) >= len(d.files) {
+			d.err = fmt.Errorf("source map refers to unknown file %d", file)
+			return nil
+		}
+		sm[int(offset)] = token.Position{
+			Filename: d.files[file],
+			Line:     int(line),
+			Column:   int(column),
+		}
+	}
+
+	return sm
+}
+
+func (d *decoder) constant() object.Object {
+	kind := d.byte()
+
+	switch kind {
+	case constInteger:
+		return &object.Integer{Value: int64(d.uint64())}
+	case constFloat:
+		return &object.Float{Value: math.Float64frombits(d.uint64())}
+	case constString:
+		return &object.String{Value: d.string()}
+	case constCompiledFunction:
+		fn := &object.CompiledFunction{}
+		fn.NumLocals = int(d.uint32())
+		fn.NumParameters = int(d.uint32())
+		fn.Name = d.string()
+		fn.Instructions = d.bytes()
+		fn.SourceMap = d.sourceMap()
+		return fn
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unknown constant kind %d", kind)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,214 @@
+package compiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"monkey/code"
+	"monkey/object"
+	"reflect"
+	"testing"
+)
+
+func TestEncodeDecode(t *testing.T) {
+	input := `
+let greeting = "hello";
+let add = fn(a, b) {
+	let c = a + b;
+	c
+};
+add(1, 2.5);
+`
+	program := parse(input)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+	expected := compiler.Bytecode()
+
+	var buf bytes.Buffer
+	err = Encode(&buf, expected)
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+
+	actual, err := Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("decode error: %s", err)
+	}
+
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("decoded bytecode is different.\nwant=%#v\ngot=%#v", expected, actual)
+	}
+
+	fn, ok := actual.Constants[1].(*object.CompiledFunction)
+	if !ok {
+		t.Fatalf("constant 1 is not CompiledFunction. got=%T", actual.Constants[1])
+	}
+	if fn.Name != "add" || fn.NumLocals != 3 || fn.NumParameters != 2 {
+		t.Errorf("wrong function. got name=%q locals=%d params=%d",
+			fn.Name, fn.NumLocals, fn.NumParameters)
+	}
+}
+
+func TestDecodeErrors(t *testing.T) {
+	program := parse(`1 + 2`)
+	compiler := New()
+	err := compiler.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	var buf bytes.Buffer
+	err = Encode(&buf, compiler.Bytecode())
+	if err != nil {
+		t.Fatalf("encode error: %s", err)
+	}
+	valid := buf.Bytes()
+
+	corrupted := append([]byte{}, valid...)
+	corrupted[10] ^= 0xff
+
+	newVersion := append([]byte{}, valid...)
+	newVersion[5] = 99
+
+	tests := []struct {
+		name     string
+		input    []byte
+		expected string
+	}{
+		{"empty", []byte{}, ErrBadMagic.Error()},
+		{"magic", []byte("#!/usr/bin/env monkey"), ErrBadMagic.Error()},
+		{"checksum", corrupted, ErrChecksum.Error()},
+		{"version", fixChecksum(newVersion), "unsupported bytecode version 99 (want 2)"},
+		{"truncated", fixChecksum(append([]byte{}, valid[:12]...)), "unexpected EOF"},
+	}
+
+	for _, tt := range tests {
+		_, err := Decode(bytes.NewReader(tt.input))
+		if err == nil {
+			t.Errorf("%s: expected error", tt.name)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%s: wrong error. want=%q, got=%q", tt.name, tt.expected, err)
+		}
+	}
+}
+
+// fixChecksum replaces the last 4 bytes with a valid checksum.
+func fixChecksum(b []byte) []byte {
+	body := b[:len(b)-4]
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(body))
+	return append(body, sum...)
+}
+
+// TestDecodeInvalidBytecode decodes files with a valid checksum, which the vm can't run.
+func TestDecodeInvalidBytecode(t *testing.T) {
+	concat := func(ins ...[]byte) code.Instructions {
+		out := code.Instructions{}
+		for _, i := range ins {
+			out = append(out, i...)
+		}
+		return out
+	}
+	function := func(numLocals int, ins ...[]byte) *object.CompiledFunction {
+		return &object.CompiledFunction{Instructions: concat(ins...), NumLocals: numLocals}
+	}
+
+	tests := []struct {
+		name      string
+		main      code.Instructions
+		constants []object.Object
+		expected  string
+	}{
+		{
+			"undefined opcode",
+			code.Instructions{255},
+			nil,
+			"main: offset 0: opcode 255 undefined",
+		},
+		{
+			"truncated operand",
+			code.Make(code.OpConstant, 0)[:2],
+			[]object.Object{&object.Integer{Value: 1}},
+			"main: offset 0: OpConstant needs 2 bytes of operands",
+		},
+		{
+			"constant out of range",
+			concat(code.Make(code.OpConstant, 1), code.Make(code.OpPop)),
+			[]object.Object{&object.Integer{Value: 1}},
+			"main: offset 0: constant 1 out of range",
+		},
+		{
+			"closure of an integer",
+			concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{&object.Integer{Value: 1}},
+			"main: offset 0: constant 0 is not a function",
+		},
+		{
+			"jump into an instruction",
+			concat(code.Make(code.OpJump, 4), code.Make(code.OpConstant, 0)),
+			[]object.Object{&object.Integer{Value: 1}},
+			"main: offset 4 is not an instruction",
+		},
+		{
+			"jump out of the instructions",
+			code.Make(code.OpJump, 100),
+			nil,
+			"main: offset 100 is not an instruction",
+		},
+		{
+			"stack underflow",
+			concat(code.Make(code.OpTrue), code.Make(code.OpAdd)),
+			nil,
+			"main: offset 1: OpAdd pops 2 values from a stack of 1",
+		},
+		{
+			"different stack depths",
+			concat(code.Make(code.OpTrue), code.Make(code.OpJumpNotTruthy, 5), code.Make(code.OpTrue)),
+			nil,
+			"main: offset 5: stack depth 0 and 1",
+		},
+		{
+			"local in main",
+			concat(code.Make(code.OpGetLocal, 0), code.Make(code.OpPop)),
+			nil,
+			"main: offset 0: local 0 out of range",
+		},
+		{
+			"local out of range",
+			concat(code.Make(code.OpClosure, 0, 0), code.Make(code.OpPop)),
+			[]object.Object{function(1, code.Make(code.OpGetLocal, 1), code.Make(code.OpReturnValue))},
+			"constant 0: offset 0: local 1 out of range",
+		},
+		{
+			"free variable out of range",
+			concat(code.Make(code.OpTrue), code.Make(code.OpClosure, 0, 1), code.Make(code.OpPop)),
+			[]object.Object{function(0, code.Make(code.OpGetFree, 1), code.Make(code.OpReturnValue))},
+			"constant 0: offset 0: free variable 1 out of range",
+		},
+		{
+			"more parameters than locals",
+			nil,
+			[]object.Object{&object.CompiledFunction{NumParameters: 2, NumLocals: 1}},
+			"constant 0: 2 parameters but 1 locals",
+		},
+	}
+
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		err := Encode(&buf, &Bytecode{Instructions: tt.main, Constants: tt.constants})
+		if err != nil {
+			t.Fatalf("%s: encode error: %s", tt.name, err)
+		}
+
+		_, err = Decode(bytes.NewReader(buf.Bytes()))
+		expected := "invalid bytecode: " + tt.expected
+		if err == nil || err.Error() != expected {
+			t.Errorf("%s: wrong error. want=%q, got=%v", tt.name, expected, err)
+		}
+	}
+}
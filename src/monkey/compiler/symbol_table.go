@@ -1,5 +1,7 @@
 package compiler
 
+import "sort"
+
 type SymbolScope string
 
 const (
@@ -7,20 +9,30 @@ const (
 	GlobalScope  SymbolScope = "GLOBAL"
 	BuiltinScope SymbolScope = "BUILTIN"
 	FreeScope    SymbolScope = "FREE"
+	// FunctionScope is the name of the function being compiled, bound by let.
+	// It is loaded with OpCurrentClosure, since the closure can't capture itself
+	// as a free variable before the let has stored it.
+	FunctionScope SymbolScope = "FUNCTION"
 )
 
 type SymbolTable struct {
 	Outer *SymbolTable
+	// 全moduleのglobalsは1つの領域に置くので、moduleのtableはmainのtableで番号を振る
+	main *SymbolTable
 
 	store          map[string]Symbol
 	numDefinitions int
 	FreeSymbols    []Symbol
+	// cells defined by DefineCell before the lets that define their names
+	cells map[string]Symbol
 }
 
 type Symbol struct {
 	Name  string
 	Scope SymbolScope
 	Index int
+	// Cell is set for locals which are cells (see object.Cell), and free variables of them.
+	Cell bool
 }
 
 func NewSymbolTable() *SymbolTable {
@@ -35,8 +47,52 @@ func NewEnclosedSymbolTable(outer *SymbolTable) *SymbolTable {
 	return s
 }
 
+// NewModuleSymbolTable makes the global table of a module imported by the program of main.
+// The module has names of its own, and sees the builtins of main.
+func NewModuleSymbolTable(main *SymbolTable) *SymbolTable {
+	if main.main != nil {
+		main = main.main
+	}
+
+	s := NewSymbolTable()
+	s.main = main
+	for _, symbol := range main.store {
+		if symbol.Scope == BuiltinScope {
+			s.store[symbol.Name] = symbol
+		}
+	}
+	return s
+}
+
+// Globals returns the global symbols defined in s, sorted by name.
+func (s *SymbolTable) Globals() []Symbol {
+	globals := []Symbol{}
+	for _, symbol := range s.store {
+		if symbol.Scope == GlobalScope {
+			globals = append(globals, symbol)
+		}
+	}
+	sort.Slice(globals, func(i, j int) bool { return globals[i].Name < globals[j].Name })
+	return globals
+}
+
 func (s *SymbolTable) Define(name string) Symbol {
-	symbol := Symbol{Name: name, Index: s.numDefinitions}
+	// 同じscopeで定義済みの名前は同じslotを使い回す
+	//  evaluatorと同じく let x = x + 1 が元のxを読めるようにするため(whileの中で使う)
+	if symbol, ok := s.store[name]; ok && (symbol.Scope == GlobalScope || symbol.Scope == LocalScope) {
+		return symbol
+	}
+	if symbol, ok := s.cells[name]; ok {
+		s.store[name] = symbol
+		return symbol
+	}
+
+	counter := s
+	if s.main != nil {
+		counter = s.main
+	}
+
+	symbol := Symbol{Name: name, Index: counter.numDefinitions}
 	if s.Outer == nil {
 		symbol.Scope = GlobalScope
 	} else {
@@ -44,7 +100,7 @@ func (s *SymbolTable) Define(name string) Symbol {
 	}
 
 	s.store[name] = symbol
-	s.numDefinitions++
+	counter.numDefinitions++
 	return symbol
 }
 
@@ -68,6 +124,47 @@ func (s *SymbolTable) Resolve(name string) (Symbol, bool) {
 	return obj, ok
 }
 
+// NameOf returns the name of the symbol with the scope and index.
+// It looks in the outer tables as well.
+func (s *SymbolTable) NameOf(scope SymbolScope, index int) (string, bool) {
+	for _, symbol := range s.store {
+		if symbol.Scope == scope && symbol.Index == index {
+			return symbol.Name, true
+		}
+	}
+	if s.Outer != nil {
+		return s.Outer.NameOf(scope, index)
+	}
+	return "", false
+}
+
+// DefineFunctionName defines the name of the function of this table.
+// Parameters and lets with the same name shadow it.
+func (s *SymbolTable) DefineFunctionName(name string) Symbol {
+	symbol := Symbol{Name: name, Index: 0, Scope: FunctionScope}
+	s.store[name] = symbol
+	return symbol
+}
+
+// DefineCell makes the local name a cell. A parameter, which is already defined,
+// is made a cell in place and true is returned. Otherwise the cell gets its slot now,
+// and the let that defines name later binds it, so name is resolved as before until then.
+func (s *SymbolTable) DefineCell(name string) (Symbol, bool) {
+	if symbol, ok := s.store[name]; ok && symbol.Scope == LocalScope {
+		symbol.Cell = true
+		s.store[name] = symbol
+		return symbol, true
+	}
+
+	symbol := Symbol{Name: name, Scope: LocalScope, Index: s.numDefinitions, Cell: true}
+	if s.cells == nil {
+		s.cells = map[string]Symbol{}
+	}
+	s.cells[name] = symbol
+	s.numDefinitions++
+	return symbol, false
+}
+
 func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 	symbol := Symbol{Name: name, Index: index, Scope: BuiltinScope}
 	s.store[name] = symbol
@@ -79,7 +176,7 @@ func (s *SymbolTable) DefineBuiltin(index int, name string) Symbol {
 func (s *SymbolTable) definefree(original Symbol) Symbol {
 	s.FreeSymbols = append(s.FreeSymbols, original)
 
-	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1}
+	symbol := Symbol{Name: original.Name, Index: len(s.FreeSymbols) - 1, Cell: original.Cell}
 	symbol.Scope = FreeScope
 
 	s.store[original.Name] = symbol
@@ -301,3 +301,94 @@ func TestResolveUnresolvableFree(t *testing.T) {
 		}
 	}
 }
+
+func TestRedefine(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("a")
+	global.Define("b")
+
+	a := global.Define("a")
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 0}
+	if a != expected {
+		t.Errorf("expected a=%+v, got=%+v", expected, a)
+	}
+	if global.numDefinitions != 2 {
+		t.Errorf("numDefinitions wrong. want=2, got=%d", global.numDefinitions)
+	}
+
+	// 外側のaを捕まえたあとの再定義はlocalとして新しく定義する
+	local := NewEnclosedSymbolTable(NewEnclosedSymbolTable(global))
+	local.Outer.Define("a")
+	local.Resolve("a")
+
+	a = local.Define("a")
+	expected = Symbol{Name: "a", Scope: LocalScope, Index: 0}
+	if a != expected {
+		t.Errorf("expected a=%+v, got=%+v", expected, a)
+	}
+}
+
+func TestDefineCell(t *testing.T) {
+	global := NewSymbolTable()
+	global.Define("b")
+	local := NewEnclosedSymbolTable(global)
+	local.Define("a")
+
+	// 引数はその場でcellにする
+	a, param := local.DefineCell("a")
+	expected := Symbol{Name: "a", Scope: LocalScope, Index: 0, Cell: true}
+	if a != expected || !param {
+		t.Errorf("expected a=%+v, got=%+v (param %t)", expected, a, param)
+	}
+
+	// letの前は外側のbのまま
+	b, param := local.DefineCell("b")
+	expected = Symbol{Name: "b", Scope: LocalScope, Index: 1, Cell: true}
+	if b != expected || param {
+		t.Errorf("expected b=%+v, got=%+v (param %t)", expected, b, param)
+	}
+	result, _ := local.Resolve("b")
+	if result.Scope != GlobalScope {
+		t.Errorf("b resolved to %+v before its let", result)
+	}
+	if b = local.Define("b"); b != expected {
+		t.Errorf("expected b=%+v, got=%+v", expected, b)
+	}
+
+	// 自由変数もcellのまま
+	inner := NewEnclosedSymbolTable(local)
+	result, _ = inner.Resolve("a")
+	expected = Symbol{Name: "a", Scope: FreeScope, Index: 0, Cell: true}
+	if result != expected {
+		t.Errorf("expected a=%+v, got=%+v", expected, result)
+	}
+}
+
+func TestDefineAndResolveFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineFunctionName("a")
+
+	expected := Symbol{Name: "a", Scope: FunctionScope, Index: 0}
+	result, ok := global.Resolve(expected.Name)
+	if !ok {
+		t.Fatalf("function name %s not resolvable", expected.Name)
+	}
+	if result != expected {
+		t.Errorf("expected %s to resolve to %+v, got=%+v", expected.Name, expected, result)
+	}
+}
+
+func TestShadowingFunctionName(t *testing.T) {
+	global := NewSymbolTable()
+	global.DefineFunctionName("a")
+	global.Define("a")
+
+	expected := Symbol{Name: "a", Scope: GlobalScope, Index: 0}
+	result, ok := global.Resolve(expected.Name)
+	if !ok {
+		t.Fatalf("function name %s not resolvable", expected.Name)
+	}
+	if result != expected {
+		t.Errorf("expected %s to resolve to %+v, got=%+v", expected.Name, expected, result)
+	}
+}
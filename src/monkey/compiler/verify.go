@@ -0,0 +1,231 @@
+package compiler
+
+import (
+	"fmt"
+	"monkey/code"
+	"monkey/object"
+)
+
+// verify checks that the vm can run b without going out of its instructions, constants or stack.
+// Decode uses it, since a .mkc file with a valid checksum may still be written by hand.
+//
+// Each instruction stream is walked with code.Lookup: every opcode has to be defined,
+// its operands have to be in the stream, constants, locals and free variables have to exist,
+// and jumps have to land on an instruction. The depth of the stack is followed along
+// every path, so an instruction never pops a value that isn't there.
+func verify(b *Bytecode) error {
+	// OpClosureで作られるときの自由変数の数. 作られない関数(module)は0
+	numFree := map[int]int{}
+	streams := append([]object.Object{nil}, b.Constants...)
+	for i, c := range streams {
+		ins := b.Instructions
+		if i > 0 {
+			fn, ok := c.(*object.CompiledFunction)
+			if !ok {
+				continue
+			}
+			ins = fn.Instructions
+		}
+		err := walk(ins, func(ip int, op code.Opcode, operands []int) error {
+			if op != code.OpClosure || operands[0] >= len(b.Constants) {
+				return nil
+			}
+			if n, ok := numFree[operands[0]]; !ok || operands[1] < n {
+				numFree[operands[0]] = operands[1]
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s: %s", streamName(i-1), err)
+		}
+	}
+
+	v := &verifier{constants: b.Constants, numFree: numFree, numLocals: -1}
+	err := v.verify(b.Instructions)
+	if err != nil {
+		return fmt.Errorf("%s: %s", streamName(-1), err)
+	}
+
+	for i, c := range b.Constants {
+		fn, ok := c.(*object.CompiledFunction)
+		if !ok {
+			continue
+		}
+		if fn.NumParameters > fn.NumLocals {
+			return fmt.Errorf("%s: %d parameters but %d locals", streamName(i), fn.NumParameters, fn.NumLocals)
+		}
+		v := &verifier{constants: b.Constants, numFree: numFree, numLocals: fn.NumLocals, function: i}
+		err := v.verify(fn.Instructions)
+		if err != nil {
+			return fmt.Errorf("%s: %s", streamName(i), err)
+		}
+	}
+	return nil
+}
+
+func streamName(constIndex int) string {
+	if constIndex < 0 {
+		return "main"
+	}
+	return fmt.Sprintf("constant %d", constIndex)
+}
+
+// walk calls f for each instruction of ins, and reports undefined opcodes and missing operands.
+func walk(ins code.Instructions, f func(ip int, op code.Opcode, operands []int) error) error {
+	for ip := 0; ip < len(ins); {
+		def, err := code.Lookup(ins[ip])
+		if err != nil {
+			return fmt.Errorf("offset %d: %s", ip, err)
+		}
+		width := 0
+		for _, w := range def.OperandWidths {
+			width += w
+		}
+		if ip+1+width > len(ins) {
+			return fmt.Errorf("offset %d: %s needs %d bytes of operands", ip, def.Name, width)
+		}
+
+		operands, read := code.ReadOperands(def, ins[ip+1:])
+		err = f(ip, code.Opcode(ins[ip]), operands)
+		if err != nil {
+			return fmt.Errorf("offset %d: %s", ip, err)
+		}
+		ip += 1 + read
+	}
+	return nil
+}
+
+type verifier struct {
+	constants []object.Object
+	numFree   map[int]int
+	// -1 in main, which has no locals
+	numLocals int
+	function  int
+}
+
+func (v *verifier) verify(ins code.Instructions) error {
+	// 命令の先頭の位置. 最後の命令の後ろにもjumpできる
+	starts := map[int]bool{len(ins): true}
+	err := walk(ins, func(ip int, op code.Opcode, operands []int) error {
+		starts[ip] = true
+		return v.operands(op, operands)
+	})
+	if err != nil {
+		return err
+	}
+
+	// 各命令の前のstackの深さ. 合流する経路は同じ深さでなければならない
+	depths := map[int]int{0: 0}
+	work := []int{0}
+	reach := func(ip, depth int) error {
+		if !starts[ip] {
+			return fmt.Errorf("offset %d is not an instruction", ip)
+		}
+		if d, ok := depths[ip]; ok {
+			if d != depth {
+				return fmt.Errorf("offset %d: stack depth %d and %d", ip, d, depth)
+			}
+			return nil
+		}
+		depths[ip] = depth
+		work = append(work, ip)
+		return nil
+	}
+
+	for len(work) > 0 {
+		ip := work[len(work)-1]
+		work = work[:len(work)-1]
+		if ip == len(ins) {
+			continue
+		}
+
+		def, _ := code.Lookup(ins[ip])
+		operands, read := code.ReadOperands(def, ins[ip+1:])
+		op := code.Opcode(ins[ip])
+		pop, push := stackEffect(op, operands)
+
+		depth := depths[ip]
+		if depth < pop {
+			return fmt.Errorf("offset %d: %s pops %d values from a stack of %d", ip, def.Name, pop, depth)
+		}
+		depth += push - pop
+
+		switch op {
+		case code.OpReturnValue, code.OpReturn:
+			continue
+		case code.OpJump:
+			err = reach(operands[0], depth)
+			if err != nil {
+				return err
+			}
+			continue
+		case code.OpJumpNotTruthy:
+			err = reach(operands[0], depth)
+			if err != nil {
+				return err
+			}
+		}
+		err = reach(ip+1+read, depth)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// operands checks the operands which refer to constants, locals and free variables.
+func (v *verifier) operands(op code.Opcode, operands []int) error {
+	switch op {
+	case code.OpConstant:
+		if operands[0] >= len(v.constants) {
+			return fmt.Errorf("constant %d out of range", operands[0])
+		}
+	case code.OpClosure, code.OpImport:
+		if operands[0] >= len(v.constants) {
+			return fmt.Errorf("constant %d out of range", operands[0])
+		}
+		if _, ok := v.constants[operands[0]].(*object.CompiledFunction); !ok {
+			return fmt.Errorf("constant %d is not a function", operands[0])
+		}
+	case code.OpGetLocal, code.OpSetLocal, code.OpMakeCell, code.OpGetLocalCell, code.OpSetLocalCell:
+		if operands[0] >= v.numLocals {
+			return fmt.Errorf("local %d out of range", operands[0])
+		}
+	case code.OpGetFree, code.OpSetFree, code.OpGetFreeCell:
+		if v.numLocals < 0 || operands[0] >= v.numFree[v.function] {
+			return fmt.Errorf("free variable %d out of range", operands[0])
+		}
+	}
+	return nil
+}
+
+// stackEffect returns how many values op pops and pushes.
+func stackEffect(op code.Opcode, operands []int) (int, int) {
+	switch op {
+	case code.OpConstant, code.OpTrue, code.OpFalse, code.OpNull, code.OpGetGlobal,
+		code.OpGetLocal, code.OpGetBuiltin, code.OpGetFree, code.OpCurrentClosure, code.OpImport,
+		code.OpGetLocalCell, code.OpGetFreeCell:
+		return 0, 1
+	case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan,
+		code.OpGreaterEqual, code.OpLessEqual, code.OpIndex:
+		return 2, 1
+	case code.OpMinus, code.OpBang:
+		return 1, 1
+	case code.OpPop, code.OpJumpNotTruthy, code.OpSetGlobal, code.OpSetLocal,
+		code.OpSetFree, code.OpReturnValue, code.OpMakeCell, code.OpSetLocalCell:
+		return 1, 0
+	case code.OpArray, code.OpHash:
+		return operands[0], 1
+	case code.OpClosure:
+		return operands[1], 1
+	case code.OpCall, code.OpTailCall:
+		// the callee and the arguments
+		return operands[0] + 1, 1
+	case code.OpSlice:
+		return 3, 1
+	default:
+		// OpJump, OpReturn
+		return 0, 0
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"monkey/object"
 )
 
-var builtins = map[string]*object.Builtin{
-	"puts":  object.GetBuiltinByName("puts"),
-	"len":   object.GetBuiltinByName("len"),
-	"first": object.GetBuiltinByName("first"),
-	"last":  object.GetBuiltinByName("last"),
-	"rest":  object.GetBuiltinByName("rest"),
-	"push":  object.GetBuiltinByName("push"),
+// builtins are the same functions as the vm uses.
+var builtins = map[string]*object.Builtin{}
+
+func init() {
+	for _, def := range object.Builtins {
+		builtins[def.Name] = def.Builtin
+	}
 }
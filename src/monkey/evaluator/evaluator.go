@@ -1,21 +1,57 @@
 package evaluator
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"monkey/ast"
+	"monkey/lexer"
 	"monkey/object"
+	"monkey/parser"
+	"strings"
 )
 
 // メモリ節約のためにtrue, falseへのポインタを共有するという説明があるP130
 // しかしながらこれでのメモリ節約は微々たるもの。どちらかというと、
 // あとで比較などをするときに一緒のポインタ見てると間違えなくて楽というメリットはある？
 var (
-	TRUE  = &object.Boolean{Value: true}
-	FALSE = &object.Boolean{Value: false}
-	NULL  = &object.Null{}
+	TRUE  = object.True
+	FALSE = object.False
+	NULL  = object.NullValue
+
+	BREAK    = &object.Break{}
+	CONTINUE = &object.Continue{}
 )
 
+// EvalContext is Eval that stops when ctx is done or a limit trips.
+// Then it returns a *object.LimitError. Errors of the program are returned as
+// *object.Error objects like Eval.
+func EvalContext(ctx context.Context, node ast.Node, env *object.Environment, limits object.Limits) (object.Object, error) {
+	env.SetBudget(object.NewBudget(ctx, limits))
+	defer env.SetBudget(nil)
+
+	result := Eval(node, env)
+	if s, ok := result.(*stopped); ok {
+		return nil, s.err
+	}
+	return result, nil
+}
+
+// stopped is passed up like an error when the budget of EvalContext runs out.
+type stopped struct {
+	err *object.LimitError
+}
+
+func (s *stopped) Type() object.ObjectType { return object.ERROR_OBJ }
+func (s *stopped) Inspect() string         { return "ERROR: " + s.err.Error() }
+
 func Eval(node ast.Node, env *object.Environment) object.Object {
+	if b := env.Budget(); b != nil {
+		if err := b.Step(); err != nil {
+			return &stopped{err: err.(*object.LimitError)}
+		}
+	}
+
 	switch node := node.(type) {
 
 	case *ast.InfixExpression:
@@ -23,28 +59,39 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		if isError(left) {
 			return left
 		}
+		if node.Operator == "&&" || node.Operator == "||" {
+			return evalLogicalExpression(node, left, env)
+		}
 		right := Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
-		return evalInfixExpression(node.Operator, left, right)
+		return allocate(errorAt(evalInfixExpression(node.Operator, left, right), node), env)
 
 	case *ast.PrefixExpression:
 		right := Eval(node.Right, env)
 		if isError(right) {
 			return right
 		}
-		return evalPrefixExpression(node.Operator, right)
+		return allocate(errorAt(evalPrefixExpression(node.Operator, right), node), env)
 
 	case *ast.Program:
 		return evalProgram(node.Statements, env)
 
 	case *ast.ExpressionStatement:
+		// 文としてのifからはbreakとcontinueをloopまで返す
+		if ie, ok := node.Expression.(*ast.IfExpression); ok {
+			return evalIfExpression(ie, env)
+		}
 		return Eval(node.Expression, env)
 
+	// literalはvmの定数と同じく数えない
 	case *ast.IntegerLiteral:
 		return &object.Integer{Value: node.Value}
 
+	case *ast.FloatLiteral:
+		return &object.Float{Value: node.Value}
+
 	case *ast.StringLiteral:
 		return &object.String{Value: node.Value}
 
@@ -55,7 +102,24 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		return evalBlockStatements(node.Statements, env)
 
 	case *ast.IfExpression:
-		return evalIfExpression(node, env)
+		// 式の中のifの値としてBREAKやCONTINUEを使わせない
+		result := evalIfExpression(node, env)
+		switch result.(type) {
+		case *object.Break:
+			return errorAt(newError("break inside an expression"), node)
+		case *object.Continue:
+			return errorAt(newError("continue inside an expression"), node)
+		}
+		return result
+
+	case *ast.WhileStatement:
+		return evalWhileStatement(node, env)
+
+	case *ast.BreakStatement:
+		return BREAK
+
+	case *ast.ContinueStatement:
+		return CONTINUE
 
 	case *ast.ReturnStatement:
 		val := Eval(node.ReturnValue, env)
@@ -72,12 +136,15 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 		env.Set(node.Name.Value, val)
 
 	case *ast.Identifier:
-		return evalIdentifier(node, env)
+		return errorAt(evalIdentifier(node, env), node)
+
+	case *ast.AssignExpression:
+		return errorAt(evalAssignExpression(node, env), node)
 
 	case *ast.FunctionLiteral:
 		params := node.Parameters
 		body := node.Body
-		return &object.Function{Parameters: params, Env: env, Body: body}
+		return allocate(&object.Function{Parameters: params, Env: env, Body: body, Name: node.Name}, env)
 
 	case *ast.CallExpression:
 		function := Eval(node.Function, env)
@@ -94,16 +161,27 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			return args[0]
 		}
 
-		return applyFunction(function, args)
+		result := applyFunction(function, args, env)
+		// 関数の中で起きたエラーには呼び出し元を記録していく(スタックトレース用)
+		if err, ok := result.(*object.Error); ok && err.Pos.IsValid() {
+			if fn, ok := function.(*object.Function); ok {
+				err.AddCall(object.FunctionName(fn.Name), node.Pos())
+			}
+		}
+		// builtinの戻り値は新しいobjectとして数える
+		if _, ok := function.(*object.Builtin); ok {
+			result = allocate(result, env)
+		}
+		return errorAt(result, node)
 
 	case *ast.ArrayLiteral:
 		elements := evalExpressions(node.Elements, env)
 		if len(elements) == 1 && isError(elements[0]) {
 			return elements[0]
 		}
-		return &object.Array{Elements: elements}
+		return allocate(&object.Array{Elements: elements}, env)
 	case *ast.HashLiteral:
-		return evalHashLiteral(node, env)
+		return allocate(errorAt(evalHashLiteral(node, env), node), env)
 
 	case *ast.IndexExpression: //Array, Hash呼び出し
 		left := Eval(node.Left, env)
@@ -116,13 +194,67 @@ func Eval(node ast.Node, env *object.Environment) object.Object {
 			return index
 		}
 
-		return evalIndexExpression(left, index)
+		result := errorAt(evalIndexExpression(left, index), node)
+		// 文字列のindexは新しい文字列になる
+		if left.Type() == object.STRING_OBJ {
+			result = allocate(result, env)
+		}
+		return result
+
+	case *ast.SliceExpression:
+		return allocate(errorAt(evalSliceExpression(node, env), node), env)
+
+	case *ast.ImportExpression:
+		return errorAt(evalImportExpression(node, env), node)
 	}
 
 	return nil
 
 }
 
+// evalImportExpression evaluates the imported file in its own environment, once,
+// and returns its top-level bindings as a hash.
+func evalImportExpression(node *ast.ImportExpression, env *object.Environment) object.Object {
+	path := node.File()
+	modules := env.Modules()
+	if module, ok := modules.Get(path); ok {
+		return module
+	}
+
+	if err := modules.Start(path); err != nil {
+		return newError("%s", err)
+	}
+	var module object.Object
+	defer func() { modules.Done(path, module) }()
+
+	src, err := modules.Load(path)
+	if err != nil {
+		return newError("%s", err)
+	}
+	p := parser.New(lexer.NewWithFilename(path, string(src)))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return newError("import %s: %s", path, strings.Join(p.Errors(), "\n"))
+	}
+
+	moduleEnv := object.NewModuleEnvironment(env)
+	if result := Eval(program, moduleEnv); isError(result) {
+		return result
+	}
+
+	pairs := map[object.HashKey]object.HashPair{}
+	for _, name := range moduleEnv.Names() {
+		value, _ := moduleEnv.Get(name)
+		key := &object.String{Value: name}
+		pairs[key.HashKey()] = object.HashPair{Key: key, Value: value}
+	}
+	hash := allocate(&object.Hash{Pairs: pairs}, env)
+	if !isError(hash) {
+		module = hash
+	}
+	return hash
+}
+
 func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object {
 	if val, ok := env.Get(node.Value); ok {
 		return val
@@ -136,6 +268,35 @@ func evalIdentifier(node *ast.Identifier, env *object.Environment) object.Object
 
 }
 
+// 代入は変数が定義されたenvironmentに対して行う(closureから外側の変数も書き換えられる)
+func evalAssignExpression(ae *ast.AssignExpression, env *object.Environment) object.Object {
+	name := ae.Name.Value
+
+	current, ok := env.Get(name)
+	if !ok {
+		if _, ok := builtins[name]; ok {
+			return newError("cannot assign to builtin %s", name)
+		}
+		return newError("identifier not found: %s", name)
+	}
+
+	val := Eval(ae.Value, env)
+	if isError(val) {
+		return val
+	}
+
+	// x += 1 は x = x + 1 と同じ
+	if ae.Operator != "=" {
+		val = allocate(evalInfixExpression(strings.TrimSuffix(ae.Operator, "="), current, val), env)
+		if isError(val) {
+			return val
+		}
+	}
+
+	env.Assign(name, val)
+	return val
+}
+
 func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 	var result object.Object
 
@@ -145,7 +306,7 @@ func evalProgram(stmts []ast.Statement, env *object.Environment) object.Object {
 		switch result := result.(type) {
 		case *object.ReturnValue:
 			return result.Value
-		case *object.Error:
+		case *object.Error, *stopped:
 			return result
 		}
 	}
@@ -163,8 +324,9 @@ func evalBlockStatements(stmts []ast.Statement, env *object.Environment) object.
 
 		// letstatementなどの場合はreturnがnilになるのでうまくhandleできるようにifを付ける
 		if result != nil {
-			rt := result.Type()
-			if rt == object.RETURN_VALUE_OBJ || rt == object.ERROR_OBJ {
+			switch result.Type() {
+			case object.RETURN_VALUE_OBJ, object.ERROR_OBJ,
+				object.BREAK_OBJ, object.CONTINUE_OBJ:
 				//ここだけparseProgramと違う
 				return result
 			}
@@ -208,18 +370,23 @@ func evalBangOperatorExpression(right object.Object) object.Object {
 }
 
 func evalMinusPrefixOperatorExpression(right object.Object) object.Object {
-	if right.Type() != object.INTEGER_OBJ {
+	switch right := right.(type) {
+	case *object.Integer:
+		return &object.Integer{Value: -right.Value}
+	case *object.Float:
+		return &object.Float{Value: -right.Value}
+	default:
 		return newError("unknown operator: -%s", right.Type())
 	}
-
-	value := right.(*object.Integer).Value
-	return &object.Integer{Value: -value}
 }
 
 func evalInfixExpression(operator string, left, right object.Object) object.Object {
 	switch {
 	case left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ:
 		return evalIntegerInfixExpression(operator, left, right)
+	case isNumber(left) && isNumber(right):
+		// 片方がfloatならfloatとして計算する
+		return evalFloatInfixExpression(operator, left, right)
 	case left.Type() == object.STRING_OBJ && right.Type() == object.STRING_OBJ:
 		return evalStringInfixExpression(operator, left, right)
 	case operator == "==":
@@ -251,11 +418,23 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	case "*":
 		return &object.Integer{Value: leftVal * rightVal}
 	case "/":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
 		return &object.Integer{Value: leftVal / rightVal}
+	case "%":
+		if rightVal == 0 {
+			return newError("division by zero")
+		}
+		return &object.Integer{Value: leftVal % rightVal}
 	case "<":
 		return nativeBooleanObject(leftVal < rightVal)
 	case ">":
 		return nativeBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBooleanObject(leftVal >= rightVal)
 	case "==":
 		return nativeBooleanObject(leftVal == rightVal)
 	case "!=":
@@ -266,6 +445,54 @@ func evalIntegerInfixExpression(operator string, left, right object.Object) obje
 	}
 }
 
+func evalFloatInfixExpression(operator string, left, right object.Object) object.Object {
+	leftVal := toFloat(left)
+	rightVal := toFloat(right)
+
+	switch operator {
+	case "+":
+		return &object.Float{Value: leftVal + rightVal}
+	case "-":
+		return &object.Float{Value: leftVal - rightVal}
+	case "*":
+		return &object.Float{Value: leftVal * rightVal}
+	case "/":
+		return &object.Float{Value: leftVal / rightVal}
+	case "%":
+		return &object.Float{Value: math.Mod(leftVal, rightVal)}
+	case "<":
+		return nativeBooleanObject(leftVal < rightVal)
+	case ">":
+		return nativeBooleanObject(leftVal > rightVal)
+	case "<=":
+		return nativeBooleanObject(leftVal <= rightVal)
+	case ">=":
+		return nativeBooleanObject(leftVal >= rightVal)
+	case "==":
+		return nativeBooleanObject(leftVal == rightVal)
+	case "!=":
+		return nativeBooleanObject(leftVal != rightVal)
+	default:
+		return newError("unknown operator: %s %s %s",
+			left.Type(), operator, right.Type())
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+// toFloat converts an Integer or a Float to float64.
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
 func evalStringInfixExpression(operator string, left, right object.Object) object.Object {
 	if operator != "+" {
 		return newError("unknown operator: %s %s %s", left.Type(), operator, right.Type())
@@ -277,6 +504,23 @@ func evalStringInfixExpression(operator string, left, right object.Object) objec
 
 }
 
+// evalLogicalExpression evaluates the right side of && and || only when it decides the result.
+// The result is always TRUE or FALSE.
+func evalLogicalExpression(node *ast.InfixExpression, left object.Object, env *object.Environment) object.Object {
+	if node.Operator == "&&" && !isTruthy(left) {
+		return FALSE
+	}
+	if node.Operator == "||" && isTruthy(left) {
+		return TRUE
+	}
+
+	right := Eval(node.Right, env)
+	if isError(right) {
+		return right
+	}
+	return nativeBooleanObject(isTruthy(right))
+}
+
 func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Object {
 	condition := Eval(ie.Condition, env)
 	if isError(condition) {
@@ -292,6 +536,31 @@ func evalIfExpression(ie *ast.IfExpression, env *object.Environment) object.Obje
 	}
 }
 
+// while文自体は値を持たないのでnilを返す(letと同じ)
+func evalWhileStatement(ws *ast.WhileStatement, env *object.Environment) object.Object {
+	for {
+		condition := Eval(ws.Condition, env)
+		if isError(condition) {
+			return condition
+		}
+		if !isTruthy(condition) {
+			return nil
+		}
+
+		result := Eval(ws.Body, env)
+		if result == nil {
+			continue
+		}
+		switch result.Type() {
+		case object.RETURN_VALUE_OBJ, object.ERROR_OBJ:
+			return result
+		case object.BREAK_OBJ:
+			return nil
+		}
+		// CONTINUE_OBJはそのまま次の条件判定へ
+	}
+}
+
 // 何をtrueとするかを規定する
 //  NULLもしくはFALSEではない場合true.
 func isTruthy(obj object.Object) bool {
@@ -323,11 +592,18 @@ func evalExpressions(exps []ast.Expression, env *object.Environment) []object.Ob
 }
 
 // call function
-func applyFunction(fn object.Object, args []object.Object) object.Object {
+// env is the environment of the caller.
+func applyFunction(fn object.Object, args []object.Object, env *object.Environment) object.Object {
 	switch fn := fn.(type) {
 	case *object.Function:
+		// vmのframeと同じ数え方で深さを制限する(Goのstackが溢れないように)
+		if env.Depth() >= env.Budget().MaxDepth() {
+			return newError("stack overflow (call depth %d)", env.Depth()-1)
+		}
+
 		// environmentの拡張(包含)
 		extendedEnv := extendFunctionEnv(fn, args)
+		extendedEnv.SetDepth(env.Depth() + 1)
 
 		//普通にbodyを評価する
 		evaluated := Eval(fn.Body, extendedEnv)
@@ -369,6 +645,8 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return evalArrayIndexExpression(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return evalStringIndexExpression(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return evalHashIndexExpression(left, index)
 	default:
@@ -376,6 +654,39 @@ func evalIndexExpression(left, index object.Object) object.Object {
 	}
 }
 
+func evalSliceExpression(se *ast.SliceExpression, env *object.Environment) object.Object {
+	left := Eval(se.Left, env)
+	if isError(left) {
+		return left
+	}
+
+	// 省略された範囲はnilのまま渡す
+	bounds := []object.Object{nil, nil}
+	for i, exp := range []ast.Expression{se.Low, se.High} {
+		if exp == nil {
+			continue
+		}
+		bounds[i] = Eval(exp, env)
+		if isError(bounds[i]) {
+			return bounds[i]
+		}
+	}
+
+	result, err := object.Slice(left, bounds[0], bounds[1])
+	if err != nil {
+		return newError("%s", err)
+	}
+	return result
+}
+
+func evalStringIndexExpression(str, index object.Object) object.Object {
+	ch, ok := str.(*object.String).Index(index.(*object.Integer).Value)
+	if !ok {
+		return NULL
+	}
+	return ch
+}
+
 func evalArrayIndexExpression(array, index object.Object) object.Object {
 	arrayObject := array.(*object.Array)
 	idx := index.(*object.Integer).Value
@@ -436,6 +747,27 @@ func newError(format string, a ...interface{}) *object.Error {
 	return &object.Error{Message: fmt.Sprintf(format, a...)}
 }
 
+// errorAt records the position of node on obj if obj is an error without one.
+// Errors keep the innermost position as they propagate to the top.
+func errorAt(obj object.Object, node ast.Node) object.Object {
+	if err, ok := obj.(*object.Error); ok && !err.Pos.IsValid() {
+		err.Pos = node.Pos()
+	}
+	return obj
+}
+
+// allocate counts obj in the budget of EvalContext.
+func allocate(obj object.Object, env *object.Environment) object.Object {
+	b := env.Budget()
+	if b == nil || obj == nil || isError(obj) {
+		return obj
+	}
+	if err := b.Allocate(obj); err != nil {
+		return &stopped{err: err.(*object.LimitError)}
+	}
+	return obj
+}
+
 func isError(obj object.Object) bool {
 	if obj != nil {
 		return obj.Type() == object.ERROR_OBJ
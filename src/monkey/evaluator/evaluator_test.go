@@ -1,6 +1,8 @@
 package evaluator
 
 import (
+	"context"
+	"errors"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
@@ -27,6 +29,9 @@ func TestEvalIntegerExpression(t *testing.T) {
 		{"3 * 3 * 3 + 10", 37},
 		{"3 * (3 * 3) + 10", 37},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"1 + 7 % 4 * 2", 7},
 	}
 
 	for _, tt := range tests {
@@ -59,6 +64,42 @@ func testIntegerObject(t *testing.T, obj object.Object, expected int64) bool {
 	return true
 }
 
+func TestEvalFloatExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14", 3.14},
+		{"-2.5", -2.5},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2},
+		{"1 / 4.0", 0.25},
+		{"1e3 - 1", 999},
+		{"let x = 1; x += 0.5; x", 1.5},
+		{"7.5 % 2", 1.5},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testFloatObject(t, evaluated, tt.expected)
+	}
+}
+
+func testFloatObject(t *testing.T, obj object.Object, expected float64) bool {
+	result, ok := obj.(*object.Float)
+	if !ok {
+		t.Errorf("object is not Float. got=%T (%+v)", obj, obj)
+		return false
+	}
+	if result.Value != expected {
+		t.Errorf("object has wrong value. got=%g, want=%g",
+			result.Value, expected)
+		return false
+	}
+
+	return true
+}
+
 func TestEvalBooleanExpression(t *testing.T) {
 	tests := []struct {
 		input    string
@@ -82,6 +123,42 @@ func TestEvalBooleanExpression(t *testing.T) {
 		{"(1 < 2) == false", false},
 		{"(1 > 2) == true", false},
 		{"(1 > 2) == false", true},
+		{"1 == 1.0", true},
+		{"1.5 > 1", true},
+		{"2 < 1.5", false},
+		{"0.1 + 0.2 == 0.3", false},
+		{"2.0 != 2", false},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"2.5 >= 2", true},
+		{"1 <= 0.5", false},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		testBooleanObject(t, evaluated, tt.expected)
+	}
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected bool
+	}{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && \"a\"", true},
+		{"1 < 2 && 2 < 3 || false", true},
+		{"false && false || true", true},
+		{"let x = 0; let f = fn() { x = 1; true }; false && f(); x == 0", true},
+		{"let x = 0; true || (x = 1); x == 0", true},
+		{"let x = 0; false || (x = 1); x == 1", true},
 	}
 
 	for _, tt := range tests {
@@ -234,6 +311,54 @@ func TestErrorHandling(t *testing.T) {
 			`{"name": "monke"}[fn(x) { x }];`,
 			"unusable as hash key: FUNCTION",
 		},
+		{
+			"foobar = 1",
+			"identifier not found: foobar",
+		},
+		{
+			"len = 1",
+			"cannot assign to builtin len",
+		},
+		{
+			`let x = 1; x += "a"`,
+			"type mismatch: INTEGER + STRING",
+		},
+		{
+			`"a" < "b"`,
+			"unknown operator: STRING < STRING",
+		},
+		{
+			`1 >= "a"`,
+			"type mismatch: INTEGER >= STRING",
+		},
+		{
+			"5 / 0",
+			"division by zero",
+		},
+		{
+			"5 % 0",
+			"division by zero",
+		},
+		{
+			"let x = 5; x /= 0; x",
+			"division by zero",
+		},
+		{
+			"while (true) { let x = if (true) { break }; }",
+			"break inside an expression",
+		},
+		{
+			"let i = 0; while (i < 3) { i += 1; [1, if (i < 3) { continue } else { 2 }] }",
+			"continue inside an expression",
+		},
+		{
+			"while (true) { let x = if (true) { if (true) { break } }; }",
+			"break inside an expression",
+		},
+		{
+			"let f = fn(a, b) { a / b }; f(1, 0); 2",
+			"division by zero",
+		},
 	}
 
 	for _, tt := range tests {
@@ -270,6 +395,105 @@ func TestLetStatements(t *testing.T) {
 	}
 }
 
+func TestWhileLoops(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let i = 0; while (i < 5) { let i = i + 1; }; i", 5},
+		{"while (false) { 1 }; 2", 2},
+		{`
+		let i = 0;
+		let sum = 0;
+		while (i < 10) {
+			let i = i + 1;
+			if (i == 5) { continue; }
+			if (i > 7) { break; }
+			let sum = sum + i;
+		}
+		sum`, 23},
+		{`
+		let f = fn(n) {
+			let i = 0;
+			while (true) {
+				if (i == n) { return i * 10; }
+				let i = i + 1;
+			}
+		};
+		f(3)`, 30},
+		{`
+		let i = 0;
+		let c = 0;
+		while (i < 3) {
+			let i = i + 1;
+			let j = 0;
+			while (true) {
+				let j = j + 1;
+				if (j > 2) { break; }
+				let c = c + 1;
+			}
+		}
+		c`, 6},
+		// 文としてのifの中のifからもbreakできる
+		{"let i = 0; while (true) { i += 1; if (i > 1) { if (i == 4) { break } } }; i", 4},
+		// 再帰と違ってstackを消費しない
+		{"let i = 0; while (i < 100000) { let i = i + 1; }; i", 100000},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
+func TestAssignExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected int64
+	}{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let x = 10; x += 5; x -= 3; x *= 2; x /= 4; x", 6},
+		{"let x = 1; let y = 2; x = y = 3; x + y", 6},
+		{"let i = 0; let sum = 0; while (i < 5) { i += 1; sum += i; }; sum", 15},
+		{"let x = 1; let f = fn() { x = 5; }; f(); x", 5},
+		{"let f = fn(a) { a += 1; a }; f(1)", 2},
+		// closureが捕まえた変数は呼び出しの間も保持される
+		{`
+		let counter = fn() {
+			let c = 0;
+			fn() { c += 1; c }
+		};
+		let next = counter();
+		next(); next();
+		next()`, 3},
+		// 代入される変数は定義した関数とclosureが共有する
+		{"let c = fn(n) { let g = fn() { n += 1; n }; g(); let a = g(); a * 10 + n }; c(5)", 77},
+		{`
+		let make = fn() {
+			let count = 0;
+			[fn() { count += 1 }, fn() { count }]
+		};
+		let p = make();
+		p[0](); p[0]();
+		p[1]()`, 2},
+		// 間のclosureもcellを渡す
+		{"let f = fn() { let a = 1; let g = fn() { fn() { a += 10 } }; g()(); a }; f()", 11},
+		// loopの中のletも同じ変数に代入する
+		{`
+		let f = fn() {
+			let fs = [];
+			let i = 0;
+			while (i < 3) { let x = i; fs = push(fs, fn() { x }); i += 1; }
+			fs[0]()
+		};
+		f()`, 2},
+	}
+
+	for _, tt := range tests {
+		testIntegerObject(t, testEval(tt.input), tt.expected)
+	}
+}
+
 func TestFunctionObject(t *testing.T) {
 	input := "fn(x) { x + 2; };"
 
@@ -341,6 +565,82 @@ func TestStringLiteral(t *testing.T) {
 	}
 }
 
+func TestStringEscapes(t *testing.T) {
+	input := `"a\tb\n\"c\"\\ \u{3042}\u{1F600}"`
+
+	evaluated := testEval(input)
+	str, ok := evaluated.(*object.String)
+	if !ok {
+		t.Fatalf("object is not String. got=%T (%+v)", evaluated, evaluated)
+	}
+
+	if str.Value != "a\tb\n\"c\"\\ あ😀" {
+		t.Errorf("String has wrong value. got=%q", str.Value)
+	}
+}
+
+func TestStringIndexExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`"abc"[1]`, "b"},
+		{`"日本語"[2]`, "語"},
+		{`let s = "héllo"; s[1] + s[4]`, "éo"},
+		{`"日本語"[3]`, nil},
+		{`"abc"[-1]`, nil},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		str, ok := tt.expected.(string)
+		if !ok {
+			testNullObject(t, evaluated)
+			continue
+		}
+
+		result, ok := evaluated.(*object.String)
+		if !ok {
+			t.Errorf("object is not String. got=%T (%+v)", evaluated, evaluated)
+			continue
+		}
+		if result.Value != str {
+			t.Errorf("String has wrong value. got=%q, want=%q", result.Value, str)
+		}
+	}
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"[1, 2, 3, 4][1:3]", "[2, 3]"},
+		{"[1, 2, 3][:2]", "[1, 2]"},
+		{"[1, 2, 3][1:]", "[2, 3]"},
+		{"[1, 2, 3][-1:99]", "[1, 2, 3]"},
+		{"[1, 2, 3][2:1]", "[]"},
+		{`"hello"[1:3]`, "el"},
+		{`"日本語です"[1:3]`, "本語"},
+		{`let s = "monkey"; s[len(s) - 3:]`, "key"},
+		{`1[1:]`, "slice operator not supported: INTEGER"},
+		{`"abc"["a":]`, "slice index must be INTEGER, got STRING"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+		if err, ok := evaluated.(*object.Error); ok {
+			if err.Message != tt.expected {
+				t.Errorf("wrong error message. expected=%q, got=%q", tt.expected, err.Message)
+			}
+			continue
+		}
+		if evaluated.Inspect() != tt.expected {
+			t.Errorf("wrong slice for %q. expected=%q, got=%q", tt.input, tt.expected, evaluated.Inspect())
+		}
+	}
+}
+
 func TestStringConcatenation(t *testing.T) {
 	input := `"Hello" + " " + "World!"`
 
@@ -363,6 +663,8 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
+		{`len("héllo")`, 5},
+		{`len("\u{1F600}")`, 1},
 		{`len(1)`, "argument to `len` not supported, got INTEGER"},
 		{`len("one", "two")`, "wrong number of arguments. got=2, want=1"},
 		{`len([1, 2, 3])`, 3},
@@ -373,6 +675,17 @@ func TestBuiltinFunctions(t *testing.T) {
 		{`let a = [1, 2, 3]; let b = rest(a); a`, "[1, 2, 3]"},
 		{`push([1, 2, 3], 4)`, "[1, 2, 3, 4]"},
 		{`let a = [1, 2, 3]; push(a, 4); a`, "[1, 2, 3]"},
+		{`split("a,b,c", ",")`, `[a, b, c]`},
+		{`join(split("a b c", " "), "-")`, "a-b-c"},
+		{`trim("  hi \n")`, "hi"},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`upper("héllo")`, "HÉLLO"},
+		{`lower("ABC")`, "abc"},
+		{`format("%s is %d (%.1f, %t)", "x", 1, 2.5, true)`, "x is 1 (2.5, true)"},
+		{`split(1, ",")`, "argument to `split` must be STRING, got INTEGER"},
+		{`join(["a", 1], ",")`, "elements to `join` must be STRING, got INTEGER"},
+		{`contains("monkey", "key")`, true},
+		{`contains("monkey", "dog")`, false},
 	}
 
 	for _, tt := range tests {
@@ -381,6 +694,8 @@ func TestBuiltinFunctions(t *testing.T) {
 		switch expected := tt.expected.(type) {
 		case int:
 			testIntegerObject(t, evaluated, int64(expected))
+		case bool:
+			testBooleanObject(t, evaluated, expected)
 		case string:
 			switch obj := evaluated.(type) {
 			case *object.Error:
@@ -389,9 +704,9 @@ func TestBuiltinFunctions(t *testing.T) {
 						expected, obj.Message)
 				}
 
-			case *object.Array:
+			case *object.Array, *object.String:
 				if obj.Inspect() != expected {
-					t.Errorf("wrong array. expected=%q, got=%q",
+					t.Errorf("wrong value. expected=%q, got=%q",
 						expected, obj.Inspect())
 				}
 			default:
@@ -548,6 +863,14 @@ func TestHashIndexExpressions(t *testing.T) {
 			`{true: 5}[true]`,
 			5,
 		},
+		{
+			`{1: 5}[1.0]`,
+			5,
+		},
+		{
+			`{2.5: 5}[2.5]`,
+			5,
+		},
 		{
 			`{false: 5}[false]`,
 			5,
@@ -564,3 +887,233 @@ func TestHashIndexExpressions(t *testing.T) {
 		}
 	}
 }
+
+func TestErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"5 + true", "ERROR: 1:1: type mismatch: INTEGER + BOOLEAN"},
+		{"let a = 1;\n  -true", "ERROR: 2:3: unknown operator: -BOOLEAN"},
+		{"let f = fn(x) {\n  x + foobar\n};\nf(1)", "ERROR: 2:7: identifier not found: foobar"},
+		{"len(1)", "ERROR: 1:1: argument to `len` not supported, got INTEGER"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		errObj, ok := evaluated.(*object.Error)
+		if !ok {
+			t.Errorf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+			continue
+		}
+
+		if errObj.Inspect() != tt.expected {
+			t.Errorf("wrong error. expected=%q, got=%q", tt.expected, errObj.Inspect())
+		}
+	}
+}
+
+func TestStackTrace(t *testing.T) {
+	input := `let inner = fn(x) {
+  x[0]
+};
+let outer = fn(y) {
+  let z = y + 1;
+  inner(z)
+};
+outer(1);`
+
+	evaluated := testEval(input)
+
+	errObj, ok := evaluated.(*object.Error)
+	if !ok {
+		t.Fatalf("no error object returned. got=%T(%+v)", evaluated, evaluated)
+	}
+
+	expected := `runtime error: index operator not supported: INTEGER
+
+inner(...)
+	2:3
+outer(...)
+	6:3
+main()
+	8:1
+`
+	trace := errObj.RuntimeError().StackTrace()
+	if trace != expected {
+		t.Errorf("wrong stack trace. expected=\n%s\ngot=\n%s", expected, trace)
+	}
+}
+
+func TestEvalContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input    string
+		ctx      context.Context
+		limits   object.Limits
+		expected error
+	}{
+		{`while (true) { }`, context.Background(), object.Limits{MaxSteps: 10000}, object.ErrStepLimit},
+		{`let f = fn(n) { f(n + 1) }; f(0)`, context.Background(), object.Limits{MaxSteps: 1000}, object.ErrStepLimit},
+		{`let a = []; while (true) { a = push(a, 1) }`, context.Background(), object.Limits{MaxAllocations: 10000}, object.ErrAllocationLimit},
+		{`let s = "a"; while (true) { s = s + s }`, context.Background(), object.Limits{MaxAllocations: 10000}, object.ErrAllocationLimit},
+		{`while (true) { }`, canceled, object.Limits{}, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		env := object.NewEnvironment()
+
+		result, err := EvalContext(tt.ctx, program, env, tt.limits)
+		if _, ok := err.(*object.LimitError); !ok {
+			t.Fatalf("expected *object.LimitError for %q. got=%T (%+v), result=%v", tt.input, err, err, result)
+		}
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+		if env.Budget() != nil {
+			t.Errorf("budget is left in the environment")
+		}
+	}
+}
+
+func TestEvalContextStackOverflow(t *testing.T) {
+	tests := []struct {
+		input    string
+		limits   object.Limits
+		expected string
+	}{
+		// vmのTestStackOverflowと同じ深さで止まる
+		{`let f = fn(n) { f(n + 1) }; f(0)`, object.Limits{}, "1:17: stack overflow (call depth 1023)"},
+		{`let f = fn(n) { f(n + 1) }; f(0)`, object.Limits{MaxDepth: 10}, "1:17: stack overflow (call depth 9)"},
+		{`let f = fn(n) { if (n == 9) { return n; } f(n + 1) }; f(0)`, object.Limits{MaxDepth: 11}, ""},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		env := object.NewEnvironment()
+
+		result, err := EvalContext(context.Background(), program, env, tt.limits)
+		if err != nil {
+			t.Fatalf("unexpected error for %q: %s", tt.input, err)
+		}
+		if tt.expected == "" {
+			testIntegerObject(t, result, 9)
+			continue
+		}
+		errObj, ok := result.(*object.Error)
+		if !ok {
+			t.Fatalf("no error object returned for %q. got=%T (%+v)", tt.input, result, result)
+		}
+		if got := errObj.Pos.String() + ": " + errObj.Message; got != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestEvalContextWithinLimits(t *testing.T) {
+	input := `
+	let sum = fn(n) { if (n == 0) { return 0; } n + sum(n - 1) };
+	let i = 0;
+	let a = [];
+	while (i < 10) { a = push(a, sum(i)); i += 1; }
+	a[9]
+	`
+	program := parser.New(lexer.New(input)).ParseProgram()
+	env := object.NewEnvironment()
+
+	limits := object.Limits{MaxSteps: 100000, MaxAllocations: 10000}
+	result, err := EvalContext(context.Background(), program, env, limits)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testIntegerObject(t, result, 45)
+
+	// 同じenvironmentのclosureをlimitなしで呼べる
+	result = Eval(parser.New(lexer.New("sum(100)")).ParseProgram(), env)
+	testIntegerObject(t, result, 5050)
+}
+
+func TestImports(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`let c = import "../testdata/import/counter.mk"; c["inc"](); c["inc"]()`, 2},
+		// 2回目のimportは同じmoduleを返す
+		{`let a = import "../testdata/import/counter.mk"; a["inc"]();
+		  let b = import "../testdata/import/counter.mk"; b["inc"]()`, 2},
+		{`(import "../testdata/import/math.mk")["quad"](3)`, 12},
+		{`let count = 5; let c = import "../testdata/import/counter.mk"; c["inc"](); count`, 5},
+		{`let f = fn() { import "../testdata/import/counter.mk" }; f()["inc"](); f()["inc"]()`, 2},
+		{`(import "../testdata/import/early.mk")["a"]`, 1},
+		{`(import "../testdata/import/early.mk")["b"]`, nil},
+		{`let secret = 1; import "../testdata/import/private.mk"`,
+			"identifier not found: secret"},
+		{`import "../testdata/import/missing.mk"`,
+			"open ../testdata/import/missing.mk: no such file or directory"},
+		{`import "../testdata/import/broken.mk"`,
+			"import ../testdata/import/broken.mk: ../testdata/import/broken.mk:1:9: no prefix parse function for ; found"},
+		{`import "../testdata/import/cycle_a.mk"`,
+			"import cycle: ../testdata/import/cycle_a.mk -> ../testdata/import/cycle_b.mk -> ../testdata/import/cycle_a.mk"},
+	}
+
+	for _, tt := range tests {
+		evaluated := testEval(tt.input)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case nil:
+			testNullObject(t, evaluated)
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned for %q. got=%T(%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. want=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
+
+func TestImportLoader(t *testing.T) {
+	tests := []struct {
+		input    string
+		loader   object.Loader
+		expected interface{}
+	}{
+		{`(import "../testdata/import/math.mk")["quad"](3)`, object.DirLoader("../testdata/import"), 12},
+		{`(import "../testdata/import/math.mk")["quad"](3)`, object.DenyImports,
+			"import ../testdata/import/math.mk: import not allowed"},
+		// ".."でrootの外に出るimport
+		{`import "../testdata/import/../../evaluator/evaluator.go"`, object.DirLoader("../testdata/import"),
+			"import ../evaluator/evaluator.go: import not allowed"},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		env := object.NewEnvironment()
+		env.Modules().SetLoader(tt.loader)
+		evaluated := Eval(program, env)
+
+		switch expected := tt.expected.(type) {
+		case int:
+			testIntegerObject(t, evaluated, int64(expected))
+		case string:
+			errObj, ok := evaluated.(*object.Error)
+			if !ok {
+				t.Errorf("no error object returned for %q. got=%T(%+v)", tt.input, evaluated, evaluated)
+				continue
+			}
+			if errObj.Message != expected {
+				t.Errorf("wrong error message. want=%q, got=%q", expected, errObj.Message)
+			}
+		}
+	}
+}
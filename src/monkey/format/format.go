@@ -0,0 +1,386 @@
+// Package format prints Monkey programs in a canonical layout.
+//
+// Blocks are indented with tabs, statements end with ";" and
+// parentheses are only kept where precedence needs them.
+//
+// Comments are kept as the lexer attaches them to tokens. A comment on its own line is
+// printed on its own line before the next statement, and a comment after a statement or
+// inside an expression is printed at the end of the statement.
+package format
+
+import (
+	"bytes"
+	"errors"
+	"monkey/ast"
+	"monkey/lexer"
+	"monkey/parser"
+	"monkey/token"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Source parses src and returns it formatted with its comments.
+func Source(filename string, src []byte) ([]byte, error) {
+	l := lexer.NewWithFilename(filename, string(src))
+	p := parser.New(l)
+
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, errors.New(strings.Join(p.Errors(), "\n"))
+	}
+
+	pr := &printer{comments: comments(filename, src)}
+	pr.statements(program.Statements, token.Position{})
+	return pr.out.Bytes(), nil
+}
+
+// comments returns the comments of src in order.
+func comments(filename string, src []byte) []token.Comment {
+	l := lexer.NewWithFilename(filename, string(src))
+	l.SetKeepComments(true)
+
+	var comments []token.Comment
+	for {
+		tok := l.NextToken()
+		comments = append(comments, tok.Comments...)
+		if tok.Type == token.EOF {
+			return comments
+		}
+	}
+}
+
+// Node returns the formatted source of node.
+func Node(node ast.Node) string {
+	pr := &printer{}
+	switch node := node.(type) {
+	case *ast.Program:
+		pr.statements(node.Statements, token.Position{})
+	case ast.Statement:
+		pr.statement(node)
+	case ast.Expression:
+		pr.expression(node, parser.LOWEST)
+	}
+	return pr.out.String()
+}
+
+type printer struct {
+	out    bytes.Buffer
+	indent int
+
+	// comments not printed yet, in the order of the source
+	comments []token.Comment
+}
+
+func (pr *printer) write(s string) {
+	pr.out.WriteString(s)
+}
+
+func (pr *printer) newline() {
+	pr.out.WriteByte('\n')
+	pr.out.WriteString(strings.Repeat("\t", pr.indent))
+}
+
+// statements prints one statement per line, and the comments before end on their lines.
+// An invalid end is the end of the source.
+// A blank line in the source between two statements or comments is kept.
+func (pr *printer) statements(stmts []ast.Statement, end token.Position) {
+	// 最後に出力した文かコメントが終わるソースの行. 0は行をまだ出力していない
+	last := 0
+	line := func(pos token.Position) {
+		if last > 0 {
+			if pos.Line > last+1 {
+				pr.out.WriteByte('\n')
+			}
+			pr.newline()
+		}
+	}
+
+	for _, s := range stmts {
+		for pr.commentBefore(s.Pos()) {
+			line(pr.comments[0].Pos)
+			last = pr.comment().End.Line
+		}
+
+		line(s.Pos())
+		pr.statement(s)
+		last = s.End().Line
+
+		// 式の中のコメントと、文と同じ行に続くコメントは文の後ろにつける
+		for len(pr.comments) > 0 {
+			pos := pr.comments[0].Pos
+			trailing := before(pos, s.End()) || pos.Line == last
+			if !trailing || end.IsValid() && !before(pos, end) {
+				break
+			}
+			pr.write(" ")
+			c := pr.comment()
+			last = c.End.Line
+			// // のコメントの後ろは次の行にする
+			if strings.HasPrefix(c.Text, "//") {
+				break
+			}
+		}
+	}
+
+	for len(pr.comments) > 0 && (!end.IsValid() || pr.commentBefore(end)) {
+		line(pr.comments[0].Pos)
+		last = pr.comment().End.Line
+	}
+
+	if last > 0 && pr.indent == 0 {
+		pr.out.WriteByte('\n')
+	}
+}
+
+// commentBefore reports whether the next comment is before pos.
+func (pr *printer) commentBefore(pos token.Position) bool {
+	return len(pr.comments) > 0 && before(pr.comments[0].Pos, pos)
+}
+
+// comment prints the next comment as it is in the source, and returns it.
+func (pr *printer) comment() token.Comment {
+	c := pr.comments[0]
+	pr.comments = pr.comments[1:]
+	pr.write(c.Text)
+	return c
+}
+
+func before(a, b token.Position) bool {
+	return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+}
+
+func (pr *printer) statement(stmt ast.Statement) {
+	switch stmt := stmt.(type) {
+	case *ast.LetStatement:
+		pr.write("let " + stmt.Name.Value + " = ")
+		pr.expression(stmt.Value, parser.LOWEST)
+		pr.write(";")
+
+	case *ast.ReturnStatement:
+		pr.write("return")
+		if stmt.ReturnValue != nil {
+			pr.write(" ")
+			pr.expression(stmt.ReturnValue, parser.LOWEST)
+		}
+		pr.write(";")
+
+	case *ast.ExpressionStatement:
+		pr.expression(stmt.Expression, parser.LOWEST)
+		// if (...) { } の後ろには;をつけない
+		if _, ok := stmt.Expression.(*ast.IfExpression); !ok {
+			pr.write(";")
+		}
+
+	case *ast.WhileStatement:
+		pr.write("while (")
+		pr.expression(stmt.Condition, parser.LOWEST)
+		pr.write(") ")
+		pr.block(stmt.Body)
+
+	case *ast.BreakStatement:
+		pr.write("break;")
+
+	case *ast.ContinueStatement:
+		pr.write("continue;")
+
+	case *ast.BlockStatement:
+		pr.block(stmt)
+	}
+}
+
+func (pr *printer) block(block *ast.BlockStatement) {
+	if len(block.Statements) == 0 && !pr.commentBefore(block.EndPos) {
+		pr.write("{}")
+		return
+	}
+
+	pr.write("{")
+	pr.indent++
+	pr.newline()
+	pr.statements(block.Statements, block.EndPos)
+	pr.indent--
+	pr.newline()
+	pr.write("}")
+}
+
+// expression prints exp inside an operator of the given precedence,
+// adding parentheses if exp binds more loosely.
+func (pr *printer) expression(exp ast.Expression, precedence int) {
+	if prec := expressionPrecedence(exp); prec < precedence {
+		pr.write("(")
+		pr.expression(exp, parser.LOWEST)
+		pr.write(")")
+		return
+	}
+
+	switch exp := exp.(type) {
+	case *ast.Identifier:
+		pr.write(exp.Value)
+
+	case *ast.IntegerLiteral:
+		pr.write(exp.Token.Literal)
+
+	case *ast.FloatLiteral:
+		pr.write(exp.Token.Literal)
+
+	case *ast.Boolean:
+		pr.write(exp.Token.Literal)
+
+	case *ast.StringLiteral:
+		pr.write(quote(exp.Value))
+
+	case *ast.PrefixExpression:
+		pr.write(exp.Operator)
+		pr.expression(exp.Right, parser.PREFIX)
+
+	case *ast.InfixExpression:
+		// 左結合なので、右側は同じ優先度でも括弧が必要
+		prec := parser.Precedence(exp.Token.Type)
+		pr.expression(exp.Left, prec)
+		pr.write(" " + exp.Operator + " ")
+		pr.expression(exp.Right, prec+1)
+
+	case *ast.AssignExpression:
+		// 右結合なので、右側は同じ優先度なら括弧はいらない
+		pr.write(exp.Name.Value + " " + exp.Operator + " ")
+		pr.expression(exp.Value, parser.ASSIGN)
+
+	case *ast.IfExpression:
+		pr.write("if (")
+		pr.expression(exp.Condition, parser.LOWEST)
+		pr.write(") ")
+		pr.block(exp.Consequence)
+		if exp.Alternative != nil {
+			pr.write(" else ")
+			pr.block(exp.Alternative)
+		}
+
+	case *ast.FunctionLiteral:
+		params := []string{}
+		for _, p := range exp.Parameters {
+			params = append(params, p.Value)
+		}
+		pr.write("fn(" + strings.Join(params, ", ") + ") ")
+		pr.block(exp.Body)
+
+	case *ast.CallExpression:
+		pr.expression(exp.Function, parser.CALL)
+		pr.write("(")
+		pr.expressionList(exp.Arguments)
+		pr.write(")")
+
+	case *ast.ArrayLiteral:
+		pr.write("[")
+		pr.expressionList(exp.Elements)
+		pr.write("]")
+
+	case *ast.IndexExpression:
+		pr.expression(exp.Left, parser.INDEX)
+		pr.write("[")
+		pr.expression(exp.Index, parser.LOWEST)
+		pr.write("]")
+
+	case *ast.SliceExpression:
+		pr.expression(exp.Left, parser.INDEX)
+		pr.write("[")
+		if exp.Low != nil {
+			pr.expression(exp.Low, parser.LOWEST)
+		}
+		pr.write(":")
+		if exp.High != nil {
+			pr.expression(exp.High, parser.LOWEST)
+		}
+		pr.write("]")
+
+	case *ast.ImportExpression:
+		pr.write("import " + quote(exp.Path.Value))
+
+	case *ast.HashLiteral:
+		// Pairsはmapなのでソース上の順番に並べ直す
+		keys := []ast.Expression{}
+		for k := range exp.Pairs {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool {
+			a, b := keys[i].Pos(), keys[j].Pos()
+			return a.Line < b.Line || a.Line == b.Line && a.Column < b.Column
+		})
+
+		pr.write("{")
+		for i, k := range keys {
+			if i > 0 {
+				pr.write(", ")
+			}
+			pr.expression(k, parser.LOWEST)
+			pr.write(": ")
+			pr.expression(exp.Pairs[k], parser.LOWEST)
+		}
+		pr.write("}")
+	}
+}
+
+func (pr *printer) expressionList(list []ast.Expression) {
+	for i, e := range list {
+		if i > 0 {
+			pr.write(", ")
+		}
+		pr.expression(e, parser.LOWEST)
+	}
+}
+
+// quote returns s as a Monkey string literal.
+// Characters that can't be printed are written as escape sequences.
+func quote(s string) string {
+	var out strings.Builder
+	out.WriteByte('"')
+
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			// UTF-8でないバイトはソースにあったままにする
+			out.WriteByte(s[i])
+		case r == '"':
+			out.WriteString(`\"`)
+		case r == '\\':
+			out.WriteString(`\\`)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r == '\r':
+			out.WriteString(`\r`)
+		case r == 0:
+			out.WriteString(`\0`)
+		case !strconv.IsPrint(r):
+			out.WriteString(`\u{` + strconv.FormatInt(int64(r), 16) + `}`)
+		default:
+			out.WriteRune(r)
+		}
+		i += size
+	}
+
+	out.WriteByte('"')
+	return out.String()
+}
+
+// expressionPrecedence is how tightly exp binds when printed without parentheses.
+func expressionPrecedence(exp ast.Expression) int {
+	switch exp := exp.(type) {
+	case *ast.InfixExpression:
+		return parser.Precedence(exp.Token.Type)
+	case *ast.PrefixExpression:
+		return parser.PREFIX
+	case *ast.AssignExpression:
+		return parser.ASSIGN
+	case *ast.CallExpression:
+		return parser.CALL
+	case *ast.IndexExpression, *ast.SliceExpression:
+		return parser.INDEX
+	default:
+		// literals and identifiers never need parentheses
+		return parser.INDEX + 1
+	}
+}
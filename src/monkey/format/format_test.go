@@ -0,0 +1,143 @@
+package format
+
+import "testing"
+
+func TestSource(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"let x=5",
+			"let x = 5;\n",
+		},
+		{
+			"let pi=3.14;1e-9*-2.5E+3",
+			"let pi = 3.14;\n1e-9 * -2.5E+3;\n",
+		},
+		{
+			"1+2*3; (1+2)*3; 1-(2-3); (1-2)-3; -(1+2); !true",
+			"1 + 2 * 3;\n(1 + 2) * 3;\n1 - (2 - 3);\n1 - 2 - 3;\n-(1 + 2);\n!true;\n",
+		},
+		{
+			"let add = fn(a,b){return a+b;};\n\n\nadd(1,2)",
+			"let add = fn(a, b) {\n\treturn a + b;\n};\n\nadd(1, 2);\n",
+		},
+		{
+			"if(x>1){ if (y) { 1 } } else {2}",
+			"if (x > 1) {\n\tif (y) {\n\t\t1;\n\t}\n} else {\n\t2;\n}\n",
+		},
+		{
+			"while(i<3){if(i==1){break}else{continue;}}",
+			"while (i < 3) {\n\tif (i == 1) {\n\t\tbreak;\n\t} else {\n\t\tcontinue;\n\t}\n}\n",
+		},
+		{
+			"x=y=1; x+=(y-=2)*3; f(x=1); (x=1)+2",
+			"x = y = 1;\nx += (y -= 2) * 3;\nf(x = 1);\n(x = 1) + 2;\n",
+		},
+		{
+			`"a\tb\u{41}\u{3042}\"\\"; "\u{7f}\0"`,
+			"\"a\\tbAあ\\\"\\\\\";\n\"\\u{7f}\\0\";\n",
+		},
+		{
+			"s[1:2]; s[:n+1]; s[ : ]; (a+b)[1:]",
+			"s[1:2];\ns[:n + 1];\ns[:];\n(a + b)[1:];\n",
+		},
+		{
+			"a||b&&c; (a||b)&&c; a%(b*c); a<=b>=c",
+			"a || b && c;\n(a || b) && c;\na % (b * c);\na <= b >= c;\n",
+		},
+		{
+			`let h = {"b": [1,2][0], "a": fn(){}}; (a + b)[0]; f(1)(2)`,
+			"let h = {\"b\": [1, 2][0], \"a\": fn() {}};\n(a + b)[0];\nf(1)(2);\n",
+		},
+		{
+			`let m=import   "lib.mk"; (import "a.mk")["f"](1)`,
+			"let m = import \"lib.mk\";\nimport \"a.mk\"[\"f\"](1);\n",
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := Source("test.mk", []byte(tt.input))
+		if err != nil {
+			t.Fatalf("format error: %s", err)
+		}
+
+		if string(out) != tt.expected {
+			t.Errorf("wrong output for %q.\nwant=%q\ngot= %q", tt.input, tt.expected, out)
+		}
+
+		// 整形結果をもう一度整形しても変わらないこと
+		again, err := Source("test.mk", out)
+		if err != nil {
+			t.Fatalf("format error on formatted source: %s", err)
+		}
+		if string(again) != string(out) {
+			t.Errorf("format is not idempotent.\nfirst= %q\nsecond=%q", out, again)
+		}
+	}
+}
+
+func TestSourceWithComments(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{
+			"let x = 5;\nx; // five\n",
+			"let x = 5;\nx; // five\n",
+		},
+		{
+			"// header\n\n// about x\nlet x=5 /* five */;\n\n\n// end\n",
+			"// header\n\n// about x\nlet x = 5; /* five */\n\n// end\n",
+		},
+		{
+			"let f = fn(a) {\n// first\na+1 // add\n// last\n};",
+			"let f = fn(a) {\n\t// first\n\ta + 1; // add\n\t// last\n};\n",
+		},
+		{
+			"if (x) { // nothing\n} else { 1 } // one",
+			"if (x) {\n\t// nothing\n} else {\n\t1;\n} // one\n",
+		},
+		{
+			// 式の中のコメントは文の後ろに移す
+			"let a = [1, // one\n2 /* two */];\nf(a)",
+			"let a = [1, 2]; // one\n/* two */\nf(a);\n",
+		},
+		{
+			"/* only\n   a comment */",
+			"/* only\n   a comment */\n",
+		},
+	}
+
+	for _, tt := range tests {
+		out, err := Source("test.mk", []byte(tt.input))
+		if err != nil {
+			t.Fatalf("format error: %s", err)
+		}
+
+		if string(out) != tt.expected {
+			t.Errorf("wrong output for %q.\nwant=%q\ngot= %q", tt.input, tt.expected, out)
+		}
+
+		again, err := Source("test.mk", out)
+		if err != nil {
+			t.Fatalf("format error on formatted source: %s", err)
+		}
+		if string(again) != string(out) {
+			t.Errorf("format is not idempotent.\nfirst= %q\nsecond=%q", out, again)
+		}
+	}
+}
+
+func TestSourceParseError(t *testing.T) {
+	_, err := Source("test.mk", []byte("let x 5;"))
+	if err == nil {
+		t.Fatalf("expected error")
+	}
+
+	expected := "test.mk:1:7: expected next token to be =, got INT instead"
+	if err.Error() != expected {
+		t.Errorf("wrong error. want=%q, got=%q", expected, err)
+	}
+}
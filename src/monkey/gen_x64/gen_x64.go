@@ -3,14 +3,18 @@ package gen_x64
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"monkey/code"
 	"monkey/compiler"
 	"monkey/object"
+	"strings"
 )
 
 type Gen struct {
 	constants []object.Object
 	Global    *bytes.Buffer
+	// closures of functions without free variables
+	Data *bytes.Buffer
 
 	labelcnt int
 
@@ -18,6 +22,9 @@ type Gen struct {
 	fcnt    int
 	fIndex  map[int]int
 	builtin map[int]struct{}
+
+	// label of each string, so that equal strings have the same address (and are equal hash keys)
+	strings map[string]int
 }
 
 type Frame struct {
@@ -60,10 +67,12 @@ func New(b *compiler.Bytecode) *Gen {
 	g := &Gen{
 		constants: b.Constants,
 		Global:    &bytes.Buffer{},
+		Data:      &bytes.Buffer{},
 		frame:     []*Frame{f},
 		fcnt:      0,
 		fIndex:    make(map[int]int),
 		builtin:   make(map[int]struct{}),
+		strings:   make(map[string]int),
 	}
 	return g
 }
@@ -77,10 +86,23 @@ func (g *Gen) Assembly() *bytes.Buffer {
 	// write Global binding
 	if g.Global.Len() > 0 {
 		fmt.Fprintf(b, ".text\n.section	.rodata\n")
-		fmt.Fprintf(b, g.Global.String())
+		b.WriteString(g.Global.String())
 		fmt.Fprintf(b, "\n")
 	}
 
+	// write closures of functions and builtins
+	if g.Data.Len() > 0 || len(g.builtin) > 0 {
+		fmt.Fprintln(b, ".data")
+		fmt.Fprint(b, g.Data.String())
+		for i := range g.builtin {
+			name := object.Builtins[i].Name
+			writeHeader(b, header(typeBuiltin, 0))
+			fmt.Fprintf(b, ".CLOSURE_%s:\n", name)
+			fmt.Fprintf(b, "	.quad %s\n", name)
+		}
+		fmt.Fprintln(b)
+	}
+
 	fmt.Fprintln(b, ".text")
 
 	// write function
@@ -93,6 +115,11 @@ func (g *Gen) Assembly() *bytes.Buffer {
 		fmt.Fprintln(b, object.Builtins[i].Assembly)
 	}
 
+	fmt.Fprintln(b, runtime())
+
+	// stackは実行しない
+	fmt.Fprintln(b, `.section .note.GNU-stack,"",@progbits`)
+
 	return b
 }
 
@@ -104,14 +131,23 @@ func (g *Gen) Genx64() error {
 	if currentFCnt == 0 {
 		fmt.Fprintln(cf.Assembly, ".global main")
 		fmt.Fprintln(cf.Assembly, "main:")
+		fmt.Fprintln(cf.Assembly, "	push rbp")
+		fmt.Fprintln(cf.Assembly, "	mov rbp, rsp")
+		// the collector scans the stack up to the frame of main
+		//  globalsはmainのframeに置くので、関数からもここを使って読み書きする
+		fmt.Fprintln(cf.Assembly, "	mov monkey_stack_bottom[rip], rbp")
+		fmt.Fprintln(cf.Assembly, "	mov rdi, rbp")
+		fmt.Fprintln(cf.Assembly, "	call monkey_stack_init")
 	} else {
 		fmt.Fprintf(cf.Assembly, ".global function%d\n", currentFCnt)
 		fmt.Fprintf(cf.Assembly, "function%d:\n", currentFCnt)
+		fmt.Fprintln(cf.Assembly, "	push rbp")
+		fmt.Fprintln(cf.Assembly, "	mov rbp, rsp")
+		// 再帰が深すぎるとき、segfaultではなくvmと同じ実行時エラーにする
+		fmt.Fprintln(cf.Assembly, "	cmp rsp, monkey_stack_limit[rip]")
+		fmt.Fprintln(cf.Assembly, "	jb monkey_stack_overflow")
 	}
 
-	fmt.Fprintln(cf.Assembly, "	push rbp")
-	fmt.Fprintln(cf.Assembly, "	mov rbp, rsp")
-
 	// treat parameter
 	//  x64 and Monkey VM ABI are different.
 	//  Monkey: Parameter is used as local binding.
@@ -130,6 +166,8 @@ func (g *Gen) Genx64() error {
 	//     Return Poiner
 	//     -----------------
 	//     Argument1
+	//     -----------------
+	//     Closure (pushed by the caller before the arguments)
 
 	//   so, out x64 compiler's leyout is below
 	//     Local binding1
@@ -145,15 +183,18 @@ func (g *Gen) Genx64() error {
 	// in x64, we move Argument1 to below of Local bindings. bacause bytecode requires it.
 	paramNum := cf.paramNum
 	// move Argument to above of Return pointer.
-	n := 16 + (8 * (paramNum - 1))
+	//  最後の引数が[rbp+16]にあるので、最初の引数から順にpushする
 	for i := 0; i < paramNum; i++ {
-		n -= (8 * i)
-		fmt.Fprintf(cf.Assembly, "	push [rbp+%d]\n", n)
+		fmt.Fprintf(cf.Assembly, "	push [rbp+%d]\n", 16+8*(paramNum-1-i))
 	}
 
-	// 変数分を先に引いておく
+	// 変数分を先にnullで埋めておく(collectorが古い値をpointerと見ないように)
 	//  symbolnum contains paramNum, so have to sub cf.paramNum
-	fmt.Fprintf(cf.Assembly, "	sub rsp, %d\n", (cf.symbolnum-cf.paramNum)*8)
+	for i := cf.paramNum; i < cf.symbolnum; i++ {
+		fmt.Fprintf(cf.Assembly, "	push %d\n", valueNull)
+	}
+
+	g.reserveLabels(cf)
 
 	for ip := 0; ip < len(cf.instraction); ip++ {
 		op := code.Opcode(cf.instraction[ip])
@@ -172,92 +213,86 @@ func (g *Gen) Genx64() error {
 
 			switch obj := obj.(type) {
 			case *object.Integer:
-				i := obj.Value
-				fmt.Fprintf(cf.Assembly, "	push %d\n", i)
+				i, err := tagInteger(obj.Value)
+				if err != nil {
+					return err
+				}
+				// pushの即値は32bitなので、raxを経由する
+				fmt.Fprintf(cf.Assembly, "	mov rax, %d\n", i)
+				fmt.Fprintln(cf.Assembly, "	push rax")
+			case *object.Float:
+				g.addFloat(obj.Value, int(constIndex))
+				fmt.Fprintf(cf.Assembly, "	lea rax, .FLOAT%d[rip]\n", constIndex)
+				fmt.Fprintln(cf.Assembly, "	push rax")
 			case *object.String:
-				g.addString(obj.Value, int(constIndex))
-				fmt.Fprintf(cf.Assembly, "	lea rax, .STRGBL%d[rip]\n", constIndex)
+				label := g.stringLabel(obj.Value, int(constIndex))
+				fmt.Fprintf(cf.Assembly, "	lea rax, .STRGBL%d[rip]\n", label)
 				fmt.Fprintln(cf.Assembly, "	push rax")
 
 			default:
-
+				return fmt.Errorf("x64: unsupported constant %s", obj.Type())
 			}
 
 		case code.OpReturnValue:
 			fmt.Fprintln(cf.Assembly, "	pop rax")
+			if currentFCnt == 0 {
+				// mainの戻り値は終了コードになる
+				fmt.Fprintln(cf.Assembly, "	mov rdi, rax")
+				fmt.Fprintln(cf.Assembly, "	call monkey_exit_code")
+			}
 			fmt.Fprintln(cf.Assembly, "	mov rsp, rbp")
 			fmt.Fprintln(cf.Assembly, "	pop rbp")
 			fmt.Fprintln(cf.Assembly, "	ret")
 
-		case code.OpAdd:
-			fmt.Fprintln(cf.Assembly, "	pop rbx")
-			fmt.Fprintln(cf.Assembly, "	pop rax")
-			fmt.Fprintln(cf.Assembly, "	add rax, rbx")
-			fmt.Fprintln(cf.Assembly, "	push rax")
-		case code.OpSub:
-			fmt.Fprintln(cf.Assembly, "	pop rbx")
-			fmt.Fprintln(cf.Assembly, "	pop rax")
-			fmt.Fprintln(cf.Assembly, "	sub rax, rbx")
-			fmt.Fprintln(cf.Assembly, "	push rax")
-		case code.OpMul:
-			fmt.Fprintln(cf.Assembly, "	pop rbx")
-			fmt.Fprintln(cf.Assembly, "	pop rax")
-			fmt.Fprintln(cf.Assembly, "	imul rbx")
-			fmt.Fprintln(cf.Assembly, "	push rax")
-		case code.OpDiv:
-			fmt.Fprintln(cf.Assembly, "	pop rbx")
+		case code.OpReturn:
+			// whileで終わる関数などはnullを返す
+			if currentFCnt == 0 {
+				fmt.Fprintln(cf.Assembly, "	mov rax, 0")
+			} else {
+				fmt.Fprintf(cf.Assembly, "	mov rax, %d\n", valueNull)
+			}
+			fmt.Fprintln(cf.Assembly, "	mov rsp, rbp")
+			fmt.Fprintln(cf.Assembly, "	pop rbp")
+			fmt.Fprintln(cf.Assembly, "	ret")
+
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+			code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan,
+			code.OpGreaterEqual, code.OpLessEqual:
+			// 型によって演算が変わるので、runtimeで行う
+			fmt.Fprintf(cf.Assembly, "	mov rdi, %d\n", op)
+			cf.callRuntime("monkey_binary", 2)
+
+		case code.OpBang:
+			// falseとnullは!でtrue、それ以外はfalse
 			fmt.Fprintln(cf.Assembly, "	pop rax")
-			fmt.Fprintln(cf.Assembly, "	cdq")
-			fmt.Fprintln(cf.Assembly, "	idiv rbx")
-			fmt.Fprintln(cf.Assembly, "	push rax")
+			fmt.Fprintf(cf.Assembly, "	mov rcx, %d\n", valueFalse)
+			fmt.Fprintf(cf.Assembly, "	mov rdx, %d\n", valueTrue)
+			fmt.Fprintf(cf.Assembly, "	cmp rax, %d\n", valueFalse)
+			fmt.Fprintln(cf.Assembly, "	cmove rcx, rdx")
+			fmt.Fprintf(cf.Assembly, "	cmp rax, %d\n", valueNull)
+			fmt.Fprintln(cf.Assembly, "	cmove rcx, rdx")
+			fmt.Fprintln(cf.Assembly, "	push rcx")
+
 		case code.OpMinus:
-			fmt.Fprintln(cf.Assembly, "	mov rax, 0")
-			fmt.Fprintln(cf.Assembly, "	pop rbx")
-			fmt.Fprintln(cf.Assembly, "	sub rax, rbx")
-			fmt.Fprintln(cf.Assembly, "	push rax")
-		case code.OpEqual:
-			// Trueだったら0, それ以外は0以外をpush
-			fmt.Fprintln(cf.Assembly, "	pop rbx")
-			fmt.Fprintln(cf.Assembly, "	pop rax")
-			// cmp命令でZFを立てるのではなく、sub演算の結果をstackに積む
-			fmt.Fprintln(cf.Assembly, "	sub rax, rbx")
-			fmt.Fprintln(cf.Assembly, "	push rax")
-		case code.OpNotEqual:
-			// Trueだったら0以外、それ以外は0をpush
-			fmt.Fprintln(cf.Assembly, "	pop rax")
-			fmt.Fprintln(cf.Assembly, "	pop rbx")
-			// cmp命令でZFを立てるのではなく、sub演算の結果をstackに積む
-			fmt.Fprintln(cf.Assembly, "	cmp rax, rbx")
-			// rax, rbxが一致しなかったら0をpush
-			fmt.Fprintf(cf.Assembly, "	jne .LABEL%d\n", g.labelcnt)
-			fmt.Fprintln(cf.Assembly, "	push 1")
-			fmt.Fprintf(cf.Assembly, "	jmp .LABEL%d\n", g.labelcnt+1)
-			fmt.Fprintf(cf.Assembly, ".LABEL%d:\n", g.labelcnt)
-			fmt.Fprintln(cf.Assembly, "	push 0")
-			fmt.Fprintf(cf.Assembly, ".LABEL%d:\n", g.labelcnt+1)
-			g.labelcnt += 2
-
-		case code.OpGreaterThan:
-			fmt.Fprintln(cf.Assembly, "	pop rbx")
-			fmt.Fprintln(cf.Assembly, "	pop rax")
-			fmt.Fprintln(cf.Assembly, "	cmp rax, rbx")
-			fmt.Fprintf(cf.Assembly, "	jle .LABEL%d\n", g.labelcnt)
-			fmt.Fprintln(cf.Assembly, "	push 0")
-			fmt.Fprintf(cf.Assembly, "	jmp .LABEL%d\n", g.labelcnt+1)
-			fmt.Fprintf(cf.Assembly, ".LABEL%d:\n", g.labelcnt)
-			fmt.Fprintln(cf.Assembly, "	push 1")
-			fmt.Fprintf(cf.Assembly, ".LABEL%d:\n", g.labelcnt+1)
-			g.labelcnt += 2
+			cf.callRuntime("monkey_negate", 1)
+
+		case code.OpTrue:
+			fmt.Fprintf(cf.Assembly, "	push %d\n", valueTrue)
+		case code.OpFalse:
+			fmt.Fprintf(cf.Assembly, "	push %d\n", valueFalse)
 
 		case code.OpSetGlobal:
 			globalIndex := code.ReadUint16(cf.instraction[ip+1:])
 			ip += 2
+
 			fmt.Fprintln(cf.Assembly, "	pop rax")
-			fmt.Fprintf(cf.Assembly, "	mov [rbp-%d] ,rax\n", (globalIndex+1)*8)
+			base := cf.globalBase(currentFCnt)
+			fmt.Fprintf(cf.Assembly, "	mov [%s-%d], rax\n", base, (globalIndex+1)*8)
 
 		case code.OpSetLocal:
 			globalIndex := code.ReadUint8(cf.instraction[ip+1:])
 			ip += 1
+
 			fmt.Fprintln(cf.Assembly, "	pop rax")
 			fmt.Fprintf(cf.Assembly, "	mov [rbp-%d] ,rax\n", (globalIndex+1)*8)
 
@@ -265,7 +300,8 @@ func (g *Gen) Genx64() error {
 			globalIndex := code.ReadUint16(cf.instraction[ip+1:])
 			ip += 2
 
-			fmt.Fprintf(cf.Assembly, "	mov rax, [rbp-%d]\n", (globalIndex+1)*8)
+			base := cf.globalBase(currentFCnt)
+			fmt.Fprintf(cf.Assembly, "	mov rax, [%s-%d]\n", base, (globalIndex+1)*8)
 			fmt.Fprintln(cf.Assembly, "	push rax")
 
 		case code.OpGetLocal:
@@ -276,110 +312,318 @@ func (g *Gen) Genx64() error {
 			fmt.Fprintln(cf.Assembly, "	push rax")
 
 		case code.OpNull:
-			fmt.Fprintln(cf.Assembly, "	push 0")
+			fmt.Fprintf(cf.Assembly, "	push %d\n", valueNull)
 
 		case code.OpJump:
-			fmt.Fprintf(cf.Assembly, "	jmp .LABEL%d\n", g.labelcnt)
 			bytecodeNo := int(code.ReadUint16(cf.instraction[ip+1:]))
-
-			pushLabel(cf, g.labelcnt, bytecodeNo)
-
-			g.labelcnt++
 			ip += 2
 
+			fmt.Fprintf(cf.Assembly, "	jmp .LABEL%d\n", cf.reserveLabel[bytecodeNo])
+
 		case code.OpJumpNotTruthy:
-			fmt.Fprintln(cf.Assembly, "	pop rax")
-			fmt.Fprintln(cf.Assembly, "	cmp rax, 0")
-			fmt.Fprintf(cf.Assembly, "	jne .LABEL%d\n", g.labelcnt)
 			bytecodeNo := int(code.ReadUint16(cf.instraction[ip+1:]))
-
-			pushLabel(cf, g.labelcnt, bytecodeNo)
-
-			g.labelcnt++
 			ip += 2
 
+			// falseとnullだけがtruthyでない
+			fmt.Fprintln(cf.Assembly, "	pop rax")
+			fmt.Fprintf(cf.Assembly, "	cmp rax, %d\n", valueFalse)
+			fmt.Fprintf(cf.Assembly, "	je .LABEL%d\n", cf.reserveLabel[bytecodeNo])
+			fmt.Fprintf(cf.Assembly, "	cmp rax, %d\n", valueNull)
+			fmt.Fprintf(cf.Assembly, "	je .LABEL%d\n", cf.reserveLabel[bytecodeNo])
+
 		case code.OpPop:
 			fmt.Fprintln(cf.Assembly, "	pop rax")
 
 		case code.OpClosure:
 			constIndex := code.ReadUint16(cf.instraction[ip+1:])
-			numFree := code.ReadUint8(cf.instraction[ip+3:])
+			numFree := int(code.ReadUint8(cf.instraction[ip+3:]))
 			ip += 3
 
-			err := g.pushClosure(int(constIndex), int(numFree))
+			err := g.pushClosure(int(constIndex))
 			if err != nil {
 				return err
 			}
-			fmt.Fprintf(cf.Assembly, "	lea rax, function%d[rip]\n", g.fcnt)
+			// 関数の中に関数があるとg.fcntは進んでいるので、constIndexから引く
+			fIndex := g.fIndex[int(constIndex)]
+			numParams := g.frame[fIndex].paramNum
+
+			// Closure Layout
+			//  [function address]
+			//  [number of parameters]
+			//  [free variable 0]
+			//  [free variable 1]
+			// 自由変数のない関数のclosureは変わらないので、dataに1つだけ置く
+			if numFree == 0 {
+				writeHeader(g.Data, header(typeClosure, 0))
+				fmt.Fprintf(g.Data, ".CLOSURE%d:\n", fIndex)
+				fmt.Fprintf(g.Data, "	.quad function%d\n", fIndex)
+				fmt.Fprintf(g.Data, "	.quad %d\n", numParams)
+				fmt.Fprintf(cf.Assembly, "	lea rax, .CLOSURE%d[rip]\n", fIndex)
+				fmt.Fprintln(cf.Assembly, "	push rax")
+				break
+			}
+
+			// 自由変数はallocの間stackに置いておく
+			g.alloc(cf, 8*(numFree+2), header(typeClosure, 0))
+			fmt.Fprintf(cf.Assembly, "	lea rbx, function%d[rip]\n", fIndex)
+			fmt.Fprintln(cf.Assembly, "	mov [rax], rbx")
+			fmt.Fprintf(cf.Assembly, "	mov qword ptr [rax+8], %d\n", numParams)
+			cf.popElements(numFree, 2)
+
+		case code.OpCurrentClosure:
+			fmt.Fprintf(cf.Assembly, "	mov rax, [rbp+%d]\n", cf.closureOffset())
 			fmt.Fprintln(cf.Assembly, "	push rax")
 
+		case code.OpGetFree:
+			freeIndex := int(code.ReadUint8(cf.instraction[ip+1:]))
+			ip += 1
+
+			fmt.Fprintf(cf.Assembly, "	mov rax, [rbp+%d]\n", cf.closureOffset())
+			fmt.Fprintf(cf.Assembly, "	push [rax+%d]\n", 8*(freeIndex+2))
+
+		case code.OpSetFree:
+			freeIndex := int(code.ReadUint8(cf.instraction[ip+1:]))
+			ip += 1
+
+			// 代入される自由変数はcellで、定義した関数や他のclosureと共有している
+			fmt.Fprintln(cf.Assembly, "	pop rax")
+			fmt.Fprintf(cf.Assembly, "	mov rbx, [rbp+%d]\n", cf.closureOffset())
+			fmt.Fprintf(cf.Assembly, "	mov rbx, [rbx+%d]\n", 8*(freeIndex+2))
+			fmt.Fprintln(cf.Assembly, "	mov [rbx], rax")
+
+		case code.OpGetFreeCell:
+			freeIndex := int(code.ReadUint8(cf.instraction[ip+1:]))
+			ip += 1
+
+			fmt.Fprintf(cf.Assembly, "	mov rax, [rbp+%d]\n", cf.closureOffset())
+			fmt.Fprintf(cf.Assembly, "	mov rax, [rax+%d]\n", 8*(freeIndex+2))
+			fmt.Fprintln(cf.Assembly, "	push [rax]")
+
+		case code.OpMakeCell:
+			localIndex := code.ReadUint8(cf.instraction[ip+1:])
+			ip += 1
+
+			// 値はallocの間stackに置いておく
+			g.alloc(cf, 8, header(typeCell, 0))
+			fmt.Fprintln(cf.Assembly, "	pop rbx")
+			fmt.Fprintln(cf.Assembly, "	mov [rax], rbx")
+			fmt.Fprintf(cf.Assembly, "	mov [rbp-%d], rax\n", (localIndex+1)*8)
+
+		case code.OpGetLocalCell:
+			localIndex := code.ReadUint8(cf.instraction[ip+1:])
+			ip += 1
+
+			fmt.Fprintf(cf.Assembly, "	mov rax, [rbp-%d]\n", (localIndex+1)*8)
+			fmt.Fprintln(cf.Assembly, "	push [rax]")
+
+		case code.OpSetLocalCell:
+			localIndex := code.ReadUint8(cf.instraction[ip+1:])
+			ip += 1
+
+			fmt.Fprintln(cf.Assembly, "	pop rax")
+			fmt.Fprintf(cf.Assembly, "	mov rbx, [rbp-%d]\n", (localIndex+1)*8)
+			fmt.Fprintln(cf.Assembly, "	mov [rbx], rax")
+
 		case code.OpGetBuiltin:
 			builtinIndex := code.ReadUint8(cf.instraction[ip+1:])
 			ip += 1
 
+			// アセンブリ版のないbuiltinはリンクできない
+			if object.Builtins[builtinIndex].Assembly == "" {
+				return fmt.Errorf("x64: builtin %s is not supported", object.Builtins[builtinIndex].Name)
+			}
 			g.builtin[int(builtinIndex)] = struct{}{}
-			fmt.Fprintf(cf.Assembly, "	lea rax, %s[rip]\n", object.Builtins[builtinIndex].Name)
+			fmt.Fprintf(cf.Assembly, "	lea rax, .CLOSURE_%s[rip]\n", object.Builtins[builtinIndex].Name)
 			fmt.Fprintln(cf.Assembly, "	push rax")
 
 		case code.OpCall:
 			paramNum := code.ReadUint8(cf.instraction[ip+1:])
 			ip += 1
 
-			fmt.Fprintf(cf.Assembly, "	mov rax, [rsp+%d]\n", paramNum*8)
-			fmt.Fprintln(cf.Assembly, "	call rax")
-			fmt.Fprintf(cf.Assembly, "	add rsp, %d\n", 8+paramNum*8) // pop paramNum * 8
-			fmt.Fprintln(cf.Assembly, "	push rax")
+			cf.call(int(paramNum))
+
+		case code.OpTailCall:
+			paramNum := code.ReadUint8(cf.instraction[ip+1:])
+			ip += 1
+
+			// 引数の数が違うと呼び出し元がpopする量が変わるので、普通のcallにする
+			//  mainは戻り値を終了コードにするので、jmpできない
+			if int(paramNum) != cf.paramNum || currentFCnt == 0 {
+				cf.call(int(paramNum))
+				break
+			}
+
+			// 自分の引数とclosureを上書きして、returnの代わりにjmpする
+			//  呼ばれた関数は自分の呼び出し元に直接returnする
+			for i := 0; i < int(paramNum); i++ {
+				fmt.Fprintln(cf.Assembly, "	pop rax")
+				fmt.Fprintf(cf.Assembly, "	mov [rbp+%d], rax\n", 16+8*i)
+			}
+			fmt.Fprintln(cf.Assembly, "	pop rax")
+			fmt.Fprintf(cf.Assembly, "	mov [rbp+%d], rax\n", cf.closureOffset())
+			fmt.Fprintln(cf.Assembly, "	mov rsp, rbp")
+			fmt.Fprintln(cf.Assembly, "	pop rbp")
+			fmt.Fprintf(cf.Assembly, "	mov rcx, %d\n", paramNum)
+			fmt.Fprintln(cf.Assembly, "	jmp monkey_call")
 
 		case code.OpArray:
 			size := int(code.ReadUint16(cf.instraction[ip+1:]))
 			ip += 2
-			// Stack Layout
-			//  [pointer(&array size)]
-			//  [array size]
-			//  [data2]
-			//  [data1]
+
+			// Heap Layout
+			//  [array size] <- pointer
 			//  [data0]
-			fmt.Fprintf(cf.Assembly, "	push %d\n", size)
-			fmt.Fprintln(cf.Assembly, "	push rsp")
+			//  [data1]
+			//  [data2]
+			g.alloc(cf, 8*(size+1), header(typeArray, 0))
+			fmt.Fprintf(cf.Assembly, "	mov qword ptr [rax], %d\n", size)
+			cf.popElements(size, 1)
+
+		case code.OpHash:
+			size := int(code.ReadUint16(cf.instraction[ip+1:]))
+			ip += 2
+
+			// Heap Layout
+			//  [number of pairs] <- pointer
+			//  [key0]
+			//  [value0]
+			//  [key1]
+			//  [value1]
+			g.alloc(cf, 8*(size+1), header(typeHash, 0))
+			fmt.Fprintf(cf.Assembly, "	mov qword ptr [rax], %d\n", size/2)
+			cf.popElements(size, 1)
+			// hashにできないkeyはvmと同じエラーにする
+			fmt.Fprintln(cf.Assembly, "	mov rdi, [rsp]")
+			fmt.Fprintln(cf.Assembly, "	call monkey_hash_check")
 
 		case code.OpIndex:
-			// Stack Layout
-			//  [index]
-			//  [array pointer]
-			fmt.Fprintln(cf.Assembly, "	pop rax") // index
-			fmt.Fprintln(cf.Assembly, "	pop rbx") // &array size
-
-			// confirm index out of range.
-			fmt.Fprintln(cf.Assembly, "	cmp rax, [rbx]")
-			fmt.Fprintf(cf.Assembly, "	jl .LABEL%d\n", g.labelcnt)
-			fmt.Fprintln(cf.Assembly, "	mov rax, 60")
-			fmt.Fprintln(cf.Assembly, "	mov rdi, 1")
-			fmt.Fprintln(cf.Assembly, "	syscall")
-			//
-			fmt.Fprintf(cf.Assembly, ".LABEL%d:\n", g.labelcnt)
-			fmt.Fprintln(cf.Assembly, "	imul rax, 8")
-			fmt.Fprintln(cf.Assembly, "	mov rdx, [rbx]")
-			fmt.Fprintln(cf.Assembly, "	imul rdx, 8")
-			fmt.Fprintln(cf.Assembly, "	add rbx, rdx") // &arraysize + arraysize
-			fmt.Fprintln(cf.Assembly, "	sub rbx, rax") // - index
-			fmt.Fprintln(cf.Assembly, "	push [rbx]")
+			cf.callRuntime("monkey_index", 2)
+
+		case code.OpSlice:
+			// 省略された範囲はnullになっている
+			cf.callRuntime("monkey_slice", 3)
+
+		case code.OpImport:
+			constIndex := int(code.ReadUint16(cf.instraction[ip+1:]))
+			globalIndex := int(code.ReadUint16(cf.instraction[ip+3:]))
+			ip += 4
+
+			// moduleは引数のない関数で、結果のhashを自分でglobalに置く
+			//  同じmoduleを何度importしても、関数は1つだけ書く
+			fIndex, ok := g.fIndex[constIndex]
+			if !ok {
+				err := g.pushClosure(constIndex)
+				if err != nil {
+					return err
+				}
+				fIndex = g.fIndex[constIndex]
+				writeHeader(g.Data, header(typeClosure, 0))
+				fmt.Fprintf(g.Data, ".CLOSURE%d:\n", fIndex)
+				fmt.Fprintf(g.Data, "	.quad function%d\n", fIndex)
+				fmt.Fprintln(g.Data, "	.quad 0")
+			}
+
+			// 2回目以降は最初に実行したときのmoduleを使う
+			label := g.labelcnt
 			g.labelcnt++
+			base := cf.globalBase(currentFCnt)
+			fmt.Fprintf(cf.Assembly, "	mov rax, [%s-%d]\n", base, (globalIndex+1)*8)
+			fmt.Fprintf(cf.Assembly, "	cmp rax, %d\n", valueNull)
+			fmt.Fprintf(cf.Assembly, "	jne .LABEL%d\n", label)
+			fmt.Fprintf(cf.Assembly, "	lea rax, .CLOSURE%d[rip]\n", fIndex)
+			fmt.Fprintln(cf.Assembly, "	push rax")
+			cf.call(0)
+			fmt.Fprintln(cf.Assembly, "	pop rax")
+			fmt.Fprintf(cf.Assembly, ".LABEL%d:\n", label)
+			fmt.Fprintln(cf.Assembly, "	push rax")
 
 		default:
-			return fmt.Errorf("non-supported opcode")
+			def, err := code.Lookup(byte(op))
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("x64: unsupported opcode %s", def.Name)
 		}
 	}
 
+	// 最後の命令の後ろへのjump(whileが最後の文のときなど)
+	if l, ok := cf.reserveLabel[len(cf.instraction)]; ok {
+		fmt.Fprintf(cf.Assembly, ".LABEL%d:\n", l)
+	}
+
+	// returnのないmainは0で終わる
+	if currentFCnt == 0 {
+		fmt.Fprintln(cf.Assembly, "	mov rax, 0")
+		fmt.Fprintln(cf.Assembly, "	mov rsp, rbp")
+		fmt.Fprintln(cf.Assembly, "	pop rbp")
+		fmt.Fprintln(cf.Assembly, "	ret")
+	}
+
 	return nil
 }
 
-// 指定したbytecodeのline noの箇所に、ラベルを吐く
-func pushLabel(cf *Frame, labelcnt, b_line int) {
-	cf.reserveLabel[b_line] = labelcnt
-	return
+// reserveLabels は jump先のbytecodeの位置にラベルを振っておく
+//  whileのループは後ろ向きにjumpし、breakとループの条件は同じ場所にjumpするので、
+//  jump命令を出力する前にすべての飛び先を決めておく必要がある
+func (g *Gen) reserveLabels(cf *Frame) {
+	ins := cf.instraction
+
+	for ip := 0; ip < len(ins); {
+		def, err := code.Lookup(ins[ip])
+		if err != nil {
+			// 不正な命令はGenx64の方でエラーにする
+			ip++
+			continue
+		}
+		operands, read := code.ReadOperands(def, ins[ip+1:])
+
+		switch code.Opcode(ins[ip]) {
+		case code.OpJump, code.OpJumpNotTruthy:
+			if _, ok := cf.reserveLabel[operands[0]]; !ok {
+				cf.reserveLabel[operands[0]] = g.labelcnt
+				g.labelcnt++
+			}
+		}
+
+		ip += 1 + read
+	}
+}
+
+// callRuntime calls the runtime function name with the operands on the stack,
+// and replaces them with the result.
+func (cf *Frame) callRuntime(name string, operands int) {
+	fmt.Fprintf(cf.Assembly, "	call %s\n", name)
+	fmt.Fprintf(cf.Assembly, "	add rsp, %d\n", 8*operands)
+	fmt.Fprintln(cf.Assembly, "	push rax")
+}
+
+// call calls the closure below the arguments through monkey_call, which checks
+// that it is a function with paramNum parameters.
+// The closure stays on the stack above the arguments, where the callee finds its free variables.
+func (cf *Frame) call(paramNum int) {
+	fmt.Fprintf(cf.Assembly, "	mov rax, [rsp+%d]\n", paramNum*8)
+	fmt.Fprintf(cf.Assembly, "	mov rcx, %d\n", paramNum)
+	fmt.Fprintln(cf.Assembly, "	call monkey_call")
+	fmt.Fprintf(cf.Assembly, "	add rsp, %d\n", 8+paramNum*8) // pop paramNum * 8
+	fmt.Fprintln(cf.Assembly, "	push rax")
+}
+
+// globalBase returns the register with the base pointer of main, below which the globals are.
+// In the functions it is loaded into rbx from monkey_stack_bottom.
+func (cf *Frame) globalBase(fcnt int) string {
+	if fcnt == 0 {
+		return "rbp"
+	}
+	fmt.Fprintln(cf.Assembly, "	mov rbx, monkey_stack_bottom[rip]")
+	return "rbx"
+}
+
+// closureOffset is where the closure of the function is from rbp.
+func (cf *Frame) closureOffset() int {
+	return 16 + 8*cf.paramNum
 }
 
-func (g *Gen) pushClosure(constIndex int, numFree int) error {
+func (g *Gen) pushClosure(constIndex int) error {
 	constant := g.constants[constIndex]
 	function, ok := constant.(*object.CompiledFunction)
 	if !ok {
@@ -389,7 +633,7 @@ func (g *Gen) pushClosure(constIndex int, numFree int) error {
 
 	err := g.writeFunction(function, constIndex, paramNum)
 	if err != nil {
-		fmt.Errorf("writing function error: %+v", err)
+		return fmt.Errorf("writing function error: %+v", err)
 	}
 
 	return nil
@@ -401,9 +645,69 @@ func (g *Gen) writeFunction(f *object.CompiledFunction, constIndex, paramNum int
 	return err
 }
 
+// alloc allocates bytes of an object with the header h into rax.
+func (g *Gen) alloc(cf *Frame, bytes int, h uint64) {
+	fmt.Fprintf(cf.Assembly, "	mov rdi, %d\n", bytes)
+	fmt.Fprintf(cf.Assembly, "	mov rsi, %d\n", h)
+	fmt.Fprintln(cf.Assembly, "	call monkey_alloc")
+}
+
+// popElements moves size values from the stack to the words from the word first at rax,
+// the first pushed value first, and pushes rax.
+func (cf *Frame) popElements(size int, first int) {
+	for i := size - 1; i >= 0; i-- {
+		fmt.Fprintln(cf.Assembly, "	pop rbx")
+		fmt.Fprintf(cf.Assembly, "	mov [rax+%d], rbx\n", 8*(i+first))
+	}
+	fmt.Fprintln(cf.Assembly, "	push rax")
+}
+
+// writeHeader writes the header word of a static object, which has to be before its label.
+func writeHeader(b *bytes.Buffer, h uint64) {
+	fmt.Fprintln(b, "	.align 8")
+	fmt.Fprintf(b, "	.quad %d\n", h)
+}
+
+// stringLabel returns the label of the string s, adding it the first time with the label index.
+func (g *Gen) stringLabel(s string, index int) int {
+	if label, ok := g.strings[s]; ok {
+		return label
+	}
+	g.addString(s, index)
+	g.strings[s] = index
+	return index
+}
+
 func (g *Gen) addString(s string, index int) {
+	writeHeader(g.Global, header(typeString, heapNoScan))
 	fmt.Fprintf(g.Global, ".STRGBL%d:\n", index)
-	fmt.Fprintf(g.Global, `	.string "%s"`, s)
+	fmt.Fprintf(g.Global, `	.string "%s"`, escapeString(s))
 	fmt.Fprintf(g.Global, "\n")
 
 }
+
+// addFloat adds the float constant f with the label index.
+func (g *Gen) addFloat(f float64, index int) {
+	writeHeader(g.Global, header(typeFloat, heapNoScan))
+	fmt.Fprintf(g.Global, ".FLOAT%d:\n", index)
+	fmt.Fprintf(g.Global, "	.quad 0x%x\n", math.Float64bits(f))
+}
+
+// escapeString escapes s for the .string directive of the GNU assembler.
+//  Bytes other than printable ASCII are written in octal, so UTF-8 is kept as it is.
+func escapeString(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			out.WriteByte('\\')
+			out.WriteByte(c)
+		case c < 0x20 || c >= 0x7f:
+			fmt.Fprintf(&out, "\\%03o", c)
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
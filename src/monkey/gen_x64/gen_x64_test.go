@@ -2,11 +2,17 @@ package gen_x64
 
 import (
 	"fmt"
+	"math"
+	"math/rand"
+	"monkey/code"
 	"monkey/compiler"
 	"monkey/lexer"
+	"monkey/object"
 	"monkey/parser"
+	"monkey/vm"
 	"os"
 	"os/exec"
+	"strconv"
 	"strings"
 	"syscall"
 	"testing"
@@ -185,6 +191,294 @@ func TestGenerator(t *testing.T) {
 			input:    `let a = [0, 1, 2]; return len(a);`,
 			expected: 3,
 		},
+		// while
+		{
+			input:    `let i = 0; while (i < 5) { let i = i + 1; }; return i;`,
+			expected: 5,
+		},
+		{
+			input: `
+			let i = 0;
+			let sum = 0;
+			while (i < 10) {
+				let i = i + 1;
+				if (i == 5) { continue; }
+				if (i > 7) { break; }
+				let sum = sum + i;
+			}
+			return sum;`,
+			expected: 23,
+		},
+		{
+			input: `
+			let f = fn(n) {
+				let i = 0;
+				while (1 == 1) {
+					if (i == n) { return i * 10; }
+					let i = i + 1;
+				}
+			};
+			return f(3);`,
+			expected: 30,
+		},
+		{
+			input:    `let f = fn() { let i = 0; while (i < 3) { let i = i + 1; } }; f(); return 7;`,
+			expected: 7,
+		},
+		// assignment
+		{
+			input:    `let i = 0; let n = 1; while (i < 5) { i += 1; n *= 2; }; return n - i;`,
+			expected: 27,
+		},
+		{
+			input:    `let f = fn(a) { a = a + 1; return a; }; return f(41);`,
+			expected: 42,
+		},
+		// float
+		{
+			input:    `return 2.5 * 2.0`,
+			expected: 5,
+		},
+		{
+			input:    `return 7 / 2.0 + 0.5`,
+			expected: 4,
+		},
+		{
+			input:    `return -1.5 + 3`,
+			expected: 1,
+		},
+		{
+			input:    `if (1.5 > 1) { return 1 }; return 0;`,
+			expected: 1,
+		},
+		{
+			input:    `if (0.1 + 0.2 == 0.3) { return 1 }; return 0;`,
+			expected: 0,
+		},
+		{
+			input:    `if (0.5 != 0.25 * 2) { return 1 }; return 0;`,
+			expected: 0,
+		},
+		{
+			input:    `let x = 0.0; let i = 0; while (i < 4) { x += 0.5; i += 1; }; return x * 10;`,
+			expected: 20,
+		},
+		{
+			input:    `let half = fn(n) { return n / 2.0; }; return half(9) * 2;`,
+			expected: 9,
+		},
+		// comparison and logical operators
+		{
+			input:    `return 17 % 5 + 100 / -7 * -1`,
+			expected: 16,
+		},
+		{
+			input:    `return -7 % 3 + 10`,
+			expected: 9,
+		},
+		{
+			input:    `if (2 <= 2) { if (3 >= 4) { return 1 } return 2 } return 3`,
+			expected: 2,
+		},
+		{
+			input:    `if (1 < 2 && 2.5 <= 2.5 && 0.5 >= 0.5) { return 1 } return 0`,
+			expected: 1,
+		},
+		{
+			input:    `if (1 > 2 || 0.5 < 0.25) { return 1 } return 0`,
+			expected: 0,
+		},
+		{
+			input:    `let x = 0; let f = fn() { return 1; }; if (false && f()) { return 10 } if (true || f()) { return 20 } return 30`,
+			expected: 20,
+		},
+		{
+			input:    `let i = 0; let n = 0; while (i < 10 && n < 12) { i += 1; if (i % 2 == 0 || i == 5) { n += i; } }; return n;`,
+			expected: 17,
+		},
+		{
+			input:    `return 7.5 % 2 * 2`,
+			expected: 3,
+		},
+		// recursive functions
+		{
+			input:    `let sum = fn(n) { if (n == 0) { return 0; } return n + sum(n - 1); }; return sum(10);`,
+			expected: 55,
+		},
+		{
+			input:    `let wrapper = fn() { let fib = fn(n) { if (n < 2) { return n; } return fib(n - 1) + fib(n - 2); }; return fib(10); }; return wrapper();`,
+			expected: 55,
+		},
+		// tail calls
+		{
+			input:    `let sum = fn(n, acc) { if (n == 0) { return acc; } return sum(n - 1, acc + n); }; return sum(1000000, 0) % 256;`,
+			expected: 32,
+		},
+		{
+			input:    `let f = fn(a, b) { let sub = fn(a, b) { return a - b; }; return sub(a, b); }; return f(10, 3);`,
+			expected: 7,
+		},
+		{
+			input:    `let f = fn(a, b) { let g = fn(x) { return x * 2; }; return g(a + b); }; return f(10, 3);`,
+			expected: 26,
+		},
+		// bang
+		{
+			input:    `if (!false) { return 3 } return 4`,
+			expected: 3,
+		},
+		{
+			input:    `if (!(1 < 2)) { return 3 } return 4`,
+			expected: 4,
+		},
+		{
+			input:    `if (!!true) { return 3 } return 4`,
+			expected: 3,
+		},
+		// hash
+		{
+			input:    `let h = {1: 10, 2: 20}; return h[2];`,
+			expected: 20,
+		},
+		{
+			input:    `let h = {"a": 1, "b": 2}; let k = "b"; return h[k];`,
+			expected: 2,
+		},
+		{
+			input:    `let h = {1: 10}; if (!h[3]) { return 1 } return 0;`,
+			expected: 1,
+		},
+		{
+			// 整数のkeyはfloatのkeyと同じ
+			input:    `let h = {1: 10, "a": 20}; return h[1.0] + h["a"];`,
+			expected: 30,
+		},
+		// slice
+		{
+			input:    `let a = [1, 2, 3, 4]; let b = a[1:3]; return b[0] * 10 + b[1];`,
+			expected: 23,
+		},
+		{
+			input:    `let a = [1, 2, 3]; return len(a[1:]) * 10 + len(a[:]) + a[-5:10][2] * 10;`,
+			expected: 53,
+		},
+		{
+			input:    `let a = [1, 2, 3]; let b = a[2:1]; return len(b);`,
+			expected: 0,
+		},
+		// closure
+		{
+			input:    `let f = fn(a, b, c) { a * 100 + b * 10 + c }; return f(1, 2, 3);`,
+			expected: 123,
+		},
+		{
+			input:    `let add = fn(a) { fn(b) { a + b } }; let f = add(3); let g = add(10); return f(4) + g(1);`,
+			expected: 18,
+		},
+		{
+			input:    `let f = fn(a) { fn(b) { fn(c) { a * 100 + b * 10 + c } } }; let g = f(1); let h = g(2); return h(3);`,
+			expected: 123,
+		},
+		{
+			// 代入される変数は定義した関数とclosureが共有する
+			input:    `let c = fn(n) { let g = fn() { n += 1; n }; g(); let a = g(); a * 10 + n }; return c(5);`,
+			expected: 77,
+		},
+		{
+			input:    `let make = fn() { let count = 0; [fn() { count += 1 }, fn() { count }] }; let p = make(); p[0](); p[0](); return p[1]();`,
+			expected: 2,
+		},
+		{
+			input:    `let f = fn() { let a = 1; let g = fn() { fn() { a += 10 } }; g()(); a }; return f();`,
+			expected: 11,
+		},
+		{
+			input:    `let mk = fn(k) { let r = fn(n) { if (n == 0) { return k } r(n - 1) }; r(3) }; return mk(9);`,
+			expected: 9,
+		},
+		{
+			input:    `let apply = fn(g, x) { g(x) }; let add = fn(a) { fn(b) { a + b } }; let f = add(10); return apply(f, 5);`,
+			expected: 15,
+		},
+		// heap
+		{
+			input:    `let f = fn() { [1, 2, 3] }; let a = f(); return a[2] + len(f());`,
+			expected: 6,
+		},
+		{
+			input:    `return len([1, 2, 3]) + [4, 5][1] + [[1, 2], [3, 4]][1][0];`,
+			expected: 11,
+		},
+		{
+			input:    `let f = fn(v) { {"a": v, "b": [v, v * 2]} }; let h = f(5); return h["b"][1] + f(1)["a"];`,
+			expected: 11,
+		},
+		{
+			// 範囲外はvmと同じくnull(終了コード0)
+			input:    `let a = [1, 2]; return a[-1];`,
+			expected: 0,
+		},
+		// dynamic types
+		{
+			input:    `let f = fn(x) { x * 2 }; return f(1.5) + f(1);`,
+			expected: 5,
+		},
+		{
+			input:    `let a = [1.5, "a", true]; if (a[2]) { return len(a) + a[0] * 2 } return 0;`,
+			expected: 6,
+		},
+		{
+			input:    `let x = 1; x = 2.5; return x * 2;`,
+			expected: 5,
+		},
+		{
+			input:    `if ("a" + "b" == "ab") { return 2 } if (true == true) { return 3 } return 4;`,
+			expected: 3,
+		},
+		{
+			input:    `if ([][0]) { return 1 } if (0) { return 2 } return 3;`,
+			expected: 2,
+		},
+		{
+			input:    `return false;`,
+			expected: 1,
+		},
+		// globals in functions
+		{
+			input:    `let g = 10; let f = fn(y) { g + y }; return f(5);`,
+			expected: 15,
+		},
+		{
+			input:    `let g = 1; let f = fn() { g = g + 2; let h = fn() { g *= 3 }; h(); }; f(); f(); return g;`,
+			expected: 33,
+		},
+		{
+			input:    `let double = fn(x) { x * 2 }; let f = fn(x) { double(x) + 1 }; let g = fn(x) { let a = 5; f(x) + a }; return g(10);`,
+			expected: 26,
+		},
+		// import
+		{
+			input:    `let m = import "../testdata/import/math.mk"; return m["quad"](3);`,
+			expected: 12,
+		},
+		{
+			// moduleは1回だけ実行され、同じhashが返る
+			input:    `let a = import "../testdata/import/counter.mk"; a["inc"](); let b = import "../testdata/import/counter.mk"; b["inc"](); let f = fn() { import "../testdata/import/counter.mk" }; return f()["inc"]();`,
+			expected: 3,
+		},
+		{
+			input:    `let m = import "../testdata/import/early.mk"; if (m["b"]) { return 9; } return m["a"];`,
+			expected: 1,
+		},
+		{
+			// 64MBのheapを何度も使い切るので、GCがないと終わらない
+			input:    `let keep = [7, [8, 9]]; let i = 0; while (i < 3000000) { let t = [i, i, i, i]; i += 1; } return keep[0] + keep[1][1];`,
+			expected: 16,
+		},
+		{
+			input:    `let make = fn(n) { let k = [n, n + 1]; fn() { k[1] } }; let fs = [make(1), make(2)]; let i = 0; while (i < 3000000) { let t = "a" + "b"; i += 1; } let f = fs[1]; return f();`,
+			expected: 3,
+		},
 	}
 
 	for _, tt := range tests {
@@ -245,6 +539,305 @@ func TestGenerator(t *testing.T) {
 	os.Remove("/tmp/mokeytmp")
 }
 
+// TestRuntimeErrors runs programs failing at runtime, which write the error of the vm to stderr
+// and exit with 1. When vm is set, the vm fails with the same message.
+func TestRuntimeErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+		vm       bool
+	}{
+		{`1 + "a"`, "unsupported types for binary operation: INTEGER STRING", true},
+		{`[1] * 2.5`, "unsupported types for binary operation: ARRAY FLOAT", true},
+		{`"a" - "b"`, "unknown operator: STRING - STRING", true},
+		{`true > false`, "unknown operator: BOOLEAN > BOOLEAN", true},
+		{`"a" <= "b"`, "unknown operator: STRING <= STRING", true},
+		{`1 < "a"`, "type mismatch: INTEGER < STRING", true},
+		{`[1] % [2]`, "unsupported types for binary operation: ARRAY ARRAY", true},
+		{`-"a"`, "unsupported type for negation: STRING", true},
+		{`{[1]: 2}`, "unusable as hash key: ARRAY", true},
+		{`{1: 2}[fn() { 1 }]`, "unusable as hash key: CLOSURE", true},
+		{`1[0]`, "index operator not supported: INTEGER", true},
+		{`[1]["a"]`, "index operator not supported: ARRAY", true},
+		{`1()`, "calling non-function and non-built-in", true},
+		{`let f = fn(a) { a }; f()`, "wrong number of arguments: want=1, got=0", true},
+		{`let f = fn(a) { f(a, a) }; f(1)`, "wrong number of arguments: want=1, got=2", true},
+		{`true[0:1]`, "slice operator not supported: BOOLEAN", true},
+		{`[1][true:]`, "slice index must be INTEGER, got BOOLEAN", true},
+		// the builtins of the vm return error values
+		{`len(1)`, "argument to `len` not supported, got INTEGER", false},
+		{`len("a", "b")`, "wrong number of arguments. got=2, want=1", false},
+		{`first(1)`, "argument to `first` must be ARRAY, got INTEGER", false},
+		{`last("a")`, "argument to `last` must be ARRAY, got STRING", false},
+		{`rest({})`, "argument to `rest` must be ARRAY, got HASH", false},
+		{`push(1, 2)`, "argument to `push` must be ARRAY, got INTEGER", false},
+		{`push([1])`, "wrong number of arguments. got=1, want=2", false},
+		{`let z = 0; 1 / z`, "division by zero", true},
+		{`let z = 0; 1 % z`, "division by zero", true},
+		// the vm counts frames, and also reports the call depth
+		{`let f = fn(n) { f(n + 1) + 1 }; f(0)`, "stack overflow", false},
+	}
+
+	for _, tt := range tests {
+		g := compile(tt.input, t)
+		_, stderr, returncode := run(g, t)
+
+		if returncode != 1 {
+			t.Errorf("%q: return code is different got=%d, expected=1", tt.input, returncode)
+		}
+		expected := "runtime error: " + tt.expected + "\n"
+		if stderr != expected {
+			t.Errorf("%q: wrong stderr. want=%q, got=%q", tt.input, expected, stderr)
+		}
+
+		if !tt.vm {
+			continue
+		}
+		comp := compiler.New()
+		err := comp.Compile(parser.New(lexer.New(tt.input)).ParseProgram())
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		err = vm.New(comp.Bytecode()).Run()
+		rerr, ok := err.(*object.RuntimeError)
+		if !ok {
+			t.Errorf("%q: vm error is not *object.RuntimeError. got=%T (%v)", tt.input, err, err)
+			continue
+		}
+		if rerr.Message != tt.expected {
+			t.Errorf("%q: vm error is different. x64=%q, vm=%q", tt.input, tt.expected, rerr.Message)
+		}
+	}
+}
+
+// run assembles, links and runs the program of g, and returns its stdout, stderr and exit code.
+func run(g *Gen, t *testing.T) (string, string, int) {
+	err := os.WriteFile("/tmp/monkeytmp.s", g.Assembly().Bytes(), 0644)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	out, err := exec.Command("/usr/bin/gcc", "/tmp/monkeytmp.s", "-o", "/tmp/monkeytmp").CombinedOutput()
+	if err != nil {
+		t.Fatalf("gcc error: %s", out)
+	}
+	defer os.Remove("/tmp/monkeytmp")
+
+	var stdout, stderr strings.Builder
+	cmd := exec.Command("/tmp/monkeytmp")
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	err = cmd.Run()
+	if exit, ok := err.(*exec.ExitError); ok {
+		return stdout.String(), stderr.String(), exit.ExitCode()
+	}
+	if err != nil {
+		t.Fatalf("execution error: %s", err)
+	}
+	return stdout.String(), stderr.String(), 0
+}
+
+// TestLink builds static executables with each toolchain, which start at _start without libc.
+func TestLink(t *testing.T) {
+	tests := []struct {
+		input    string
+		stdout   string
+		expected int
+	}{
+		{`return 42`, "", 42},
+		{`let fib = fn(n) { if (n < 2) { n } else { fib(n - 1) + fib(n - 2) } }; puts(fib(20)); return 0;`, "6765\n", 0},
+		{`puts("a" + "b", [1, 2.5, true], {"k": [][0]}, len); return 3;`, "ab\n[1, 2.5, true]\n{k: null}\nbuiltin function\n", 3},
+		{`let make = fn(n) { fn(m) { n * m } }; let f = make(6); return f(7);`, "", 42},
+		{`let keep = [7]; let i = 0; while (i < 3000000) { let t = [i, i]; i += 1; } return keep[0];`, "", 7},
+		{`puts("x"); 1 + "a"`, "x\n", 1},
+	}
+
+	for _, toolchain := range []string{ToolchainSystem, ToolchainGo} {
+		for _, tt := range tests {
+			g := compile(tt.input, t)
+			err := Link(g.Executable().Bytes(), "/tmp/monkeytmp", toolchain)
+			if err != nil {
+				t.Fatalf("%s: link error: %s", toolchain, err)
+			}
+
+			out, err := exec.Command("/tmp/monkeytmp").Output()
+			returncode := 0
+			if exit, ok := err.(*exec.ExitError); ok {
+				returncode = exit.ExitCode()
+			} else if err != nil {
+				t.Fatalf("%s: execution error: %s", toolchain, err)
+			}
+
+			if string(out) != tt.stdout {
+				t.Errorf("%s %q: wrong stdout. want=%q, got=%q", toolchain, tt.input, tt.stdout, out)
+			}
+			if returncode != tt.expected {
+				t.Errorf("%s %q: return code is different got=%d, expected=%d", toolchain, tt.input, returncode, tt.expected)
+			}
+		}
+	}
+	os.Remove("/tmp/monkeytmp")
+
+	err := Link(nil, "/tmp/monkeytmp", "tcc")
+	if err == nil || err.Error() != `x64: unknown toolchain "tcc"` {
+		t.Errorf("wrong error for an unknown toolchain. got=%v", err)
+	}
+}
+
+// TestSampleFile builds sample/file.mk, which uses map and reduce written with the array builtins.
+func TestSampleFile(t *testing.T) {
+	src, err := os.ReadFile("../sample/file.mk")
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	g := compile(string(src)+"\nputs(b, sum(b));", t)
+
+	for _, toolchain := range []string{ToolchainSystem, ToolchainGo} {
+		err := Link(g.Executable().Bytes(), "/tmp/monkeytmp", toolchain)
+		if err != nil {
+			t.Fatalf("%s: link error: %s", toolchain, err)
+		}
+		out, err := exec.Command("/tmp/monkeytmp").CombinedOutput()
+		if err != nil {
+			t.Errorf("%s: execution error: %s", toolchain, err)
+		}
+		if string(out) != "[2, 4, 6, 8]\n20\n" {
+			t.Errorf("%s: wrong output. got=%q", toolchain, out)
+		}
+	}
+	os.Remove("/tmp/monkeytmp")
+}
+
+func TestUnsupportedErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`split("a b", " ")`, "x64: builtin split is not supported"},
+	}
+
+	for _, tt := range tests {
+		program := parser.New(lexer.New(tt.input)).ParseProgram()
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		err = New(comp.Bytecode()).Genx64()
+		if err == nil {
+			t.Errorf("expected error for %q", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+// TestOpcodeCoverage compiles a program using each opcode, and checks that no opcode
+// fails in Genx64.
+func TestOpcodeCoverage(t *testing.T) {
+	programs := map[code.Opcode]string{
+		code.OpConstant:       `1`,
+		code.OpAdd:            `1 + 2`,
+		code.OpPop:            `1;`,
+		code.OpSub:            `1 - 2`,
+		code.OpMul:            `1 * 2`,
+		code.OpDiv:            `1 / 2`,
+		code.OpTrue:           `true`,
+		code.OpFalse:          `false`,
+		code.OpEqual:          `1 == 2`,
+		code.OpNotEqual:       `1 != 2`,
+		code.OpGreaterThan:    `1 > 2`,
+		code.OpMinus:          `-1`,
+		code.OpBang:           `!true`,
+		code.OpJumpNotTruthy:  `if (true) { 1 }`,
+		code.OpJump:           `if (true) { 1 } else { 2 }`,
+		code.OpNull:           `if (false) { 1 }`,
+		code.OpGetGlobal:      `let a = 1; a`,
+		code.OpSetGlobal:      `let a = 1;`,
+		code.OpArray:          `[1, 2]`,
+		code.OpHash:           `{1: 2}`,
+		code.OpIndex:          `[1, 2][0]`,
+		code.OpCall:           `let f = fn() { 1 }; f() + 1`,
+		code.OpReturnValue:    `let f = fn() { return 1 }; f()`,
+		code.OpReturn:         `let f = fn() { }; f()`,
+		code.OpGetLocal:       `let f = fn(a) { a }; f(1)`,
+		code.OpSetLocal:       `let f = fn() { let a = 1; a }; f()`,
+		code.OpGetBuiltin:     `puts("a")`,
+		code.OpClosure:        `fn() { 1 }`,
+		code.OpGetFree:        `let f = fn(a) { fn() { a } }; f(1)`,
+		code.OpSetFree:        `let f = fn(a) { fn() { a = 2 } }; f(1)`,
+		code.OpMod:            `1 % 2`,
+		code.OpLessThan:       `1 < 2`,
+		code.OpLessEqual:      `1 <= 2`,
+		code.OpGreaterEqual:   `1 >= 2`,
+		code.OpSlice:          `[1, 2][1:]`,
+		code.OpCurrentClosure: `let f = fn(n) { if (n == 0) { return 0 } f(n - 1) + 1 }; f(1)`,
+		code.OpTailCall:       `let f = fn(n) { f(n) }`,
+		code.OpImport:         `import "../testdata/import/util/double.mk"`,
+		code.OpMakeCell:       `let f = fn(a) { fn() { a = 2 } }; f(1)`,
+		code.OpGetLocalCell:   `let f = fn(a) { fn() { a = 2 }; a }; f(1)`,
+		code.OpSetLocalCell:   `let f = fn() { let a = 1; fn() { a = 2 } }; f()`,
+		code.OpGetFreeCell:    `let f = fn(a) { fn() { a += 2 } }; f(1)`,
+	}
+
+	for op := 0; ; op++ {
+		def, err := code.Lookup(byte(op))
+		if err != nil {
+			break
+		}
+
+		input, ok := programs[code.Opcode(op)]
+		if !ok {
+			t.Errorf("no program for %s", def.Name)
+			continue
+		}
+
+		program := parser.New(lexer.New(input)).ParseProgram()
+		comp := compiler.New()
+		err = comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error for %q: %s", input, err)
+		}
+		bytecode := comp.Bytecode()
+		if !usesOpcode(bytecode, code.Opcode(op)) {
+			t.Errorf("program for %s doesn't use it: %q", def.Name, input)
+			continue
+		}
+
+		err = New(bytecode).Genx64()
+		if err != nil {
+			t.Errorf("%s is not handled: %s", def.Name, err)
+		}
+	}
+}
+
+// usesOpcode reports whether op is in the main program or in a function of bytecode.
+func usesOpcode(bytecode *compiler.Bytecode, op code.Opcode) bool {
+	instructions := []code.Instructions{bytecode.Instructions}
+	for _, c := range bytecode.Constants {
+		if fn, ok := c.(*object.CompiledFunction); ok {
+			instructions = append(instructions, fn.Instructions)
+		}
+	}
+
+	for _, ins := range instructions {
+		for ip := 0; ip < len(ins); {
+			def, err := code.Lookup(ins[ip])
+			if err != nil {
+				return false
+			}
+			if code.Opcode(ins[ip]) == op {
+				return true
+			}
+			_, read := code.ReadOperands(def, ins[ip+1:])
+			ip += 1 + read
+		}
+	}
+	return false
+}
+
 type stringTestCase struct {
 	input    string
 	expected string
@@ -306,6 +899,43 @@ func TestStringOutput(t *testing.T) {
 			input:    `if(1 == 1){puts("Hello World\n");} return 0;`,
 			expected: `Hello World`,
 		},
+		{
+			input:    `puts("tab\t\"quoted\" back\\slash \u{3042}\n"); return 0;`,
+			expected: "tab\t\"quoted\" back\\slash あ\n",
+		},
+		{
+			input:    `puts("100% sure %d %s\n"); return 0;`,
+			expected: "100% sure %d %s\n",
+		},
+		{
+			input:    `let greet = fn(name) { "Hello, " + name + "!" }; puts(greet("Monkey") + "\n"); return 0;`,
+			expected: "Hello, Monkey!\n",
+		},
+		{
+			input:    `let s = "aあbい"; puts(s[1:3] + "|" + s[2:] + "|" + s[:-1] + "|" + s[3:1] + "\n"); return 0;`,
+			expected: "あb|bい||\n",
+		},
+		// putsはvmと同じくInspectの形で書く
+		{
+			input:    `puts(1, -23, true, false, [][0]); return 0;`,
+			expected: "1\n-23\ntrue\nfalse\nnull\n",
+		},
+		{
+			input:    `puts([1, "a", [2, 3]], {"k": [true]}, []); return 0;`,
+			expected: "[1, a, [2, 3]]\n{k: [true]}\n[]\n",
+		},
+		{
+			input:    `puts(1.5, 2.0, -0.25, 1.0 / 3.0, 1000000.0, 123456.0, 0.0001, 0.00001, 1.0 / 0.0, 7 % 2.5); return 0;`,
+			expected: "1.5\n2.0\n-0.25\n0.3333333333333333\n1e+06\n123456.0\n0.0001\n1e-05\n+Inf\n2.0\n",
+		},
+		{
+			input:    `puts(len, !puts("a")); return 0;`,
+			expected: "a\nbuiltin function\ntrue\n",
+		},
+		{
+			input:    `let a = [1, 2, 3]; puts(first(a), last(a), rest(a), push(a, "x"), a, first([]), rest([]), rest([1])); return 0;`,
+			expected: "1\n3\n[2, 3]\n[1, 2, 3, x]\n[1, 2, 3]\nnull\nnull\n[]\n",
+		},
 	}
 
 	for _, tt := range tests {
@@ -371,6 +1001,70 @@ func compile(input string, t *testing.T) *Gen {
 	return g
 }
 
+// TestFloatOutput checks that puts writes floats like the vm: the shortest digits that read back as the float.
+func TestFloatOutput(t *testing.T) {
+	inputs := []string{
+		"0.1 + 0.2", "1e21", "-0.0", "1.0 / 3.0", "2.0 / 3.0", "100.0", "123456789.0", "0.000123",
+		"5e-324", "2.2250738585072014e-308", "1.7976931348623157e308", "9007199254740993.0", "1e23", "0.3",
+	}
+	// 乱数のbit列の値もvmと同じ桁になる
+	r := rand.New(rand.NewSource(1))
+	for len(inputs) < 300 {
+		v := math.Float64frombits(r.Uint64())
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+		inputs = append(inputs, strconv.FormatFloat(v, 'g', -1, 64))
+	}
+
+	var expected strings.Builder
+	for _, input := range inputs {
+		comp := compiler.New()
+		if err := comp.Compile(parser.New(lexer.New(input)).ParseProgram()); err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+		machine := vm.New(comp.Bytecode())
+		if err := machine.Run(); err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+		expected.WriteString(machine.LastPoppedStackElem().Inspect() + "\n")
+	}
+
+	g := compile("puts("+strings.Join(inputs, "); puts(")+"); return 0;", t)
+	stdout, stderr, returncode := run(g, t)
+	if returncode != 0 || stderr != "" {
+		t.Fatalf("wrong exit: %d, %q", returncode, stderr)
+	}
+	want := strings.Split(expected.String(), "\n")
+	got := strings.Split(stdout, "\n")
+	if len(got) != len(want) {
+		t.Fatalf("wrong number of lines. want=%d, got=%d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Errorf("%s: x64=%q, vm=%q", inputs[i], got[i], want[i])
+		}
+	}
+}
+
+func TestEscapeString(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"hello", "hello"},
+		{"a\nb\t", `a\012b\011`},
+		{`say "hi" \ bye`, `say \"hi\" \\ bye`},
+		{"あ", `\343\201\202`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeString(tt.input); got != tt.expected {
+			t.Errorf("escapeString(%q) wrong. want=%q, got=%q", tt.input, tt.expected, got)
+		}
+	}
+}
+
 func TestAddString(t *testing.T) {
 	input := `
 "hello world";
@@ -381,6 +1075,7 @@ func TestAddString(t *testing.T) {
 	g := compile(input, t)
 	g.addString("hello world", 0)
 	g.addString("foobar", 2)
+	g.addString("100% sure %d", 3)
 
 	expected := `.STRGBL0:
 		.string "hello world"
@@ -393,4 +1088,9 @@ func TestAddString(t *testing.T) {
 		t.Errorf("add string error: \ngot=%s, \nexpected=%s", g.Global.String(), expected)
 	}
 
+	// %はformatとして読まない
+	directive := `.string "100% sure %d"`
+	if !strings.Contains(g.Assembly().String(), directive) {
+		t.Errorf("add string error: %s not in\n%s", directive, g.Global.String())
+	}
 }
@@ -0,0 +1,104 @@
+package gen_x64
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"monkey/x64asm"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// toolchains for Link
+const (
+	// the assembler and the linker of the system: as and ld of GNU binutils
+	ToolchainSystem = "system"
+	// x64asm, without any program outside monkey
+	ToolchainGo = "go"
+)
+
+// entry is the entry point of an executable without the C runtime.
+// main returns the exit status, and the program ends with the exit system call.
+const entry = `.text
+.global _start
+_start:
+	xor ebp, ebp
+	call main
+	mov edi, eax
+	mov eax, 60
+	syscall
+`
+
+// Executable returns the assembly of a static executable, which starts at _start.
+// The assembly of Assembly has only main, and needs the C runtime (gcc) to call it.
+// The runtime doesn't use libc, so nothing else is linked.
+func (g *Gen) Executable() *bytes.Buffer {
+	b := g.Assembly()
+	fmt.Fprint(b, entry)
+	return b
+}
+
+// Link assembles asm from Executable and links it into the executable output with toolchain.
+func Link(asm []byte, output string, toolchain string) error {
+	switch toolchain {
+	case ToolchainSystem:
+		return linkSystem(asm, output)
+	case ToolchainGo:
+		obj, err := x64asm.Assemble(string(asm))
+		if err != nil {
+			return err
+		}
+		exe, err := obj.Executable("_start")
+		if err != nil {
+			return err
+		}
+		return writeExecutable(output, exe)
+	default:
+		return fmt.Errorf("x64: unknown toolchain %q", toolchain)
+	}
+}
+
+func linkSystem(asm []byte, output string) error {
+	as, err := exec.LookPath("as")
+	if err != nil {
+		return fmt.Errorf("x64: the assembler (as) is not found. install GNU binutils, or use the %s toolchain", ToolchainGo)
+	}
+	ld, err := exec.LookPath("ld")
+	if err != nil {
+		return fmt.Errorf("x64: the linker (ld) is not found. install GNU binutils, or use the %s toolchain", ToolchainGo)
+	}
+
+	dir, err := ioutil.TempDir("", "monkey")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "main.s")
+	obj := filepath.Join(dir, "main.o")
+	err = ioutil.WriteFile(src, asm, 0644)
+	if err != nil {
+		return err
+	}
+
+	out, err := exec.Command(as, "-o", obj, src).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("x64: as failed: %s\n%s", err, out)
+	}
+	// linkするのは自分だけなので、libcもcrtもいらない
+	out, err = exec.Command(ld, "-static", "-o", output, obj).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("x64: ld failed: %s\n%s", err, out)
+	}
+	return nil
+}
+
+func writeExecutable(output string, exe []byte) error {
+	err := ioutil.WriteFile(output, exe, 0755)
+	if err != nil {
+		return err
+	}
+	// WriteFileは既存のファイルのmodeを変えない
+	return os.Chmod(output, 0755)
+}
@@ -0,0 +1,2084 @@
+package gen_x64
+
+import (
+	"fmt"
+	"monkey/code"
+	"strings"
+)
+
+// heapSize is the size of the heap of a generated program.
+const heapSize = 64 << 20
+
+// Heap Layout
+//
+//	[header] <- type << 56 | size of the payload in bytes | flags
+//	[payload] <- values point here
+//	...
+//
+// Every block of the heap, allocated or free, has a header, so the collector can walk
+// the heap from monkey_heap to monkey_heap_next. monkey_heap_starts has a bit for each word
+// of the heap, set where the payload of an allocated object starts.
+//
+// The collector is a conservative mark-sweep: every word on the machine stack and in
+// a reachable object that points at an allocated payload is taken as a pointer,
+// so the raw lengths in arrays and the code addresses in closures are harmless.
+// Objects never move. Free blocks are linked through their first word.
+//
+// Object Layouts
+//
+//	string:  NUL-terminated UTF-8 bytes
+//	array:   [length] [element0] [element1] ...
+//	hash:    [number of pairs] [key0] [value0] [key1] [value1] ...
+//	float:   [IEEE 754 bits]
+//	closure: [function address] [number of parameters] [free0] [free1] ...
+//	builtin: [function address]
+//	cell:    [value]
+const (
+	heapMarked = 1
+	// the payload has no pointers (strings and floats)
+	heapNoScan = 2
+)
+
+// runtime returns the assembly of the runtime linked into every program:
+// the heap, the operators on values and the runtime errors.
+//
+// Functions called by generated code take their operands on the stack like builtins,
+// and return a value in rax. The others take their arguments in rdi, rsi, rdx and rcx.
+// All of them may break any register but rbx, rbp, rsp and r12-r15, so live values
+// have to be on the stack or in those registers when they allocate: the collector
+// pushes them and scans the stack.
+func runtime() string {
+	r := []string{
+		"{NULL}", fmt.Sprint(valueNull),
+		"{FALSE}", fmt.Sprint(valueFalse),
+		"{TRUE}", fmt.Sprint(valueTrue),
+		"{MARKED}", fmt.Sprint(heapMarked),
+		"{NOSCAN}", fmt.Sprint(heapNoScan),
+		"{HEAP_SIZE}", fmt.Sprint(heapSize),
+		"{HEAP_BITS}", fmt.Sprint(heapSize / 64),
+		"{STRING_HEADER}", fmt.Sprint(header(typeString, heapNoScan)),
+		"{ARRAY_HEADER}", fmt.Sprint(header(typeArray, 0)),
+		"{FLOAT_HEADER}", fmt.Sprint(header(typeFloat, heapNoScan)),
+	}
+	for i, name := range typeNames {
+		r = append(r, "{T_"+name+"}", fmt.Sprint(i))
+	}
+	for _, op := range []code.Opcode{code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod,
+		code.OpEqual, code.OpNotEqual, code.OpGreaterThan, code.OpLessThan, code.OpGreaterEqual, code.OpLessEqual} {
+		def, _ := code.Lookup(byte(op))
+		r = append(r, "{"+def.Name+"}", fmt.Sprint(byte(op)))
+	}
+
+	var names strings.Builder
+	for _, name := range typeNames {
+		fmt.Fprintf(&names, "	.quad .Lmonkey_name_%s\n", strings.ToLower(name))
+	}
+	for _, name := range typeNames {
+		fmt.Fprintf(&names, ".Lmonkey_name_%s:\n	.string \"%s\"\n", strings.ToLower(name), name)
+	}
+	r = append(r, "{TYPE_NAMES}", names.String())
+
+	// opcodeで引く表にする。演算子でないopcodeは0
+	var operators strings.Builder
+	var symbols strings.Builder
+	for op := 0; op <= int(code.OpGreaterEqual); op++ {
+		operator, ok := code.Operator(code.Opcode(op))
+		if !ok {
+			fmt.Fprintln(&operators, "	.quad 0")
+			continue
+		}
+		fmt.Fprintf(&operators, "	.quad .Lmonkey_operator_%d\n", op)
+		fmt.Fprintf(&symbols, ".Lmonkey_operator_%d:\n	.string \"%s\"\n", op, operator)
+	}
+	r = append(r, "{OPERATOR_NAMES}", operators.String()+symbols.String())
+
+	return strings.NewReplacer(r...).Replace(runtimeHeap + runtimeValues + runtimeOperators + runtimeStrings + runtimeBuiltins)
+}
+
+// runtimeHeap is the allocator and the collector.
+//
+//	monkey_alloc: rdi = bytes, rsi = header (type and flags). returns the zeroed payload in rax.
+//
+// A program out of heap exits with 1.
+const runtimeHeap = `.data
+monkey_heap_next:
+	.quad monkey_heap
+monkey_free_list:
+	.quad 0
+monkey_stack_bottom:
+	.quad 0
+.section .rodata
+.Lmonkey_oom:
+	.ascii "monkey: out of memory\n"
+.bss
+	.align 8
+monkey_heap:
+	.zero {HEAP_SIZE}
+monkey_heap_end:
+monkey_heap_starts:
+	.zero {HEAP_BITS}
+.text
+monkey_alloc:
+	add rdi, 7
+	and rdi, -8
+	mov rax, 8
+	cmp rdi, rax
+	cmovb rdi, rax
+	push rdi
+	push rsi
+	call monkey_heap_find
+	test rax, rax
+	jnz .Lmonkey_alloc_found
+	call monkey_gc
+	mov rdi, [rsp+8]
+	call monkey_heap_find
+	test rax, rax
+	jnz .Lmonkey_alloc_found
+	mov rax, 1
+	mov rdi, 2
+	lea rsi, .Lmonkey_oom[rip]
+	mov rdx, 22
+	syscall
+	mov rax, 60
+	mov rdi, 1
+	syscall
+.Lmonkey_alloc_found:
+	pop rsi
+	pop rdi
+	or [rax-8], rsi
+	lea rcx, monkey_heap[rip]
+	mov rdx, rax
+	sub rdx, rcx
+	shr rdx, 3
+	lea rcx, monkey_heap_starts[rip]
+	bts qword ptr [rcx], rdx
+	# zero the payload
+	mov rdx, rax
+	mov rcx, rdi
+	shr rcx, 3
+	mov rdi, rax
+	xor eax, eax
+	rep stosq
+	mov rax, rdx
+	ret
+
+# monkey_heap_find: rdi = bytes (a multiple of 8). returns a payload whose header is its size, or 0.
+# first fit from the free list, then the untouched end of the heap.
+monkey_heap_find:
+	lea rdx, monkey_free_list[rip]
+.Lmonkey_find_loop:
+	mov rax, [rdx]
+	test rax, rax
+	jz .Lmonkey_find_bump
+	mov rcx, [rax-8]
+	cmp rcx, rdi
+	jae .Lmonkey_find_found
+	mov rdx, rax
+	jmp .Lmonkey_find_loop
+.Lmonkey_find_found:
+	mov r8, [rax]
+	lea r9, [rdi+16]
+	cmp rcx, r9
+	jb .Lmonkey_find_whole
+	# split: the rest stays in the free list
+	lea r9, [rax+rdi+8]
+	sub rcx, rdi
+	sub rcx, 8
+	mov [r9-8], rcx
+	mov [r9], r8
+	mov [rdx], r9
+	mov [rax-8], rdi
+	ret
+.Lmonkey_find_whole:
+	mov [rdx], r8
+	ret
+.Lmonkey_find_bump:
+	mov rax, monkey_heap_next[rip]
+	lea rcx, [rax+rdi+8]
+	lea r8, monkey_heap_end[rip]
+	cmp rcx, r8
+	ja .Lmonkey_find_none
+	mov monkey_heap_next[rip], rcx
+	mov [rax], rdi
+	add rax, 8
+	ret
+.Lmonkey_find_none:
+	xor eax, eax
+	ret
+
+# monkey_mark: rdi = a word that may point to an object.
+monkey_mark:
+	lea rax, monkey_heap[rip]
+	cmp rdi, rax
+	jb .Lmonkey_mark_end
+	cmp rdi, monkey_heap_next[rip]
+	jae .Lmonkey_mark_end
+	test rdi, 7
+	jnz .Lmonkey_mark_end
+	mov rcx, rdi
+	sub rcx, rax
+	shr rcx, 3
+	lea rdx, monkey_heap_starts[rip]
+	bt qword ptr [rdx], rcx
+	jnc .Lmonkey_mark_end
+	mov rax, [rdi-8]
+	test rax, {MARKED}
+	jnz .Lmonkey_mark_end
+	or qword ptr [rdi-8], {MARKED}
+	test rax, {NOSCAN}
+	jnz .Lmonkey_mark_end
+	# size without the type and the flags
+	shl rax, 8
+	shr rax, 8
+	and rax, -8
+	push rbx
+	push r12
+	mov rbx, rdi
+	lea r12, [rdi+rax]
+.Lmonkey_mark_loop:
+	cmp rbx, r12
+	jae .Lmonkey_mark_done
+	mov rdi, [rbx]
+	call monkey_mark
+	add rbx, 8
+	jmp .Lmonkey_mark_loop
+.Lmonkey_mark_done:
+	pop r12
+	pop rbx
+.Lmonkey_mark_end:
+	ret
+
+# monkey_gc marks from the stack and the registers kept across calls, and frees
+# the unmarked objects into a new free list, joining free blocks next to each other.
+monkey_gc:
+	push rbx
+	push r12
+	push r13
+	push r14
+	push r15
+	mov rbx, rsp
+	mov r12, monkey_stack_bottom[rip]
+.Lmonkey_gc_roots:
+	cmp rbx, r12
+	ja .Lmonkey_gc_sweep
+	mov rdi, [rbx]
+	call monkey_mark
+	add rbx, 8
+	jmp .Lmonkey_gc_roots
+.Lmonkey_gc_sweep:
+	lea r10, monkey_heap[rip]
+	lea r9, monkey_heap_starts[rip]
+	mov rsi, r10
+	xor r8, r8
+	mov qword ptr monkey_free_list[rip], 0
+.Lmonkey_gc_block:
+	cmp rsi, monkey_heap_next[rip]
+	jae .Lmonkey_gc_done
+	mov rax, [rsi]
+	mov rdx, rax
+	shl rdx, 8
+	shr rdx, 8
+	and rdx, -8
+	lea rdi, [rsi+8]
+	mov rcx, rdi
+	sub rcx, r10
+	shr rcx, 3
+	bt qword ptr [r9], rcx
+	jnc .Lmonkey_gc_free
+	test rax, {MARKED}
+	jz .Lmonkey_gc_unmarked
+	and qword ptr [rsi], -2
+	xor r8, r8
+	jmp .Lmonkey_gc_next
+.Lmonkey_gc_unmarked:
+	btr qword ptr [r9], rcx
+	mov [rsi], rdx
+.Lmonkey_gc_free:
+	test r8, r8
+	jz .Lmonkey_gc_new_free
+	# r8 is the free block just before this one
+	lea rax, [rdx+8]
+	add [r8-8], rax
+	jmp .Lmonkey_gc_next
+.Lmonkey_gc_new_free:
+	mov rax, monkey_free_list[rip]
+	mov [rdi], rax
+	mov monkey_free_list[rip], rdi
+	mov r8, rdi
+.Lmonkey_gc_next:
+	lea rsi, [rdi+rdx]
+	jmp .Lmonkey_gc_block
+.Lmonkey_gc_done:
+	pop r15
+	pop r14
+	pop r13
+	pop r12
+	pop rbx
+	ret
+`
+
+// runtimeValues inspects values and reports runtime errors.
+//
+//	monkey_type: rdi = value. returns the type in rax, and breaks no other register.
+//	monkey_panic: rdi = format, rsi, rdx, rcx = arguments. writes "runtime error: ..." to stderr and exits with 1.
+//	  %d is an integer, %s a NUL-terminated string and %T the type of a value.
+//	monkey_inspect: rdi = fd, rsi = value. writes the value like object.Object.Inspect.
+//	monkey_exit_code: rdi = value. returns the exit status of a program returning the value.
+//	monkey_stack_init: rdi = the frame of main. sets monkey_stack_limit from the stack limit of the process.
+//	monkey_stack_overflow: jumped to by a function whose rsp is below monkey_stack_limit.
+const runtimeValues = `.data
+	.align 8
+monkey_type_names:
+{TYPE_NAMES}
+monkey_stack_limit:
+	.quad 0
+.section .rodata
+.Lmonkey_runtime_error:
+	.string "runtime error: "
+.Lmonkey_msg_stack_overflow:
+	.string "stack overflow"
+.Lmonkey_true:
+	.string "true"
+.Lmonkey_false:
+	.string "false"
+.Lmonkey_null:
+	.string "null"
+.Lmonkey_newline:
+	.string "\n"
+.Lmonkey_comma:
+	.string ", "
+.Lmonkey_colon:
+	.string ": "
+.Lmonkey_lbracket:
+	.string "["
+.Lmonkey_rbracket:
+	.string "]"
+.Lmonkey_lbrace:
+	.string "{"
+.Lmonkey_rbrace:
+	.string "}"
+.Lmonkey_closure:
+	.string "closure[0x"
+.Lmonkey_builtin_function:
+	.string "builtin function"
+.Lmonkey_nan:
+	.string "NaN"
+.Lmonkey_plus_inf:
+	.string "+Inf"
+.Lmonkey_minus_inf:
+	.string "-Inf"
+.text
+monkey_type:
+	test dil, 1
+	jnz .Lmonkey_type_integer
+	cmp rdi, {NULL}
+	je .Lmonkey_type_null
+	cmp rdi, {FALSE}
+	je .Lmonkey_type_boolean
+	cmp rdi, {TRUE}
+	je .Lmonkey_type_boolean
+	mov rax, [rdi-8]
+	shr rax, 56
+	ret
+.Lmonkey_type_integer:
+	mov eax, {T_INTEGER}
+	ret
+.Lmonkey_type_null:
+	mov eax, {T_NULL}
+	ret
+.Lmonkey_type_boolean:
+	mov eax, {T_BOOLEAN}
+	ret
+
+# monkey_write: rdi = fd, rsi = bytes, rdx = length.
+monkey_write:
+	mov eax, 1
+	syscall
+	ret
+
+# monkey_write_cstr: rdi = fd, rsi = NUL-terminated string.
+monkey_write_cstr:
+	push rdi
+	push rsi
+	mov rdi, rsi
+	call monkey_strlen
+	mov rdx, rax
+	pop rsi
+	pop rdi
+	jmp monkey_write
+
+# monkey_write_number: rdi = fd, rsi = number, rdx = base. a negative number is written with "-" in base 10.
+monkey_write_number:
+	push rbp
+	mov rbp, rsp
+	sub rsp, 80
+	mov r8, rdi
+	mov r10, rdx
+	mov rax, rsi
+	xor r9d, r9d
+	cmp r10, 10
+	jne .Lmonkey_number_digits
+	test rax, rax
+	jns .Lmonkey_number_digits
+	neg rax
+	mov r9d, 1
+.Lmonkey_number_digits:
+	mov rsi, rbp
+.Lmonkey_number_loop:
+	xor edx, edx
+	div r10
+	cmp dl, 10
+	jb .Lmonkey_number_decimal
+	add dl, 39
+.Lmonkey_number_decimal:
+	add dl, 48
+	sub rsi, 1
+	mov [rsi], dl
+	test rax, rax
+	jnz .Lmonkey_number_loop
+	test r9d, r9d
+	jz .Lmonkey_number_write
+	sub rsi, 1
+	mov byte ptr [rsi], 45
+.Lmonkey_number_write:
+	mov rdi, r8
+	mov rdx, rbp
+	sub rdx, rsi
+	call monkey_write
+	leave
+	ret
+
+# monkey_bn_*: unsigned integers of 20 64-bit limbs, the lowest first, for monkey_write_float.
+# rdi = the integer changed, rsi = the other integer or a number. they break rax, rcx, rdx and r8-r10.
+monkey_bn_set:
+	mov [rdi], rsi
+	mov ecx, 1
+.Lmonkey_bn_set_loop:
+	mov qword ptr [rdi+rcx*8], 0
+	add rcx, 1
+	cmp rcx, 20
+	jb .Lmonkey_bn_set_loop
+	ret
+
+monkey_bn_copy:
+	xor ecx, ecx
+.Lmonkey_bn_copy_loop:
+	mov rax, [rsi+rcx*8]
+	mov [rdi+rcx*8], rax
+	add rcx, 1
+	cmp rcx, 20
+	jb .Lmonkey_bn_copy_loop
+	ret
+
+# rdi *= rsi
+monkey_bn_mul:
+	mov r8, rsi
+	xor r9d, r9d
+	xor ecx, ecx
+.Lmonkey_bn_mul_loop:
+	mov rax, [rdi+rcx*8]
+	mul r8
+	add rax, r9
+	adc rdx, 0
+	mov [rdi+rcx*8], rax
+	mov r9, rdx
+	add rcx, 1
+	cmp rcx, 20
+	jb .Lmonkey_bn_mul_loop
+	ret
+
+# rdi *= 2^rsi
+monkey_bn_shl:
+	mov r10, rsi
+.Lmonkey_bn_shl_loop:
+	test r10, r10
+	jz .Lmonkey_bn_shl_end
+	mov ecx, 32
+	cmp r10, rcx
+	cmovb rcx, r10
+	sub r10, rcx
+	mov esi, 1
+	shl rsi, cl
+	call monkey_bn_mul
+	jmp .Lmonkey_bn_shl_loop
+.Lmonkey_bn_shl_end:
+	ret
+
+# rdi += rsi. the carry is kept in r8, as cmp breaks the carry flag
+monkey_bn_add:
+	xor r8d, r8d
+	xor ecx, ecx
+.Lmonkey_bn_add_loop:
+	xor edx, edx
+	mov rax, [rdi+rcx*8]
+	add rax, r8
+	adc rdx, 0
+	add rax, [rsi+rcx*8]
+	adc rdx, 0
+	mov [rdi+rcx*8], rax
+	mov r8, rdx
+	add rcx, 1
+	cmp rcx, 20
+	jb .Lmonkey_bn_add_loop
+	ret
+
+# rdi -= rsi, where rdi >= rsi
+monkey_bn_sub:
+	xor r8d, r8d
+	xor ecx, ecx
+.Lmonkey_bn_sub_loop:
+	xor edx, edx
+	mov rax, [rdi+rcx*8]
+	sub rax, r8
+	adc rdx, 0
+	sub rax, [rsi+rcx*8]
+	adc rdx, 0
+	mov [rdi+rcx*8], rax
+	mov r8, rdx
+	add rcx, 1
+	cmp rcx, 20
+	jb .Lmonkey_bn_sub_loop
+	ret
+
+# eax = -1, 0 or 1 as rdi is less than, equal to or greater than rsi
+monkey_bn_cmp:
+	mov ecx, 19
+.Lmonkey_bn_cmp_loop:
+	mov rax, [rdi+rcx*8]
+	cmp rax, [rsi+rcx*8]
+	ja .Lmonkey_bn_cmp_greater
+	jb .Lmonkey_bn_cmp_less
+	sub rcx, 1
+	jns .Lmonkey_bn_cmp_loop
+	xor eax, eax
+	ret
+.Lmonkey_bn_cmp_greater:
+	mov eax, 1
+	ret
+.Lmonkey_bn_cmp_less:
+	mov eax, -1
+	ret
+
+# monkey_write_float: rdi = fd, xmm0 = float.
+# Like strconv.FormatFloat(f, 'g', -1, 64) with ".0" for integers: the shortest digits
+# that read back as f, exactly computed with the integers of monkey_bn_*.
+monkey_write_float:
+	push rbp
+	mov rbp, rsp
+	sub rsp, 944
+	mov [rbp-8], rdi
+	# the output is built from rbp-96, the digits at rbp-32, and the integers below rbp-96
+	lea rdi, [rbp-96]
+	ucomisd xmm0, xmm0
+	jp .Lmonkey_float_nan
+	movq rax, xmm0
+	xor r11d, r11d
+	btr rax, 63
+	adc r11d, 0
+	mov rcx, 0x7ff0000000000000
+	cmp rax, rcx
+	je .Lmonkey_float_inf
+	test r11d, r11d
+	jz .Lmonkey_float_positive
+	mov byte ptr [rdi], 45
+	add rdi, 1
+.Lmonkey_float_positive:
+	test rax, rax
+	jz .Lmonkey_float_zero
+	mov [rbp-904], rbx
+	mov [rbp-912], r12
+	mov [rbp-920], r13
+	mov [rbp-928], r14
+	mov [rbp-936], r15
+	mov [rbp-944], rdi
+	# v = f * 2^e, bl = the lower neighbor is nearer (f is a power of 2)
+	mov r12, 0xfffffffffffff
+	and r12, rax
+	shr rax, 52
+	mov r13, -1074
+	xor ebx, ebx
+	test rax, rax
+	jz .Lmonkey_float_bignums
+	cmp rax, 1
+	je .Lmonkey_float_normal
+	test r12, r12
+	setz bl
+.Lmonkey_float_normal:
+	bts r12, 52
+	lea r13, [rax-1075]
+.Lmonkey_float_bignums:
+	# r/s = v, m+/s and m-/s = the distances to the middles between v and its neighbors
+	xor eax, eax
+	mov r14, r13
+	test r14, r14
+	cmovs r14, rax
+	mov r15, r14
+	sub r15, r13
+	lea rdi, [rbp-256]
+	mov rsi, r12
+	call monkey_bn_set
+	lea rdi, [rbp-256]
+	lea rsi, [r14+1]
+	call monkey_bn_shl
+	lea rdi, [rbp-416]
+	mov esi, 1
+	call monkey_bn_set
+	lea rdi, [rbp-416]
+	lea rsi, [r15+1]
+	call monkey_bn_shl
+	lea rdi, [rbp-576]
+	mov esi, 1
+	call monkey_bn_set
+	lea rdi, [rbp-576]
+	mov rsi, r14
+	call monkey_bn_shl
+	lea rdi, [rbp-736]
+	mov esi, 1
+	call monkey_bn_set
+	lea rdi, [rbp-736]
+	mov rsi, r14
+	call monkey_bn_shl
+	test bl, bl
+	jz .Lmonkey_float_even
+	lea rdi, [rbp-256]
+	mov esi, 1
+	call monkey_bn_shl
+	lea rdi, [rbp-416]
+	mov esi, 1
+	call monkey_bn_shl
+	lea rdi, [rbp-576]
+	mov esi, 1
+	call monkey_bn_shl
+.Lmonkey_float_even:
+	# ebx = 1 if the middles round to v (f is even), as strconv.ParseFloat rounds half to even
+	mov ebx, r12d
+	not ebx
+	and ebx, 1
+	# r13 = k, the exponent with (r + m+) / s < 1 <= 10 * (r + m+) / s
+	xor r13d, r13d
+.Lmonkey_float_scale_up:
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-256]
+	call monkey_bn_copy
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-576]
+	call monkey_bn_add
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-416]
+	call monkey_bn_cmp
+	add eax, ebx
+	jle .Lmonkey_float_scale_down
+	lea rdi, [rbp-416]
+	mov esi, 10
+	call monkey_bn_mul
+	add r13, 1
+	jmp .Lmonkey_float_scale_up
+.Lmonkey_float_scale_down:
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-256]
+	call monkey_bn_copy
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-576]
+	call monkey_bn_add
+	lea rdi, [rbp-896]
+	mov esi, 10
+	call monkey_bn_mul
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-416]
+	call monkey_bn_cmp
+	add eax, ebx
+	jg .Lmonkey_float_generate
+	lea rdi, [rbp-256]
+	mov esi, 10
+	call monkey_bn_mul
+	lea rdi, [rbp-576]
+	mov esi, 10
+	call monkey_bn_mul
+	lea rdi, [rbp-736]
+	mov esi, 10
+	call monkey_bn_mul
+	sub r13, 1
+	jmp .Lmonkey_float_scale_down
+.Lmonkey_float_generate:
+	# the digits until one of the neighbors' middles is reached (Burger and Dybvig)
+	xor r14d, r14d
+.Lmonkey_float_generate_loop:
+	lea rdi, [rbp-256]
+	mov esi, 10
+	call monkey_bn_mul
+	lea rdi, [rbp-576]
+	mov esi, 10
+	call monkey_bn_mul
+	lea rdi, [rbp-736]
+	mov esi, 10
+	call monkey_bn_mul
+	xor r12d, r12d
+.Lmonkey_float_divide:
+	lea rdi, [rbp-256]
+	lea rsi, [rbp-416]
+	call monkey_bn_cmp
+	test eax, eax
+	js .Lmonkey_float_low
+	lea rdi, [rbp-256]
+	lea rsi, [rbp-416]
+	call monkey_bn_sub
+	add r12, 1
+	jmp .Lmonkey_float_divide
+.Lmonkey_float_low:
+	# r15 = 1 if the digits so far are within the lower middle
+	lea rdi, [rbp-256]
+	lea rsi, [rbp-736]
+	call monkey_bn_cmp
+	sub eax, ebx
+	shr eax, 31
+	mov r15d, eax
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-256]
+	call monkey_bn_copy
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-576]
+	call monkey_bn_add
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-416]
+	call monkey_bn_cmp
+	add eax, ebx
+	jg .Lmonkey_float_high
+	test r15, r15
+	jnz .Lmonkey_float_last
+	call .Lmonkey_float_put
+	jmp .Lmonkey_float_generate_loop
+.Lmonkey_float_high:
+	test r15, r15
+	jz .Lmonkey_float_up
+	# both are within: the nearer of the digit and the digit + 1, the even one if they are as near
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-256]
+	call monkey_bn_copy
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-256]
+	call monkey_bn_add
+	lea rdi, [rbp-896]
+	lea rsi, [rbp-416]
+	call monkey_bn_cmp
+	test eax, eax
+	js .Lmonkey_float_last
+	jg .Lmonkey_float_up
+	test r12, 1
+	jz .Lmonkey_float_last
+.Lmonkey_float_up:
+	add r12, 1
+.Lmonkey_float_last:
+	call .Lmonkey_float_put
+	mov r10, r14
+	lea r9, [r13-1]
+	lea rsi, [rbp-32]
+	mov rdi, [rbp-944]
+	mov rbx, [rbp-904]
+	mov r12, [rbp-912]
+	mov r13, [rbp-920]
+	mov r14, [rbp-928]
+	mov r15, [rbp-936]
+	jmp .Lmonkey_float_layout
+# stores the digit r12 as the digit r14 at rbp-32 of the caller
+.Lmonkey_float_put:
+	mov rax, r12
+	add rax, 48
+	lea rcx, [rbp-32]
+	add rcx, r14
+	mov [rcx], al
+	add r14, 1
+	ret
+.Lmonkey_float_layout:
+	# r10 digits at rsi, exponent r9
+	cmp r9, -4
+	jl .Lmonkey_float_exponent
+	cmp r9, 6
+	jge .Lmonkey_float_exponent
+	test r9, r9
+	js .Lmonkey_float_small
+	xor ecx, ecx
+.Lmonkey_float_int_loop:
+	cmp rcx, r9
+	jg .Lmonkey_float_int_done
+	mov al, 48
+	cmp rcx, r10
+	jae .Lmonkey_float_int_put
+	mov al, [rsi+rcx]
+.Lmonkey_float_int_put:
+	mov [rdi], al
+	add rdi, 1
+	add rcx, 1
+	jmp .Lmonkey_float_int_loop
+.Lmonkey_float_int_done:
+	cmp rcx, r10
+	jae .Lmonkey_float_point_zero
+	mov byte ptr [rdi], 46
+	add rdi, 1
+.Lmonkey_float_frac_loop:
+	cmp rcx, r10
+	jae .Lmonkey_float_write
+	mov al, [rsi+rcx]
+	mov [rdi], al
+	add rdi, 1
+	add rcx, 1
+	jmp .Lmonkey_float_frac_loop
+.Lmonkey_float_point_zero:
+	mov word ptr [rdi], 0x302e
+	add rdi, 2
+	jmp .Lmonkey_float_write
+.Lmonkey_float_small:
+	mov word ptr [rdi], 0x2e30
+	add rdi, 2
+	mov rcx, r9
+.Lmonkey_float_zeros:
+	add rcx, 1
+	jz .Lmonkey_float_small_digits
+	mov byte ptr [rdi], 48
+	add rdi, 1
+	jmp .Lmonkey_float_zeros
+.Lmonkey_float_small_digits:
+	xor ecx, ecx
+	jmp .Lmonkey_float_frac_loop
+.Lmonkey_float_exponent:
+	mov al, [rsi]
+	mov [rdi], al
+	add rdi, 1
+	mov ecx, 1
+	cmp r10, 1
+	je .Lmonkey_float_e
+	mov byte ptr [rdi], 46
+	add rdi, 1
+.Lmonkey_float_exponent_digits:
+	cmp rcx, r10
+	jae .Lmonkey_float_e
+	mov al, [rsi+rcx]
+	mov [rdi], al
+	add rdi, 1
+	add rcx, 1
+	jmp .Lmonkey_float_exponent_digits
+.Lmonkey_float_e:
+	mov byte ptr [rdi], 101
+	add rdi, 1
+	mov al, 43
+	test r9, r9
+	jns .Lmonkey_float_e_sign
+	mov al, 45
+	neg r9
+.Lmonkey_float_e_sign:
+	mov [rdi], al
+	add rdi, 1
+	# at least 2 digits
+	mov rax, r9
+	cmp rax, 100
+	jb .Lmonkey_float_e_two
+	xor edx, edx
+	mov ecx, 100
+	div rcx
+	add al, 48
+	mov [rdi], al
+	add rdi, 1
+	mov rax, rdx
+.Lmonkey_float_e_two:
+	xor edx, edx
+	mov ecx, 10
+	div rcx
+	add al, 48
+	mov [rdi], al
+	add dl, 48
+	mov [rdi+1], dl
+	add rdi, 2
+	jmp .Lmonkey_float_write
+.Lmonkey_float_zero:
+	mov byte ptr [rdi], 48
+	mov word ptr [rdi+1], 0x302e
+	add rdi, 3
+	jmp .Lmonkey_float_write
+.Lmonkey_float_inf:
+	lea rsi, .Lmonkey_plus_inf[rip]
+	test r11d, r11d
+	jz .Lmonkey_float_cstr
+	lea rsi, .Lmonkey_minus_inf[rip]
+	jmp .Lmonkey_float_cstr
+.Lmonkey_float_nan:
+	lea rsi, .Lmonkey_nan[rip]
+.Lmonkey_float_cstr:
+	mov rdi, [rbp-8]
+	call monkey_write_cstr
+	leave
+	ret
+.Lmonkey_float_write:
+	mov rdx, rdi
+	lea rsi, [rbp-96]
+	sub rdx, rsi
+	mov rdi, [rbp-8]
+	call monkey_write
+	leave
+	ret
+
+monkey_panic:
+	push rbp
+	mov rbp, rsp
+	# argument i is at rbp-24+8*i
+	push rcx
+	push rdx
+	push rsi
+	mov r12, rdi
+	xor r13d, r13d
+	mov edi, 2
+	lea rsi, .Lmonkey_runtime_error[rip]
+	call monkey_write_cstr
+.Lmonkey_panic_loop:
+	mov rbx, r12
+.Lmonkey_panic_scan:
+	mov al, [r12]
+	test al, al
+	jz .Lmonkey_panic_flush
+	cmp al, 37
+	je .Lmonkey_panic_flush
+	add r12, 1
+	jmp .Lmonkey_panic_scan
+.Lmonkey_panic_flush:
+	mov edi, 2
+	mov rsi, rbx
+	mov rdx, r12
+	sub rdx, rbx
+	call monkey_write
+	mov al, [r12]
+	test al, al
+	jz .Lmonkey_panic_end
+	movzx eax, byte ptr [r12+1]
+	add r12, 2
+	mov rsi, [rbp+r13*8-24]
+	add r13, 1
+	cmp al, 100
+	je .Lmonkey_panic_d
+	cmp al, 84
+	je .Lmonkey_panic_type
+	mov edi, 2
+	call monkey_write_cstr
+	jmp .Lmonkey_panic_loop
+.Lmonkey_panic_d:
+	mov edi, 2
+	mov edx, 10
+	call monkey_write_number
+	jmp .Lmonkey_panic_loop
+.Lmonkey_panic_type:
+	mov rdi, rsi
+	call monkey_type
+	lea rcx, monkey_type_names[rip]
+	mov rsi, [rcx+rax*8]
+	mov edi, 2
+	call monkey_write_cstr
+	jmp .Lmonkey_panic_loop
+.Lmonkey_panic_end:
+	mov edi, 2
+	lea rsi, .Lmonkey_newline[rip]
+	call monkey_write_cstr
+	mov eax, 60
+	mov edi, 1
+	syscall
+
+monkey_inspect:
+	push rbp
+	mov rbp, rsp
+	push rbx
+	push r12
+	push r13
+	push r14
+	mov r12, rdi
+	mov rbx, rsi
+	mov rdi, rsi
+	call monkey_type
+	cmp eax, {T_INTEGER}
+	je .Lmonkey_inspect_integer
+	cmp eax, {T_FLOAT}
+	je .Lmonkey_inspect_float
+	cmp eax, {T_STRING}
+	je .Lmonkey_inspect_string
+	cmp eax, {T_BOOLEAN}
+	je .Lmonkey_inspect_boolean
+	cmp eax, {T_ARRAY}
+	je .Lmonkey_inspect_array
+	cmp eax, {T_HASH}
+	je .Lmonkey_inspect_hash
+	cmp eax, {T_CLOSURE}
+	je .Lmonkey_inspect_closure
+	cmp eax, {T_BUILTIN}
+	je .Lmonkey_inspect_builtin
+	lea rsi, .Lmonkey_null[rip]
+	jmp .Lmonkey_inspect_cstr
+.Lmonkey_inspect_integer:
+	mov rdi, r12
+	mov rsi, rbx
+	sar rsi, 1
+	mov edx, 10
+	call monkey_write_number
+	jmp .Lmonkey_inspect_end
+.Lmonkey_inspect_float:
+	mov rdi, r12
+	movq xmm0, [rbx]
+	call monkey_write_float
+	jmp .Lmonkey_inspect_end
+.Lmonkey_inspect_string:
+	mov rsi, rbx
+	jmp .Lmonkey_inspect_cstr
+.Lmonkey_inspect_boolean:
+	lea rsi, .Lmonkey_true[rip]
+	cmp rbx, {TRUE}
+	je .Lmonkey_inspect_cstr
+	lea rsi, .Lmonkey_false[rip]
+	jmp .Lmonkey_inspect_cstr
+.Lmonkey_inspect_builtin:
+	lea rsi, .Lmonkey_builtin_function[rip]
+	jmp .Lmonkey_inspect_cstr
+.Lmonkey_inspect_closure:
+	mov rdi, r12
+	lea rsi, .Lmonkey_closure[rip]
+	call monkey_write_cstr
+	mov rdi, r12
+	mov rsi, rbx
+	mov edx, 16
+	call monkey_write_number
+	lea rsi, .Lmonkey_rbracket[rip]
+	jmp .Lmonkey_inspect_cstr
+.Lmonkey_inspect_array:
+	mov rdi, r12
+	lea rsi, .Lmonkey_lbracket[rip]
+	call monkey_write_cstr
+	xor r13d, r13d
+.Lmonkey_inspect_array_loop:
+	cmp r13, [rbx]
+	jae .Lmonkey_inspect_array_end
+	test r13, r13
+	jz .Lmonkey_inspect_element
+	mov rdi, r12
+	lea rsi, .Lmonkey_comma[rip]
+	call monkey_write_cstr
+.Lmonkey_inspect_element:
+	mov rdi, r12
+	mov rsi, [rbx+r13*8+8]
+	call monkey_inspect
+	add r13, 1
+	jmp .Lmonkey_inspect_array_loop
+.Lmonkey_inspect_array_end:
+	lea rsi, .Lmonkey_rbracket[rip]
+	jmp .Lmonkey_inspect_cstr
+.Lmonkey_inspect_hash:
+	mov rdi, r12
+	lea rsi, .Lmonkey_lbrace[rip]
+	call monkey_write_cstr
+	xor r13d, r13d
+.Lmonkey_inspect_hash_loop:
+	cmp r13, [rbx]
+	jae .Lmonkey_inspect_hash_end
+	test r13, r13
+	jz .Lmonkey_inspect_pair
+	mov rdi, r12
+	lea rsi, .Lmonkey_comma[rip]
+	call monkey_write_cstr
+.Lmonkey_inspect_pair:
+	mov r14, r13
+	shl r14, 4
+	mov rdi, r12
+	mov rsi, [rbx+r14+8]
+	call monkey_inspect
+	mov rdi, r12
+	lea rsi, .Lmonkey_colon[rip]
+	call monkey_write_cstr
+	mov rdi, r12
+	mov rsi, [rbx+r14+16]
+	call monkey_inspect
+	add r13, 1
+	jmp .Lmonkey_inspect_hash_loop
+.Lmonkey_inspect_hash_end:
+	lea rsi, .Lmonkey_rbrace[rip]
+.Lmonkey_inspect_cstr:
+	mov rdi, r12
+	call monkey_write_cstr
+.Lmonkey_inspect_end:
+	pop r14
+	pop r13
+	pop r12
+	pop rbx
+	pop rbp
+	ret
+
+# 関数が使ってよいのはstackの上限(RLIMIT_STACK, 最大256MB)の半分まで.
+# 残りはargvと環境変数、monkey_panicの分
+monkey_stack_init:
+	push rbp
+	mov rbp, rsp
+	push rdi
+	sub rsp, 16
+	mov eax, 97
+	mov edi, 3
+	mov rsi, rsp
+	syscall
+	mov rdx, 0x10000000
+	mov rcx, [rsp]
+	test rax, rax
+	cmovnz rcx, rdx
+	cmp rcx, rdx
+	cmova rcx, rdx
+	shr rcx, 1
+	mov rax, [rbp-8]
+	sub rax, rcx
+	mov monkey_stack_limit[rip], rax
+	leave
+	ret
+
+monkey_stack_overflow:
+	lea rdi, .Lmonkey_msg_stack_overflow[rip]
+	call monkey_panic
+
+# an integer is the status, false is 1 and true 0 like a shell, a float is truncated
+monkey_exit_code:
+	test dil, 1
+	jz .Lmonkey_exit_not_integer
+	mov rax, rdi
+	sar rax, 1
+	ret
+.Lmonkey_exit_not_integer:
+	mov eax, 1
+	cmp rdi, {FALSE}
+	je .Lmonkey_exit_end
+	call monkey_type
+	cmp eax, {T_FLOAT}
+	jne .Lmonkey_exit_zero
+	cvttsd2si rax, [rdi]
+	ret
+.Lmonkey_exit_zero:
+	xor eax, eax
+.Lmonkey_exit_end:
+	ret
+`
+
+// runtimeOperators are the operators with the checks and the errors of the vm.
+//
+//	monkey_binary(left, right): rdi = opcode. arithmetic and comparisons
+//	monkey_negate(operand)
+//	monkey_index(left, index)
+//	monkey_slice(left, low, high): low and high are null when omitted
+//	monkey_hash_check: rdi = hash. reports an unusable key
+//	monkey_call: rax = callee, rcx = number of arguments, the arguments on the stack as a call.
+//	  jumps to the function of the closure, which returns to the caller.
+const runtimeOperators = `.section .rodata
+.Lmonkey_msg_binary:
+	.string "unsupported types for binary operation: %T %T"
+.Lmonkey_msg_operator:
+	.string "unknown operator: %T %s %T"
+.Lmonkey_msg_type_mismatch:
+	.string "type mismatch: %T %s %T"
+.Lmonkey_msg_divide:
+	.string "division by zero"
+.Lmonkey_msg_negation:
+	.string "unsupported type for negation: %T"
+.Lmonkey_msg_index:
+	.string "index operator not supported: %T"
+.Lmonkey_msg_hash_key:
+	.string "unusable as hash key: %T"
+	.align 8
+monkey_operator_names:
+{OPERATOR_NAMES}.Lmonkey_msg_slice:
+	.string "slice operator not supported: %T"
+.Lmonkey_msg_slice_index:
+	.string "slice index must be INTEGER, got %T"
+.Lmonkey_msg_call:
+	.string "calling non-function and non-built-in"
+.Lmonkey_msg_arguments:
+	.string "wrong number of arguments: want=%d, got=%d"
+.text
+monkey_binary:
+	push rbp
+	mov rbp, rsp
+	push rdi
+	mov rax, [rbp+24]
+	mov rcx, [rbp+16]
+	mov rdx, rax
+	and rdx, rcx
+	test dl, 1
+	jz .Lmonkey_binary_other
+	sar rax, 1
+	sar rcx, 1
+	cmp rdi, {OpAdd}
+	je .Lmonkey_binary_add
+	cmp rdi, {OpSub}
+	je .Lmonkey_binary_sub
+	cmp rdi, {OpMul}
+	je .Lmonkey_binary_mul
+	cmp rdi, {OpDiv}
+	je .Lmonkey_binary_div
+	cmp rdi, {OpMod}
+	je .Lmonkey_binary_mod
+	cmp rdi, {OpEqual}
+	je .Lmonkey_binary_int_eq
+	cmp rdi, {OpNotEqual}
+	je .Lmonkey_binary_int_ne
+	cmp rdi, {OpGreaterThan}
+	je .Lmonkey_binary_int_gt
+	cmp rdi, {OpLessThan}
+	je .Lmonkey_binary_int_lt
+	cmp rdi, {OpGreaterEqual}
+	je .Lmonkey_binary_int_ge
+	cmp rax, rcx
+	setle al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_int_eq:
+	cmp rax, rcx
+	sete al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_int_ne:
+	cmp rax, rcx
+	setne al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_int_gt:
+	cmp rax, rcx
+	setg al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_int_lt:
+	cmp rax, rcx
+	setl al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_int_ge:
+	cmp rax, rcx
+	setge al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_add:
+	add rax, rcx
+	jmp .Lmonkey_binary_int
+.Lmonkey_binary_sub:
+	sub rax, rcx
+	jmp .Lmonkey_binary_int
+.Lmonkey_binary_mul:
+	imul rax, rcx
+	jmp .Lmonkey_binary_int
+.Lmonkey_binary_div:
+	test rcx, rcx
+	jz .Lmonkey_binary_divide_by_zero
+	cqo
+	idiv rcx
+	jmp .Lmonkey_binary_int
+.Lmonkey_binary_mod:
+	test rcx, rcx
+	jz .Lmonkey_binary_divide_by_zero
+	cqo
+	idiv rcx
+	mov rax, rdx
+.Lmonkey_binary_int:
+	lea rax, [rax*2+1]
+	leave
+	ret
+.Lmonkey_binary_bool:
+	movzx eax, al
+	lea rax, [rax*2+{FALSE}]
+	leave
+	ret
+.Lmonkey_binary_divide_by_zero:
+	lea rdi, .Lmonkey_msg_divide[rip]
+	call monkey_panic
+
+.Lmonkey_binary_other:
+	mov rdi, [rbp+24]
+	call monkey_type
+	push rax
+	mov rdi, [rbp+16]
+	call monkey_type
+	push rax
+	# left type at rbp-16, right type at rbp-24
+	mov rdi, [rbp-16]
+	call monkey_is_number
+	jz .Lmonkey_binary_not_numbers
+	mov rdi, [rbp-24]
+	call monkey_is_number
+	jz .Lmonkey_binary_not_numbers
+	mov rdi, [rbp+16]
+	call monkey_float_value
+	movapd xmm1, xmm0
+	mov rdi, [rbp+24]
+	call monkey_float_value
+	mov rdi, [rbp-8]
+	cmp rdi, {OpAdd}
+	je .Lmonkey_binary_float_add
+	cmp rdi, {OpSub}
+	je .Lmonkey_binary_float_sub
+	cmp rdi, {OpMul}
+	je .Lmonkey_binary_float_mul
+	cmp rdi, {OpDiv}
+	je .Lmonkey_binary_float_div
+	cmp rdi, {OpMod}
+	je .Lmonkey_binary_float_mod
+	# comparisons: NaN is false for all but !=
+	cmp rdi, {OpEqual}
+	je .Lmonkey_binary_float_eq
+	cmp rdi, {OpNotEqual}
+	je .Lmonkey_binary_float_ne
+	cmp rdi, {OpGreaterThan}
+	je .Lmonkey_binary_float_gt
+	cmp rdi, {OpGreaterEqual}
+	je .Lmonkey_binary_float_ge
+	cmp rdi, {OpLessThan}
+	je .Lmonkey_binary_float_lt
+	ucomisd xmm1, xmm0
+	setae al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_float_eq:
+	ucomisd xmm0, xmm1
+	sete al
+	setnp cl
+	and al, cl
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_float_ne:
+	ucomisd xmm0, xmm1
+	setne al
+	setp cl
+	or al, cl
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_float_gt:
+	ucomisd xmm0, xmm1
+	seta al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_float_ge:
+	ucomisd xmm0, xmm1
+	setae al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_float_lt:
+	ucomisd xmm1, xmm0
+	seta al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_float_add:
+	addsd xmm0, xmm1
+	jmp .Lmonkey_binary_float
+.Lmonkey_binary_float_sub:
+	subsd xmm0, xmm1
+	jmp .Lmonkey_binary_float
+.Lmonkey_binary_float_mul:
+	mulsd xmm0, xmm1
+	jmp .Lmonkey_binary_float
+.Lmonkey_binary_float_div:
+	divsd xmm0, xmm1
+	jmp .Lmonkey_binary_float
+.Lmonkey_binary_float_mod:
+	# x - trunc(x / y) * y
+	movapd xmm2, xmm0
+	divsd xmm2, xmm1
+	roundsd xmm2, xmm2, 3
+	mulsd xmm2, xmm1
+	subsd xmm0, xmm2
+.Lmonkey_binary_float:
+	call monkey_box_float
+	leave
+	ret
+
+.Lmonkey_binary_not_numbers:
+	mov rdi, [rbp-8]
+	cmp rdi, {OpEqual}
+	je .Lmonkey_binary_same
+	cmp rdi, {OpNotEqual}
+	je .Lmonkey_binary_not_same
+	cmp rdi, {OpAdd}
+	je .Lmonkey_binary_arithmetic
+	cmp rdi, {OpSub}
+	je .Lmonkey_binary_arithmetic
+	cmp rdi, {OpMul}
+	je .Lmonkey_binary_arithmetic
+	cmp rdi, {OpDiv}
+	je .Lmonkey_binary_arithmetic
+	cmp rdi, {OpMod}
+	je .Lmonkey_binary_arithmetic
+	mov rsi, [rbp+24]
+	mov rdx, [rbp+16]
+	call monkey_operator_error
+.Lmonkey_binary_same:
+	# the vm compares the objects: booleans and null by value, the others by address
+	mov rax, [rbp+24]
+	cmp rax, [rbp+16]
+	sete al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_not_same:
+	mov rax, [rbp+24]
+	cmp rax, [rbp+16]
+	setne al
+	jmp .Lmonkey_binary_bool
+.Lmonkey_binary_arithmetic:
+	cmp qword ptr [rbp-16], {T_STRING}
+	jne .Lmonkey_binary_unsupported
+	cmp qword ptr [rbp-24], {T_STRING}
+	jne .Lmonkey_binary_unsupported
+	cmp rdi, {OpAdd}
+	jne .Lmonkey_binary_string_operator
+	push [rbp+24]
+	push [rbp+16]
+	call monkey_string_concat
+	leave
+	ret
+.Lmonkey_binary_string_operator:
+	mov rsi, [rbp+24]
+	mov rdx, [rbp+16]
+	call monkey_operator_error
+.Lmonkey_binary_unsupported:
+	lea rdi, .Lmonkey_msg_binary[rip]
+	mov rsi, [rbp+24]
+	mov rdx, [rbp+16]
+	call monkey_panic
+
+# monkey_operator_error: rdi = opcode, rsi = left, rdx = right. reports the operator
+# with the message of the evaluator, which names the operator and the types.
+monkey_operator_error:
+	lea rax, monkey_operator_names[rip]
+	mov rcx, rdx
+	mov rdx, [rax+rdi*8]
+	mov rdi, rsi
+	call monkey_type
+	mov r8, rax
+	mov rdi, rcx
+	call monkey_type
+	lea rdi, .Lmonkey_msg_operator[rip]
+	lea r9, .Lmonkey_msg_type_mismatch[rip]
+	cmp rax, r8
+	cmovne rdi, r9
+	call monkey_panic
+
+# monkey_is_number: rdi = type. ZF is clear for INTEGER and FLOAT.
+monkey_is_number:
+	cmp rdi, {T_INTEGER}
+	je .Lmonkey_is_number_yes
+	cmp rdi, {T_FLOAT}
+	je .Lmonkey_is_number_yes
+	xor eax, eax
+	test eax, eax
+	ret
+.Lmonkey_is_number_yes:
+	mov eax, 1
+	test eax, eax
+	ret
+
+# monkey_float_value: rdi = integer or float. returns it in xmm0, breaking only rax.
+monkey_float_value:
+	test dil, 1
+	jz .Lmonkey_float_value_float
+	mov rax, rdi
+	sar rax, 1
+	cvtsi2sd xmm0, rax
+	ret
+.Lmonkey_float_value_float:
+	movq xmm0, [rdi]
+	ret
+
+# monkey_box_float: xmm0 = float. returns a new float.
+monkey_box_float:
+	movq rax, xmm0
+	push rax
+	mov edi, 8
+	mov rsi, {FLOAT_HEADER}
+	call monkey_alloc
+	pop rdx
+	mov [rax], rdx
+	ret
+
+monkey_negate:
+	push rbp
+	mov rbp, rsp
+	mov rdi, [rbp+16]
+	test dil, 1
+	jz .Lmonkey_negate_other
+	mov rax, rdi
+	sar rax, 1
+	neg rax
+	lea rax, [rax*2+1]
+	leave
+	ret
+.Lmonkey_negate_other:
+	call monkey_type
+	cmp eax, {T_FLOAT}
+	jne .Lmonkey_negate_error
+	mov rax, [rdi]
+	btc rax, 63
+	movq xmm0, rax
+	call monkey_box_float
+	leave
+	ret
+.Lmonkey_negate_error:
+	mov rsi, rdi
+	lea rdi, .Lmonkey_msg_negation[rip]
+	call monkey_panic
+
+monkey_index:
+	push rbp
+	mov rbp, rsp
+	mov rdi, [rbp+24]
+	call monkey_type
+	cmp eax, {T_ARRAY}
+	je .Lmonkey_index_array
+	cmp eax, {T_STRING}
+	je .Lmonkey_index_string
+	cmp eax, {T_HASH}
+	je .Lmonkey_index_hash
+.Lmonkey_index_error:
+	lea rdi, .Lmonkey_msg_index[rip]
+	mov rsi, [rbp+24]
+	call monkey_panic
+.Lmonkey_index_array:
+	mov rcx, [rbp+16]
+	test cl, 1
+	jz .Lmonkey_index_error
+	sar rcx, 1
+	mov rdx, [rbp+24]
+	# 符号なしで比べると負のindexも範囲外になる
+	cmp rcx, [rdx]
+	jae .Lmonkey_index_null
+	mov rax, [rdx+rcx*8+8]
+	leave
+	ret
+.Lmonkey_index_null:
+	mov eax, {NULL}
+	leave
+	ret
+.Lmonkey_index_string:
+	mov rsi, [rbp+16]
+	test sil, 1
+	jz .Lmonkey_index_error
+	sar rsi, 1
+	js .Lmonkey_index_null
+	push rsi
+	mov rdi, [rbp+24]
+	call monkey_rune_offset
+	mov rdi, [rbp+24]
+	cmp byte ptr [rdi+rax], 0
+	je .Lmonkey_index_null
+	push rax
+	mov rsi, [rbp-8]
+	add rsi, 1
+	call monkey_rune_offset
+	mov rdx, rax
+	mov rsi, [rbp-16]
+	mov rdi, [rbp+24]
+	call monkey_substring
+	leave
+	ret
+.Lmonkey_index_hash:
+	mov rdi, [rbp+16]
+	call monkey_check_key
+	mov rdi, [rbp+24]
+	mov rsi, [rbp+16]
+	call monkey_hash_get
+	leave
+	ret
+
+# monkey_check_key: rdi = key. integers, floats, strings and booleans are hashable.
+monkey_check_key:
+	call monkey_type
+	cmp eax, {T_INTEGER}
+	je .Lmonkey_check_key_ok
+	cmp eax, {T_FLOAT}
+	je .Lmonkey_check_key_ok
+	cmp eax, {T_STRING}
+	je .Lmonkey_check_key_ok
+	cmp eax, {T_BOOLEAN}
+	je .Lmonkey_check_key_ok
+	mov rsi, rdi
+	lea rdi, .Lmonkey_msg_hash_key[rip]
+	call monkey_panic
+.Lmonkey_check_key_ok:
+	ret
+
+monkey_hash_check:
+	push rbx
+	push r12
+	mov rbx, rdi
+	xor r12d, r12d
+.Lmonkey_hash_check_loop:
+	cmp r12, [rbx]
+	jae .Lmonkey_hash_check_end
+	mov rax, r12
+	shl rax, 4
+	mov rdi, [rbx+rax+8]
+	call monkey_check_key
+	add r12, 1
+	jmp .Lmonkey_hash_check_loop
+.Lmonkey_hash_check_end:
+	pop r12
+	pop rbx
+	ret
+
+# monkey_hash_get: rdi = hash, rsi = key. returns the value or null.
+# 同じkeyは後のpairが勝つので、最後のpairから順に見る
+monkey_hash_get:
+	push rbx
+	push r12
+	push r13
+	mov rbx, rdi
+	mov r12, rsi
+	mov r13, [rbx]
+.Lmonkey_hash_get_loop:
+	test r13, r13
+	jz .Lmonkey_hash_get_null
+	sub r13, 1
+	mov rax, r13
+	shl rax, 4
+	mov rdi, [rbx+rax+8]
+	mov rsi, r12
+	call monkey_key_equal
+	test eax, eax
+	jz .Lmonkey_hash_get_loop
+	mov rax, r13
+	shl rax, 4
+	mov rax, [rbx+rax+16]
+	jmp .Lmonkey_hash_get_end
+.Lmonkey_hash_get_null:
+	mov eax, {NULL}
+.Lmonkey_hash_get_end:
+	pop r13
+	pop r12
+	pop rbx
+	ret
+
+# monkey_key_equal: rdi, rsi = hashable values. returns 1 in eax if they are the same key:
+# strings by their bytes and numbers by value, so that {1: x}[1.0] finds x as in the vm.
+monkey_key_equal:
+	cmp rdi, rsi
+	je .Lmonkey_key_equal_true
+	call monkey_type
+	mov r8, rax
+	xchg rdi, rsi
+	call monkey_type
+	mov r9, rax
+	cmp r8, {T_STRING}
+	jne .Lmonkey_key_equal_numbers
+	cmp r9, {T_STRING}
+	jne .Lmonkey_key_equal_false
+	xor ecx, ecx
+.Lmonkey_key_equal_bytes:
+	mov al, [rdi+rcx]
+	cmp al, [rsi+rcx]
+	jne .Lmonkey_key_equal_false
+	test al, al
+	jz .Lmonkey_key_equal_true
+	add rcx, 1
+	jmp .Lmonkey_key_equal_bytes
+.Lmonkey_key_equal_numbers:
+	# different integers or booleans are different keys
+	cmp r8, {T_FLOAT}
+	je .Lmonkey_key_equal_float
+	cmp r9, {T_FLOAT}
+	jne .Lmonkey_key_equal_false
+.Lmonkey_key_equal_float:
+	push rdi
+	mov rdi, r8
+	call monkey_is_number
+	pop rdi
+	jz .Lmonkey_key_equal_false
+	push rdi
+	mov rdi, r9
+	call monkey_is_number
+	pop rdi
+	jz .Lmonkey_key_equal_false
+	call monkey_float_value
+	movapd xmm1, xmm0
+	mov rdi, rsi
+	call monkey_float_value
+	ucomisd xmm0, xmm1
+	jne .Lmonkey_key_equal_false
+	jp .Lmonkey_key_equal_false
+.Lmonkey_key_equal_true:
+	mov eax, 1
+	ret
+.Lmonkey_key_equal_false:
+	xor eax, eax
+	ret
+
+monkey_slice:
+	push rbp
+	mov rbp, rsp
+	mov rdi, [rbp+32]
+	call monkey_type
+	cmp eax, {T_ARRAY}
+	je .Lmonkey_slice_array
+	cmp eax, {T_STRING}
+	je .Lmonkey_slice_string
+	lea rdi, .Lmonkey_msg_slice[rip]
+	mov rsi, [rbp+32]
+	call monkey_panic
+.Lmonkey_slice_array:
+	mov rax, [rdi]
+	jmp .Lmonkey_slice_bounds
+.Lmonkey_slice_string:
+	call monkey_rune_count
+.Lmonkey_slice_bounds:
+	# length at rbp-8, low at rbp-16, high at rbp-24
+	push rax
+	mov rdi, [rbp+24]
+	xor esi, esi
+	mov rdx, rax
+	call monkey_slice_bound
+	push rax
+	mov rdi, [rbp+16]
+	mov rsi, [rbp-8]
+	mov rdx, [rbp-8]
+	call monkey_slice_bound
+	cmp rax, [rbp-16]
+	jge .Lmonkey_slice_high
+	mov rax, [rbp-16]
+.Lmonkey_slice_high:
+	push rax
+	mov rdi, [rbp+32]
+	call monkey_type
+	cmp eax, {T_STRING}
+	je .Lmonkey_slice_substring
+	mov rdi, [rbp-24]
+	sub rdi, [rbp-16]
+	lea rdi, [rdi*8+8]
+	mov rsi, {ARRAY_HEADER}
+	call monkey_alloc
+	mov rcx, [rbp-24]
+	sub rcx, [rbp-16]
+	mov [rax], rcx
+	mov rsi, [rbp+32]
+	mov rdx, [rbp-16]
+	lea rsi, [rsi+rdx*8+8]
+	lea rdi, [rax+8]
+	rep movsq
+	leave
+	ret
+.Lmonkey_slice_substring:
+	mov rdi, [rbp+32]
+	mov rsi, [rbp-16]
+	call monkey_rune_offset
+	push rax
+	mov rdi, [rbp+32]
+	mov rsi, [rbp-24]
+	call monkey_rune_offset
+	mov rdx, rax
+	mov rsi, [rbp-32]
+	mov rdi, [rbp+32]
+	call monkey_substring
+	leave
+	ret
+
+# monkey_slice_bound: rdi = bound, rsi = the bound when omitted, rdx = length. as object.Slice
+monkey_slice_bound:
+	cmp rdi, {NULL}
+	jne .Lmonkey_slice_bound_value
+	mov rax, rsi
+	ret
+.Lmonkey_slice_bound_value:
+	test dil, 1
+	jz .Lmonkey_slice_bound_error
+	mov rax, rdi
+	sar rax, 1
+	js .Lmonkey_slice_bound_zero
+	cmp rax, rdx
+	jle .Lmonkey_slice_bound_end
+	mov rax, rdx
+.Lmonkey_slice_bound_end:
+	ret
+.Lmonkey_slice_bound_zero:
+	xor eax, eax
+	ret
+.Lmonkey_slice_bound_error:
+	mov rsi, rdi
+	lea rdi, .Lmonkey_msg_slice_index[rip]
+	call monkey_panic
+
+monkey_call:
+	test al, 7
+	jnz .Lmonkey_call_error
+	mov rdx, [rax-8]
+	shr rdx, 56
+	cmp edx, {T_BUILTIN}
+	je .Lmonkey_call_jump
+	cmp edx, {T_CLOSURE}
+	jne .Lmonkey_call_error
+	cmp rcx, [rax+8]
+	jne .Lmonkey_call_arguments
+.Lmonkey_call_jump:
+	jmp qword ptr [rax]
+.Lmonkey_call_error:
+	lea rdi, .Lmonkey_msg_call[rip]
+	call monkey_panic
+.Lmonkey_call_arguments:
+	lea rdi, .Lmonkey_msg_arguments[rip]
+	mov rsi, [rax+8]
+	mov rdx, rcx
+	call monkey_panic
+`
+
+// runtimeStrings are the operations on the bytes of strings.
+// Strings are NUL-terminated, and counted in characters (runes) like object.String.
+const runtimeStrings = `.text
+# monkey_strlen: rdi = string. returns the number of bytes in rax.
+monkey_strlen:
+	xor eax, eax
+.Lmonkey_strlen_loop:
+	cmp byte ptr [rdi+rax], 0
+	je .Lmonkey_strlen_end
+	add rax, 1
+	jmp .Lmonkey_strlen_loop
+.Lmonkey_strlen_end:
+	ret
+
+# monkey_rune_offset: rdi = string, rsi = index of a character.
+# returns the byte offset of the character in rax, or the length of the string if it is out of range.
+monkey_rune_offset:
+	xor eax, eax
+.Lmonkey_rune_loop:
+	movzx ecx, byte ptr [rdi+rax]
+	test ecx, ecx
+	jz .Lmonkey_rune_end
+	# UTF-8の継続バイト(10xxxxxx)は文字の先頭ではない
+	and ecx, 0xc0
+	cmp ecx, 0x80
+	je .Lmonkey_rune_next
+	test rsi, rsi
+	jz .Lmonkey_rune_end
+	sub rsi, 1
+.Lmonkey_rune_next:
+	add rax, 1
+	jmp .Lmonkey_rune_loop
+.Lmonkey_rune_end:
+	ret
+
+# monkey_rune_count: rdi = string. returns the number of characters in rax.
+monkey_rune_count:
+	mov rsi, -1
+	call monkey_rune_offset
+	xor eax, eax
+	xor edx, edx
+.Lmonkey_rune_count_loop:
+	movzx ecx, byte ptr [rdi+rdx]
+	test ecx, ecx
+	jz .Lmonkey_rune_count_end
+	and ecx, 0xc0
+	cmp ecx, 0x80
+	je .Lmonkey_rune_count_next
+	add rax, 1
+.Lmonkey_rune_count_next:
+	add rdx, 1
+	jmp .Lmonkey_rune_count_loop
+.Lmonkey_rune_count_end:
+	ret
+
+# monkey_substring: rdi = string, rsi, rdx = byte offsets. returns a new string of the bytes rsi to rdx.
+monkey_substring:
+	push rbp
+	mov rbp, rsp
+	push rdi
+	push rsi
+	push rdx
+	mov rdi, rdx
+	sub rdi, rsi
+	add rdi, 1
+	mov rsi, {STRING_HEADER}
+	call monkey_alloc
+	mov rdi, rax
+	mov rsi, [rbp-8]
+	add rsi, [rbp-16]
+	mov rcx, [rbp-24]
+	sub rcx, [rbp-16]
+	rep movsb
+	leave
+	ret
+
+# monkey_string_concat(left, right)
+monkey_string_concat:
+	push rbp
+	mov rbp, rsp
+	mov rdi, [rbp+24]
+	call monkey_strlen
+	push rax
+	mov rdi, [rbp+16]
+	call monkey_strlen
+	push rax
+	mov rdi, [rbp-8]
+	add rdi, [rbp-16]
+	add rdi, 1
+	mov rsi, {STRING_HEADER}
+	call monkey_alloc
+	mov rdi, rax
+	mov rsi, [rbp+24]
+	mov rcx, [rbp-8]
+	rep movsb
+	mov rsi, [rbp+16]
+	mov rcx, [rbp-16]
+	rep movsb
+	leave
+	ret
+`
+
+// runtimeBuiltins are the builtins with an Assembly in object.Builtins.
+// A builtin is called like a function with rcx = number of arguments. Its errors are
+// runtime errors, as in the evaluator: generated code has no error values.
+const runtimeBuiltins = `.section .rodata
+.Lmonkey_msg_builtin_arguments:
+	.string "wrong number of arguments. got=%d, want=1"
+.Lmonkey_msg_builtin_arguments2:
+	.string "wrong number of arguments. got=%d, want=2"
+.Lmonkey_msg_len:
+	.string "argument to ` + "`len`" + ` not supported, got %T"
+.Lmonkey_msg_first:
+	.string "argument to ` + "`first`" + ` must be ARRAY, got %T"
+.Lmonkey_msg_last:
+	.string "argument to ` + "`last`" + ` must be ARRAY, got %T"
+.Lmonkey_msg_rest:
+	.string "argument to ` + "`rest`" + ` must be ARRAY, got %T"
+.Lmonkey_msg_push:
+	.string "argument to ` + "`push`" + ` must be ARRAY, got %T"
+.text
+monkey_len:
+	push rbp
+	mov rbp, rsp
+	cmp rcx, 1
+	jne .Lmonkey_builtin_arguments
+	mov rdi, [rbp+16]
+	call monkey_type
+	cmp eax, {T_ARRAY}
+	je .Lmonkey_len_array
+	cmp eax, {T_STRING}
+	je .Lmonkey_len_string
+	mov rsi, rdi
+	lea rdi, .Lmonkey_msg_len[rip]
+	call monkey_panic
+.Lmonkey_len_array:
+	mov rax, [rdi]
+	jmp .Lmonkey_len_end
+.Lmonkey_len_string:
+	call monkey_rune_count
+.Lmonkey_len_end:
+	lea rax, [rax*2+1]
+	leave
+	ret
+.Lmonkey_builtin_arguments:
+	mov rsi, rcx
+	lea rdi, .Lmonkey_msg_builtin_arguments[rip]
+	call monkey_panic
+.Lmonkey_builtin_arguments2:
+	mov rsi, rcx
+	lea rdi, .Lmonkey_msg_builtin_arguments2[rip]
+	call monkey_panic
+
+# monkey_array_argument: rdi = value, rsi = message. panics with the message and the type
+# of the value unless it is an array.
+monkey_array_argument:
+	call monkey_type
+	cmp eax, {T_ARRAY}
+	jne .Lmonkey_array_argument_error
+	ret
+.Lmonkey_array_argument_error:
+	xchg rdi, rsi
+	call monkey_panic
+
+# first and last return null for an empty array
+monkey_first:
+	push rbp
+	mov rbp, rsp
+	cmp rcx, 1
+	jne .Lmonkey_builtin_arguments
+	mov rdi, [rbp+16]
+	lea rsi, .Lmonkey_msg_first[rip]
+	call monkey_array_argument
+	mov eax, {NULL}
+	cmp qword ptr [rdi], 0
+	je .Lmonkey_first_end
+	mov rax, [rdi+8]
+.Lmonkey_first_end:
+	leave
+	ret
+
+monkey_last:
+	push rbp
+	mov rbp, rsp
+	cmp rcx, 1
+	jne .Lmonkey_builtin_arguments
+	mov rdi, [rbp+16]
+	lea rsi, .Lmonkey_msg_last[rip]
+	call monkey_array_argument
+	mov eax, {NULL}
+	mov rcx, [rdi]
+	test rcx, rcx
+	jz .Lmonkey_last_end
+	mov rax, [rdi+rcx*8]
+.Lmonkey_last_end:
+	leave
+	ret
+
+# rest and push make new arrays. the argument stays on the stack of the caller while allocating,
+# so the collector keeps it
+monkey_rest:
+	push rbp
+	mov rbp, rsp
+	cmp rcx, 1
+	jne .Lmonkey_builtin_arguments
+	mov rdi, [rbp+16]
+	lea rsi, .Lmonkey_msg_rest[rip]
+	call monkey_array_argument
+	mov eax, {NULL}
+	mov rdi, [rdi]
+	test rdi, rdi
+	jz .Lmonkey_rest_end
+	# [size] and size-1 elements
+	shl rdi, 3
+	mov rsi, {ARRAY_HEADER}
+	call monkey_alloc
+	mov rsi, [rbp+16]
+	mov rcx, [rsi]
+	sub rcx, 1
+	mov [rax], rcx
+	lea rdi, [rax+8]
+	add rsi, 16
+	rep movsq
+.Lmonkey_rest_end:
+	leave
+	ret
+
+monkey_push:
+	push rbp
+	mov rbp, rsp
+	cmp rcx, 2
+	jne .Lmonkey_builtin_arguments2
+	mov rdi, [rbp+24]
+	lea rsi, .Lmonkey_msg_push[rip]
+	call monkey_array_argument
+	# [size] and size+1 elements
+	mov rdi, [rdi]
+	add rdi, 2
+	shl rdi, 3
+	mov rsi, {ARRAY_HEADER}
+	call monkey_alloc
+	mov rsi, [rbp+24]
+	mov rcx, [rsi]
+	lea rdx, [rcx+1]
+	mov [rax], rdx
+	lea rdi, [rax+8]
+	add rsi, 8
+	rep movsq
+	mov rdx, [rbp+16]
+	mov [rdi], rdx
+	leave
+	ret
+
+# puts writes each argument on a line, and returns null
+monkey_puts:
+	push rbp
+	mov rbp, rsp
+	push rbx
+	push r12
+	# the first argument is the farthest
+	lea rbx, [rbp+rcx*8+8]
+	lea r12, [rbp+16]
+.Lmonkey_puts_loop:
+	cmp rbx, r12
+	jb .Lmonkey_puts_end
+	mov edi, 1
+	mov rsi, [rbx]
+	call monkey_inspect
+	mov edi, 1
+	lea rsi, .Lmonkey_newline[rip]
+	call monkey_write_cstr
+	sub rbx, 8
+	jmp .Lmonkey_puts_loop
+.Lmonkey_puts_end:
+	mov eax, {NULL}
+	pop r12
+	pop rbx
+	pop rbp
+	ret
+`
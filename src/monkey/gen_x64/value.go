@@ -0,0 +1,61 @@
+package gen_x64
+
+import "fmt"
+
+// Value Representation
+//
+// Every value of a generated program is one 64-bit word, so the runtime can tell
+// the types apart like the vm does:
+//
+//	xxxx...xxx1  integer: the value shifted left by 1 (63 bits)
+//	0x2          null
+//	0x4          false
+//	0x6          true
+//	xxxx...x000  pointer to an object: string, array, hash, float, closure or builtin
+//
+// An object has a header word before the word the pointer points to, with the type of
+// the object in the highest byte (see runtimeHeap). Literals in .rodata and .data have
+// the same header as objects on the heap.
+const (
+	valueNull  = 2
+	valueFalse = 4
+	valueTrue  = 6
+)
+
+// types of values, as the runtime returns them from monkey_type.
+// The types of objects are also in their headers.
+const (
+	typeInteger = iota
+	typeString
+	typeArray
+	typeHash
+	typeFloat
+	typeClosure
+	typeBuiltin
+	typeBoolean
+	typeNull
+	// a cell holds a local captured by closures and assigned (see object.Cell). It is never a value.
+	typeCell
+)
+
+// typeNames are the names of the types in the messages of runtime errors, as object.ObjectType.
+var typeNames = []string{"INTEGER", "STRING", "ARRAY", "HASH", "FLOAT", "CLOSURE", "BUILTIN", "BOOLEAN", "NULL", "CELL"}
+
+// header returns the header word of an object of typ.
+func header(typ int, flags int) uint64 {
+	return uint64(typ)<<56 | uint64(flags)
+}
+
+// integer limits of the 63 bits of a tagged integer
+const (
+	maxInteger = 1<<62 - 1
+	minInteger = -1 << 62
+)
+
+// tagInteger returns the word of the integer n.
+func tagInteger(n int64) (int64, error) {
+	if n > maxInteger || n < minInteger {
+		return 0, fmt.Errorf("x64: integer %d doesn't fit in 63 bits", n)
+	}
+	return n<<1 | 1, nil
+}
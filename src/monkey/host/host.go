@@ -0,0 +1,244 @@
+// Package host runs Monkey programs inside a Go program.
+//
+//	rt := host.New(host.VM)
+//	rt.Register("double", func(args ...object.Object) object.Object { ... })
+//	rt.RegisterFunc("upper", strings.ToUpper)
+//	rt.Set("name", "gopher")
+//	result, err := rt.Run(ctx, "script.mk", src)
+//
+// A Runtime keeps its global bindings between runs, like the repl, so a host can
+// run a library first and then the code using it. Builtins are per Runtime:
+// a registered function with the name of a standard builtin replaces it only there.
+// As with the standard builtins, an *object.Error returned by a registered function
+// stops the program in the evaluator, and is a value in the vm.
+// A script can import no file unless the host sets a Loader with SetLoader.
+// A Runtime is not safe for concurrent use.
+package host
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"monkey/compiler"
+	"monkey/evaluator"
+	"monkey/lexer"
+	"monkey/object"
+	"monkey/parser"
+	"monkey/token"
+	"monkey/vm"
+	"reflect"
+	"strings"
+)
+
+// Engine runs the programs of a Runtime.
+type Engine int
+
+const (
+	VM Engine = iota
+	Evaluator
+)
+
+func (e Engine) String() string {
+	switch e {
+	case VM:
+		return "vm"
+	case Evaluator:
+		return "eval"
+	default:
+		return fmt.Sprintf("Engine(%d)", int(e))
+	}
+}
+
+// OpGetBuiltinのoperandは1byte
+const maxBuiltins = 256
+
+// Runtime is an instance of Monkey with its own builtins and globals.
+type Runtime struct {
+	engine Engine
+	limits object.Limits
+	loader object.Loader
+
+	// vm: builtins by index, and the compiler state kept between runs
+	builtins     []*object.Builtin
+	builtinIndex map[string]int
+	symbolTable  *compiler.SymbolTable
+	constants    []object.Object
+	globals      []object.Object
+
+	// evaluator
+	env *object.Environment
+}
+
+// New makes a Runtime with the standard builtins.
+func New(engine Engine) *Runtime {
+	r := &Runtime{
+		engine:       engine,
+		builtinIndex: map[string]int{},
+		symbolTable:  compiler.NewSymbolTable(),
+		constants:    []object.Object{},
+		globals:      make([]object.Object, vm.GlobalsSize),
+		env:          object.NewEnvironment(),
+	}
+	r.SetLoader(nil)
+
+	for i, def := range object.Builtins {
+		r.builtins = append(r.builtins, def.Builtin)
+		r.builtinIndex[def.Name] = i
+		r.symbolTable.DefineBuiltin(i, def.Name)
+	}
+	return r
+}
+
+// Engine returns the engine of r.
+func (r *Runtime) Engine() Engine {
+	return r.engine
+}
+
+// SetLimits sets the limits of the following runs. The zero Limits is no limit
+// but the call depth of object.DefaultMaxDepth.
+func (r *Runtime) SetLimits(limits object.Limits) {
+	r.limits = limits
+}
+
+// SetLoader sets the Loader that reads the files imported by the following runs.
+// A nil loader, the default, allows no import: a script reads no file unless the host lets it,
+// for example with object.DirLoader.
+func (r *Runtime) SetLoader(loader object.Loader) {
+	if loader == nil {
+		loader = object.DenyImports
+	}
+	r.loader = loader
+	r.env.Modules().SetLoader(loader)
+}
+
+// Register makes fn callable as a builtin named name.
+func (r *Runtime) Register(name string, fn object.BuiltinFunction) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	builtin := &object.Builtin{Fn: fn}
+
+	if r.engine == Evaluator {
+		// evaluatorは環境の変数をbuiltinより先に探す
+		r.env.Set(name, builtin)
+		return nil
+	}
+
+	if i, ok := r.builtinIndex[name]; ok {
+		r.builtins[i] = builtin
+		return nil
+	}
+	if len(r.builtins) >= maxBuiltins {
+		return fmt.Errorf("host: too many builtins (limit %d)", maxBuiltins)
+	}
+
+	i := len(r.builtins)
+	r.builtins = append(r.builtins, builtin)
+	r.builtinIndex[name] = i
+	r.symbolTable.DefineBuiltin(i, name)
+	return nil
+}
+
+// RegisterFunc makes the Go function fn callable as a builtin named name.
+// The arguments and the result are converted as by object.ToObject.
+func (r *Runtime) RegisterFunc(name string, fn interface{}) error {
+	if reflect.TypeOf(fn) == nil || reflect.TypeOf(fn).Kind() != reflect.Func {
+		return fmt.Errorf("host: RegisterFunc needs a func, got %T", fn)
+	}
+	obj, err := object.ToObject(fn)
+	if err != nil {
+		return err
+	}
+	return r.Register(name, obj.(*object.Builtin).Fn)
+}
+
+// Set binds a global variable name to value, converted with object.ToObject
+// unless it is already an object.Object.
+func (r *Runtime) Set(name string, v interface{}) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	value, err := object.ToObject(v)
+	if err != nil {
+		return err
+	}
+
+	if r.engine == Evaluator {
+		r.env.Set(name, value)
+		return nil
+	}
+
+	symbol := r.symbolTable.Define(name)
+	if symbol.Index >= len(r.globals) {
+		return fmt.Errorf("host: too many global variables (limit %d)", len(r.globals))
+	}
+	r.globals[symbol.Index] = value
+	return nil
+}
+
+// Run runs src and returns the value of the program: the value of a return at the top level
+// or of the last expression statement.
+// Parse and compile errors are returned together as one error, a failure of the program as
+// *object.RuntimeError, and a stop by ctx or the limits as *object.LimitError.
+// A panic in the engine or in a registered function is recovered and returned as
+// *object.RuntimeError. A recursion deeper than the MaxDepth of the limits is the
+// *object.RuntimeError "stack overflow" in both engines before it can overflow the Go stack,
+// which no recover can catch. A program that never ends is stopped only by ctx or the limits.
+func (r *Runtime) Run(ctx context.Context, filename, src string) (result object.Object, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			result = nil
+			err = &object.RuntimeError{Message: fmt.Sprintf("panic: %v", p)}
+		}
+	}()
+
+	p := parser.New(lexer.NewWithFilename(filename, src))
+	program := p.ParseProgram()
+	if len(p.Errors()) != 0 {
+		return nil, errors.New(strings.Join(p.Errors(), "\n"))
+	}
+
+	if r.engine == Evaluator {
+		result, err := evaluator.EvalContext(ctx, program, r.env, r.limits)
+		if err != nil {
+			return nil, err
+		}
+		if rerr, ok := result.(*object.Error); ok {
+			return nil, rerr.RuntimeError()
+		}
+		if result == nil {
+			return evaluator.NULL, nil
+		}
+		return result, nil
+	}
+
+	comp := compiler.NewWithState(r.symbolTable, r.constants)
+	comp.SetLoader(r.loader)
+	err = comp.Compile(program)
+	if err != nil {
+		return nil, err
+	}
+	bytecode := comp.Bytecode()
+	r.constants = bytecode.Constants
+
+	machine := vm.NewWithOptions(bytecode, vm.Options{
+		Limits:   r.limits,
+		Builtins: r.builtins,
+		Globals:  r.globals,
+	})
+	err = machine.RunContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return machine.Result(), nil
+}
+
+// checkName reports an error unless name is an identifier.
+func checkName(name string) error {
+	l := lexer.New(name)
+	tok := l.NextToken()
+	if tok.Type != token.IDENT || tok.Literal != name || l.NextToken().Type != token.EOF {
+		return fmt.Errorf("host: %q is not an identifier", name)
+	}
+	return nil
+}
@@ -0,0 +1,348 @@
+package host
+
+import (
+	"context"
+	"errors"
+	"monkey/object"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var engines = []Engine{VM, Evaluator}
+
+func double(args ...object.Object) object.Object {
+	if len(args) != 1 {
+		return &object.Error{Message: "double takes 1 argument"}
+	}
+	n, ok := args[0].(*object.Integer)
+	if !ok {
+		return &object.Error{Message: "double takes an integer"}
+	}
+	return &object.Integer{Value: n.Value * 2}
+}
+
+func TestRun(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`double(21)`, int64(42)},
+		{`"hello " + name`, "hello gopher"},
+		{`let f = fn(x) { double(x) + 1 }; [f(1), f(2)]`, []interface{}{int64(3), int64(5)}},
+		{`if (len(name) > 3) { return true; } false`, true},
+		{`{"a": double(1)}`, map[interface{}]interface{}{"a": int64(2)}},
+		{`let x = 1;`, nil},
+	}
+
+	for _, engine := range engines {
+		for _, tt := range tests {
+			rt := New(engine)
+			if err := rt.Register("double", double); err != nil {
+				t.Fatalf("Register: %s", err)
+			}
+			if err := rt.Set("name", &object.String{Value: "gopher"}); err != nil {
+				t.Fatalf("Set: %s", err)
+			}
+
+			result, err := rt.Run(context.Background(), "test.mk", tt.input)
+			if err != nil {
+				t.Fatalf("%s: run error for %q: %s", engine, tt.input, err)
+			}
+			if got := Value(result); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("%s: wrong result for %q. want=%#v, got=%#v", engine, tt.input, tt.expected, got)
+			}
+		}
+	}
+}
+
+func TestRunKeepsGlobals(t *testing.T) {
+	for _, engine := range engines {
+		rt := New(engine)
+
+		_, err := rt.Run(context.Background(), "lib.mk", `let add = fn(a, b) { a + b }; let base = 10;`)
+		if err != nil {
+			t.Fatalf("%s: run error: %s", engine, err)
+		}
+		rt.Set("x", &object.Integer{Value: 5})
+
+		result, err := rt.Run(context.Background(), "main.mk", `add(base, x)`)
+		if err != nil {
+			t.Fatalf("%s: run error: %s", engine, err)
+		}
+		if got := Value(result); got != int64(15) {
+			t.Errorf("%s: wrong result. want=15, got=%#v", engine, got)
+		}
+	}
+}
+
+func TestRegisterReplacesBuiltin(t *testing.T) {
+	for _, engine := range engines {
+		var printed []string
+		rt := New(engine)
+		rt.Register("puts", func(args ...object.Object) object.Object {
+			for _, arg := range args {
+				printed = append(printed, arg.Inspect())
+			}
+			return nil
+		})
+
+		_, err := rt.Run(context.Background(), "test.mk", `puts("a", 1); puts(len("bc"))`)
+		if err != nil {
+			t.Fatalf("%s: run error: %s", engine, err)
+		}
+		expected := []string{"a", "1", "2"}
+		if !reflect.DeepEqual(printed, expected) {
+			t.Errorf("%s: wrong output. want=%q, got=%q", engine, expected, printed)
+		}
+
+		// 他のRuntimeのputsは変わらない
+		if New(engine).builtins[1] == rt.builtins[1] && engine == VM {
+			t.Errorf("builtins are shared between runtimes")
+		}
+	}
+}
+
+func TestRunErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		limits   object.Limits
+		expected string
+	}{
+		{`let x = ;`, object.Limits{}, "test.mk:1:9: no prefix parse function for ; found"},
+		{`while (true) { }`, object.Limits{MaxSteps: 1000}, "execution stopped: step limit exceeded"},
+	}
+
+	for _, engine := range engines {
+		for _, tt := range tests {
+			rt := New(engine)
+			rt.Register("double", double)
+			rt.SetLimits(tt.limits)
+
+			_, err := rt.Run(context.Background(), "test.mk", tt.input)
+			if err == nil {
+				t.Fatalf("%s: expected error for %q", engine, tt.input)
+			}
+			if err.Error() != tt.expected {
+				t.Errorf("%s: wrong error for %q. want=%q, got=%q", engine, tt.input, tt.expected, err)
+			}
+		}
+	}
+
+	// evaluatorではbuiltinが返したエラーは実行時エラーになり、vmでは値になる
+	rt := New(Evaluator)
+	rt.Register("double", double)
+	_, err := rt.Run(context.Background(), "test.mk", `double("a")`)
+	if err == nil || err.Error() != "test.mk:1:1: double takes an integer" {
+		t.Errorf("wrong runtime error: %v", err)
+	}
+
+	rt = New(VM)
+	rt.Register("double", double)
+	result, err := rt.Run(context.Background(), "test.mk", `double("a")`)
+	if err != nil || result.Inspect() != "ERROR: double takes an integer" {
+		t.Errorf("wrong result: %v, %v", result, err)
+	}
+
+	rt = New(VM)
+	_, err = rt.Run(context.Background(), "test.mk", `undefined + 1`)
+	if err == nil || err.Error() != "test.mk:1:1: undefined variable undefined" {
+		t.Errorf("wrong compile error: %v", err)
+	}
+
+	rt = New(VM)
+	_, err = rt.Run(context.Background(), "test.mk", `let f = fn() { f() + 1 }; f()`)
+	var rerr *object.RuntimeError
+	if !errors.As(err, &rerr) {
+		t.Errorf("expected *object.RuntimeError, got=%T (%v)", err, err)
+	}
+}
+
+// TestAllocationLimit runs programs through both engines with the same MaxAllocations.
+// Each program makes exactly allocations objects, so it runs with that limit and stops with one less.
+func TestAllocationLimit(t *testing.T) {
+	tests := []struct {
+		input       string
+		allocations int64
+	}{
+		// literal, boolean, nullは数えない
+		{`1; 2.5; "a"; true; !false; 1 < 2; 1.5 == 2; if (false) { 1 }`, 0},
+		{`let i = 0; while (i < 3) { i += 1; }; i`, 3},
+		{`let f = fn(x) { x * 2 }; f(-1)`, 3},
+		{`let a = [1, 2, 3]; let h = {"k": a[0]}; a[1:]`, 4 + 2 + 3},
+		{`"abcd" + "efgh" + "i"`, 2 + 2},
+		{`len([1]); first([])`, 2 + 1 + 1},
+	}
+
+	for _, engine := range engines {
+		for _, tt := range tests {
+			rt := New(engine)
+			rt.SetLimits(object.Limits{MaxAllocations: tt.allocations})
+			_, err := rt.Run(context.Background(), "test.mk", tt.input)
+			if err != nil {
+				t.Errorf("%s: error for %q with %d allocations: %s", engine, tt.input, tt.allocations, err)
+			}
+			if tt.allocations == 0 {
+				continue
+			}
+
+			rt = New(engine)
+			rt.SetLimits(object.Limits{MaxAllocations: tt.allocations - 1})
+			_, err = rt.Run(context.Background(), "test.mk", tt.input)
+			if !errors.Is(err, object.ErrAllocationLimit) {
+				t.Errorf("%s: expected allocation limit for %q with %d allocations, got=%v",
+					engine, tt.input, tt.allocations-1, err)
+			}
+		}
+	}
+}
+
+func TestRunRecoversPanics(t *testing.T) {
+	for _, engine := range engines {
+		rt := New(engine)
+		rt.Register("boom", func(args ...object.Object) object.Object {
+			panic("boom")
+		})
+		rt.RegisterFunc("index", func(s []int, i int) int { return s[i] })
+
+		tests := []struct {
+			input    string
+			expected string
+		}{
+			{`boom()`, "panic: boom"},
+			{`index([1, 2], 5)`, "panic: runtime error: index out of range [5] with length 2"},
+		}
+		for _, tt := range tests {
+			result, err := rt.Run(context.Background(), "test.mk", tt.input)
+			var rerr *object.RuntimeError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("%s: expected *object.RuntimeError for %q, got=%T (%v)", engine, tt.input, err, err)
+			}
+			if rerr.Message != tt.expected || result != nil {
+				t.Errorf("%s: wrong result for %q. want=%q, got=%q (%v)", engine, tt.input, tt.expected, rerr.Message, result)
+			}
+		}
+
+		// panicの後もRuntimeは使える
+		result, err := rt.Run(context.Background(), "test.mk", `index([1, 2], 1)`)
+		if err != nil || result.Inspect() != "2" {
+			t.Errorf("%s: wrong result after a panic: %v, %v", engine, result, err)
+		}
+	}
+}
+
+func TestImportLoader(t *testing.T) {
+	input := `(import "../testdata/import/math.mk")["quad"](3)`
+	for _, engine := range engines {
+		// importはhostが許すまでできない
+		rt := New(engine)
+		_, err := rt.Run(context.Background(), "test.mk", input)
+		if err == nil || !strings.HasSuffix(err.Error(), "import ../testdata/import/math.mk: import not allowed") {
+			t.Errorf("%s: wrong error of a denied import: %v", engine, err)
+		}
+
+		rt.SetLoader(object.DirLoader("../testdata/import"))
+		result, err := rt.Run(context.Background(), "test.mk", input)
+		if err != nil || result.Inspect() != "12" {
+			t.Errorf("%s: wrong result of an allowed import: %v, %v", engine, result, err)
+		}
+
+		_, err = rt.Run(context.Background(), "test.mk", `import "../host/host.go"`)
+		if err == nil || !strings.HasSuffix(err.Error(), "import ../host/host.go: import not allowed") {
+			t.Errorf("%s: wrong error of an import outside the root: %v", engine, err)
+		}
+	}
+}
+
+// TestRunStackOverflow runs an unbounded recursion, which would overflow the Go stack
+// of the evaluator without the call depth limit.
+func TestRunStackOverflow(t *testing.T) {
+	tests := []struct {
+		limits   object.Limits
+		expected string
+	}{
+		{object.Limits{}, "stack overflow"},
+		{object.Limits{MaxDepth: 10}, "stack overflow (call depth 9)"},
+	}
+
+	for _, engine := range engines {
+		for _, tt := range tests {
+			rt := New(engine)
+			rt.SetLimits(tt.limits)
+			// vmでは末尾呼び出しはframeを増やさないので、末尾でない再帰にする
+			result, err := rt.Run(context.Background(), "test.mk", `let f = fn(n) { f(n + 1) + 1 }; f(0)`)
+			var rerr *object.RuntimeError
+			if !errors.As(err, &rerr) {
+				t.Fatalf("%s: expected *object.RuntimeError, got=%T (%v), result=%v", engine, err, err, result)
+			}
+			if !strings.HasPrefix(rerr.Message, tt.expected) {
+				t.Errorf("%s: wrong error with %+v. want=%q, got=%q", engine, tt.limits, tt.expected, rerr.Message)
+			}
+		}
+	}
+}
+
+func TestCheckName(t *testing.T) {
+	rt := New(VM)
+	for _, name := range []string{"", "1a", "a b", "fn", "let", "a-b"} {
+		if err := rt.Register(name, double); err == nil {
+			t.Errorf("expected error for name %q", name)
+		}
+		if err := rt.Set(name, &object.Integer{Value: 1}); err == nil {
+			t.Errorf("expected error for name %q", name)
+		}
+	}
+	if err := rt.Register("_ok", double); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestGoValues(t *testing.T) {
+	type user struct {
+		Name string `monkey:"name"`
+		Age  int    `monkey:"age"`
+	}
+
+	tests := []struct {
+		input    string
+		expected interface{}
+	}{
+		{`greet(user["name"])`, "hello, gopher"},
+		{`user["age"] + sum(1, 2, 3)`, int64(16)},
+		{`if (nothing) { 1 } else { 2 }`, int64(2)},
+		{`tags[1]`, "b"},
+	}
+
+	for _, engine := range engines {
+		for _, tt := range tests {
+			rt := New(engine)
+			rt.RegisterFunc("greet", func(name string) string { return "hello, " + name })
+			rt.RegisterFunc("sum", func(ns ...int) int {
+				total := 0
+				for _, n := range ns {
+					total += n
+				}
+				return total
+			})
+			rt.Set("user", user{Name: "gopher", Age: 10})
+			rt.Set("nothing", nil)
+			rt.Set("tags", []string{"a", "b"})
+
+			result, err := rt.Run(context.Background(), "test.mk", tt.input)
+			if err != nil {
+				t.Fatalf("%s: run error for %q: %s", engine, tt.input, err)
+			}
+			if got := Value(result); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("%s: wrong result for %q. want=%#v, got=%#v", engine, tt.input, tt.expected, got)
+			}
+		}
+	}
+
+	rt := New(VM)
+	if err := rt.RegisterFunc("f", 1); err == nil || err.Error() != "host: RegisterFunc needs a func, got int" {
+		t.Errorf("wrong error for RegisterFunc with int: %v", err)
+	}
+	if err := rt.Set("c", make(chan int)); err == nil || err.Error() != "object: cannot convert chan int to a Monkey value" {
+		t.Errorf("wrong error for Set with chan: %v", err)
+	}
+}
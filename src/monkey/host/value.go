@@ -0,0 +1,14 @@
+package host
+
+import "monkey/object"
+
+// Value returns obj as a Go value:
+// int64, float64, string, bool, nil for null, []interface{} for arrays and
+// map[interface{}]interface{} for hashes. Functions are returned as they are.
+// Use object.FromObject to get a value of a given type.
+func Value(obj object.Object) interface{} {
+	var v interface{}
+	// interface{}への変換は失敗しない
+	object.FromObject(obj, &v)
+	return v
+}
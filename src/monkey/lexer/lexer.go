@@ -1,21 +1,69 @@
 package lexer
 
-import "monkey/token"
+import (
+	"fmt"
+	"monkey/token"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
 
 type Lexer struct {
 	input        string
 	position     int
 	readPosition int
 	ch           byte
+
+	// source position of ch
+	filename string
+	line     int
+	column   int
+
+	// attach comments to tokens as token.Token.Comments
+	keepComments bool
+
+	// why ILLEGAL tokens were made, as "pos: message"
+	errors []string
 }
 
 func New(input string) *Lexer {
-	l := &Lexer{input: input}
+	return NewWithFilename("", input)
+}
+
+// NewWithFilename makes a Lexer whose token positions carry filename.
+func NewWithFilename(filename, input string) *Lexer {
+	l := &Lexer{input: input, filename: filename, line: 1}
 	l.readChar()
 	return l
 }
 
+// Errors returns the errors found so far. Each of them made an ILLEGAL token.
+func (l *Lexer) Errors() []string {
+	return l.errors
+}
+
+func (l *Lexer) error(pos token.Position, format string, a ...interface{}) {
+	l.errors = append(l.errors, fmt.Sprintf("%s: %s", pos, fmt.Sprintf(format, a...)))
+}
+
+// SetKeepComments makes NextToken keep the comments before each token in Token.Comments.
+// Comments are skipped by default.
+func (l *Lexer) SetKeepComments(keep bool) {
+	l.keepComments = keep
+}
+
 func (l *Lexer) readChar() {
+	// EOFより先には進まない
+	if l.readPosition > len(l.input) {
+		return
+	}
+
+	// 改行を読み終えたら次の行へ
+	if l.ch == '\n' {
+		l.line++
+		l.column = 0
+	}
+
 	if l.readPosition >= len(l.input) {
 		l.ch = 0
 	} else {
@@ -23,12 +71,76 @@ func (l *Lexer) readChar() {
 	}
 	l.position = l.readPosition
 	l.readPosition += 1
+	l.column++
+}
+
+// pos returns the source position of the current character.
+func (l *Lexer) pos() token.Position {
+	return token.Position{Filename: l.filename, Line: l.line, Column: l.column}
 }
 
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
+	var comments []token.Comment
+	for {
+		l.skipWhitespace()
+		if l.ch != '/' || (l.peekChar() != '/' && l.peekChar() != '*') {
+			break
+		}
 
-	l.skipWhitespace()
+		c, ok := l.readComment()
+		if !ok {
+			// 閉じていない /* はILLEGALにする
+			l.error(c.Pos, "comment not terminated")
+			return token.Token{Type: token.ILLEGAL, Literal: c.Text, Pos: c.Pos, End: c.End}
+		}
+		comments = append(comments, c)
+	}
+
+	start := l.pos()
+	tok := l.nextToken()
+	tok.Pos = start
+	tok.End = l.pos()
+	if l.keepComments {
+		tok.Comments = comments
+	}
+
+	return tok
+}
+
+// readComment reads a // comment to the end of the line, or a /* */ comment.
+//  Block comments don't nest. It reports false when a /* comment is not closed.
+func (l *Lexer) readComment() (token.Comment, bool) {
+	c := token.Comment{Pos: l.pos()}
+	position := l.position
+	closed := true
+
+	if l.peekChar() == '/' {
+		for l.ch != '\n' && l.ch != 0 {
+			l.readChar()
+		}
+	} else {
+		l.readChar() // /
+		l.readChar() // *
+		for !(l.ch == '*' && l.peekChar() == '/') {
+			if l.ch == 0 {
+				closed = false
+				break
+			}
+			l.readChar()
+		}
+		if closed {
+			l.readChar() // *
+			l.readChar() // /
+		}
+	}
+
+	c.Text = strings.TrimRight(l.input[position:l.position], "\r")
+	c.End = l.pos()
+	return c, closed
+}
+
+func (l *Lexer) nextToken() token.Token {
+	var tok token.Token
 
 	switch l.ch {
 	case '=':
@@ -54,17 +166,58 @@ func (l *Lexer) NextToken() token.Token {
 			tok = newToken(token.BANG, l.ch)
 		}
 	case '+':
-		tok = newToken(token.PLUS, l.ch)
+		if l.peekChar() == '=' {
+			tok = l.newTwoCharToken(token.PLUS_ASSIGN)
+		} else {
+			tok = newToken(token.PLUS, l.ch)
+		}
 	case '-':
-		tok = newToken(token.MINUS, l.ch)
+		if l.peekChar() == '=' {
+			tok = l.newTwoCharToken(token.MINUS_ASSIGN)
+		} else {
+			tok = newToken(token.MINUS, l.ch)
+		}
 	case '/':
-		tok = newToken(token.SLASH, l.ch)
+		if l.peekChar() == '=' {
+			tok = l.newTwoCharToken(token.SLASH_ASSIGN)
+		} else {
+			tok = newToken(token.SLASH, l.ch)
+		}
 	case '*':
-		tok = newToken(token.ASTERISK, l.ch)
+		if l.peekChar() == '=' {
+			tok = l.newTwoCharToken(token.ASTERISK_ASSIGN)
+		} else {
+			tok = newToken(token.ASTERISK, l.ch)
+		}
+	case '%':
+		tok = newToken(token.PERCENT, l.ch)
 	case '<':
-		tok = newToken(token.LT, l.ch)
+		if l.peekChar() == '=' {
+			tok = l.newTwoCharToken(token.LT_EQ)
+		} else {
+			tok = newToken(token.LT, l.ch)
+		}
 	case '>':
-		tok = newToken(token.GT, l.ch)
+		if l.peekChar() == '=' {
+			tok = l.newTwoCharToken(token.GT_EQ)
+		} else {
+			tok = newToken(token.GT, l.ch)
+		}
+	case '&':
+		// &だけの演算子はない
+		if l.peekChar() == '&' {
+			tok = l.newTwoCharToken(token.AND)
+		} else {
+			l.error(l.pos(), "illegal character %q", l.ch)
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
+	case '|':
+		if l.peekChar() == '|' {
+			tok = l.newTwoCharToken(token.OR)
+		} else {
+			l.error(l.pos(), "illegal character %q", l.ch)
+			tok = newToken(token.ILLEGAL, l.ch)
+		}
 	case ';':
 		tok = newToken(token.SEMICOLON, l.ch)
 	case '(':
@@ -84,8 +237,7 @@ func (l *Lexer) NextToken() token.Token {
 	case ':':
 		tok = newToken(token.COLON, l.ch)
 	case '"': // string
-		tok.Type = token.STRING
-		tok.Literal = l.readString()
+		return l.readString()
 
 	case 0:
 		tok.Literal = ""
@@ -97,10 +249,10 @@ func (l *Lexer) NextToken() token.Token {
 			// readChar() is run in readIdentifer()
 			return tok
 		} else if isDigit(l.ch) {
-			tok.Type = token.INT
-			tok.Literal = l.readNumber()
+			tok.Type, tok.Literal = l.readNumber()
 			return tok
 		} else {
+			l.error(l.pos(), "illegal character %q", l.ch)
 			tok = newToken(token.ILLEGAL, l.ch)
 		}
 	}
@@ -114,6 +266,14 @@ func newToken(tokenType token.TokenType, ch byte) token.Token {
 	return token.Token{Type: tokenType, Literal: string(ch)}
 }
 
+// newTwoCharToken makes a token of the current and the next character.
+//  It proceeds to the next character, e.g. "+=".
+func (l *Lexer) newTwoCharToken(tokenType token.TokenType) token.Token {
+	ch := l.ch
+	l.readChar()
+	return token.Token{Type: tokenType, Literal: string(ch) + string(l.ch)}
+}
+
 func (l *Lexer) readIdentifier() string {
 	position := l.position
 	for isLetter(l.ch) {
@@ -132,12 +292,42 @@ func (l *Lexer) skipWhitespace() {
 	}
 }
 
-func (l *Lexer) readNumber() string {
+// readNumber reads an integer or a float such as 3.14, 1e-9 or 2.5E+3.
+//  "." and "e" are part of the number only when digits follow them.
+func (l *Lexer) readNumber() (token.TokenType, string) {
 	position := l.position
+	tokenType := token.TokenType(token.INT)
+
+	l.readDigits()
+
+	if l.ch == '.' && isDigit(l.peekChar()) {
+		tokenType = token.FLOAT
+		l.readChar()
+		l.readDigits()
+	}
+
+	if l.ch == 'e' || l.ch == 'E' {
+		next := l.peekChar()
+		if (next == '+' || next == '-') && l.readPosition+1 < len(l.input) {
+			next = l.input[l.readPosition+1]
+		}
+		if isDigit(next) {
+			tokenType = token.FLOAT
+			l.readChar() // e
+			if l.ch == '+' || l.ch == '-' {
+				l.readChar()
+			}
+			l.readDigits()
+		}
+	}
+
+	return tokenType, l.input[position:l.position]
+}
+
+func (l *Lexer) readDigits() {
 	for isDigit(l.ch) {
 		l.readChar()
 	}
-	return l.input[position:l.position]
 }
 
 func isDigit(ch byte) bool {
@@ -154,14 +344,97 @@ func (l *Lexer) peekChar() byte {
 	}
 }
 
-// string
-func (l *Lexer) readString() string {
-	position := l.position + 1
+// readString reads a string literal. The Literal of the token is the value of the string,
+// with escape sequences replaced.
+//  \n \t \r \0 \" \\ and \u{XXXX} (1 to 6 hex digits) are supported.
+//  A bad escape sequence or a missing closing quote makes an ILLEGAL token of the source text.
+func (l *Lexer) readString() token.Token {
+	position := l.position
+	start := l.pos()
+	var out strings.Builder
+	ok := true
+
 	for {
 		l.readChar()
-		if l.ch == '"' || l.ch == 0 {
+
+		if l.ch == '"' {
 			break
 		}
+		if l.ch == 0 {
+			l.error(start, "string literal not terminated")
+			return token.Token{Type: token.ILLEGAL, Literal: l.input[position:l.position]}
+		}
+		if l.ch != '\\' {
+			out.WriteByte(l.ch)
+			continue
+		}
+
+		// escape sequence
+		escapePos := l.pos()
+		l.readChar()
+		switch l.ch {
+		case 'n':
+			out.WriteByte('\n')
+		case 't':
+			out.WriteByte('\t')
+		case 'r':
+			out.WriteByte('\r')
+		case '0':
+			out.WriteByte(0)
+		case '"':
+			out.WriteByte('"')
+		case '\\':
+			out.WriteByte('\\')
+		case 'u':
+			r, valid := l.readUnicodeEscape()
+			if !valid {
+				l.error(escapePos, "invalid unicode escape sequence")
+				ok = false
+				continue
+			}
+			out.WriteRune(r)
+		case 0:
+			// EOFでは読み進まないので、次のループで閉じていない文字列としてエラーになる
+		default:
+			l.error(escapePos, "unknown escape sequence \\%c", l.ch)
+			ok = false
+		}
 	}
-	return l.input[position:l.position]
+
+	// 閉じる " を読み飛ばす
+	l.readChar()
+
+	if !ok {
+		return token.Token{Type: token.ILLEGAL, Literal: l.input[position:l.position]}
+	}
+	return token.Token{Type: token.STRING, Literal: out.String()}
+}
+
+// readUnicodeEscape reads "{XXXX}" after \u. l.ch is 'u'.
+//  When it fails, l.ch is the last character read, so that the string can be read on.
+func (l *Lexer) readUnicodeEscape() (rune, bool) {
+	if l.peekChar() != '{' {
+		return 0, false
+	}
+	l.readChar() // {
+
+	start := l.readPosition
+	for isHexDigit(l.peekChar()) {
+		l.readChar()
+	}
+	digits := l.input[start:l.readPosition]
+	if l.peekChar() != '}' || len(digits) == 0 || len(digits) > 6 {
+		return 0, false
+	}
+	l.readChar() // }
+
+	r, err := strconv.ParseUint(digits, 16, 32)
+	if err != nil || !utf8.ValidRune(rune(r)) {
+		return 0, false
+	}
+	return rune(r), true
+}
+
+func isHexDigit(ch byte) bool {
+	return isDigit(ch) || 'a' <= ch && ch <= 'f' || 'A' <= ch && ch <= 'F'
 }
@@ -14,7 +14,7 @@ let add = fn(x, y) {
 };
 
 let result = add(five,ten);
-!-/*5;
+!-/ *5;
 5 < 10 > 5;
 
 if (5 < 10) {
@@ -29,6 +29,9 @@ if (5 < 10) {
 "foo bar"
 [1, 2];
 {"foo": "bar"}
+while (x) { break; continue; }
+x += 1 -= 2 *= 3 /= 4;
+a <= b >= c % d && e || f;
 `
 	tests := []struct {
 		expectedType    token.TokenType
@@ -120,6 +123,38 @@ if (5 < 10) {
 		{token.COLON, ":"},
 		{token.STRING, "bar"},
 		{token.RBRACE, "}"},
+		{token.WHILE, "while"},
+		{token.LPAREN, "("},
+		{token.IDENT, "x"},
+		{token.RPAREN, ")"},
+		{token.LBRACE, "{"},
+		{token.BREAK, "break"},
+		{token.SEMICOLON, ";"},
+		{token.CONTINUE, "continue"},
+		{token.SEMICOLON, ";"},
+		{token.RBRACE, "}"},
+		{token.IDENT, "x"},
+		{token.PLUS_ASSIGN, "+="},
+		{token.INT, "1"},
+		{token.MINUS_ASSIGN, "-="},
+		{token.INT, "2"},
+		{token.ASTERISK_ASSIGN, "*="},
+		{token.INT, "3"},
+		{token.SLASH_ASSIGN, "/="},
+		{token.INT, "4"},
+		{token.SEMICOLON, ";"},
+		{token.IDENT, "a"},
+		{token.LT_EQ, "<="},
+		{token.IDENT, "b"},
+		{token.GT_EQ, ">="},
+		{token.IDENT, "c"},
+		{token.PERCENT, "%"},
+		{token.IDENT, "d"},
+		{token.AND, "&&"},
+		{token.IDENT, "e"},
+		{token.OR, "||"},
+		{token.IDENT, "f"},
+		{token.SEMICOLON, ";"},
 		{token.EOF, ""},
 	}
 
@@ -136,3 +171,235 @@ if (5 < 10) {
 		}
 	}
 }
+
+func TestTokenPositions(t *testing.T) {
+	input := `let x = 5;
+  "ab" != x;`
+
+	tests := []struct {
+		expectedType token.TokenType
+		line, column int
+		endColumn    int
+	}{
+		{token.LET, 1, 1, 4},
+		{token.IDENT, 1, 5, 6},
+		{token.ASSIGN, 1, 7, 8},
+		{token.INT, 1, 9, 10},
+		{token.SEMICOLON, 1, 10, 11},
+		{token.STRING, 2, 3, 7},
+		{token.NOT_EQ, 2, 8, 10},
+		{token.IDENT, 2, 11, 12},
+		{token.SEMICOLON, 2, 12, 13},
+		{token.EOF, 2, 13, 13},
+	}
+
+	l := NewWithFilename("test.mk", input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+
+		if tok.Pos.Filename != "test.mk" || tok.Pos.Line != tt.line || tok.Pos.Column != tt.column {
+			t.Fatalf("tests[%d] - position wrong. expected=test.mk:%d:%d, got=%s",
+				i, tt.line, tt.column, tok.Pos)
+		}
+
+		if tok.End.Line != tt.line || tok.End.Column != tt.endColumn {
+			t.Fatalf("tests[%d] - end position wrong. expected=%d:%d, got=%s",
+				i, tt.line, tt.endColumn, tok.End)
+		}
+	}
+}
+
+func TestNumbers(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []token.Token
+	}{
+		{"42", []token.Token{{Type: token.INT, Literal: "42"}}},
+		{"3.14", []token.Token{{Type: token.FLOAT, Literal: "3.14"}}},
+		{"1e-9", []token.Token{{Type: token.FLOAT, Literal: "1e-9"}}},
+		{"2.5E+3", []token.Token{{Type: token.FLOAT, Literal: "2.5E+3"}}},
+		{"6e2", []token.Token{{Type: token.FLOAT, Literal: "6e2"}}},
+		// 数字が続かない . や e は数値の一部ではない
+		{"1.", []token.Token{{Type: token.INT, Literal: "1"}, {Type: token.ILLEGAL, Literal: "."}}},
+		{"1e", []token.Token{{Type: token.INT, Literal: "1"}, {Type: token.IDENT, Literal: "e"}}},
+		{"1e+", []token.Token{{Type: token.INT, Literal: "1"}, {Type: token.IDENT, Literal: "e"}, {Type: token.PLUS, Literal: "+"}}},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		for i, expected := range tt.expected {
+			tok := l.NextToken()
+			if tok.Type != expected.Type || tok.Literal != expected.Literal {
+				t.Errorf("%q: tokens[%d] wrong. expected=%s %q, got=%s %q",
+					tt.input, i, expected.Type, expected.Literal, tok.Type, tok.Literal)
+			}
+		}
+		if tok := l.NextToken(); tok.Type != token.EOF {
+			t.Errorf("%q: expected EOF, got=%s %q", tt.input, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	input := `// add two numbers
+let x = 1 / 2; // half
+/* block
+   comment */ x /* inline */ + 1;
+// at the end`
+
+	expected := []struct {
+		expectedType token.TokenType
+		comments     []string
+	}{
+		{token.LET, []string{"// add two numbers"}},
+		{token.IDENT, nil},
+		{token.ASSIGN, nil},
+		{token.INT, nil},
+		{token.SLASH, nil},
+		{token.INT, nil},
+		{token.SEMICOLON, nil},
+		{token.IDENT, []string{"// half", "/* block\n   comment */"}},
+		{token.PLUS, []string{"/* inline */"}},
+		{token.INT, nil},
+		{token.SEMICOLON, nil},
+		{token.EOF, []string{"// at the end"}},
+	}
+
+	// コメントは既定では読み飛ばす
+	l := New(input)
+	for i, tt := range expected {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+		if tok.Comments != nil {
+			t.Fatalf("tests[%d] - comments are kept without SetKeepComments", i)
+		}
+	}
+
+	l = New(input)
+	l.SetKeepComments(true)
+	for i, tt := range expected {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong. expected=%q, got=%q", i, tt.expectedType, tok.Type)
+		}
+
+		texts := []string{}
+		for _, c := range tok.Comments {
+			texts = append(texts, c.Text)
+		}
+		if len(texts) != len(tt.comments) {
+			t.Fatalf("tests[%d] - wrong comments. expected=%q, got=%q", i, tt.comments, texts)
+		}
+		for j := range texts {
+			if texts[j] != tt.comments[j] {
+				t.Fatalf("tests[%d] - wrong comments. expected=%q, got=%q", i, tt.comments, texts)
+			}
+		}
+	}
+}
+
+func TestCommentPositions(t *testing.T) {
+	l := NewWithFilename("test.mk", "x /* a\nb */ // c\ny")
+	l.SetKeepComments(true)
+
+	l.NextToken() // x
+	tok := l.NextToken()
+	if len(tok.Comments) != 2 {
+		t.Fatalf("expected 2 comments, got=%d", len(tok.Comments))
+	}
+
+	block, line := tok.Comments[0], tok.Comments[1]
+	if block.Pos.String() != "test.mk:1:3" || block.End.String() != "test.mk:2:5" {
+		t.Errorf("wrong block comment position. got=%s-%s", block.Pos, block.End)
+	}
+	if line.Pos.String() != "test.mk:2:6" || line.End.String() != "test.mk:2:10" {
+		t.Errorf("wrong line comment position. got=%s-%s", line.Pos, line.End)
+	}
+	if tok.Pos.String() != "test.mk:3:1" {
+		t.Errorf("wrong token position. got=%s", tok.Pos)
+	}
+}
+
+func TestUnterminatedComment(t *testing.T) {
+	l := New("1 /* never closed")
+
+	l.NextToken() // 1
+	tok := l.NextToken()
+	if tok.Type != token.ILLEGAL || tok.Literal != "/* never closed" {
+		t.Fatalf("expected ILLEGAL %q, got=%s %q", "/* never closed", tok.Type, tok.Literal)
+	}
+	if tok := l.NextToken(); tok.Type != token.EOF {
+		t.Fatalf("expected EOF, got=%s", tok.Type)
+	}
+	if len(l.Errors()) != 1 || l.Errors()[0] != "1:3: comment not terminated" {
+		t.Errorf("wrong errors. got=%q", l.Errors())
+	}
+}
+
+func TestStrings(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{`"foo bar"`, "foo bar"},
+		{`"a\nb\tc\rd"`, "a\nb\tc\rd"},
+		{`"\"quoted\" \\ back"`, `"quoted" \ back`},
+		{`"nul\0"`, "nul\x00"},
+		{`"\u{41}\u{3042}\u{1F600}"`, "Aあ😀"},
+		{`"日本語"`, "日本語"},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+		if tok.Type != token.STRING || tok.Literal != tt.expected {
+			t.Errorf("%s: expected STRING %q, got=%s %q", tt.input, tt.expected, tok.Type, tok.Literal)
+		}
+		if tok := l.NextToken(); tok.Type != token.EOF {
+			t.Errorf("%s: expected EOF after the string, got=%s", tt.input, tok.Type)
+		}
+		if len(l.Errors()) != 0 {
+			t.Errorf("%s: unexpected errors %q", tt.input, l.Errors())
+		}
+	}
+}
+
+func TestStringErrors(t *testing.T) {
+	tests := []struct {
+		input   string
+		literal string
+		err     string
+	}{
+		{`"a\qb" 1`, `"a\qb"`, `1:3: unknown escape sequence \q`},
+		{`"\u{110000}" 1`, `"\u{110000}"`, "1:2: invalid unicode escape sequence"},
+		{`"\u{D800}" 1`, `"\u{D800}"`, "1:2: invalid unicode escape sequence"},
+		{`"\u{}" 1`, `"\u{}"`, "1:2: invalid unicode escape sequence"},
+		{`"\u0041" 1`, `"\u0041"`, "1:2: invalid unicode escape sequence"},
+		{`"abc`, `"abc`, "1:1: string literal not terminated"},
+		{`"abc\`, `"abc\`, "1:1: string literal not terminated"},
+	}
+
+	for _, tt := range tests {
+		l := New(tt.input)
+		tok := l.NextToken()
+		if tok.Type != token.ILLEGAL || tok.Literal != tt.literal {
+			t.Errorf("%s: expected ILLEGAL %q, got=%s %q", tt.input, tt.literal, tok.Type, tok.Literal)
+		}
+
+		// 不正な文字列の後も読み進められること
+		next := l.NextToken()
+		if next.Type != token.INT && next.Type != token.EOF {
+			t.Errorf("%s: wrong token after the string. got=%s %q", tt.input, next.Type, next.Literal)
+		}
+
+		if len(l.Errors()) != 1 || l.Errors()[0] != tt.err {
+			t.Errorf("%s: wrong errors. want=%q, got=%q", tt.input, tt.err, l.Errors())
+		}
+	}
+}
@@ -1,66 +1,169 @@
+// Command monkey runs, compiles and formats Monkey programs.
+//
+//	monkey run [-engine eval|vm] [file.mk | file.mkc | -]
+//	monkey repl [-engine eval|vm]
+//	monkey build [-target bytecode|x64] [-toolchain system|go] [-o file] file.mk
+//	monkey disasm file.mk | file.mkc
+//	monkey asm [-o file.s] file.mk
+//	monkey fmt [-w] [file.mk ...]
+//
+// Without a file (or with "-") the source is read from stdin.
+// "monkey file.mk" is the same as "monkey run file.mk".
 package main
 
 import (
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"monkey/evaluator"
+	"monkey/ast"
+	"monkey/compiler"
 	"monkey/lexer"
-	"monkey/object"
 	"monkey/parser"
-	"monkey/repl"
 	"os"
-	"os/user"
+	"strings"
 )
 
+// exit codes
+const (
+	exitOK           = 0
+	exitRuntimeError = 1
+	exitUsage        = 2
+	exitParseError   = 3
+	exitCompileError = 4
+)
+
+const stdinName = "<stdin>"
+
+type command struct {
+	name  string
+	usage string
+	run   func(args []string) int
+}
+
+var commands []command
+
+func init() {
+	// runCommand等がcommandsを参照するのでinitで初期化する
+	commands = []command{
+		{"run", "run a .mk or .mkc program", runCommand},
+		{"repl", "start an interactive session", replCommand},
+		{"build", "compile a program to .mkc bytecode or an x64 executable", buildCommand},
+		{"disasm", "print the bytecode of a program", disasmCommand},
+		{"asm", "print x64 assembly of a program", asmCommand},
+		{"fmt", "format source code", fmtCommand},
+	}
+}
+
 func main() {
+	os.Exit(dispatch(os.Args[1:]))
+}
 
-	if len(os.Args) == 1 || os.Args[1] == "interpreter" {
-		user, err := user.Current()
-		if err != nil {
-			panic(err)
-		}
+func dispatch(args []string) int {
+	if len(args) == 0 {
+		return replCommand(args)
+	}
 
-		fmt.Printf("Hello %s\n", user.Username)
-		fmt.Printf("This is interpreter mode. Feel free to type in commands\n")
-		repl.StartInterpreter(os.Stdin, os.Stdout)
-		return
-	} else if os.Args[1] == "compiler" {
-		user, err := user.Current()
-		if err != nil {
-			panic(err)
+	for _, c := range commands {
+		if c.name == args[0] {
+			return c.run(args[1:])
 		}
-		fmt.Printf("Hello %s\n", user.Username)
-		fmt.Printf("This is compiler mode. Feel free to type in commands\n")
-		repl.StartVm(os.Stdin, os.Stdout)
-		return
+	}
 
+	switch {
+	case args[0] == "help" || args[0] == "-h" || args[0] == "-help" || args[0] == "--help":
+		usage(os.Stdout)
+		return exitOK
+	case strings.HasSuffix(args[0], ".mk") || strings.HasSuffix(args[0], ".mkc"):
+		return runCommand(args)
+	default:
+		fmt.Fprintf(os.Stderr, "monkey: unknown command %q\n", args[0])
+		usage(os.Stderr)
+		return exitUsage
 	}
+}
 
-	fp, err := os.Open(os.Args[1])
-	if err != nil {
-		panic(err)
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "usage: monkey <command> [arguments]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(w, "\t%-8s %s\n", c.name, c.usage)
 	}
-	line, err := ioutil.ReadAll(fp)
-	if err != nil {
-		panic(err)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, `Use "monkey <command> -h" for the options of a command.`)
+}
+
+// newFlagSet makes a FlagSet that reports errors instead of exiting.
+func newFlagSet(name, args string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: monkey %s %s\n", name, args)
+		fs.PrintDefaults()
 	}
-	env := object.NewEnvironment()
+	return fs
+}
 
-	l := lexer.New(string(line))
+// readSource reads the file named by args, or stdin when there is none or it is "-".
+func readSource(args []string) (string, []byte, error) {
+	if len(args) == 0 || args[0] == "-" {
+		src, err := ioutil.ReadAll(os.Stdin)
+		return stdinName, src, err
+	}
+
+	src, err := ioutil.ReadFile(args[0])
+	return args[0], src, err
+}
+
+// parse returns the program or prints the parser errors.
+func parse(filename string, src []byte) (*ast.Program, bool) {
+	l := lexer.NewWithFilename(filename, string(src))
 	p := parser.New(l)
 
 	program := p.ParseProgram()
 	if len(p.Errors()) != 0 {
-		printParserErrors(os.Stdout, p.Errors())
+		printParserErrors(os.Stderr, p.Errors())
+		return nil, false
 	}
+	return program, true
+}
 
-	evaluated := evaluator.Eval(program, env)
-	if evaluated != nil {
-		fmt.Println(evaluated.Inspect())
+// compile parses and compiles the source to bytecode.
+// It returns the exit code to use on failure.
+func compile(filename string, src []byte) (*compiler.Compiler, int) {
+	program, ok := parse(filename, src)
+	if !ok {
+		return nil, exitParseError
 	}
 
-	return
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "compile error: %s\n", err)
+		return nil, exitCompileError
+	}
+
+	return comp, exitOK
+}
+
+// loadBytecode compiles a .mk file or decodes a .mkc file.
+// The symbol table is nil for .mkc files.
+func loadBytecode(filename string, src []byte) (*compiler.Bytecode, *compiler.SymbolTable, int) {
+	if !strings.HasSuffix(filename, ".mkc") {
+		comp, status := compile(filename, src)
+		if comp == nil {
+			return nil, nil, status
+		}
+		return comp.Bytecode(), comp.SymbolTable(), exitOK
+	}
+
+	bytecode, err := compiler.Decode(strings.NewReader(string(src)))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", filename, err)
+		return nil, nil, exitCompileError
+	}
+	return bytecode, nil, exitOK
 }
 
 func printParserErrors(out io.Writer, errors []string) {
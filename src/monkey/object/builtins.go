@@ -1,6 +1,9 @@
 package object
 
-import "fmt"
+import (
+	"fmt"
+	"strings"
+)
 
 var Builtins = []struct {
 	Name     string
@@ -18,7 +21,7 @@ var Builtins = []struct {
 
 				switch arg := args[0].(type) {
 				case *String:
-					return &Integer{Value: int64(len(arg.Value))}
+					return &Integer{Value: int64(arg.Len())}
 				case *Array:
 					return &Integer{Value: int64(len(arg.Elements))}
 				default:
@@ -27,20 +30,10 @@ var Builtins = []struct {
 				}
 			},
 		},
+		// 型の検査とエラーはgen_x64のruntimeにある
 		Assembly: `.global len
 len:
-	#header
-	push rbp
-	mov rbp, rsp
-
-	# len
-	mov rax, [rbp+16]
-	mov rax, [rax]
-
-	#footar
-	mov rsp, rbp
-	pop rbp
-	ret`,
+	jmp monkey_len`,
 	},
 	{
 		Name: "puts",
@@ -54,41 +47,7 @@ len:
 		},
 		Assembly: `.global puts
 puts:
-	#header
-	push rbp
-	mov rbp, rsp
-	
-	#strlen start
-	xor rcx, rcx
-	sub rcx, 1
-
-	xor rax, rax
-	mov rdx, [rbp+16]
-	mov bl, [rdx]
-	cmp bl, 0
-	je .L1
-.L0:
-	add rdx, 1
-	mov bl, [rdx]
-	cmp bl, 0
-	loopne .L0
-.L1:
-	not rcx	
-	mov rdx, rcx
-	# strlen end
-
-	# write(1, "string", strlen) // printf
-	mov rax, 1
-	mov rdi, 1
-	mov rsi, [rbp+16]
-	syscall
-	push rax
-
-	#footar
-	mov rsp, rbp
-	pop rbp
-	ret
-`,
+	jmp monkey_puts`,
 	},
 	{
 		Name: "first",
@@ -110,6 +69,9 @@ puts:
 				return nil
 			},
 		},
+		Assembly: `.global first
+first:
+	jmp monkey_first`,
 	},
 	{
 		Name: "last",
@@ -132,6 +94,9 @@ puts:
 				return nil
 			},
 		},
+		Assembly: `.global last
+last:
+	jmp monkey_last`,
 	},
 	{
 		Name: "rest",
@@ -157,6 +122,9 @@ puts:
 				return nil
 			},
 		},
+		Assembly: `.global rest
+rest:
+	jmp monkey_rest`,
 	}, {
 		Name: "push",
 		Builtin: &Builtin{
@@ -181,7 +149,180 @@ puts:
 
 			},
 		},
+		Assembly: `.global push
+push:
+	jmp monkey_push`,
 	},
+	{
+		Name: "split",
+		Builtin: &Builtin{
+			Fn: func(args ...Object) Object {
+				s, err := stringArgs("split", args, 2)
+				if err != nil {
+					return err
+				}
+
+				parts := strings.Split(s[0], s[1])
+				elements := make([]Object, len(parts))
+				for i, p := range parts {
+					elements[i] = &String{Value: p}
+				}
+				return &Array{Elements: elements}
+			},
+		},
+	},
+	{
+		Name: "join",
+		Builtin: &Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) != 2 {
+					return newError("wrong number of arguments. got=%d, want=2",
+						len(args))
+				}
+				arr, ok := args[0].(*Array)
+				if !ok {
+					return newError("argument to `join` must be ARRAY, got %s",
+						args[0].Type())
+				}
+				sep, ok := args[1].(*String)
+				if !ok {
+					return newError("argument to `join` must be STRING, got %s",
+						args[1].Type())
+				}
+
+				parts := make([]string, len(arr.Elements))
+				for i, e := range arr.Elements {
+					s, ok := e.(*String)
+					if !ok {
+						return newError("elements to `join` must be STRING, got %s", e.Type())
+					}
+					parts[i] = s.Value
+				}
+				return &String{Value: strings.Join(parts, sep.Value)}
+			},
+		},
+	},
+	{
+		Name: "trim",
+		Builtin: &Builtin{
+			Fn: func(args ...Object) Object {
+				s, err := stringArgs("trim", args, 1)
+				if err != nil {
+					return err
+				}
+				return &String{Value: strings.TrimSpace(s[0])}
+			},
+		},
+	},
+	{
+		Name: "contains",
+		Builtin: &Builtin{
+			Fn: func(args ...Object) Object {
+				s, err := stringArgs("contains", args, 2)
+				if err != nil {
+					return err
+				}
+				if strings.Contains(s[0], s[1]) {
+					return True
+				}
+				return False
+			},
+		},
+	},
+	{
+		Name: "replace",
+		Builtin: &Builtin{
+			Fn: func(args ...Object) Object {
+				s, err := stringArgs("replace", args, 3)
+				if err != nil {
+					return err
+				}
+				return &String{Value: strings.ReplaceAll(s[0], s[1], s[2])}
+			},
+		},
+	},
+	{
+		Name: "upper",
+		Builtin: &Builtin{
+			Fn: func(args ...Object) Object {
+				s, err := stringArgs("upper", args, 1)
+				if err != nil {
+					return err
+				}
+				return &String{Value: strings.ToUpper(s[0])}
+			},
+		},
+	},
+	{
+		Name: "lower",
+		Builtin: &Builtin{
+			Fn: func(args ...Object) Object {
+				s, err := stringArgs("lower", args, 1)
+				if err != nil {
+					return err
+				}
+				return &String{Value: strings.ToLower(s[0])}
+			},
+		},
+	},
+	{
+		// format("%s is %d", "x", 1) formats like fmt.Sprintf.
+		Name: "format",
+		Builtin: &Builtin{
+			Fn: func(args ...Object) Object {
+				if len(args) < 1 {
+					return newError("wrong number of arguments. got=%d, want at least 1",
+						len(args))
+				}
+				format, ok := args[0].(*String)
+				if !ok {
+					return newError("argument to `format` must be STRING, got %s",
+						args[0].Type())
+				}
+
+				values := make([]interface{}, len(args)-1)
+				for i, arg := range args[1:] {
+					values[i] = formatValue(arg)
+				}
+				return &String{Value: fmt.Sprintf(format.Value, values...)}
+			},
+		},
+	},
+}
+
+// stringArgs checks that args are n Strings and returns their values.
+func stringArgs(name string, args []Object, n int) ([]string, Object) {
+	if len(args) != n {
+		return nil, newError("wrong number of arguments. got=%d, want=%d",
+			len(args), n)
+	}
+
+	values := make([]string, n)
+	for i, arg := range args {
+		s, ok := arg.(*String)
+		if !ok {
+			return nil, newError("argument to `%s` must be STRING, got %s",
+				name, arg.Type())
+		}
+		values[i] = s.Value
+	}
+	return values, nil
+}
+
+// formatValue converts obj to the Go value given to fmt.Sprintf.
+func formatValue(obj Object) interface{} {
+	switch obj := obj.(type) {
+	case *Integer:
+		return obj.Value
+	case *Float:
+		return obj.Value
+	case *String:
+		return obj.Value
+	case *Boolean:
+		return obj.Value
+	default:
+		return obj.Inspect()
+	}
 }
 
 func newError(format string, a ...interface{}) *Error {
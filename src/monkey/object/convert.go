@@ -0,0 +1,402 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+)
+
+// Conversion between Go values and Monkey values
+//
+//	Go                               Monkey
+//	nil, nil pointer                 null
+//	bool                             BOOLEAN
+//	int*, uint*                      INTEGER
+//	float*                           FLOAT
+//	string                           STRING
+//	slice, array                     ARRAY
+//	map                              HASH, keys must convert to a hashable value
+//	struct                           HASH with the exported field names as keys
+//	func                             BUILTIN
+//
+// A struct field is named by its `monkey:"name"` tag if it has one, and skipped
+// with `monkey:"-"`. A func may return at most one value and then an error;
+// a non-nil error is returned to the program as an ERROR.
+// Values that are already Objects are passed through as they are.
+
+var (
+	objectType = reflect.TypeOf((*Object)(nil)).Elem()
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// ToObject converts v to a Monkey value.
+func ToObject(v interface{}) (Object, error) {
+	return toObject(reflect.ValueOf(v), "")
+}
+
+// FromObject stores obj in the value target points to, converting it to the type of that value.
+// A null stores the zero value. An interface{} gets int64, float64, string, bool, nil,
+// []interface{} or map[interface{}]interface{}, and functions as they are.
+func FromObject(obj Object, target interface{}) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("object: FromObject target must be a non-nil pointer, got %T", target)
+	}
+	return fromObject(obj, rv.Elem(), "")
+}
+
+func convertError(path string, format string, a ...interface{}) error {
+	msg := "object: " + fmt.Sprintf(format, a...)
+	if path != "" {
+		msg += " (at " + path + ")"
+	}
+	return errors.New(msg)
+}
+
+func toObject(rv reflect.Value, path string) (Object, error) {
+	if !rv.IsValid() {
+		return NullValue, nil
+	}
+	if (rv.Kind() == reflect.Interface || rv.Kind() == reflect.Ptr) && rv.IsNil() {
+		return NullValue, nil
+	}
+	if rv.Type().Implements(objectType) {
+		return rv.Interface().(Object), nil
+	}
+
+	switch rv.Kind() {
+	case reflect.Interface, reflect.Ptr:
+		return toObject(rv.Elem(), path)
+
+	case reflect.Bool:
+		if rv.Bool() {
+			return True, nil
+		}
+		return False, nil
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return &Integer{Value: rv.Int()}, nil
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		u := rv.Uint()
+		if u > math.MaxInt64 {
+			return nil, convertError(path, "%d overflows %s", u, INTEGER_OBJ)
+		}
+		return &Integer{Value: int64(u)}, nil
+
+	case reflect.Float32, reflect.Float64:
+		return &Float{Value: rv.Float()}, nil
+
+	case reflect.String:
+		return &String{Value: rv.String()}, nil
+
+	case reflect.Slice, reflect.Array:
+		elements := make([]Object, rv.Len())
+		for i := range elements {
+			e, err := toObject(rv.Index(i), fmt.Sprintf("%s[%d]", path, i))
+			if err != nil {
+				return nil, err
+			}
+			elements[i] = e
+		}
+		return &Array{Elements: elements}, nil
+
+	case reflect.Map:
+		pairs := make(map[HashKey]HashPair, rv.Len())
+		iter := rv.MapRange()
+		for iter.Next() {
+			elemPath := fmt.Sprintf("%s[%v]", path, iter.Key())
+			key, err := toObject(iter.Key(), elemPath)
+			if err != nil {
+				return nil, err
+			}
+			hashKey, ok := key.(Hashable)
+			if !ok {
+				return nil, convertError(elemPath, "unusable as hash key: %s", key.Type())
+			}
+			value, err := toObject(iter.Value(), elemPath)
+			if err != nil {
+				return nil, err
+			}
+			pairs[hashKey.HashKey()] = HashPair{Key: key, Value: value}
+		}
+		return &Hash{Pairs: pairs}, nil
+
+	case reflect.Struct:
+		pairs := map[HashKey]HashPair{}
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := fieldName(t.Field(i))
+			if !ok {
+				continue
+			}
+			value, err := toObject(rv.Field(i), path+"."+name)
+			if err != nil {
+				return nil, err
+			}
+			key := &String{Value: name}
+			pairs[key.HashKey()] = HashPair{Key: key, Value: value}
+		}
+		return &Hash{Pairs: pairs}, nil
+
+	case reflect.Func:
+		return funcToBuiltin(rv, path)
+
+	default:
+		return nil, convertError(path, "cannot convert %s to a Monkey value", rv.Type())
+	}
+}
+
+// fieldName returns the hash key of a struct field, and false if the field is not converted.
+func fieldName(f reflect.StructField) (string, bool) {
+	if f.PkgPath != "" {
+		// unexported
+		return "", false
+	}
+	tag := f.Tag.Get("monkey")
+	switch tag {
+	case "-":
+		return "", false
+	case "":
+		return f.Name, true
+	default:
+		return tag, true
+	}
+}
+
+// funcToBuiltin wraps fn so that its arguments are converted with FromObject and its result with ToObject.
+func funcToBuiltin(fn reflect.Value, path string) (*Builtin, error) {
+	ft := fn.Type()
+
+	numOut := ft.NumOut()
+	hasError := numOut > 0 && ft.Out(numOut-1) == errorType
+	if hasError {
+		numOut--
+	}
+	if numOut > 1 {
+		return nil, convertError(path, "cannot convert %s to a builtin: it may return one value and an error", ft)
+	}
+
+	numIn := ft.NumIn()
+	return &Builtin{Fn: func(args ...Object) Object {
+		if ft.IsVariadic() {
+			if len(args) < numIn-1 {
+				return newError("wrong number of arguments. got=%d, want at least %d", len(args), numIn-1)
+			}
+		} else if len(args) != numIn {
+			return newError("wrong number of arguments. got=%d, want=%d", len(args), numIn)
+		}
+
+		in := make([]reflect.Value, len(args))
+		for i, arg := range args {
+			var t reflect.Type
+			if ft.IsVariadic() && i >= numIn-1 {
+				t = ft.In(numIn - 1).Elem()
+			} else {
+				t = ft.In(i)
+			}
+			in[i] = reflect.New(t).Elem()
+			if err := fromObject(arg, in[i], fmt.Sprintf("argument %d", i+1)); err != nil {
+				return newError("%s", err)
+			}
+		}
+
+		out := fn.Call(in)
+		if hasError {
+			if err := out[len(out)-1]; !err.IsNil() {
+				return newError("%s", err.Interface().(error))
+			}
+		}
+		if numOut == 0 {
+			return nil
+		}
+
+		result, err := toObject(out[0], "result")
+		if err != nil {
+			return newError("%s", err)
+		}
+		return result
+	}}, nil
+}
+
+func fromObject(obj Object, rv reflect.Value, path string) error {
+	if obj == nil {
+		obj = NullValue
+	}
+	if rv.Kind() == reflect.Interface && rv.NumMethod() == 0 {
+		if v := natural(obj); v != nil {
+			rv.Set(reflect.ValueOf(v))
+		} else {
+			rv.Set(reflect.Zero(rv.Type()))
+		}
+		return nil
+	}
+	if reflect.TypeOf(obj).AssignableTo(rv.Type()) {
+		rv.Set(reflect.ValueOf(obj))
+		return nil
+	}
+	if _, ok := obj.(*Null); ok {
+		rv.Set(reflect.Zero(rv.Type()))
+		return nil
+	}
+
+	mismatch := func() error {
+		return convertError(path, "cannot convert %s to %s", obj.Type(), rv.Type())
+	}
+
+	switch rv.Kind() {
+	case reflect.Bool:
+		b, ok := obj.(*Boolean)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetBool(b.Value)
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, ok := obj.(*Integer)
+		if !ok {
+			return mismatch()
+		}
+		if rv.OverflowInt(i.Value) {
+			return convertError(path, "%d overflows %s", i.Value, rv.Type())
+		}
+		rv.SetInt(i.Value)
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		i, ok := obj.(*Integer)
+		if !ok {
+			return mismatch()
+		}
+		if i.Value < 0 || rv.OverflowUint(uint64(i.Value)) {
+			return convertError(path, "%d overflows %s", i.Value, rv.Type())
+		}
+		rv.SetUint(uint64(i.Value))
+
+	case reflect.Float32, reflect.Float64:
+		switch n := obj.(type) {
+		case *Float:
+			rv.SetFloat(n.Value)
+		case *Integer:
+			rv.SetFloat(float64(n.Value))
+		default:
+			return mismatch()
+		}
+
+	case reflect.String:
+		s, ok := obj.(*String)
+		if !ok {
+			return mismatch()
+		}
+		rv.SetString(s.Value)
+
+	case reflect.Slice:
+		arr, ok := obj.(*Array)
+		if !ok {
+			return mismatch()
+		}
+		slice := reflect.MakeSlice(rv.Type(), len(arr.Elements), len(arr.Elements))
+		for i, e := range arr.Elements {
+			if err := fromObject(e, slice.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+		rv.Set(slice)
+
+	case reflect.Array:
+		arr, ok := obj.(*Array)
+		if !ok {
+			return mismatch()
+		}
+		if len(arr.Elements) != rv.Len() {
+			return convertError(path, "cannot convert %s of length %d to %s", obj.Type(), len(arr.Elements), rv.Type())
+		}
+		for i, e := range arr.Elements {
+			if err := fromObject(e, rv.Index(i), fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		hash, ok := obj.(*Hash)
+		if !ok {
+			return mismatch()
+		}
+		m := reflect.MakeMapWithSize(rv.Type(), len(hash.Pairs))
+		for _, pair := range hash.Pairs {
+			elemPath := fmt.Sprintf("%s[%s]", path, pair.Key.Inspect())
+			key := reflect.New(rv.Type().Key()).Elem()
+			if err := fromObject(pair.Key, key, elemPath); err != nil {
+				return err
+			}
+			value := reflect.New(rv.Type().Elem()).Elem()
+			if err := fromObject(pair.Value, value, elemPath); err != nil {
+				return err
+			}
+			m.SetMapIndex(key, value)
+		}
+		rv.Set(m)
+
+	case reflect.Struct:
+		hash, ok := obj.(*Hash)
+		if !ok {
+			return mismatch()
+		}
+		// hashにないフィールドはそのままにする
+		t := rv.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name, ok := fieldName(t.Field(i))
+			if !ok {
+				continue
+			}
+			pair, ok := hash.Pairs[(&String{Value: name}).HashKey()]
+			if !ok {
+				continue
+			}
+			if err := fromObject(pair.Value, rv.Field(i), path+"."+name); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Ptr:
+		p := reflect.New(rv.Type().Elem())
+		if err := fromObject(obj, p.Elem(), path); err != nil {
+			return err
+		}
+		rv.Set(p)
+
+	default:
+		return convertError(path, "cannot convert %s to unsupported type %s", obj.Type(), rv.Type())
+	}
+	return nil
+}
+
+// natural returns obj as the Go value FromObject stores in an interface{}.
+func natural(obj Object) interface{} {
+	switch obj := obj.(type) {
+	case *Integer:
+		return obj.Value
+	case *Float:
+		return obj.Value
+	case *String:
+		return obj.Value
+	case *Boolean:
+		return obj.Value
+	case *Null:
+		return nil
+	case *Array:
+		elements := make([]interface{}, len(obj.Elements))
+		for i, e := range obj.Elements {
+			elements[i] = natural(e)
+		}
+		return elements
+	case *Hash:
+		pairs := make(map[interface{}]interface{}, len(obj.Pairs))
+		for _, pair := range obj.Pairs {
+			pairs[natural(pair.Key)] = natural(pair.Value)
+		}
+		return pairs
+	default:
+		return obj
+	}
+}
@@ -0,0 +1,296 @@
+package object
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X, Y   int
+	Label  string `monkey:"label"`
+	Hidden bool   `monkey:"-"`
+	secret int
+}
+
+func TestToObject(t *testing.T) {
+	var nilPtr *point
+
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{nil, "null"},
+		{nilPtr, "null"},
+		{true, "true"},
+		{42, "42"},
+		{int8(-3), "-3"},
+		{uint16(7), "7"},
+		{2.5, "2.5"},
+		{float32(0.5), "0.5"},
+		{"hello", "hello"},
+		{[]int{1, 2, 3}, "[1, 2, 3]"},
+		{[2]string{"a", "b"}, "[a, b]"},
+		{[]interface{}{1, "a", nil, []bool{false}}, "[1, a, null, [false]]"},
+		{map[string]int{"a": 1}, "{a: 1}"},
+		{map[int]bool{2: true}, "{2: true}"},
+		{point{X: 1, Y: 2, Label: "p", Hidden: true, secret: 3}, ""},
+		{&Integer{Value: 5}, "5"},
+	}
+
+	for _, tt := range tests {
+		obj, err := ToObject(tt.input)
+		if err != nil {
+			t.Fatalf("ToObject(%#v) error: %s", tt.input, err)
+		}
+		if tt.expected == "" {
+			continue
+		}
+		if obj.Inspect() != tt.expected {
+			t.Errorf("ToObject(%#v) wrong. want=%q, got=%q", tt.input, tt.expected, obj.Inspect())
+		}
+	}
+
+	// nullは言語側と同じ値でないと真偽値の判定がずれる
+	if obj, _ := ToObject(nil); obj != NullValue {
+		t.Errorf("ToObject(nil) is not NullValue")
+	}
+	if obj, _ := ToObject(false); obj != False {
+		t.Errorf("ToObject(false) is not False")
+	}
+}
+
+func TestToObjectStruct(t *testing.T) {
+	obj, err := ToObject(&point{X: 1, Y: 2, Label: "p", Hidden: true, secret: 3})
+	if err != nil {
+		t.Fatalf("ToObject error: %s", err)
+	}
+	hash, ok := obj.(*Hash)
+	if !ok {
+		t.Fatalf("obj is not Hash. got=%T (%+v)", obj, obj)
+	}
+
+	expected := map[string]string{"X": "1", "Y": "2", "label": "p"}
+	if len(hash.Pairs) != len(expected) {
+		t.Fatalf("hash has wrong num of pairs. want=%d, got=%d", len(expected), len(hash.Pairs))
+	}
+	for key, value := range expected {
+		pair, ok := hash.Pairs[(&String{Value: key}).HashKey()]
+		if !ok {
+			t.Errorf("no pair for key %q", key)
+			continue
+		}
+		if pair.Value.Inspect() != value {
+			t.Errorf("wrong value for %q. want=%q, got=%q", key, value, pair.Value.Inspect())
+		}
+	}
+}
+
+func TestToObjectErrors(t *testing.T) {
+	tests := []struct {
+		input    interface{}
+		expected string
+	}{
+		{make(chan int), "object: cannot convert chan int to a Monkey value"},
+		{complex(1, 2), "object: cannot convert complex128 to a Monkey value"},
+		{uint64(1) << 63, "object: 9223372036854775808 overflows INTEGER"},
+		{[]interface{}{1, make(chan int)}, "object: cannot convert chan int to a Monkey value (at [1])"},
+		{map[string]interface{}{"f": func() (int, int) { return 0, 0 }},
+			"object: cannot convert func() (int, int) to a builtin: it may return one value and an error (at [f])"},
+		{map[[2]int]int{{1, 2}: 1}, "object: unusable as hash key: ARRAY (at [[1 2]])"},
+	}
+
+	for _, tt := range tests {
+		_, err := ToObject(tt.input)
+		if err == nil {
+			t.Errorf("ToObject(%#v) expected error", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestFromObject(t *testing.T) {
+	hash := func(pairs ...Object) *Hash {
+		h := &Hash{Pairs: map[HashKey]HashPair{}}
+		for i := 0; i < len(pairs); i += 2 {
+			h.Pairs[pairs[i].(Hashable).HashKey()] = HashPair{Key: pairs[i], Value: pairs[i+1]}
+		}
+		return h
+	}
+	array := func(elements ...Object) *Array { return &Array{Elements: elements} }
+	integer := func(v int64) *Integer { return &Integer{Value: v} }
+	str := func(v string) *String { return &String{Value: v} }
+
+	var (
+		i   int
+		u8  uint8
+		f   float64
+		s   string
+		b   bool
+		is  []int
+		a2  [2]string
+		m   map[string]int
+		p   point
+		pp  *point
+		any interface{}
+		obj Object
+		arr *Array
+	)
+
+	tests := []struct {
+		obj      Object
+		target   interface{}
+		expected interface{}
+	}{
+		{integer(5), &i, 5},
+		{NullValue, &i, 0},
+		{integer(255), &u8, uint8(255)},
+		{&Float{Value: 1.5}, &f, 1.5},
+		{integer(2), &f, 2.0},
+		{str("hi"), &s, "hi"},
+		{True, &b, true},
+		{array(integer(1), integer(2)), &is, []int{1, 2}},
+		{array(str("a"), str("b")), &a2, [2]string{"a", "b"}},
+		{hash(str("a"), integer(1)), &m, map[string]int{"a": 1}},
+		{hash(str("X"), integer(3), str("label"), str("q"), str("Hidden"), True, str("other"), integer(9)),
+			&p, point{X: 3, Label: "q"}},
+		{hash(str("Y"), integer(4)), &pp, &point{Y: 4}},
+		{NullValue, &pp, (*point)(nil)},
+		{integer(1), &any, int64(1)},
+		{NullValue, &any, nil},
+		{array(integer(1), str("a"), array()), &any, []interface{}{int64(1), "a", []interface{}{}}},
+		{hash(integer(1), False), &any, map[interface{}]interface{}{int64(1): false}},
+		{integer(7), &obj, Object(integer(7))},
+		{array(), &arr, array()},
+	}
+
+	for _, tt := range tests {
+		if err := FromObject(tt.obj, tt.target); err != nil {
+			t.Errorf("FromObject(%s) error: %s", tt.obj.Inspect(), err)
+			continue
+		}
+		got := reflect.ValueOf(tt.target).Elem().Interface()
+		if !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("FromObject(%s) wrong. want=%#v, got=%#v", tt.obj.Inspect(), tt.expected, got)
+		}
+	}
+}
+
+func TestFromObjectErrors(t *testing.T) {
+	var (
+		i  int
+		u  uint
+		i8 int8
+		a2 [2]int
+		is []int
+		p  point
+		ch chan int
+	)
+
+	tests := []struct {
+		obj      Object
+		target   interface{}
+		expected string
+	}{
+		{&Integer{Value: 1}, i, "object: FromObject target must be a non-nil pointer, got int"},
+		{&String{Value: "a"}, &i, "object: cannot convert STRING to int"},
+		{&Integer{Value: -1}, &u, "object: -1 overflows uint"},
+		{&Integer{Value: 300}, &i8, "object: 300 overflows int8"},
+		{&Array{Elements: []Object{&Integer{Value: 1}}}, &a2, "object: cannot convert ARRAY of length 1 to [2]int"},
+		{&Array{Elements: []Object{&Integer{Value: 1}, True}}, &is, "object: cannot convert BOOLEAN to int (at [1])"},
+		{&Hash{Pairs: map[HashKey]HashPair{
+			(&String{Value: "X"}).HashKey(): {Key: &String{Value: "X"}, Value: &String{Value: "x"}},
+		}}, &p, "object: cannot convert STRING to int (at .X)"},
+		{&Integer{Value: 1}, &ch, "object: cannot convert INTEGER to unsupported type chan int"},
+	}
+
+	for _, tt := range tests {
+		err := FromObject(tt.obj, tt.target)
+		if err == nil {
+			t.Errorf("FromObject(%s) expected error", tt.obj.Inspect())
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error. want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
+func TestGoFuncBuiltin(t *testing.T) {
+	funcs := map[string]interface{}{
+		"add":  func(a, b int) int { return a + b },
+		"join": func(sep string, parts ...string) string { return strings.Join(parts, sep) },
+		"check": func(n int) (bool, error) {
+			if n < 0 {
+				return false, errors.New("negative")
+			}
+			return n%2 == 0, nil
+		},
+		"none": func() {},
+		"len":  func(p point) int { return p.X + p.Y },
+	}
+
+	builtins := map[string]*Builtin{}
+	for name, fn := range funcs {
+		obj, err := ToObject(fn)
+		if err != nil {
+			t.Fatalf("ToObject(%s) error: %s", name, err)
+		}
+		builtin, ok := obj.(*Builtin)
+		if !ok {
+			t.Fatalf("ToObject(%s) is not Builtin. got=%T", name, obj)
+		}
+		builtins[name] = builtin
+	}
+
+	str := func(v string) Object { return &String{Value: v} }
+	integer := func(v int64) Object { return &Integer{Value: v} }
+
+	tests := []struct {
+		name     string
+		args     []Object
+		expected interface{}
+	}{
+		{"add", []Object{integer(1), integer(2)}, "3"},
+		{"add", []Object{integer(1)}, &Error{Message: "wrong number of arguments. got=1, want=2"}},
+		{"add", []Object{integer(1), str("a")},
+			&Error{Message: "object: cannot convert STRING to int (at argument 2)"}},
+		{"join", []Object{str("-"), str("a"), str("b")}, "a-b"},
+		{"join", []Object{str("-")}, ""},
+		{"join", []Object{}, &Error{Message: "wrong number of arguments. got=0, want at least 1"}},
+		{"check", []Object{integer(4)}, "true"},
+		{"check", []Object{integer(-1)}, &Error{Message: "negative"}},
+		{"none", []Object{}, nil},
+		{"len", []Object{&Hash{Pairs: map[HashKey]HashPair{
+			(&String{Value: "X"}).HashKey(): {Key: str("X"), Value: integer(2)},
+		}}}, "2"},
+	}
+
+	for _, tt := range tests {
+		result := builtins[tt.name].Fn(tt.args...)
+
+		switch expected := tt.expected.(type) {
+		case nil:
+			if result != nil {
+				t.Errorf("%s: expected nil. got=%T (%+v)", tt.name, result, result)
+			}
+		case string:
+			if result == nil || result.Inspect() != expected {
+				t.Errorf("%s: wrong result. want=%q, got=%+v", tt.name, expected, result)
+			}
+		case *Error:
+			errObj, ok := result.(*Error)
+			if !ok {
+				t.Errorf("%s: object is not Error. got=%T (%+v)", tt.name, result, result)
+				continue
+			}
+			if errObj.Message != expected.Message {
+				t.Errorf("%s: wrong error message. want=%q, got=%q", tt.name, expected.Message, errObj.Message)
+			}
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package object
+
+import (
+	"context"
+	"errors"
+)
+
+// Limits bound the work of a running program. A zero field is no limit, except MaxDepth.
+type Limits struct {
+	// MaxSteps is the number of steps: instructions in the vm, evaluated nodes in the evaluator.
+	MaxSteps int64
+	// MaxAllocations is the number of objects made, where an array or a hash also counts
+	// its elements and a string counts every 8 bytes. Literals are constants of the program,
+	// and booleans and null are shared, so they are not made and not counted.
+	MaxAllocations int64
+	// MaxDepth is the number of nested function calls, including the main program.
+	// Zero is DefaultMaxDepth, not no limit, so a recursion can't overflow the Go stack.
+	MaxDepth int
+}
+
+// DefaultMaxDepth is the call depth of a program whose Limits don't set MaxDepth.
+const DefaultMaxDepth = 1024
+
+var (
+	ErrStepLimit       = errors.New("step limit exceeded")
+	ErrAllocationLimit = errors.New("allocation limit exceeded")
+)
+
+// LimitError stops a program when a limit trips or the context is done.
+// Err is ErrStepLimit, ErrAllocationLimit or the error of the context.
+type LimitError struct {
+	Err error
+}
+
+func (e *LimitError) Error() string { return "execution stopped: " + e.Err.Error() }
+func (e *LimitError) Unwrap() error { return e.Err }
+
+// how often Step looks at the context
+const contextCheckInterval = 1024
+
+// Budget counts steps and allocations of a program against Limits.
+type Budget struct {
+	ctx    context.Context
+	limits Limits
+
+	steps       int64
+	allocations int64
+}
+
+func NewBudget(ctx context.Context, limits Limits) *Budget {
+	return &Budget{ctx: ctx, limits: limits}
+}
+
+// Step counts a step. It returns a *LimitError when the program has to stop.
+func (b *Budget) Step() error {
+	b.steps++
+	if b.limits.MaxSteps > 0 && b.steps > b.limits.MaxSteps {
+		return &LimitError{Err: ErrStepLimit}
+	}
+
+	// ctx.Err()はlockを取るので毎回は見ない
+	if b.steps%contextCheckInterval == 0 {
+		if err := b.ctx.Err(); err != nil {
+			return &LimitError{Err: err}
+		}
+	}
+	return nil
+}
+
+// Allocate counts obj as made by the program.
+func (b *Budget) Allocate(obj Object) error {
+	if b.limits.MaxAllocations <= 0 {
+		return nil
+	}
+
+	b.allocations += allocationSize(obj)
+	if b.allocations > b.limits.MaxAllocations {
+		return &LimitError{Err: ErrAllocationLimit}
+	}
+	return nil
+}
+
+// MaxDepth returns the call depth b allows. A nil b allows DefaultMaxDepth.
+func (b *Budget) MaxDepth() int {
+	if b == nil || b.limits.MaxDepth <= 0 {
+		return DefaultMaxDepth
+	}
+	return b.limits.MaxDepth
+}
+
+func allocationSize(obj Object) int64 {
+	switch obj := obj.(type) {
+	case *Boolean, *Null, *Error:
+		// 共有される値と、プログラムを止めるエラーは数えない
+		return 0
+	case *Array:
+		return 1 + int64(len(obj.Elements))
+	case *Hash:
+		return 1 + int64(len(obj.Pairs))
+	case *String:
+		return 1 + int64(len(obj.Value)/8)
+	default:
+		return 1
+	}
+}
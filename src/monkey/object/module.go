@@ -0,0 +1,111 @@
+package object
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Loader reads the source of the file imported as path.
+type Loader func(path string) ([]byte, error)
+
+// ErrImportDenied is the error of an import the Loader doesn't allow.
+var ErrImportDenied = errors.New("import not allowed")
+
+// FileLoader reads any file. It is the Loader of the compiler and the evaluator by default.
+func FileLoader(path string) ([]byte, error) {
+	return ioutil.ReadFile(path)
+}
+
+// DenyImports is a Loader that allows no import.
+func DenyImports(path string) ([]byte, error) {
+	return nil, fmt.Errorf("import %s: %w", path, ErrImportDenied)
+}
+
+// DirLoader returns a Loader that reads only the files under the directory root.
+func DirLoader(root string) Loader {
+	return func(path string) ([]byte, error) {
+		absRoot, err := filepath.Abs(root)
+		if err != nil {
+			return nil, err
+		}
+		absPath, err := filepath.Abs(path)
+		if err != nil {
+			return nil, err
+		}
+		// "../"でrootの外に出るpathも、Absで解決してから比べる
+		rel, err := filepath.Rel(absRoot, absPath)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return nil, fmt.Errorf("import %s: %w", path, ErrImportDenied)
+		}
+		return ioutil.ReadFile(absPath)
+	}
+}
+
+// Modules holds the modules imported by a program, by the path of their file.
+// A module is evaluated once, and the following imports get the same value.
+type Modules struct {
+	loaded map[string]Object
+
+	// modules being evaluated, outermost first
+	loading []string
+
+	loader Loader
+}
+
+// SetLoader sets the Loader of the following imports. A nil loader is FileLoader.
+func (m *Modules) SetLoader(loader Loader) {
+	m.loader = loader
+}
+
+// Load reads the source of the file imported as path with the Loader of m.
+func (m *Modules) Load(path string) ([]byte, error) {
+	if m.loader == nil {
+		return FileLoader(path)
+	}
+	return m.loader(path)
+}
+
+func NewModules() *Modules {
+	return &Modules{loaded: map[string]Object{}}
+}
+
+// Get returns the module loaded from path.
+func (m *Modules) Get(path string) (Object, bool) {
+	module, ok := m.loaded[path]
+	return module, ok
+}
+
+// Start marks path as being loaded, until Done.
+// It returns an error if path is already being loaded, that is, the modules import each other.
+func (m *Modules) Start(path string) error {
+	for i, p := range m.loading {
+		if p == path {
+			cycle := append(append([]string{}, m.loading[i:]...), path)
+			return &ImportCycleError{Cycle: cycle}
+		}
+	}
+	m.loading = append(m.loading, path)
+	return nil
+}
+
+// Done ends the loading of path started last. A nil module is not kept, so that
+// a module that failed is loaded again by the next import.
+func (m *Modules) Done(path string, module Object) {
+	m.loading = m.loading[:len(m.loading)-1]
+	if module != nil {
+		m.loaded[path] = module
+	}
+}
+
+// ImportCycleError is an import of a module that is still being loaded.
+type ImportCycleError struct {
+	// Cycle is the paths of the modules, from the first import of the module to the one again.
+	Cycle []string
+}
+
+func (e *ImportCycleError) Error() string {
+	return "import cycle: " + strings.Join(e.Cycle, " -> ")
+}
@@ -4,18 +4,26 @@ import (
 	"bytes"
 	"fmt"
 	"hash/fnv"
+	"math"
 	"monkey/ast"
 	"monkey/code"
+	"monkey/token"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 type ObjectType string
 
 const (
 	INTEGER_OBJ           = "INTEGER"
+	FLOAT_OBJ             = "FLOAT"
 	BOOLEAN_OBJ           = "BOOLEAN"
 	NULL_OBJ              = "NULL"
 	RETURN_VALUE_OBJ      = "RETURN_VALUE"
+	BREAK_OBJ             = "BREAK"
+	CONTINUE_OBJ          = "CONTINUE"
 	ERROR_OBJ             = "ERROR"
 	FUNCTION_OBJ          = "FUNCTION"
 	STRING_OBJ            = "STRING"
@@ -24,6 +32,7 @@ const (
 	HASH_OBJ              = "HASH"
 	COMPILED_FUNCTION_OBJ = "COMPILED_FUNCTION_OBJ"
 	CLOSURE_OBJ           = "CLOSURE"
+	CELL_OBJ              = "CELL"
 )
 
 type Object interface {
@@ -39,6 +48,22 @@ type Integer struct {
 func (i *Integer) Inspect() string  { return fmt.Sprintf("%d", i.Value) }
 func (i *Integer) Type() ObjectType { return INTEGER_OBJ }
 
+// Float
+//  64bit IEEE 754
+type Float struct {
+	Value float64
+}
+
+func (f *Float) Type() ObjectType { return FLOAT_OBJ }
+func (f *Float) Inspect() string {
+	s := strconv.FormatFloat(f.Value, 'g', -1, 64)
+	// 整数と見分けがつくように 2 ではなく 2.0 と表示する
+	if !strings.ContainsAny(s, ".eIN") {
+		s += ".0"
+	}
+	return s
+}
+
 // Boolean
 type Boolean struct {
 	Value bool
@@ -47,12 +72,23 @@ type Boolean struct {
 func (b *Boolean) Type() ObjectType { return BOOLEAN_OBJ }
 func (b *Boolean) Inspect() string  { return fmt.Sprintf("%t", b.Value) }
 
+// True and False are the only Booleans, so that they can be compared by pointer.
+// The evaluator, the vm and the builtins all use them.
+var (
+	True  = &Boolean{Value: true}
+	False = &Boolean{Value: false}
+)
+
 // Null
 type Null struct{}
 
 func (n *Null) Type() ObjectType { return NULL_OBJ }
 func (n *Null) Inspect() string  { return "null" }
 
+// NullValue is the only Null, shared like True and False so that values made
+// outside an engine, such as by ToObject, are falsy in both of them.
+var NullValue = &Null{}
+
 // return
 type ReturnValue struct {
 	Value Object
@@ -61,32 +97,126 @@ type ReturnValue struct {
 func (rv *ReturnValue) Type() ObjectType { return RETURN_VALUE_OBJ }
 func (rv *ReturnValue) Inspect() string  { return rv.Value.Inspect() }
 
+// break, continue
+//  like ReturnValue, these unwind the blocks up to the enclosing while loop.
+type Break struct{}
+
+func (b *Break) Type() ObjectType { return BREAK_OBJ }
+func (b *Break) Inspect() string  { return "break" }
+
+type Continue struct{}
+
+func (c *Continue) Type() ObjectType { return CONTINUE_OBJ }
+func (c *Continue) Inspect() string  { return "continue" }
+
 // error
+//  Pos is where the error happened, if it is known.
+//  calls records the function calls the error has returned through.
 type Error struct {
 	Message string
+	Pos     token.Position
+
+	calls []TraceFrame
 }
 
 func (e *Error) Type() ObjectType { return ERROR_OBJ }
-func (e *Error) Inspect() string  { return "ERROR: " + e.Message }
+func (e *Error) Inspect() string {
+	if e.Pos.IsValid() {
+		return "ERROR: " + e.Pos.String() + ": " + e.Message
+	}
+	return "ERROR: " + e.Message
+}
 
 // Environment
 //  変数の保管
 type Environment struct {
 	store map[string]Object
 	outer *Environment
+
+	// 外側のEnvironmentから探す(closureに古いBudgetが残らないように)
+	budget *Budget
+
+	// importされたmoduleの一番外側のEnvironmentだけが持つ.
+	// 変数はmoduleごとに別で、budgetとmodulesはimporterのものを使う
+	importer *Environment
+	modules  *Modules
+
+	// 関数呼び出しの深さ. mainのprogramが1
+	depth int
 }
 
 func NewEnclosedEnvironment(outer *Environment) *Environment {
 	env := NewEnvironment()
 	env.outer = outer
+	env.depth = outer.depth
 	return env
 }
 
+// NewModuleEnvironment makes the environment of a module imported from importer.
+// The module has its own variables, and shares the budget and the imported modules of importer.
+func NewModuleEnvironment(importer *Environment) *Environment {
+	env := NewEnvironment()
+	env.importer = importer
+	env.depth = importer.Depth() + 1
+	return env
+}
+
+// Modules returns the modules imported by the program e belongs to.
+func (e *Environment) Modules() *Modules {
+	for e.outer != nil {
+		e = e.outer
+	}
+	if e.importer != nil {
+		return e.importer.Modules()
+	}
+	if e.modules == nil {
+		e.modules = NewModules()
+	}
+	return e.modules
+}
+
+// Names returns the names defined in e itself, sorted.
+func (e *Environment) Names() []string {
+	names := make([]string, 0, len(e.store))
+	for name := range e.store {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// SetBudget sets the budget of evaluation in e and the environments enclosed by it.
+// A nil b removes it.
+func (e *Environment) SetBudget(b *Budget) {
+	e.budget = b
+}
+
+// Budget returns the budget of e or the nearest outer environment, or nil.
+func (e *Environment) Budget() *Budget {
+	for e != nil {
+		if e.budget != nil {
+			return e.budget
+		}
+		if e.outer == nil {
+			e = e.importer
+		} else {
+			e = e.outer
+		}
+	}
+	return nil
+}
+
 func NewEnvironment() *Environment {
 	s := make(map[string]Object)
-	return &Environment{store: s}
+	return &Environment{store: s, depth: 1}
 }
 
+// Depth returns the number of nested function calls e is evaluated in, the main program being 1.
+func (e *Environment) Depth() int { return e.depth }
+
+// SetDepth sets the call depth of e. The evaluator sets it in the environment of a called function.
+func (e *Environment) SetDepth(depth int) { e.depth = depth }
+
 func (e *Environment) Get(name string) (Object, bool) {
 	obj, ok := e.store[name]
 	if !ok && e.outer != nil {
@@ -100,11 +230,25 @@ func (e *Environment) Set(name string, val Object) Object {
 	return val
 }
 
+// Assign sets val to name in the environment where name is defined.
+// It reports false if name is not defined.
+func (e *Environment) Assign(name string, val Object) (Object, bool) {
+	if _, ok := e.store[name]; ok {
+		e.store[name] = val
+		return val, true
+	}
+	if e.outer != nil {
+		return e.outer.Assign(name, val)
+	}
+	return nil, false
+}
+
 // Function
 type Function struct {
 	Parameters []*ast.Identifier
 	Body       *ast.BlockStatement
 	Env        *Environment
+	Name       string
 }
 
 func (f *Function) Type() ObjectType { return FUNCTION_OBJ }
@@ -134,6 +278,24 @@ type String struct {
 func (s *String) Type() ObjectType { return STRING_OBJ }
 func (s *String) Inspect() string  { return s.Value }
 
+// Len returns the number of characters (runes) in s, not bytes.
+func (s *String) Len() int { return utf8.RuneCountInString(s.Value) }
+
+// Index returns the i-th character of s as a String.
+// It reports false when i is out of range.
+func (s *String) Index(i int64) (*String, bool) {
+	if i < 0 {
+		return nil, false
+	}
+	for _, r := range s.Value {
+		if i == 0 {
+			return &String{Value: string(r)}, true
+		}
+		i--
+	}
+	return nil, false
+}
+
 // builtin function
 type BuiltinFunction func(args ...Object) Object
 type Builtin struct {
@@ -221,6 +383,14 @@ func (i *Integer) HashKey() HashKey {
 }
 
 // TODO: hash の衝突の考慮をするべき
+// 整数値のFloatはIntegerと同じkeyになる(1 == 1.0 なので {1: x}[1.0] でも引ける)
+func (f *Float) HashKey() HashKey {
+	if f.Value == math.Trunc(f.Value) && math.Abs(f.Value) < 1<<63 {
+		return HashKey{Type: INTEGER_OBJ, Value: uint64(int64(f.Value))}
+	}
+	return HashKey{Type: f.Type(), Value: math.Float64bits(f.Value)}
+}
+
 func (s *String) HashKey() HashKey {
 	h := fnv.New64a()
 	h.Write([]byte(s.Value))
@@ -233,6 +403,8 @@ type CompiledFunction struct {
 	Instructions  code.Instructions
 	NumLocals     int
 	NumParameters int
+	SourceMap     code.SourceMap
+	Name          string
 }
 
 func (cf *CompiledFunction) Type() ObjectType { return COMPILED_FUNCTION_OBJ }
@@ -250,3 +422,15 @@ func (c *Closure) Type() ObjectType { return CLOSURE_OBJ }
 func (c *Closure) Inspect() string {
 	return fmt.Sprintf("closure[%p]", c)
 }
+
+// Cell holds a local variable which is captured by closures and assigned.
+// The function and the closures share the cell, so they see each other's assignments.
+// Cells are only in the slots of locals and free variables, never values of the program.
+type Cell struct {
+	Value Object
+}
+
+func (c *Cell) Type() ObjectType { return CELL_OBJ }
+func (c *Cell) Inspect() string {
+	return fmt.Sprintf("cell[%s]", c.Value.Inspect())
+}
@@ -1,6 +1,9 @@
 package object
 
-import "testing"
+import (
+	"math"
+	"testing"
+)
 
 func TestStringHashKey(t *testing.T) {
 	hello1 := &String{Value: "Hello world"}
@@ -20,3 +23,89 @@ func TestStringHashKey(t *testing.T) {
 		t.Errorf("strings with different content have same hash keys")
 	}
 }
+
+func TestFloatHashKey(t *testing.T) {
+	one := &Integer{Value: 1}
+	oneFloat := &Float{Value: 1.0}
+	half := &Float{Value: 0.5}
+
+	if one.HashKey() != oneFloat.HashKey() {
+		t.Errorf("1 and 1.0 have different hash keys")
+	}
+
+	if half.HashKey() != (&Float{Value: 0.5}).HashKey() {
+		t.Errorf("floats with same value have different hash keys")
+	}
+
+	if half.HashKey() == (&Integer{Value: 0}).HashKey() {
+		t.Errorf("0.5 and 0 have same hash keys")
+	}
+}
+
+func TestFloatInspect(t *testing.T) {
+	tests := []struct {
+		value    float64
+		expected string
+	}{
+		{2, "2.0"},
+		{-0.25, "-0.25"},
+		{1e21, "1e+21"},
+		{math.Inf(1), "+Inf"},
+	}
+
+	for _, tt := range tests {
+		f := &Float{Value: tt.value}
+		if f.Inspect() != tt.expected {
+			t.Errorf("wrong Inspect(). want=%q, got=%q", tt.expected, f.Inspect())
+		}
+	}
+}
+
+func TestSlice(t *testing.T) {
+	arr := &Array{Elements: []Object{&Integer{Value: 1}, &Integer{Value: 2}, &Integer{Value: 3}}}
+	str := &String{Value: "日本語です"}
+	i := func(v int64) Object { return &Integer{Value: v} }
+
+	tests := []struct {
+		left      Object
+		low, high Object
+		expected  string
+	}{
+		{arr, i(1), i(3), "[2, 3]"},
+		{arr, nil, i(2), "[1, 2]"},
+		{arr, i(1), nil, "[2, 3]"},
+		{arr, &Null{}, &Null{}, "[1, 2, 3]"},
+		// 範囲外は切り詰める
+		{arr, i(-5), i(99), "[1, 2, 3]"},
+		{arr, i(2), i(1), "[]"},
+		{str, i(1), i(3), "本語"},
+		{str, i(3), nil, "です"},
+		{str, i(10), nil, ""},
+	}
+
+	for _, tt := range tests {
+		result, err := Slice(tt.left, tt.low, tt.high)
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		if result.Inspect() != tt.expected {
+			t.Errorf("wrong slice of %s. want=%q, got=%q", tt.left.Inspect(), tt.expected, result.Inspect())
+		}
+	}
+
+	// 元の配列とは別のものになる
+	result, _ := Slice(arr, nil, nil)
+	result.(*Array).Elements[0] = i(100)
+	if arr.Elements[0].(*Integer).Value != 1 {
+		t.Errorf("slice shares elements with the array")
+	}
+
+	_, err := Slice(&Integer{Value: 1}, nil, nil)
+	if err == nil || err.Error() != "slice operator not supported: INTEGER" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+	_, err = Slice(arr, &String{Value: "a"}, nil)
+	if err == nil || err.Error() != "slice index must be INTEGER, got STRING" {
+		t.Errorf("wrong error. got=%v", err)
+	}
+}
@@ -0,0 +1,58 @@
+package object
+
+import "fmt"
+
+// Slice returns left[low:high] for an Array or a String.
+// low and high are Integers, or nil or Null when they are omitted.
+// They are clamped to the length like an index out of range gives null,
+// so a slice never fails because of the range. Strings are sliced by characters.
+func Slice(left, low, high Object) (Object, error) {
+	var length int
+	switch left := left.(type) {
+	case *Array:
+		length = len(left.Elements)
+	case *String:
+		length = left.Len()
+	default:
+		return nil, fmt.Errorf("slice operator not supported: %s", left.Type())
+	}
+
+	lo, err := sliceBound(low, 0, length)
+	if err != nil {
+		return nil, err
+	}
+	hi, err := sliceBound(high, length, length)
+	if err != nil {
+		return nil, err
+	}
+	if hi < lo {
+		hi = lo
+	}
+
+	switch left := left.(type) {
+	case *Array:
+		elements := make([]Object, hi-lo)
+		copy(elements, left.Elements[lo:hi])
+		return &Array{Elements: elements}, nil
+	default:
+		runes := []rune(left.(*String).Value)
+		return &String{Value: string(runes[lo:hi])}, nil
+	}
+}
+
+func sliceBound(bound Object, omitted, length int) (int, error) {
+	switch bound := bound.(type) {
+	case nil, *Null:
+		return omitted, nil
+	case *Integer:
+		if bound.Value < 0 {
+			return 0, nil
+		}
+		if bound.Value > int64(length) {
+			return length, nil
+		}
+		return int(bound.Value), nil
+	default:
+		return 0, fmt.Errorf("slice index must be INTEGER, got %s", bound.Type())
+	}
+}
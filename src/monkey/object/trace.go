@@ -0,0 +1,97 @@
+package object
+
+import (
+	"bytes"
+	"fmt"
+	"monkey/token"
+)
+
+const (
+	MainFunctionName      = "main"
+	AnonymousFunctionName = "fn"
+
+	// maxTraceFrames is how many frames StackTrace prints before eliding the middle.
+	maxTraceFrames = 100
+)
+
+// TraceFrame is a function call that was active when a runtime error happened.
+type TraceFrame struct {
+	Function string
+	Pos      token.Position // where the function was executing
+}
+
+// RuntimeError is an error raised while running a Monkey program.
+// It is returned by the vm and built from *Error by the evaluator.
+// Trace lists the active calls, innermost first. The last frame is the main program.
+type RuntimeError struct {
+	Message string
+	Trace   []TraceFrame
+}
+
+func (e *RuntimeError) Error() string {
+	if len(e.Trace) > 0 && e.Trace[0].Pos.IsValid() {
+		return e.Trace[0].Pos.String() + ": " + e.Message
+	}
+	return e.Message
+}
+
+// StackTrace formats the error like a Go panic.
+//
+//	runtime error: index operator not supported: INTEGER
+//
+//	inner(...)
+//		foo.mk:3:5
+//	main()
+//		foo.mk:9:1
+func (e *RuntimeError) StackTrace() string {
+	var out bytes.Buffer
+
+	fmt.Fprintf(&out, "runtime error: %s\n\n", e.Message)
+
+	for i, f := range e.Trace {
+		if len(e.Trace) > maxTraceFrames && i == maxTraceFrames/2 {
+			fmt.Fprintf(&out, "...%d frames elided...\n", len(e.Trace)-maxTraceFrames)
+		}
+		if len(e.Trace) > maxTraceFrames && i >= maxTraceFrames/2 && i < len(e.Trace)-maxTraceFrames/2 {
+			continue
+		}
+
+		if i == len(e.Trace)-1 {
+			fmt.Fprintf(&out, "%s()\n", f.Function)
+		} else {
+			fmt.Fprintf(&out, "%s(...)\n", f.Function)
+		}
+		fmt.Fprintf(&out, "\t%s\n", f.Pos)
+	}
+
+	return out.String()
+}
+
+// AddCall records that the error returned from a call of function at pos.
+// The evaluator calls it for each function the error passes through.
+func (e *Error) AddCall(function string, pos token.Position) {
+	e.calls = append(e.calls, TraceFrame{Function: function, Pos: pos})
+}
+
+// RuntimeError converts the error to a *RuntimeError with a stack trace.
+func (e *Error) RuntimeError() *RuntimeError {
+	// callsは呼び出し先の関数名と呼び出し位置の組.
+	// 関数iが実行していた位置はcalls[i-1]の呼び出し位置(最初はエラー位置)になる
+	trace := []TraceFrame{}
+	pos := e.Pos
+	for _, c := range e.calls {
+		trace = append(trace, TraceFrame{Function: c.Function, Pos: pos})
+		pos = c.Pos
+	}
+	trace = append(trace, TraceFrame{Function: MainFunctionName, Pos: pos})
+
+	return &RuntimeError{Message: e.Message, Trace: trace}
+}
+
+// FunctionName returns the name shown in stack traces for a function.
+func FunctionName(name string) string {
+	if name == "" {
+		return AnonymousFunctionName
+	}
+	return name
+}
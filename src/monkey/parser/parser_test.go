@@ -200,6 +200,33 @@ func testIntegerLiteral(t *testing.T, il ast.Expression, value int64) bool {
 	return true
 }
 
+func TestFloatLiteralExpression(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected float64
+	}{
+		{"3.14;", 3.14},
+		{"1e-9", 1e-9},
+		{"2.5E+3", 2500},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		stmt := program.Statements[0].(*ast.ExpressionStatement)
+		literal, ok := stmt.Expression.(*ast.FloatLiteral)
+		if !ok {
+			t.Fatalf("exp not *ast.FloatLiteral. got=%T", stmt.Expression)
+		}
+		if literal.Value != tt.expected {
+			t.Errorf("literal.Value not %g. got=%g", tt.expected, literal.Value)
+		}
+	}
+}
+
 func TestBooleanExpression(t *testing.T) {
 	input := "true;"
 
@@ -477,6 +504,38 @@ func TestOperatorPrecedenceParsing(t *testing.T) {
 			"add(a * b[2], b[1], 2 * [1,2][1])",
 			"add((a * (b[2])), (b[1]), (2 * ([1, 2][1])))",
 		},
+		{
+			"a = b = 1 + 2 * 3",
+			"(a = (b = (1 + (2 * 3))))",
+		},
+		{
+			"a += b == c",
+			"(a += (b == c))",
+		},
+		{
+			"a *= f(b -= 1)",
+			"(a *= f((b -= 1)))",
+		},
+		{
+			"a % b * c + d % e",
+			"(((a % b) * c) + (d % e))",
+		},
+		{
+			"a <= b == c >= d",
+			"((a <= b) == (c >= d))",
+		},
+		{
+			"a || b && c == d",
+			"(a || (b && (c == d)))",
+		},
+		{
+			"a && b || c && d",
+			"((a && b) || (c && d))",
+		},
+		{
+			"x = a || b",
+			"(x = (a || b))",
+		},
 	}
 
 	for _, tt := range tests {
@@ -753,6 +812,33 @@ func TestStringLiteralExpression(t *testing.T) {
 	}
 }
 
+func TestImportExpression(t *testing.T) {
+	input := `let m = import "lib/m.mk"; import "/abs/n.mk"`
+
+	l := lexer.NewWithFilename("src/main.mk", input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	let := program.Statements[0].(*ast.LetStatement)
+	exp, ok := let.Value.(*ast.ImportExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.ImportExpression. got=%T", let.Value)
+	}
+	if exp.Path.Value != "lib/m.mk" {
+		t.Errorf("exp.Path.Value not %q. got=%q", "lib/m.mk", exp.Path.Value)
+	}
+	// 相対パスはimportしたファイルのdirectoryから
+	if exp.File() != "src/lib/m.mk" {
+		t.Errorf("exp.File() not %q. got=%q", "src/lib/m.mk", exp.File())
+	}
+
+	stmt := program.Statements[1].(*ast.ExpressionStatement)
+	if file := stmt.Expression.(*ast.ImportExpression).File(); file != "/abs/n.mk" {
+		t.Errorf("File() not %q. got=%q", "/abs/n.mk", file)
+	}
+}
+
 func TestParsingArrayLiterals(t *testing.T) {
 	input := "[1, 2 * 2, 3 + 3]"
 
@@ -812,6 +898,45 @@ func TestParsingIndexExpressions(t *testing.T) {
 
 }
 
+func TestParsingSliceExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"a[1:3]", "(a[1:3])"},
+		{"a[:2]", "(a[:2])"},
+		{"a[1:]", "(a[1:])"},
+		{"a[:]", "(a[:])"},
+		{"f(x)[i + 1:len(s)][0]", "((f(x)[(i + 1):len(s)])[0])"},
+		{`{"k": a[1:]}`, `{k:(a[1:])}`},
+	}
+
+	for _, tt := range tests {
+		l := lexer.New(tt.input)
+		p := New(l)
+		program := p.ParseProgram()
+		checkParserErrors(t, p)
+
+		actual := program.String()
+		if actual != tt.expected {
+			t.Errorf("expected=%q, got=%q", tt.expected, actual)
+		}
+	}
+
+	program := New(lexer.New("s[1:]")).ParseProgram()
+	exp, ok := program.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.SliceExpression)
+	if !ok {
+		t.Fatalf("exp not *ast.SliceExpression. got=%T",
+			program.Statements[0].(*ast.ExpressionStatement).Expression)
+	}
+	if !testIdentifier(t, exp.Left, "s") || !testIntegerLiteral(t, exp.Low, 1) {
+		return
+	}
+	if exp.High != nil {
+		t.Errorf("exp.High is not nil. got=%s", exp.High)
+	}
+}
+
 // Hash
 func TestParsingHashLiteralsStringKeys(t *testing.T) {
 	input := `{"one": 1, "two": 2, "three": 3}`
@@ -928,3 +1053,145 @@ func TestParsingHashLiteralsWithExpressions(t *testing.T) {
 		testFunc(value)
 	}
 }
+
+func TestParserErrorPositions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"let x 5;", "test.mk:1:7: expected next token to be =, got INT instead"},
+		{"let x = 1;\nlet = 2;", "test.mk:2:5: expected next token to be IDENT, got = instead"},
+		{"1 +\n  ;", "test.mk:2:3: no prefix parse function for ; found"},
+		{"if (x) { break; }", "test.mk:1:10: break outside loop"},
+		{"while (x) { fn() { continue; } }", "test.mk:1:20: continue outside loop"},
+		{"x + 1 = 2", "test.mk:1:1: cannot assign to (x + 1)"},
+		{"1.5e999", `test.mk:1:1: could not parse "1.5e999" as float`},
+		{"f() += 2", "test.mk:1:1: cannot assign to f()"},
+		{"import lib", "test.mk:1:8: expected next token to be STRING, got IDENT instead"},
+		// lexerのエラー
+		{`let s = "a\qb";`, `test.mk:1:11: unknown escape sequence \q`},
+		{`let s = "abc`, "test.mk:1:9: string literal not terminated"},
+		{"1 # 2", "test.mk:1:3: illegal character '#'"},
+		{"a & b", "test.mk:1:3: illegal character '&'"},
+		{"a | b", "test.mk:1:3: illegal character '|'"},
+	}
+
+	for _, tt := range tests {
+		l := lexer.NewWithFilename("test.mk", tt.input)
+		p := New(l)
+		p.ParseProgram()
+
+		errors := p.Errors()
+		if len(errors) == 0 {
+			t.Fatalf("expected parser errors for %q", tt.input)
+		}
+		if errors[0] != tt.expected {
+			t.Errorf("wrong error. expected=%q, got=%q", tt.expected, errors[0])
+		}
+	}
+}
+
+func TestNodePositions(t *testing.T) {
+	input := `let add = fn(a, b) {
+  a + b
+};
+add(1, [2, 3][0]);`
+
+	l := lexer.NewWithFilename("test.mk", input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	let := program.Statements[0].(*ast.LetStatement)
+	fn := let.Value.(*ast.FunctionLiteral)
+	infix := fn.Body.Statements[0].(*ast.ExpressionStatement).Expression
+	call := program.Statements[1].(*ast.ExpressionStatement).Expression.(*ast.CallExpression)
+	index := call.Arguments[1]
+
+	tests := []struct {
+		node       ast.Node
+		start, end string
+	}{
+		{let, "test.mk:1:1", "test.mk:3:2"},
+		{fn, "test.mk:1:11", "test.mk:3:2"},
+		{infix, "test.mk:2:3", "test.mk:2:8"},
+		{call, "test.mk:4:1", "test.mk:4:18"},
+		{index, "test.mk:4:8", "test.mk:4:17"},
+	}
+
+	for _, tt := range tests {
+		if tt.node.Pos().String() != tt.start {
+			t.Errorf("wrong start of %q. expected=%s, got=%s", tt.node, tt.start, tt.node.Pos())
+		}
+		if tt.node.End().String() != tt.end {
+			t.Errorf("wrong end of %q. expected=%s, got=%s", tt.node, tt.end, tt.node.End())
+		}
+	}
+}
+
+func TestFunctionLiteralWithName(t *testing.T) {
+	input := `let myFunction = fn() { };`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	stmt, ok := program.Statements[0].(*ast.LetStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.LetStatement. got=%T",
+			program.Statements[0])
+	}
+
+	function, ok := stmt.Value.(*ast.FunctionLiteral)
+	if !ok {
+		t.Fatalf("stmt.Value is not ast.FunctionLiteral. got=%T", stmt.Value)
+	}
+
+	if function.Name != "myFunction" {
+		t.Errorf("function literal name wrong. want 'myFunction', got=%q", function.Name)
+	}
+}
+
+func TestWhileStatement(t *testing.T) {
+	input := `while (x < y) { if (x) { break; } continue; x }`
+
+	l := lexer.New(input)
+	p := New(l)
+	program := p.ParseProgram()
+	checkParserErrors(t, p)
+
+	if len(program.Statements) != 1 {
+		t.Fatalf("program.Statements does not contain 1 statement. got=%d",
+			len(program.Statements))
+	}
+
+	stmt, ok := program.Statements[0].(*ast.WhileStatement)
+	if !ok {
+		t.Fatalf("program.Statements[0] is not ast.WhileStatement. got=%T",
+			program.Statements[0])
+	}
+
+	if !testInfixExpression(t, stmt.Condition, "x", "<", "y") {
+		return
+	}
+
+	if len(stmt.Body.Statements) != 3 {
+		t.Fatalf("body is not 3 statements. got=%d", len(stmt.Body.Statements))
+	}
+
+	ifExp := stmt.Body.Statements[0].(*ast.ExpressionStatement).Expression.(*ast.IfExpression)
+	if _, ok := ifExp.Consequence.Statements[0].(*ast.BreakStatement); !ok {
+		t.Errorf("consequence is not ast.BreakStatement. got=%T", ifExp.Consequence.Statements[0])
+	}
+
+	if _, ok := stmt.Body.Statements[1].(*ast.ContinueStatement); !ok {
+		t.Errorf("Statements[1] is not ast.ContinueStatement. got=%T", stmt.Body.Statements[1])
+	}
+
+	last, ok := stmt.Body.Statements[2].(*ast.ExpressionStatement)
+	if !ok {
+		t.Fatalf("Statements[2] is not ast.ExpressionStatement. got=%T", stmt.Body.Statements[2])
+	}
+	testIdentifier(t, last.Expression, "x")
+}
@@ -38,6 +38,10 @@ func StartInterpreter(in io.Reader, out io.Writer) {
 		io.WriteString(out, "\n")
 
 		evaluated := evaluator.Eval(program, env)
+		if err, ok := evaluated.(*object.Error); ok {
+			io.WriteString(out, err.RuntimeError().StackTrace())
+			continue
+		}
 		if evaluated != nil {
 			io.WriteString(out, "Result: "+evaluated.Inspect())
 			io.WriteString(out, "\n")
@@ -90,10 +94,16 @@ func StartVm(in io.Reader, out io.Writer) {
 		code := comp.Bytecode()
 		constants = code.Constants
 
-		io.WriteString(out, "Bytecode:\n----\n"+code.Instructions.String()+"-------\n")
+		io.WriteString(out, "Bytecode:\n----\n")
+		compiler.Disassemble(out, code, symbolTable)
+		io.WriteString(out, "-------\n")
 
 		machine := vm.NewWithGlobalStore(code, globals)
 		err = machine.Run()
+		if rerr, ok := err.(*object.RuntimeError); ok {
+			io.WriteString(out, rerr.StackTrace())
+			continue
+		}
 		if err != nil {
 			fmt.Fprintf(out, "Woops! Executing bytecode failed:\n %s\n", err)
 			continue
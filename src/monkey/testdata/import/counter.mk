@@ -0,0 +1,5 @@
+let count = 0;
+let inc = fn() {
+	count += 1;
+	count
+};
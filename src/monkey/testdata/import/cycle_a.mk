@@ -0,0 +1 @@
+import "cycle_b.mk";
@@ -0,0 +1,5 @@
+let a = 1;
+if (a == 1) {
+	return 0;
+}
+let b = 2;
@@ -0,0 +1,2 @@
+let util = import "util/double.mk";
+let quad = fn(x) { util["double"](util["double"](x)) };
@@ -0,0 +1 @@
+let value = secret + 1;
@@ -0,0 +1 @@
+let double = fn(x) { x * 2 };
@@ -1,19 +1,75 @@
 package vm
 
 import (
+	"context"
 	"fmt"
+	"math"
 	"monkey/code"
 	"monkey/compiler"
 	"monkey/object"
 )
 
+// default limits of a VM
 const StackSize = 2048
 const GlobalsSize = 65536
-const MaxFrames = 1024
+const MaxFrames = object.DefaultMaxDepth
+
+// the stack and the frames start small and grow up to the limits
+const initialStackSize = 256
+const initialFrames = 64
+
+// Options are the limits of a VM. A field left zero takes the default.
+type Options struct {
+	// StackSize is the maximum number of values on the stack.
+	StackSize int
+	// MaxFrames is the maximum number of frames, including the one of the main program.
+	// If zero, Limits.MaxDepth is used.
+	MaxFrames int
+	// GlobalsSize is the number of global variables.
+	GlobalsSize int
+
+	// Limits stop RunContext. Values returned from builtins are counted as allocations.
+	Limits object.Limits
+
+	// Builtins are the functions of OpGetBuiltin, by index. If nil, object.Builtins are used.
+	// The compiler has to define the same indexes in its symbol table.
+	Builtins []*object.Builtin
+	// Globals are the global variables, kept by the caller between runs (as in the repl).
+	// If nil, GlobalsSize new ones are made.
+	Globals []object.Object
+}
+
+// defaultBuiltins are object.Builtins by index.
+var defaultBuiltins = func() []*object.Builtin {
+	builtins := make([]*object.Builtin, len(object.Builtins))
+	for i, def := range object.Builtins {
+		builtins[i] = def.Builtin
+	}
+	return builtins
+}()
+
+func (o Options) withDefaults() Options {
+	if o.StackSize <= 0 {
+		o.StackSize = StackSize
+	}
+	if o.MaxFrames <= 0 {
+		o.MaxFrames = o.Limits.MaxDepth
+	}
+	if o.MaxFrames <= 0 {
+		o.MaxFrames = MaxFrames
+	}
+	if o.GlobalsSize <= 0 {
+		o.GlobalsSize = GlobalsSize
+	}
+	if o.Builtins == nil {
+		o.Builtins = defaultBuiltins
+	}
+	return o
+}
 
-var True = &object.Boolean{Value: true}
-var False = &object.Boolean{Value: false}
-var Null = &object.Null{}
+var True = object.True
+var False = object.False
+var Null = object.NullValue
 
 type VM struct {
 	constants []object.Object
@@ -28,35 +84,57 @@ type VM struct {
 
 	frames      []*Frame
 	framesIndex int
+
+	options Options
+	budget  *object.Budget
+
+	// mainでreturnした
+	returned bool
 }
 
+// New makes a VM with the default limits.
 func New(bytecode *compiler.Bytecode) *VM {
-	mainFn := &object.CompiledFunction{Instructions: bytecode.Instructions}
+	return NewWithOptions(bytecode, Options{})
+}
+
+// NewWithOptions makes a VM with the limits in opts.
+func NewWithOptions(bytecode *compiler.Bytecode, opts Options) *VM {
+	opts = opts.withDefaults()
+
+	mainFn := &object.CompiledFunction{
+		Instructions: bytecode.Instructions,
+		SourceMap:    bytecode.SourceMap,
+	}
 	mainClosure := &object.Closure{Fn: mainFn}
 	mainFrame := NewFrame(mainClosure, 0)
 
-	frames := make([]*Frame, MaxFrames)
+	frames := make([]*Frame, minInt(initialFrames, opts.MaxFrames))
 	frames[0] = mainFrame
 
+	globals := opts.Globals
+	if globals == nil {
+		globals = make([]object.Object, opts.GlobalsSize)
+	}
+
 	return &VM{
 		constants: bytecode.Constants,
 
-		stack: make([]object.Object, StackSize),
+		stack: make([]object.Object, minInt(initialStackSize, opts.StackSize)),
 		sp:    0,
 
-		globals: make([]object.Object, GlobalsSize),
+		globals: globals,
 
 		frames:      frames,
 		framesIndex: 1,
+
+		options: opts,
 	}
 }
 
 // NewWithGlobalStore is used in repl.
 //  this can hold old GlobalStore.
 func NewWithGlobalStore(bytecode *compiler.Bytecode, s []object.Object) *VM {
-	vm := New(bytecode)
-	vm.globals = s
-	return vm
+	return NewWithOptions(bytecode, Options{Globals: s})
 }
 
 func (vm *VM) StackTop() object.Object {
@@ -71,9 +149,19 @@ func (vm *VM) currentFrame() *Frame {
 	return vm.frames[vm.framesIndex-1]
 }
 
-func (vm *VM) pushFrame(f *Frame) {
+func (vm *VM) pushFrame(f *Frame) error {
+	if vm.framesIndex >= len(vm.frames) {
+		if vm.framesIndex >= vm.options.MaxFrames {
+			return vm.stackOverflow()
+		}
+		frames := make([]*Frame, minInt(2*len(vm.frames), vm.options.MaxFrames))
+		copy(frames, vm.frames)
+		vm.frames = frames
+	}
+
 	vm.frames[vm.framesIndex] = f
 	vm.framesIndex++
+	return nil
 }
 
 func (vm *VM) popFrame() *Frame {
@@ -81,13 +169,60 @@ func (vm *VM) popFrame() *Frame {
 	return vm.frames[vm.framesIndex]
 }
 
+// Run executes the bytecode.
+// A failure is returned as *object.RuntimeError with the trace of active frames.
 func (vm *VM) Run() error {
+	return vm.RunContext(context.Background())
+}
+
+// RunContext is Run that stops when ctx is done or a limit in Options.Limits trips.
+// Then the error is *object.LimitError.
+func (vm *VM) RunContext(ctx context.Context) error {
+	vm.budget = object.NewBudget(ctx, vm.options.Limits)
+
+	err := vm.run()
+	if lerr, ok := err.(*object.LimitError); ok {
+		return lerr
+	}
+	if err != nil {
+		return vm.runtimeError(err)
+	}
+	return nil
+}
+
+// runtimeError builds the stack trace from the frames, innermost first.
+func (vm *VM) runtimeError(err error) *object.RuntimeError {
+	trace := make([]object.TraceFrame, 0, vm.framesIndex)
+
+	for i := vm.framesIndex - 1; i >= 0; i-- {
+		frame := vm.frames[i]
+
+		name := object.MainFunctionName
+		if i > 0 {
+			name = object.FunctionName(frame.cl.Fn.Name)
+		}
+
+		trace = append(trace, object.TraceFrame{
+			Function: name,
+			Pos:      frame.cl.Fn.SourceMap.Lookup(frame.ip),
+		})
+	}
+
+	return &object.RuntimeError{Message: err.Error(), Trace: trace}
+}
+
+func (vm *VM) run() error {
 	var ip int
 	var ins code.Instructions
 	var op code.Opcode
 
 	// fetch cycle
 	for vm.currentFrame().ip < len(vm.currentFrame().Instructions())-1 {
+		err := vm.budget.Step()
+		if err != nil {
+			return err
+		}
+
 		vm.currentFrame().ip++
 
 		ip = vm.currentFrame().ip
@@ -124,9 +259,9 @@ func (vm *VM) Run() error {
 
 			err := vm.pushClosure(int(constIndex), int(numFree))
 			if err != nil {
-				return nil
+				return err
 			}
-		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv:
+		case code.OpAdd, code.OpSub, code.OpMul, code.OpDiv, code.OpMod:
 			err := vm.executeBinaryOperation(op)
 			if err != nil {
 				return err
@@ -143,7 +278,8 @@ func (vm *VM) Run() error {
 			}
 		case code.OpPop:
 			vm.pop()
-		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan:
+		case code.OpEqual, code.OpNotEqual, code.OpGreaterThan,
+			code.OpLessThan, code.OpLessEqual, code.OpGreaterEqual:
 			err := vm.executeComparison(op)
 			if err != nil {
 				return err
@@ -180,13 +316,24 @@ func (vm *VM) Run() error {
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
 
+			if int(globalIndex) >= len(vm.globals) {
+				return vm.tooManyGlobals()
+			}
 			vm.globals[globalIndex] = vm.pop()
 
 		case code.OpGetGlobal:
 			globalIndex := code.ReadUint16(ins[ip+1:])
 			vm.currentFrame().ip += 2
 
-			err := vm.push(vm.globals[globalIndex])
+			if int(globalIndex) >= len(vm.globals) {
+				return vm.tooManyGlobals()
+			}
+			// letがまだ実行されていないglobal(途中でreturnしたmoduleの残りなど)はnull
+			global := vm.globals[globalIndex]
+			if global == nil {
+				global = Null
+			}
+			err := vm.push(global)
 			if err != nil {
 				return err
 			}
@@ -216,7 +363,7 @@ func (vm *VM) Run() error {
 			array := vm.buildArray(vm.sp-numElements, vm.sp)
 			vm.sp = vm.sp - numElements
 
-			err := vm.push(array)
+			err := vm.pushNew(array)
 			if err != nil {
 				return err
 			}
@@ -231,7 +378,7 @@ func (vm *VM) Run() error {
 			// hashに入れるobjectはstackからpopする
 			vm.sp = vm.sp - numElements
 
-			err = vm.push(hash)
+			err = vm.pushNew(hash)
 			if err != nil {
 				return err
 			}
@@ -248,6 +395,20 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpSlice:
+			high := vm.pop()
+			low := vm.pop()
+			left := vm.pop()
+
+			result, err := object.Slice(left, low, high)
+			if err != nil {
+				return err
+			}
+			err = vm.pushNew(result)
+			if err != nil {
+				return err
+			}
+
 		case code.OpCall:
 			numArgs := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
@@ -257,13 +418,51 @@ func (vm *VM) Run() error {
 				return err
 			}
 
+		case code.OpTailCall:
+			numArgs := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			err := vm.executeTailCall(int(numArgs))
+			if err != nil {
+				return err
+			}
+
+		case code.OpImport:
+			constIndex := code.ReadUint16(ins[ip+1:])
+			globalIndex := code.ReadUint16(ins[ip+3:])
+			vm.currentFrame().ip += 4
+
+			if int(globalIndex) >= len(vm.globals) {
+				return vm.tooManyGlobals()
+			}
+			// 2回目以降は最初に実行したときのmoduleを使う
+			if module := vm.globals[globalIndex]; module != nil {
+				err := vm.push(module)
+				if err != nil {
+					return err
+				}
+				break
+			}
+
+			fn := vm.constants[constIndex].(*object.CompiledFunction)
+			cl := &object.Closure{Fn: fn}
+			err := vm.push(cl)
+			if err != nil {
+				return err
+			}
+			err = vm.callClosure(cl, 0)
+			if err != nil {
+				return err
+			}
+
 		case code.OpGetBuiltin:
 			builtinIndex := code.ReadUint8(ins[ip+1:])
 			vm.currentFrame().ip += 1
 
-			definition := object.Builtins[builtinIndex]
-
-			err := vm.push(definition.Builtin)
+			if int(builtinIndex) >= len(vm.options.Builtins) {
+				return fmt.Errorf("undefined builtin %d", builtinIndex)
+			}
+			err := vm.push(vm.options.Builtins[builtinIndex])
 			if err != nil {
 				return err
 			}
@@ -271,6 +470,13 @@ func (vm *VM) Run() error {
 		case code.OpReturnValue:
 			returnValue := vm.pop()
 
+			// mainでのreturnはプログラムを終える. 値はLastPoppedStackElemで読める
+			if vm.framesIndex == 1 {
+				vm.currentFrame().ip = len(ins) - 1
+				vm.returned = true
+				break
+			}
+
 			frame := vm.popFrame()
 			// reset sp and -1(pop (*object.CompiledFunction))
 			vm.sp = frame.basePointer - 1
@@ -299,14 +505,81 @@ func (vm *VM) Run() error {
 			if err != nil {
 				return err
 			}
+
+		case code.OpSetFree:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			// 代入される自由変数はcellで、定義した関数や他のclosureと共有している
+			currentClosure := vm.currentFrame().cl
+			cell, err := cellOf(currentClosure.Free[freeIndex])
+			if err != nil {
+				return err
+			}
+			cell.Value = vm.pop()
+
+		case code.OpGetFreeCell:
+			freeIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			currentClosure := vm.currentFrame().cl
+			cell, err := cellOf(currentClosure.Free[freeIndex])
+			if err != nil {
+				return err
+			}
+			err = vm.push(cell.Value)
+			if err != nil {
+				return err
+			}
+
+		case code.OpMakeCell:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			vm.stack[frame.basePointer+int(localIndex)] = &object.Cell{Value: vm.pop()}
+
+		case code.OpGetLocalCell:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			cell, err := cellOf(vm.stack[frame.basePointer+int(localIndex)])
+			if err != nil {
+				return err
+			}
+			err = vm.push(cell.Value)
+			if err != nil {
+				return err
+			}
+
+		case code.OpSetLocalCell:
+			localIndex := code.ReadUint8(ins[ip+1:])
+			vm.currentFrame().ip += 1
+
+			frame := vm.currentFrame()
+			cell, err := cellOf(vm.stack[frame.basePointer+int(localIndex)])
+			if err != nil {
+				return err
+			}
+			cell.Value = vm.pop()
+
+		case code.OpCurrentClosure:
+			err := vm.push(vm.currentFrame().cl)
+			if err != nil {
+				return err
+			}
 		}
 	}
 	return nil
 }
 
 func (vm *VM) push(o object.Object) error {
-	if vm.sp >= StackSize {
-		return fmt.Errorf("stack overflow")
+	if vm.sp >= len(vm.stack) {
+		err := vm.growStack(vm.sp + 1)
+		if err != nil {
+			return err
+		}
 	}
 
 	vm.stack[vm.sp] = o
@@ -315,6 +588,50 @@ func (vm *VM) push(o object.Object) error {
 	return nil
 }
 
+// pushNew pushes an object made by the program, counting it in the budget.
+func (vm *VM) pushNew(o object.Object) error {
+	err := vm.budget.Allocate(o)
+	if err != nil {
+		return err
+	}
+	return vm.push(o)
+}
+
+// growStack makes the stack hold at least size values.
+func (vm *VM) growStack(size int) error {
+	if size <= len(vm.stack) {
+		return nil
+	}
+	if size > vm.options.StackSize {
+		return vm.stackOverflow()
+	}
+
+	newSize := 2 * len(vm.stack)
+	if newSize < size {
+		newSize = size
+	}
+	stack := make([]object.Object, minInt(newSize, vm.options.StackSize))
+	copy(stack, vm.stack)
+	vm.stack = stack
+	return nil
+}
+
+func (vm *VM) tooManyGlobals() error {
+	return fmt.Errorf("too many global variables (limit %d)", len(vm.globals))
+}
+
+// stackOverflow reports the depth of calls, not counting the main program.
+func (vm *VM) stackOverflow() error {
+	return fmt.Errorf("stack overflow (call depth %d)", vm.framesIndex-1)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
 // Memo: spが0を下回ったときのエラーハンドリングも入れたほうがよい
 func (vm *VM) pop() object.Object {
 	o := vm.stack[vm.sp-1]
@@ -322,6 +639,17 @@ func (vm *VM) pop() object.Object {
 	return o
 }
 
+// Result returns the value of the program after Run, like the evaluator does:
+// the value of a return in the main program, or of the last expression statement.
+// It is Null when the program ends with another statement.
+func (vm *VM) Result() object.Object {
+	ins := vm.frames[0].Instructions()
+	if vm.returned || len(ins) > 0 && code.Opcode(ins[len(ins)-1]) == code.OpPop {
+		return vm.LastPoppedStackElem()
+	}
+	return Null
+}
+
 // PopしたあとにPop前の一番上のstackを取りだす (for test)
 func (vm *VM) LastPoppedStackElem() object.Object {
 	return vm.stack[vm.sp]
@@ -339,6 +667,9 @@ func (vm *VM) executeBinaryOperation(op code.Opcode) error {
 	switch {
 	case leftType == object.INTEGER_OBJ && rightType == object.INTEGER_OBJ:
 		return vm.executeBinaryIntegerOperation(op, left, right)
+	case isNumber(left) && isNumber(right):
+		// 片方がfloatならfloatとして計算する
+		return vm.executeBinaryFloatOperation(op, left, right)
 	case leftType == object.STRING_OBJ && rightType == object.STRING_OBJ:
 		return vm.executeBinaryStringOperation(op, left, right)
 	default:
@@ -353,6 +684,34 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 
 	var result int64
 
+	// Goのpanicにせず、runtime errorにする
+	if rightValue == 0 && (op == code.OpDiv || op == code.OpMod) {
+		return fmt.Errorf("division by zero")
+	}
+
+	switch op {
+	case code.OpAdd:
+		result = leftValue + rightValue
+	case code.OpSub:
+		result = leftValue - rightValue
+	case code.OpMul:
+		result = leftValue * rightValue
+	case code.OpDiv:
+		result = leftValue / rightValue
+	case code.OpMod:
+		result = leftValue % rightValue
+	default:
+		return operatorError(op, left, right)
+	}
+	return vm.pushNew(&object.Integer{Value: result})
+}
+
+func (vm *VM) executeBinaryFloatOperation(op code.Opcode, left, right object.Object) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	var result float64
+
 	switch op {
 	case code.OpAdd:
 		result = leftValue + rightValue
@@ -362,30 +721,35 @@ func (vm *VM) executeBinaryIntegerOperation(op code.Opcode, left, right object.O
 		result = leftValue * rightValue
 	case code.OpDiv:
 		result = leftValue / rightValue
+	case code.OpMod:
+		result = math.Mod(leftValue, rightValue)
 	default:
-		return fmt.Errorf("unknown integer operator: %d", op)
+		return operatorError(op, left, right)
 	}
-	return vm.push(&object.Integer{Value: result})
+	return vm.pushNew(&object.Float{Value: result})
 }
 
 func (vm *VM) executeBinaryStringOperation(op code.Opcode, left, right object.Object) error {
 	if op != code.OpAdd {
-		return fmt.Errorf("unknown string operator: %d", op)
+		return operatorError(op, left, right)
 	}
 
 	leftValue := left.(*object.String).Value
 	rightValue := right.(*object.String).Value
 
-	return vm.push(&object.String{Value: leftValue + rightValue})
+	return vm.pushNew(&object.String{Value: leftValue + rightValue})
 }
 
 func (vm *VM) executeComparison(op code.Opcode) error {
 	right := vm.pop()
 	left := vm.pop()
 
-	if left.Type() == object.INTEGER_OBJ || right.Type() == object.INTEGER_OBJ {
+	if left.Type() == object.INTEGER_OBJ && right.Type() == object.INTEGER_OBJ {
 		return vm.executeIntegerComparison(op, left, right)
 	}
+	if isNumber(left) && isNumber(right) {
+		return vm.executeFloatComparison(op, left, right)
+	}
 
 	switch op {
 	// 比較対象がobject.Booleanのとき、Objectをそのまま比較する
@@ -395,9 +759,21 @@ func (vm *VM) executeComparison(op code.Opcode) error {
 	case code.OpNotEqual:
 		return vm.push(nativeBoolToBooleanObject(right != left))
 	default:
-		return fmt.Errorf("unknown operator: %d (%s %s)",
-			op, left.Type(), right.Type())
+		return operatorError(op, left, right)
+	}
+}
+
+// operatorError reports an operator which is not defined for the types of its operands,
+// with the same message as the evaluator.
+func operatorError(op code.Opcode, left, right object.Object) error {
+	operator, ok := code.Operator(op)
+	if !ok {
+		return fmt.Errorf("unknown operator: %d", op)
+	}
+	if left.Type() != right.Type() {
+		return fmt.Errorf("type mismatch: %s %s %s", left.Type(), operator, right.Type())
 	}
+	return fmt.Errorf("unknown operator: %s %s %s", left.Type(), operator, right.Type())
 }
 
 func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object) error {
@@ -411,11 +787,54 @@ func (vm *VM) executeIntegerComparison(op code.Opcode, left, right object.Object
 		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
 	case code.OpGreaterThan:
 		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
 	default:
-		return fmt.Errorf("unknown operator: %d", op)
+		return operatorError(op, left, right)
 	}
 }
 
+func (vm *VM) executeFloatComparison(op code.Opcode, left, right object.Object) error {
+	leftValue := toFloat(left)
+	rightValue := toFloat(right)
+
+	switch op {
+	case code.OpEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue == leftValue))
+	case code.OpNotEqual:
+		return vm.push(nativeBoolToBooleanObject(rightValue != leftValue))
+	case code.OpGreaterThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue > rightValue))
+	case code.OpLessThan:
+		return vm.push(nativeBoolToBooleanObject(leftValue < rightValue))
+	case code.OpGreaterEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue >= rightValue))
+	case code.OpLessEqual:
+		return vm.push(nativeBoolToBooleanObject(leftValue <= rightValue))
+	default:
+		return operatorError(op, left, right)
+	}
+}
+
+func isNumber(obj object.Object) bool {
+	return obj.Type() == object.INTEGER_OBJ || obj.Type() == object.FLOAT_OBJ
+}
+
+// toFloat converts an Integer or a Float to float64.
+func toFloat(obj object.Object) float64 {
+	switch obj := obj.(type) {
+	case *object.Integer:
+		return float64(obj.Value)
+	case *object.Float:
+		return obj.Value
+	}
+	return 0
+}
+
 func nativeBoolToBooleanObject(input bool) *object.Boolean {
 	if input {
 		return True
@@ -441,12 +860,14 @@ func (vm *VM) executeBangOperator() error {
 func (vm *VM) executeMinusOperator() error {
 	operand := vm.pop()
 
-	if operand.Type() != object.INTEGER_OBJ {
+	switch operand := operand.(type) {
+	case *object.Integer:
+		return vm.pushNew(&object.Integer{Value: -operand.Value})
+	case *object.Float:
+		return vm.pushNew(&object.Float{Value: -operand.Value})
+	default:
 		return fmt.Errorf("unsupported type for negation: %s", operand.Type())
 	}
-
-	value := operand.(*object.Integer).Value
-	return vm.push(&object.Integer{Value: -value})
 }
 
 func (vm *VM) buildArray(startIndex, endIndex int) object.Object {
@@ -484,6 +905,8 @@ func (vm *VM) executeIndexExpression(left, index object.Object) error {
 	switch {
 	case left.Type() == object.ARRAY_OBJ && index.Type() == object.INTEGER_OBJ:
 		return vm.executeArrayIndex(left, index)
+	case left.Type() == object.STRING_OBJ && index.Type() == object.INTEGER_OBJ:
+		return vm.executeStringIndex(left, index)
 	case left.Type() == object.HASH_OBJ:
 		return vm.executeHashIndex(left, index)
 	default:
@@ -503,6 +926,14 @@ func (vm *VM) executeArrayIndex(array, index object.Object) error {
 	return vm.push(arrayObject.Elements[i])
 }
 
+func (vm *VM) executeStringIndex(str, index object.Object) error {
+	ch, ok := str.(*object.String).Index(index.(*object.Integer).Value)
+	if !ok {
+		return vm.push(Null)
+	}
+	return vm.pushNew(ch)
+}
+
 func (vm *VM) executeHashIndex(hash, index object.Object) error {
 	hashObject := hash.(*object.Hash)
 
@@ -538,7 +969,14 @@ func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 	}
 
 	frame := NewFrame(cl, vm.sp-numArgs)
-	vm.pushFrame(frame)
+	err := vm.growStack(frame.basePointer + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
+	err = vm.pushFrame(frame)
+	if err != nil {
+		return err
+	}
 	// stack pointerをbp+ローカル変数にする。
 	// ローカル変数はbpとのオフセットで表現する
 	vm.sp = frame.basePointer + cl.Fn.NumLocals
@@ -546,6 +984,30 @@ func (vm *VM) callClosure(cl *object.Closure, numArgs int) error {
 	return nil
 }
 
+// executeTailCall calls a closure in the current frame.
+// The callee and the arguments are moved down to where the current callee and
+// arguments are, so deep recursion in tail position doesn't use up the frames.
+func (vm *VM) executeTailCall(numArgs int) error {
+	cl, ok := vm.stack[vm.sp-1-numArgs].(*object.Closure)
+	if !ok || numArgs != cl.Fn.NumParameters {
+		// builtinやエラーは普通のcallと同じ
+		return vm.executeCall(numArgs)
+	}
+
+	frame := vm.currentFrame()
+	err := vm.growStack(frame.basePointer + cl.Fn.NumLocals)
+	if err != nil {
+		return err
+	}
+	copy(vm.stack[frame.basePointer-1:], vm.stack[vm.sp-1-numArgs:vm.sp])
+
+	frame.cl = cl
+	frame.ip = -1
+	vm.sp = frame.basePointer + cl.Fn.NumLocals
+
+	return nil
+}
+
 func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	args := vm.stack[vm.sp-numArgs : vm.sp]
 	result := builtin.Fn(args...)
@@ -554,12 +1016,19 @@ func (vm *VM) callBuiltin(builtin *object.Builtin, numArgs int) error {
 	vm.sp = vm.sp - numArgs - 1
 
 	if result != nil {
-		vm.push(result)
-	} else {
-		vm.push(Null)
+		return vm.pushNew(result)
 	}
+	return vm.push(Null)
+}
 
-	return nil
+// cellOf returns the cell in the slot of a local or a free variable.
+// Only bytecode which isn't made by the compiler has something else there.
+func cellOf(obj object.Object) (*object.Cell, error) {
+	cell, ok := obj.(*object.Cell)
+	if !ok {
+		return nil, fmt.Errorf("not a cell: %+v", obj)
+	}
+	return cell, nil
 }
 
 func (vm *VM) pushClosure(constIndex int, numFree int) error {
@@ -576,7 +1045,7 @@ func (vm *VM) pushClosure(constIndex int, numFree int) error {
 	}
 	vm.sp = vm.sp - numFree
 	closure := &object.Closure{Fn: function, Free: free}
-	return vm.push(closure)
+	return vm.pushNew(closure)
 }
 
 // isTruthyは条件がtrueかどうか判定する
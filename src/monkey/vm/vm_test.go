@@ -1,12 +1,15 @@
 package vm
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"monkey/ast"
 	"monkey/compiler"
 	"monkey/lexer"
 	"monkey/object"
 	"monkey/parser"
+	"strings"
 	"testing"
 )
 
@@ -34,6 +37,11 @@ func TestIntegerArithmetic(t *testing.T) {
 		{"-10", -10},
 		{"-50 + 100 + -50", 0},
 		{"(5 + 10 * 2 + 15 / 3) * 2 + -10", 50},
+		{"7 % 3", 1},
+		{"-7 % 3", -1},
+		{"1 + 7 % 4 * 2", 7},
+		// operands are evaluated from left to right
+		{"let s = 0; let a = fn() { s = s * 10 + 1; 1 }; let b = fn() { s = s * 10 + 2; 2 }; a() < b(); s", 12},
 	}
 
 	runVmTests(t, tests)
@@ -73,6 +81,11 @@ func testExpectedObject(t *testing.T, expected interface{}, actual object.Object
 		if err != nil {
 			t.Errorf("testIntegerObject failed: %s", err)
 		}
+	case float64:
+		err := testFloatObject(expected, actual)
+		if err != nil {
+			t.Errorf("testFloatObject failed: %s", err)
+		}
 	case bool:
 		err := testBooleanObject(bool(expected), actual)
 		if err != nil {
@@ -163,6 +176,20 @@ func testIntegerObject(expected int64, actual object.Object) error {
 	return nil
 }
 
+func testFloatObject(expected float64, actual object.Object) error {
+	result, ok := actual.(*object.Float)
+	if !ok {
+		return fmt.Errorf("object is not Float. got=%T (%+v)",
+			actual, actual)
+	}
+
+	if result.Value != expected {
+		return fmt.Errorf("object has wrong value. got=%g, want=%g",
+			result.Value, expected)
+	}
+	return nil
+}
+
 func testStringObject(expected string, actual object.Object) error {
 	result, ok := actual.(*object.String)
 	if !ok {
@@ -178,6 +205,23 @@ func testStringObject(expected string, actual object.Object) error {
 	return nil
 }
 
+func TestFloatArithmetic(t *testing.T) {
+	tests := []vmTestCase{
+		{"3.14", 3.14},
+		{"-2.5", -2.5},
+		{"1 + 0.5", 1.5},
+		{"0.5 * 4", 2.0},
+		{"1 / 4.0", 0.25},
+		{"1e3 - 1", 999.0},
+		{"let x = 1; x += 0.5; x", 1.5},
+		{"{1: 5}[1.0]", 5},
+		{"{2.5: 5}[2.5]", 5},
+		{"7.5 % 2", 1.5},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestBooleanExpressions(t *testing.T) {
 	tests := []vmTestCase{
 		{"true", true},
@@ -207,6 +251,36 @@ func TestBooleanExpressions(t *testing.T) {
 		{"!!false", false},
 		{"!!5", true},
 		{"!(if (false) { 5; })", true},
+		{"1 == 1.0", true},
+		{"1.5 > 1", true},
+		{"2 < 1.5", false},
+		{"0.1 + 0.2 == 0.3", false},
+		{"2.0 != 2", false},
+		{"1 == true", false},
+		{"1 <= 2", true},
+		{"2 <= 2", true},
+		{"3 <= 2", false},
+		{"1 >= 2", false},
+		{"2 >= 2", true},
+		{"2.5 >= 2", true},
+		{"1 <= 0.5", false},
+	}
+	runVmTests(t, tests)
+}
+
+func TestLogicalOperators(t *testing.T) {
+	tests := []vmTestCase{
+		{"true && true", true},
+		{"true && false", false},
+		{"false && true", false},
+		{"false || true", true},
+		{"false || false", false},
+		{"1 && \"a\"", true},
+		{"1 < 2 && 2 < 3 || false", true},
+		{"false && false || true", true},
+		{"let x = 0; let f = fn() { x = 1; true }; false && f(); x == 0", true},
+		{"let x = 0; true || (x = 1); x == 0", true},
+		{"let x = 0; false || (x = 1); x == 1", true},
 	}
 	runVmTests(t, tests)
 }
@@ -241,6 +315,51 @@ func TestConditionals(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestWhileLoops(t *testing.T) {
+	tests := []vmTestCase{
+		{"let i = 0; while (i < 5) { let i = i + 1; }; i", 5},
+		{"while (false) { 1 }; 2", 2},
+		{`
+		let i = 0;
+		let sum = 0;
+		while (i < 10) {
+			let i = i + 1;
+			if (i == 5) { continue; }
+			if (i > 7) { break; }
+			let sum = sum + i;
+		}
+		sum`, 23},
+		{`
+		let f = fn(n) {
+			let i = 0;
+			while (true) {
+				if (i == n) { return i * 10; }
+				let i = i + 1;
+			}
+		};
+		f(3)`, 30},
+		{`
+		let i = 0;
+		let c = 0;
+		while (i < 3) {
+			let i = i + 1;
+			let j = 0;
+			while (true) {
+				let j = j + 1;
+				if (j > 2) { break; }
+				let c = c + 1;
+			}
+		}
+		c`, 6},
+		// 文としてのifの中のifからもbreakできる
+		{"let i = 0; while (true) { i += 1; if (i > 1) { if (i == 4) { break } } }; i", 4},
+		// 再帰と違ってstackを消費しない
+		{"let i = 0; while (i < 100000) { let i = i + 1; }; i", 100000},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestGlobalLetStatements(t *testing.T) {
 	tests := []vmTestCase{
 		{"let one = 1; one", 1},
@@ -251,11 +370,57 @@ func TestGlobalLetStatements(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestAssignExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"let x = 1; x = 2; x", 2},
+		{"let x = 1; x = x + 1", 2},
+		{"let x = 10; x += 5; x -= 3; x *= 2; x /= 4; x", 6},
+		{"let x = 1; let y = 2; x = y = 3; x + y", 6},
+		{"let i = 0; let sum = 0; while (i < 5) { i += 1; sum += i; }; sum", 15},
+		{"let x = 1; let f = fn() { x = 5; }; f(); x", 5},
+		{"let f = fn(a) { a += 1; a }; f(1)", 2},
+		// closureが捕まえた変数は呼び出しの間も保持される
+		{`
+		let counter = fn() {
+			let c = 0;
+			fn() { c += 1; c }
+		};
+		let next = counter();
+		next(); next();
+		next()`, 3},
+		// 代入される変数は定義した関数とclosureが共有する
+		{"let c = fn(n) { let g = fn() { n += 1; n }; g(); let a = g(); a * 10 + n }; c(5)", 77},
+		{`
+		let make = fn() {
+			let count = 0;
+			[fn() { count += 1 }, fn() { count }]
+		};
+		let p = make();
+		p[0](); p[0]();
+		p[1]()`, 2},
+		// 間のclosureもcellを渡す
+		{"let f = fn() { let a = 1; let g = fn() { fn() { a += 10 } }; g()(); a }; f()", 11},
+		// loopの中のletも同じ変数に代入する
+		{`
+		let f = fn() {
+			let fs = [];
+			let i = 0;
+			while (i < 3) { let x = i; fs = push(fs, fn() { x }); i += 1; }
+			fs[0]()
+		};
+		f()`, 2},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestStringExpression(t *testing.T) {
 	tests := []vmTestCase{
 		{`"monkey"`, "monkey"},
 		{`"mon" + "key"`, "monkey"},
 		{`"mon" + "key" + "banana"`, "monkeybanana"},
+		{`"a\tb\n\"c\"\\"`, "a\tb\n\"c\"\\"},
+		{`"\u{3042}\u{1F600}"`, "あ😀"},
 	}
 
 	runVmTests(t, tests)
@@ -307,6 +472,26 @@ func TestIndexExpressions(t *testing.T) {
 		{"{1: 1, 2: 2}[2]", 2},
 		{"{1: 1}[0]", Null},
 		{"{}[0]", Null},
+		{`"abc"[1]`, "b"},
+		{`"日本語"[2]`, "語"},
+		{`"日本語"[3]`, Null},
+		{`"abc"[-1]`, Null},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestSliceExpressions(t *testing.T) {
+	tests := []vmTestCase{
+		{"[1, 2, 3, 4][1:3]", []int{2, 3}},
+		{"[1, 2, 3][:2]", []int{1, 2}},
+		{"[1, 2, 3][1:]", []int{2, 3}},
+		{"[1, 2, 3][:]", []int{1, 2, 3}},
+		{"[1, 2, 3][-1:99]", []int{1, 2, 3}},
+		{"[1, 2, 3][2:1]", []int{}},
+		{`"hello"[1:3]`, "el"},
+		{`"日本語です"[1:3]`, "本語"},
+		{`let s = "monkey"; s[len(s) - 3:]`, "key"},
 	}
 
 	runVmTests(t, tests)
@@ -520,15 +705,15 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	tests := []vmTestCase{
 		{
 			input:    `fn() { 1; }(1);`,
-			expected: `wrong number of arguments: want=0, got=1`,
+			expected: `1:1: wrong number of arguments: want=0, got=1`,
 		},
 		{
 			input:    `fn(a) { a; }();`,
-			expected: `wrong number of arguments: want=1, got=0`,
+			expected: `1:1: wrong number of arguments: want=1, got=0`,
 		},
 		{
 			input:    `fn(a, b){ a + b; }(1);`,
-			expected: `wrong number of arguments: want=2, got=1`,
+			expected: `1:1: wrong number of arguments: want=2, got=1`,
 		},
 	}
 
@@ -553,11 +738,81 @@ func TestCallingFunctionsWithWrongArguments(t *testing.T) {
 	}
 }
 
+func TestRuntimeErrorPositions(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input:    "let a = 1;\n1 + true;",
+			expected: `2:1: unsupported types for binary operation: INTEGER BOOLEAN`,
+		},
+		{
+			input: `let f = fn(x) {
+  x[0]
+};
+f(1);`,
+			expected: `2:3: index operator not supported: INTEGER`,
+		},
+		{
+			input: `let g = fn(a) { a };
+let f = fn() {
+  g()
+};
+f();`,
+			expected: `3:3: wrong number of arguments: want=1, got=0`,
+		},
+		{
+			input:    `"a" < "b"`,
+			expected: `1:1: unknown operator: STRING < STRING`,
+		},
+		{
+			input:    `"a" - "b"`,
+			expected: `1:1: unknown operator: STRING - STRING`,
+		},
+		{
+			input:    `1 >= "a"`,
+			expected: `1:1: type mismatch: INTEGER >= STRING`,
+		},
+		{
+			input:    `5 / 0`,
+			expected: `1:1: division by zero`,
+		},
+		{
+			input:    `5 % 0`,
+			expected: `1:1: division by zero`,
+		},
+		{
+			input:    "let x = 5;\nx /= 0;",
+			expected: `2:1: division by zero`,
+		},
+	}
+
+	for _, tt := range tests {
+		program := parse(tt.input)
+
+		comp := compiler.New()
+		err := comp.Compile(program)
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err == nil {
+			t.Fatalf("expected VM error but resulted in none")
+		}
+
+		if err.Error() != tt.expected {
+			t.Errorf("wrong VM error: want=%q, got=%q", tt.expected, err)
+		}
+	}
+}
+
 func TestBuiltinFunctions(t *testing.T) {
 	tests := []vmTestCase{
 		{`len("")`, 0},
 		{`len("four")`, 4},
 		{`len("hello world")`, 11},
+		{`len("héllo")`, 5},
+		{`len("\u{1F600}")`, 1},
 		{
 			`len(1)`,
 			&object.Error{
@@ -598,6 +853,40 @@ func TestBuiltinFunctions(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestStringBuiltins(t *testing.T) {
+	tests := []vmTestCase{
+		{`len(split("a,b,c", ","))`, 3},
+		{`split("a,b,c", ",")[2]`, "c"},
+		{`join(split("a b c", " "), "-")`, "a-b-c"},
+		{`join([], ",")`, ""},
+		{`trim("  hi \n")`, "hi"},
+		{`contains("monkey", "key")`, true},
+		{`contains("monkey", "dog")`, false},
+		{`replace("a-b-c", "-", "+")`, "a+b+c"},
+		{`upper("héllo")`, "HÉLLO"},
+		{`lower("ABC")`, "abc"},
+		{`format("%s is %d (%.1f, %t)", "x", 1, 2.5, true)`, "x is 1 (2.5, true)"},
+		{`format("%v", [1, 2])`, "[1, 2]"},
+		{`split(1, ",")`,
+			&object.Error{
+				Message: "argument to `split` must be STRING, got INTEGER",
+			},
+		},
+		{`join(["a", 1], ",")`,
+			&object.Error{
+				Message: "elements to `join` must be STRING, got INTEGER",
+			},
+		},
+		{`upper("a", "b")`,
+			&object.Error{
+				Message: "wrong number of arguments. got=2, want=1",
+			},
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestClosures(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -676,6 +965,108 @@ func TestClosures(t *testing.T) {
 	runVmTests(t, tests)
 }
 
+func TestRecursiveClosures(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			input: `
+		let countDown = fn(x) {
+			if (x == 0) {
+				return 0;
+			} else {
+				countDown(x - 1);
+			}
+		};
+		countDown(1);
+		`,
+			expected: 0,
+		},
+		{
+			input: `
+		let wrapper = fn() {
+			let countDown = fn(x) {
+				if (x == 0) {
+					return 0;
+				} else {
+					countDown(x - 1);
+				}
+			};
+			countDown(1);
+		};
+		wrapper();
+		`,
+			expected: 0,
+		},
+		{
+			input: `
+		let wrapper = fn(n) {
+			let sum = fn(x) {
+				if (x == 0) { return 0; }
+				x + n + sum(x - 1);
+			};
+			sum(4);
+		};
+		wrapper(10);
+		`,
+			expected: 50,
+		},
+		{
+			// 引数で関数名を隠すことができる
+			input: `
+		let f = fn(f) { f * 2 };
+		f(21);
+		`,
+			expected: 42,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
+func TestTailCalls(t *testing.T) {
+	tests := []vmTestCase{
+		{
+			// MaxFramesより深い再帰でもframeを使い切らない
+			input: `
+		let sum = fn(n, acc) {
+			if (n == 0) { return acc; }
+			sum(n - 1, acc + n);
+		};
+		sum(5000, 0);
+		`,
+			expected: 12502500,
+		},
+		{
+			input: `
+		let wrapper = fn() {
+			let count = fn(n) { if (n == 0) { 7 } else { count(n - 1) } };
+			count(4000);
+		};
+		wrapper();
+		`,
+			expected: 7,
+		},
+		{
+			// builtinのtail callは普通のcallになる
+			input: `
+		let f = fn(a) { return len(a); };
+		f([1, 2, 3]) + f("ab");
+		`,
+			expected: 5,
+		},
+		{
+			// localsが増える関数へのtail call
+			input: `
+		let g = fn(x) { let y = x * 2; let z = y + 1; z };
+		let f = fn(x) { g(x + 1) };
+		f(1) + f(2);
+		`,
+			expected: 12,
+		},
+	}
+
+	runVmTests(t, tests)
+}
+
 func TestRecursiveFibonacci(t *testing.T) {
 	tests := []vmTestCase{
 		{
@@ -699,3 +1090,228 @@ func TestRecursiveFibonacci(t *testing.T) {
 
 	runVmTests(t, tests)
 }
+
+func TestStackTrace(t *testing.T) {
+	input := `let inner = fn(x) {
+  x[0]
+};
+let outer = fn(y) {
+  let z = y + 1;
+  inner(z) + 1
+};
+outer(1);`
+
+	program := parse(input)
+
+	comp := compiler.New()
+	err := comp.Compile(program)
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := New(comp.Bytecode())
+	err = vm.Run()
+
+	rerr, ok := err.(*object.RuntimeError)
+	if !ok {
+		t.Fatalf("expected *object.RuntimeError. got=%T (%+v)", err, err)
+	}
+
+	expected := `runtime error: index operator not supported: INTEGER
+
+inner(...)
+	2:3
+outer(...)
+	6:3
+main()
+	8:1
+`
+	if rerr.StackTrace() != expected {
+		t.Errorf("wrong stack trace. expected=\n%s\ngot=\n%s", expected, rerr.StackTrace())
+	}
+}
+
+func TestStackOverflow(t *testing.T) {
+	tests := []struct {
+		input    string
+		options  Options
+		expected string
+	}{
+		{
+			`let f = fn(n) { f(n + 1) + 1 }; f(0);`,
+			Options{StackSize: 100000},
+			"1:17: stack overflow (call depth 1023)",
+		},
+		{
+			// frameより先にstackが足りなくなる
+			`let f = fn(n) { f(n + 1) + 1 }; f(0);`,
+			Options{},
+			"1:23: stack overflow (call depth 1023)",
+		},
+		{
+			`let f = fn(n) { f(n + 1) + 1 }; f(0);`,
+			Options{MaxFrames: 10},
+			"1:17: stack overflow (call depth 9)",
+		},
+		{
+			`let f = fn(n) { f(n + 1) + 1 }; f(0);`,
+			Options{Limits: object.Limits{MaxDepth: 10}},
+			"1:17: stack overflow (call depth 9)",
+		},
+		{
+			// localsの分だけstackが足りなくなる
+			`let f = fn(n) { let a = n; let b = n; f(n + 1) + 1 }; f(0);`,
+			Options{StackSize: 40},
+			"1:25: stack overflow (call depth 10)",
+		},
+		{
+			`[1, 2, 3, 4, 5]`,
+			Options{StackSize: 4},
+			"1:14: stack overflow (call depth 0)",
+		},
+		{
+			`let a = 1; let b = 2; let c = 3;`,
+			Options{GlobalsSize: 2},
+			"1:23: too many global variables (limit 2)",
+		},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewWithOptions(comp.Bytecode(), tt.options)
+		err = vm.Run()
+		if _, ok := err.(*object.RuntimeError); !ok {
+			t.Fatalf("expected *object.RuntimeError for %q. got=%T (%+v)", tt.input, err, err)
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestGrowStack(t *testing.T) {
+	// 初期サイズより深い再帰と大きな配列
+	input := `
+	let sum = fn(n) { if (n == 0) { return 0; } n + sum(n - 1) };
+	let a = [` + strings.Repeat("1, ", 3000) + `1];
+	sum(1000) + len(a)
+	`
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	vm := NewWithOptions(comp.Bytecode(), Options{StackSize: 8192, MaxFrames: 2048})
+	err = vm.Run()
+	if err != nil {
+		t.Fatalf("vm error: %s", err)
+	}
+
+	testExpectedObject(t, 503501, vm.LastPoppedStackElem())
+}
+
+func TestRunContext(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	tests := []struct {
+		input    string
+		ctx      context.Context
+		limits   object.Limits
+		expected error
+	}{
+		{`while (true) { }`, context.Background(), object.Limits{MaxSteps: 10000}, object.ErrStepLimit},
+		{`let f = fn(n) { f(n + 1) }; f(0)`, context.Background(), object.Limits{MaxSteps: 10000}, object.ErrStepLimit},
+		{`let a = []; while (true) { a = push(a, 1) }`, context.Background(), object.Limits{MaxAllocations: 10000}, object.ErrAllocationLimit},
+		{`let s = "a"; while (true) { s = s + s }`, context.Background(), object.Limits{MaxAllocations: 10000}, object.ErrAllocationLimit},
+		{`while (true) { }`, canceled, object.Limits{}, context.Canceled},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := NewWithOptions(comp.Bytecode(), Options{Limits: tt.limits})
+		err = vm.RunContext(tt.ctx)
+		if _, ok := err.(*object.LimitError); !ok {
+			t.Fatalf("expected *object.LimitError for %q. got=%T (%+v)", tt.input, err, err)
+		}
+		if !errors.Is(err, tt.expected) {
+			t.Errorf("wrong error for %q. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+func TestRunContextWithinLimits(t *testing.T) {
+	input := `
+	let sum = fn(n) { if (n == 0) { return 0; } n + sum(n - 1) };
+	let i = 0;
+	let a = [];
+	while (i < 10) { a = push(a, sum(i)); i += 1; }
+	a[9]
+	`
+	comp := compiler.New()
+	err := comp.Compile(parse(input))
+	if err != nil {
+		t.Fatalf("compiler error: %s", err)
+	}
+
+	limits := object.Limits{MaxSteps: 100000, MaxAllocations: 10000}
+	vm := NewWithOptions(comp.Bytecode(), Options{Limits: limits})
+	err = vm.RunContext(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	testExpectedObject(t, 45, vm.LastPoppedStackElem())
+}
+
+func TestResult(t *testing.T) {
+	tests := []vmTestCase{
+		{"1; 2", 2},
+		{"let a = 1;", Null},
+		{"let a = 1; return a + 1; a", 2},
+		{"let a = 5; if (a > 1) { return 10; }; 20", 10},
+		{"let f = fn() { return 1; }; f(); let b = 2;", Null},
+	}
+
+	for _, tt := range tests {
+		comp := compiler.New()
+		err := comp.Compile(parse(tt.input))
+		if err != nil {
+			t.Fatalf("compiler error: %s", err)
+		}
+
+		vm := New(comp.Bytecode())
+		err = vm.Run()
+		if err != nil {
+			t.Fatalf("vm error: %s", err)
+		}
+
+		testExpectedObject(t, tt.expected, vm.Result())
+	}
+}
+
+func TestImports(t *testing.T) {
+	tests := []vmTestCase{
+		{`let c = import "../testdata/import/counter.mk"; c["inc"](); c["inc"]()`, 2},
+		// 2回目のimportは同じmoduleを返す
+		{`let a = import "../testdata/import/counter.mk"; a["inc"]();
+		  let b = import "../testdata/import/counter.mk"; b["inc"]()`, 2},
+		{`(import "../testdata/import/math.mk")["quad"](3)`, 12},
+		{`let count = 5; let c = import "../testdata/import/counter.mk"; c["inc"](); count`, 5},
+		{`let f = fn() { import "../testdata/import/counter.mk" }; f()["inc"](); f()["inc"]()`, 2},
+		{`(import "../testdata/import/early.mk")["a"]`, 1},
+		{`(import "../testdata/import/early.mk")["b"]`, Null},
+	}
+
+	runVmTests(t, tests)
+}
@@ -0,0 +1,131 @@
+package x64asm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// where the executable is mapped, as ld does without -pie
+	baseAddress = 0x400000
+	pageSize    = 0x1000
+
+	elfHeaderSize     = 64
+	programHeaderSize = 56
+	numProgramHeaders = 3
+
+	sectionAlign = 16
+)
+
+// program header types and flags
+const (
+	ptLoad     = 1
+	ptGNUStack = 0x6474e551
+	pfExecute  = 1
+	pfWrite    = 2
+	pfRead     = 4
+)
+
+// Executable links the object into a static ELF64 executable for x86-64 Linux,
+// which starts at the symbol entry. The file has no section headers, only what the
+// kernel reads to load it:
+//
+//	[ELF header] [program headers] [.text] [.rodata]   read and execute
+//	[.data] [.bss]                                       read and write, from the next page
+//
+// The sections are mapped at baseAddress plus their offsets in the file.
+func (o *Object) Executable(entry string) ([]byte, error) {
+	var offsets [numSections]int
+
+	offsets[text] = align(elfHeaderSize+programHeaderSize*numProgramHeaders, sectionAlign)
+	offsets[rodata] = align(offsets[text]+len(o.sections[text]), sectionAlign)
+	textEnd := offsets[rodata] + len(o.sections[rodata])
+
+	// 書き込める領域は別のpageから始める
+	offsets[data] = align(textEnd, pageSize)
+	offsets[bss] = align(offsets[data]+len(o.sections[data]), sectionAlign)
+	memoryEnd := offsets[bss] + o.bssSize
+
+	address := func(name string) (uint64, error) {
+		s, ok := o.symbols[name]
+		if !ok {
+			return 0, fmt.Errorf("x64asm: undefined symbol %s", name)
+		}
+		if s.section == note {
+			return 0, fmt.Errorf("x64asm: symbol %s is in .note.GNU-stack", name)
+		}
+		return uint64(baseAddress + offsets[s.section] + s.offset), nil
+	}
+
+	file := make([]byte, offsets[data]+len(o.sections[data]))
+	for _, sec := range []section{text, rodata, data} {
+		copy(file[offsets[sec]:], o.sections[sec])
+	}
+
+	for _, f := range o.fixups {
+		target, err := address(f.symbol)
+		if err != nil {
+			return nil, fmt.Errorf("%s (line %d)", err, f.line)
+		}
+		at := offsets[f.section] + f.offset
+
+		switch f.kind {
+		case rel32:
+			end := uint64(baseAddress + offsets[f.section] + f.end)
+			distance := int64(target - end)
+			if !fitsInt32(distance) {
+				return nil, fmt.Errorf("x64asm: line %d: %s is too far", f.line, f.symbol)
+			}
+			binary.LittleEndian.PutUint32(file[at:], uint32(distance))
+		case abs64:
+			binary.LittleEndian.PutUint64(file[at:], target)
+		}
+	}
+
+	start, err := address(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	// ELF header
+	h := file[:elfHeaderSize]
+	copy(h, []byte{0x7f, 'E', 'L', 'F', 2 /* 64-bit */, 1 /* little endian */, 1 /* version */})
+	le := binary.LittleEndian
+	le.PutUint16(h[16:], 2)    // ET_EXEC
+	le.PutUint16(h[18:], 0x3e) // EM_X86_64
+	le.PutUint32(h[20:], 1)    // version
+	le.PutUint64(h[24:], start)
+	le.PutUint64(h[32:], elfHeaderSize) // program headers
+	le.PutUint64(h[40:], 0)             // no section headers
+	le.PutUint16(h[52:], elfHeaderSize)
+	le.PutUint16(h[54:], programHeaderSize)
+	le.PutUint16(h[56:], numProgramHeaders)
+
+	ph := file[elfHeaderSize:]
+	programHeader(ph, ptLoad, pfRead|pfExecute, 0, textEnd, textEnd)
+	ph = ph[programHeaderSize:]
+	programHeader(ph, ptLoad, pfRead|pfWrite, offsets[data], len(o.sections[data]), memoryEnd-offsets[data])
+	ph = ph[programHeaderSize:]
+	// stackを実行不可にする
+	programHeader(ph, ptGNUStack, pfRead|pfWrite, 0, 0, 0)
+
+	return file, nil
+}
+
+func programHeader(b []byte, typ, flags uint32, offset, fileSize, memorySize int) {
+	le := binary.LittleEndian
+	le.PutUint32(b[0:], typ)
+	le.PutUint32(b[4:], flags)
+	le.PutUint64(b[8:], uint64(offset))
+	if typ == ptLoad {
+		le.PutUint64(b[16:], uint64(baseAddress+offset)) // virtual address
+		le.PutUint64(b[24:], uint64(baseAddress+offset)) // physical address
+		le.PutUint64(b[48:], pageSize)
+	}
+	le.PutUint64(b[32:], uint64(fileSize))
+	le.PutUint64(b[40:], uint64(memorySize))
+}
+
+func align(n, a int) int {
+	return (n + a - 1) / a * a
+}
@@ -0,0 +1,771 @@
+package x64asm
+
+// Instruction Encoding
+//
+//	[prefix 66/F2/F3] [REX] [opcode] [ModRM] [SIB] [displacement] [immediate]
+//
+// REX is 0100WRXB: W for 64-bit operands, and R, X and B extend the register of
+// ModRM.reg, SIB.index and ModRM.rm (or SIB.base) to r8-r15.
+
+// opcodes of add, or, adc, sbb, and, sub, xor and cmp: the /digit of 0x80, 0x81 and 0x83,
+// and the base of their register forms
+var aluOps = map[string]int{
+	"add": 0,
+	"or":  1,
+	"adc": 2,
+	"sbb": 3,
+	"and": 4,
+	"sub": 5,
+	"xor": 6,
+	"cmp": 7,
+}
+
+// the /digit of 0xF7 (0xF6 for bytes)
+var unaryOps = map[string]int{
+	"not":  2,
+	"neg":  3,
+	"mul":  4,
+	"div":  6,
+	"idiv": 7,
+}
+
+// the /digit of 0xC1, 0xD1 and 0xD3
+var shiftOps = map[string]int{
+	"shl": 4,
+	"sal": 4,
+	"shr": 5,
+	"sar": 7,
+}
+
+// bt, bts, btr and btc: the /digit of 0x0F 0xBA, and the second byte of the register form
+var bitOps = map[string][2]int{
+	"bt":  {4, 0xa3},
+	"bts": {5, 0xab},
+	"btr": {6, 0xb3},
+	"btc": {7, 0xbb},
+}
+
+var conditions = map[string]byte{
+	"o": 0x0, "no": 0x1,
+	"b": 0x2, "c": 0x2, "nae": 0x2,
+	"ae": 0x3, "nb": 0x3, "nc": 0x3,
+	"e": 0x4, "z": 0x4,
+	"ne": 0x5, "nz": 0x5,
+	"be": 0x6, "na": 0x6,
+	"a": 0x7, "nbe": 0x7,
+	"s": 0x8, "ns": 0x9,
+	"p": 0xa, "pe": 0xa,
+	"np": 0xb, "po": 0xb,
+	"l": 0xc, "nge": 0xc,
+	"ge": 0xd, "nl": 0xd,
+	"le": 0xe, "ng": 0xe,
+	"g": 0xf, "nle": 0xf,
+}
+
+// instructions without operands
+var fixedOps = map[string][]byte{
+	"ret":       {0xc3},
+	"leave":     {0xc9},
+	"syscall":   {0x0f, 0x05},
+	"cqo":       {0x48, 0x99},
+	"nop":       {0x90},
+	"rep stosq": {0xf3, 0x48, 0xab},
+	"rep stosb": {0xf3, 0xaa},
+	"rep movsq": {0xf3, 0x48, 0xa5},
+	"rep movsb": {0xf3, 0xa4},
+}
+
+// scalar double instructions xmm, xmm/m64: the prefix and the opcode after 0x0F
+var sseOps = map[string][2]byte{
+	"addsd":   {0xf2, 0x58},
+	"mulsd":   {0xf2, 0x59},
+	"subsd":   {0xf2, 0x5c},
+	"divsd":   {0xf2, 0x5e},
+	"sqrtsd":  {0xf2, 0x51},
+	"ucomisd": {0x66, 0x2e},
+	"movapd":  {0x66, 0x28},
+}
+
+func (a *assembler) instruction(name string, ops []operand) error {
+	if b, ok := fixedOps[name]; ok {
+		if len(ops) != 0 {
+			return a.errorf("%s has no operands", name)
+		}
+		a.emit(b...)
+		return nil
+	}
+
+	if n, ok := aluOps[name]; ok {
+		return a.alu(name, n, ops)
+	}
+	if n, ok := unaryOps[name]; ok {
+		if err := a.operands(name, ops, 1); err != nil {
+			return err
+		}
+		return a.unary(name, n, ops[0])
+	}
+	if n, ok := shiftOps[name]; ok {
+		return a.shift(name, n, ops)
+	}
+	if n, ok := bitOps[name]; ok {
+		return a.bit(name, n, ops)
+	}
+	if n, ok := sseOps[name]; ok {
+		if err := a.operands(name, ops, 2); err != nil {
+			return err
+		}
+		return a.sse(name, n[0], false, []byte{0x0f, n[1]}, ops[0], ops[1], nil)
+	}
+
+	switch name {
+	case "mov":
+		return a.mov(ops)
+	case "test":
+		return a.test(ops)
+	case "lea":
+		if err := a.operands(name, ops, 2); err != nil {
+			return err
+		}
+		if ops[0].kind != regOperand || ops[0].reg.size < 4 || ops[1].kind != memOperand {
+			return a.errorf("lea needs a register and a memory operand")
+		}
+		return a.modrm(nil, ops[0].reg.size == 8, []byte{0x8d}, ops[0].reg.num, ops[1], nil, false)
+	case "movzx":
+		if err := a.operands(name, ops, 2); err != nil {
+			return err
+		}
+		dst, src := ops[0], ops[1]
+		size := a.size(src)
+		if dst.kind != regOperand || dst.reg.size < 2 || (size != 1 && size != 2) {
+			return a.errorf("movzx needs a register and a byte or a word")
+		}
+		op := byte(0xb6)
+		if size == 2 {
+			op = 0xb7
+		}
+		return a.modrm(sizePrefix(dst.reg.size), dst.reg.size == 8, []byte{0x0f, op}, dst.reg.num, src, nil, needsREX(src))
+	case "imul":
+		return a.imul(ops)
+	case "xchg":
+		if err := a.operands(name, ops, 2); err != nil {
+			return err
+		}
+		dst, src := ops[0], ops[1]
+		if src.kind != regOperand {
+			dst, src = src, dst
+		}
+		return a.regRM(name, 0x86, 0x87, dst, src)
+	case "push", "pop":
+		if err := a.operands(name, ops, 1); err != nil {
+			return err
+		}
+		return a.pushPop(name, ops[0])
+	case "call", "jmp":
+		if err := a.operands(name, ops, 1); err != nil {
+			return err
+		}
+		return a.jump(name, ops[0])
+	case "movq":
+		return a.movq(ops)
+	case "cvtsi2sd":
+		if err := a.operands(name, ops, 2); err != nil {
+			return err
+		}
+		if !isXMM(ops[0]) || isXMM(ops[1]) || a.size(ops[1]) != 8 {
+			return a.errorf("cvtsi2sd needs an xmm register and a 64-bit integer")
+		}
+		return a.sse(name, 0xf2, true, []byte{0x0f, 0x2a}, ops[0], ops[1], nil)
+	case "cvtsd2si", "cvttsd2si":
+		if err := a.operands(name, ops, 2); err != nil {
+			return err
+		}
+		if ops[0].kind != regOperand || ops[0].reg.size != 8 || isXMM(ops[0]) {
+			return a.errorf("%s needs a 64-bit register", name)
+		}
+		op := byte(0x2d)
+		if name == "cvttsd2si" {
+			op = 0x2c
+		}
+		return a.modrm([]byte{0xf2}, true, []byte{0x0f, op}, ops[0].reg.num, ops[1], nil, false)
+	case "roundsd":
+		if err := a.operands(name, ops, 3); err != nil {
+			return err
+		}
+		if ops[2].kind != immOperand {
+			return a.errorf("roundsd needs an immediate mode")
+		}
+		return a.sse(name, 0x66, false, []byte{0x0f, 0x3a, 0x0b}, ops[0], ops[1], []byte{byte(ops[2].imm)})
+	}
+
+	// jcc, setcc, cmovcc
+	for _, prefix := range []string{"j", "set", "cmov"} {
+		if len(name) <= len(prefix) || name[:len(prefix)] != prefix {
+			continue
+		}
+		cc, ok := conditions[name[len(prefix):]]
+		if !ok {
+			continue
+		}
+		return a.conditional(name, prefix, cc, ops)
+	}
+
+	return a.errorf("unknown instruction %s", name)
+}
+
+func (a *assembler) operands(name string, ops []operand, n int) error {
+	if len(ops) != n {
+		return a.errorf("%s needs %d operands, got %d", name, n, len(ops))
+	}
+	return nil
+}
+
+// size returns the size of a register or a memory operand in bytes, or 0 when it is unknown.
+func (a *assembler) size(op operand) int {
+	switch op.kind {
+	case regOperand:
+		return op.reg.size
+	case memOperand:
+		return op.mem.size
+	}
+	return 0
+}
+
+// operandSize returns the size of the operation of dst and src, which have to agree.
+func (a *assembler) operandSize(name string, dst, src operand) (int, error) {
+	d, s := a.size(dst), a.size(src)
+	switch {
+	case d != 0 && s != 0 && d != s:
+		return 0, a.errorf("%s: operand sizes differ", name)
+	case d != 0:
+		return d, nil
+	case s != 0:
+		return s, nil
+	}
+	return 0, a.errorf("%s: operand size is unknown (use qword ptr etc.)", name)
+}
+
+func sizePrefix(size int) []byte {
+	if size == 2 {
+		return []byte{0x66}
+	}
+	return nil
+}
+
+// needsREX reports whether op is spl, bpl, sil or dil, which are ah, ch, dh and bh without REX.
+func needsREX(op operand) bool {
+	return op.kind == regOperand && op.reg.size == 1 && op.reg.num >= 4
+}
+
+func isXMM(op operand) bool {
+	return op.kind == regOperand && op.reg.xmm
+}
+
+func fitsInt8(n int64) bool {
+	return -128 <= n && n < 128
+}
+
+func fitsInt32(n int64) bool {
+	return -1<<31 <= n && n < 1<<31
+}
+
+// immediate returns the bytes of an immediate of size bytes (at most 4, sign-extended to 64 bits).
+func (a *assembler) immediate(n int64, size int) ([]byte, error) {
+	switch size {
+	case 1:
+		if n < -128 || n > 255 {
+			return nil, a.errorf("immediate %d doesn't fit in a byte", n)
+		}
+		return []byte{byte(n)}, nil
+	case 2:
+		if n < -1<<15 || n >= 1<<16 {
+			return nil, a.errorf("immediate %d doesn't fit in a word", n)
+		}
+		return le16(uint16(n)), nil
+	case 4:
+		if n < -1<<31 || n >= 1<<32 {
+			return nil, a.errorf("immediate %d doesn't fit in 32 bits", n)
+		}
+		return le32(uint32(n)), nil
+	default:
+		if !fitsInt32(n) {
+			return nil, a.errorf("immediate %d doesn't fit in 32 bits", n)
+		}
+		return le32(uint32(n)), nil
+	}
+}
+
+// modrm writes an instruction with a ModRM byte: reg is the register or the /digit of
+// ModRM.reg, and rm a register or a memory operand. rex forces a REX prefix for
+// spl, bpl, sil and dil.
+func (a *assembler) modrm(prefix []byte, w bool, opcode []byte, reg int, rm operand, imm []byte, rex bool) error {
+	var rexBits byte
+	if w {
+		rexBits |= 8
+	}
+	if reg >= 8 {
+		rexBits |= 4
+	}
+
+	var body []byte
+	// RIP相対のときの、body中のdisplacementの位置
+	ripAt := -1
+
+	switch rm.kind {
+	case regOperand:
+		if rm.reg.num >= 8 {
+			rexBits |= 1
+		}
+		body = append(body, 0xc0|byte(reg&7)<<3|byte(rm.reg.num&7))
+	case memOperand:
+		m := rm.mem
+		switch {
+		case m.rip:
+			body = append(body, byte(reg&7)<<3|5)
+			ripAt = len(body)
+			body = append(body, 0, 0, 0, 0)
+		case m.base < 0:
+			if m.index < 0 {
+				return a.errorf("absolute addresses are not supported")
+			}
+			if m.index >= 8 {
+				rexBits |= 2
+			}
+			// baseのないSIBはdisp32が必要
+			body = append(body, byte(reg&7)<<3|4, scaleBits(m.scale)|byte(m.index&7)<<3|5)
+			body = append(body, le32(uint32(m.disp))...)
+		default:
+			if m.base >= 8 {
+				rexBits |= 1
+			}
+			var mod byte
+			switch {
+			// rbpとr13はmod=00だとRIP相対(またはdisp32のみ)になる
+			case m.disp == 0 && m.base&7 != 5:
+				mod = 0
+			case fitsInt8(m.disp):
+				mod = 1
+			default:
+				mod = 2
+			}
+
+			if m.index >= 0 || m.base&7 == 4 {
+				index := byte(4) // none
+				if m.index >= 0 {
+					index = byte(m.index & 7)
+					if m.index >= 8 {
+						rexBits |= 2
+					}
+				}
+				body = append(body, mod<<6|byte(reg&7)<<3|4, scaleBits(m.scale)|index<<3|byte(m.base&7))
+			} else {
+				body = append(body, mod<<6|byte(reg&7)<<3|byte(m.base&7))
+			}
+
+			switch mod {
+			case 1:
+				body = append(body, byte(m.disp))
+			case 2:
+				body = append(body, le32(uint32(m.disp))...)
+			}
+		}
+	default:
+		return a.errorf("operand must be a register or memory")
+	}
+
+	a.emit(prefix...)
+	if rexBits != 0 || rex {
+		a.emit(0x40 | rexBits)
+	}
+	a.emit(opcode...)
+	bodyAt := len(a.obj.sections[a.current])
+	a.emit(body...)
+	a.emit(imm...)
+
+	if ripAt >= 0 {
+		end := len(a.obj.sections[a.current])
+		a.addFixup(rel32, bodyAt+ripAt, end, rm.mem.sym)
+	}
+	return nil
+}
+
+func scaleBits(scale int) byte {
+	switch scale {
+	case 2:
+		return 1 << 6
+	case 4:
+		return 2 << 6
+	case 8:
+		return 3 << 6
+	}
+	return 0
+}
+
+// regRM writes the forms "op r/m, reg" of an 8-bit (op8) and a wider operation (op).
+func (a *assembler) regRM(name string, op8, op byte, rm, reg operand) error {
+	if reg.kind != regOperand || isXMM(reg) || isXMM(rm) {
+		return a.errorf("bad operands of %s", name)
+	}
+	size, err := a.operandSize(name, rm, reg)
+	if err != nil {
+		return err
+	}
+	if size == 1 {
+		return a.modrm(nil, false, []byte{op8}, reg.reg.num, rm, nil, needsREX(rm) || needsREX(reg))
+	}
+	return a.modrm(sizePrefix(size), size == 8, []byte{op}, reg.reg.num, rm, nil, false)
+}
+
+func (a *assembler) alu(name string, n int, ops []operand) error {
+	if err := a.operands(name, ops, 2); err != nil {
+		return err
+	}
+	dst, src := ops[0], ops[1]
+
+	switch {
+	case src.kind == regOperand:
+		return a.regRM(name, byte(n*8), byte(n*8+1), dst, src)
+	case src.kind == memOperand && dst.kind == regOperand:
+		return a.regRM(name, byte(n*8+2), byte(n*8+3), src, dst)
+	case src.kind == immOperand:
+		size := a.size(dst)
+		if size == 0 {
+			return a.errorf("%s: operand size is unknown (use qword ptr etc.)", name)
+		}
+		if size == 1 {
+			imm, err := a.immediate(src.imm, 1)
+			if err != nil {
+				return err
+			}
+			return a.modrm(nil, false, []byte{0x80}, n, dst, imm, needsREX(dst))
+		}
+		if fitsInt8(src.imm) {
+			return a.modrm(sizePrefix(size), size == 8, []byte{0x83}, n, dst, []byte{byte(src.imm)}, false)
+		}
+		imm, err := a.immediate(src.imm, size)
+		if err != nil {
+			return err
+		}
+		return a.modrm(sizePrefix(size), size == 8, []byte{0x81}, n, dst, imm, false)
+	}
+	return a.errorf("bad operands of %s", name)
+}
+
+func (a *assembler) test(ops []operand) error {
+	if err := a.operands("test", ops, 2); err != nil {
+		return err
+	}
+	dst, src := ops[0], ops[1]
+
+	switch src.kind {
+	case regOperand:
+		return a.regRM("test", 0x84, 0x85, dst, src)
+	case immOperand:
+		size := a.size(dst)
+		if size == 0 {
+			return a.errorf("test: operand size is unknown (use qword ptr etc.)")
+		}
+		imm, err := a.immediate(src.imm, size)
+		if err != nil {
+			return err
+		}
+		if size == 1 {
+			return a.modrm(nil, false, []byte{0xf6}, 0, dst, imm, needsREX(dst))
+		}
+		return a.modrm(sizePrefix(size), size == 8, []byte{0xf7}, 0, dst, imm, false)
+	}
+	return a.errorf("bad operands of test")
+}
+
+func (a *assembler) mov(ops []operand) error {
+	if err := a.operands("mov", ops, 2); err != nil {
+		return err
+	}
+	dst, src := ops[0], ops[1]
+
+	switch {
+	case src.kind == regOperand:
+		return a.regRM("mov", 0x88, 0x89, dst, src)
+	case src.kind == memOperand && dst.kind == regOperand:
+		return a.regRM("mov", 0x8a, 0x8b, src, dst)
+	case src.kind == immOperand && dst.kind == regOperand && !dst.reg.xmm:
+		r := dst.reg
+		var rex byte
+		if r.num >= 8 {
+			rex |= 1
+		}
+		switch r.size {
+		case 8:
+			// 符号拡張で表せる値は短いC7を使う
+			if fitsInt32(src.imm) {
+				imm, _ := a.immediate(src.imm, 8)
+				return a.modrm(nil, true, []byte{0xc7}, 0, dst, imm, false)
+			}
+			a.emit(0x48|rex, 0xb8+byte(r.num&7))
+			a.emit(le64(uint64(src.imm))...)
+			return nil
+		case 1:
+			imm, err := a.immediate(src.imm, 1)
+			if err != nil {
+				return err
+			}
+			if rex != 0 || r.num >= 4 {
+				a.emit(0x40 | rex)
+			}
+			a.emit(0xb0 + byte(r.num&7))
+			a.emit(imm...)
+			return nil
+		default:
+			imm, err := a.immediate(src.imm, r.size)
+			if err != nil {
+				return err
+			}
+			a.emit(sizePrefix(r.size)...)
+			if rex != 0 {
+				a.emit(0x40 | rex)
+			}
+			a.emit(0xb8 + byte(r.num&7))
+			a.emit(imm...)
+			return nil
+		}
+	case src.kind == immOperand && dst.kind == memOperand:
+		size := dst.mem.size
+		if size == 0 {
+			return a.errorf("mov: operand size is unknown (use qword ptr etc.)")
+		}
+		imm, err := a.immediate(src.imm, size)
+		if err != nil {
+			return err
+		}
+		if size == 1 {
+			return a.modrm(nil, false, []byte{0xc6}, 0, dst, imm, false)
+		}
+		return a.modrm(sizePrefix(size), size == 8, []byte{0xc7}, 0, dst, imm, false)
+	}
+	return a.errorf("bad operands of mov")
+}
+
+func (a *assembler) unary(name string, n int, op operand) error {
+	size := a.size(op)
+	switch size {
+	case 0:
+		return a.errorf("%s: operand size is unknown (use qword ptr etc.)", name)
+	case 1:
+		return a.modrm(nil, false, []byte{0xf6}, n, op, nil, needsREX(op))
+	}
+	return a.modrm(sizePrefix(size), size == 8, []byte{0xf7}, n, op, nil, false)
+}
+
+func (a *assembler) shift(name string, n int, ops []operand) error {
+	if err := a.operands(name, ops, 2); err != nil {
+		return err
+	}
+	dst, count := ops[0], ops[1]
+	size := a.size(dst)
+	if size == 0 {
+		return a.errorf("%s: operand size is unknown (use qword ptr etc.)", name)
+	}
+
+	var op byte
+	var imm []byte
+	switch {
+	case count.kind == regOperand && count.reg.num == 1 && count.reg.size == 1:
+		// by cl
+		op = 0xd3
+	case count.kind == immOperand && count.imm == 1:
+		op = 0xd1
+	case count.kind == immOperand:
+		op = 0xc1
+		imm = []byte{byte(count.imm)}
+	default:
+		return a.errorf("%s shifts by an immediate or cl", name)
+	}
+	if size == 1 {
+		return a.modrm(nil, false, []byte{op - 1}, n, dst, imm, needsREX(dst))
+	}
+	return a.modrm(sizePrefix(size), size == 8, []byte{op}, n, dst, imm, false)
+}
+
+func (a *assembler) bit(name string, n [2]int, ops []operand) error {
+	if err := a.operands(name, ops, 2); err != nil {
+		return err
+	}
+	dst, src := ops[0], ops[1]
+
+	switch src.kind {
+	case regOperand:
+		size, err := a.operandSize(name, dst, src)
+		if err != nil {
+			return err
+		}
+		return a.modrm(sizePrefix(size), size == 8, []byte{0x0f, byte(n[1])}, src.reg.num, dst, nil, false)
+	case immOperand:
+		size := a.size(dst)
+		if size < 2 {
+			return a.errorf("%s: operand size is unknown (use qword ptr etc.)", name)
+		}
+		return a.modrm(sizePrefix(size), size == 8, []byte{0x0f, 0xba}, n[0], dst, []byte{byte(src.imm)}, false)
+	}
+	return a.errorf("bad operands of %s", name)
+}
+
+func (a *assembler) imul(ops []operand) error {
+	switch len(ops) {
+	case 1:
+		return a.unary("imul", 5, ops[0])
+	case 2, 3:
+		dst, src := ops[0], ops[1]
+		if dst.kind != regOperand || dst.reg.size < 2 || dst.reg.xmm {
+			return a.errorf("imul needs a register")
+		}
+		size := dst.reg.size
+		if len(ops) == 2 {
+			return a.modrm(sizePrefix(size), size == 8, []byte{0x0f, 0xaf}, dst.reg.num, src, nil, false)
+		}
+		n := ops[2]
+		if n.kind != immOperand {
+			return a.errorf("imul needs an immediate")
+		}
+		if fitsInt8(n.imm) {
+			return a.modrm(sizePrefix(size), size == 8, []byte{0x6b}, dst.reg.num, src, []byte{byte(n.imm)}, false)
+		}
+		imm, err := a.immediate(n.imm, size)
+		if err != nil {
+			return err
+		}
+		return a.modrm(sizePrefix(size), size == 8, []byte{0x69}, dst.reg.num, src, imm, false)
+	}
+	return a.errorf("imul needs 1 to 3 operands")
+}
+
+func (a *assembler) pushPop(name string, op operand) error {
+	switch op.kind {
+	case regOperand:
+		if op.reg.size != 8 || op.reg.xmm {
+			return a.errorf("%s needs a 64-bit register", name)
+		}
+		if op.reg.num >= 8 {
+			a.emit(0x41)
+		}
+		base := byte(0x50)
+		if name == "pop" {
+			base = 0x58
+		}
+		a.emit(base + byte(op.reg.num&7))
+		return nil
+	case memOperand:
+		if op.mem.size != 0 && op.mem.size != 8 {
+			return a.errorf("%s needs a qword", name)
+		}
+		if name == "pop" {
+			return a.modrm(nil, false, []byte{0x8f}, 0, op, nil, false)
+		}
+		return a.modrm(nil, false, []byte{0xff}, 6, op, nil, false)
+	case immOperand:
+		if name == "pop" {
+			break
+		}
+		if fitsInt8(op.imm) {
+			a.emit(0x6a, byte(op.imm))
+			return nil
+		}
+		imm, err := a.immediate(op.imm, 8)
+		if err != nil {
+			return err
+		}
+		a.emit(0x68)
+		a.emit(imm...)
+		return nil
+	}
+	return a.errorf("bad operand of %s", name)
+}
+
+// jump writes call and jmp to a label, or through a register or memory.
+func (a *assembler) jump(name string, op operand) error {
+	digit, rel := 2, byte(0xe8)
+	if name == "jmp" {
+		digit, rel = 4, 0xe9
+	}
+
+	if op.kind == symOperand {
+		a.emit(rel)
+		a.rel32(op.sym)
+		return nil
+	}
+	if op.kind == memOperand && op.mem.size != 0 && op.mem.size != 8 {
+		return a.errorf("%s needs a qword", name)
+	}
+	if op.kind == regOperand && op.reg.size != 8 {
+		return a.errorf("%s needs a 64-bit register", name)
+	}
+	return a.modrm(nil, false, []byte{0xff}, digit, op, nil, false)
+}
+
+// rel32 writes the 32-bit distance to the label, from the end of the 4 bytes.
+func (a *assembler) rel32(sym string) {
+	offset := len(a.obj.sections[a.current])
+	a.addFixup(rel32, offset, offset+4, sym)
+	a.emit(0, 0, 0, 0)
+}
+
+func (a *assembler) conditional(name, prefix string, cc byte, ops []operand) error {
+	switch prefix {
+	case "j":
+		if err := a.operands(name, ops, 1); err != nil {
+			return err
+		}
+		if ops[0].kind != symOperand {
+			return a.errorf("%s needs a label", name)
+		}
+		a.emit(0x0f, 0x80+cc)
+		a.rel32(ops[0].sym)
+		return nil
+	case "set":
+		if err := a.operands(name, ops, 1); err != nil {
+			return err
+		}
+		if a.size(ops[0]) != 1 && !(ops[0].kind == memOperand && ops[0].mem.size == 0) {
+			return a.errorf("%s needs a byte", name)
+		}
+		return a.modrm(nil, false, []byte{0x0f, 0x90 + cc}, 0, ops[0], nil, needsREX(ops[0]))
+	default:
+		if err := a.operands(name, ops, 2); err != nil {
+			return err
+		}
+		dst := ops[0]
+		if dst.kind != regOperand || dst.reg.size < 2 || dst.reg.xmm {
+			return a.errorf("%s needs a register", name)
+		}
+		return a.modrm(sizePrefix(dst.reg.size), dst.reg.size == 8, []byte{0x0f, 0x40 + cc}, dst.reg.num, ops[1], nil, false)
+	}
+}
+
+// sse writes an instruction "op xmm, xmm/m64" with a mandatory prefix.
+func (a *assembler) sse(name string, prefix byte, w bool, opcode []byte, dst, src operand, imm []byte) error {
+	if !isXMM(dst) {
+		return a.errorf("%s needs an xmm register", name)
+	}
+	return a.modrm([]byte{prefix}, w, opcode, dst.reg.num, src, imm, false)
+}
+
+func (a *assembler) movq(ops []operand) error {
+	if err := a.operands("movq", ops, 2); err != nil {
+		return err
+	}
+	dst, src := ops[0], ops[1]
+
+	switch {
+	case isXMM(dst) && isXMM(src):
+		return a.modrm([]byte{0xf3}, false, []byte{0x0f, 0x7e}, dst.reg.num, src, nil, false)
+	case isXMM(dst):
+		if a.size(src) != 8 && !(src.kind == memOperand && src.mem.size == 0) {
+			return a.errorf("movq needs a 64-bit operand")
+		}
+		return a.modrm([]byte{0x66}, true, []byte{0x0f, 0x6e}, dst.reg.num, src, nil, false)
+	case isXMM(src):
+		if a.size(dst) != 8 && !(dst.kind == memOperand && dst.mem.size == 0) {
+			return a.errorf("movq needs a 64-bit operand")
+		}
+		return a.modrm([]byte{0x66}, true, []byte{0x0f, 0x7e}, src.reg.num, dst, nil, false)
+	}
+	return a.errorf("movq needs an xmm register")
+}
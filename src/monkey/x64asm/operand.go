@@ -0,0 +1,192 @@
+package x64asm
+
+import (
+	"strconv"
+	"strings"
+)
+
+type operandKind int
+
+const (
+	regOperand operandKind = iota
+	immOperand
+	memOperand
+	// a label of jmp, jcc or call
+	symOperand
+)
+
+type register struct {
+	num int
+	// bytes: 1, 2, 4 or 8. xmm registers are 16
+	size int
+	xmm  bool
+}
+
+type memory struct {
+	// -1 when there is none
+	base  int
+	index int
+	scale int
+	disp  int64
+	// sym[rip]
+	rip bool
+	sym string
+	// bytes given by "qword ptr" and so on, 0 when not given
+	size int
+}
+
+type operand struct {
+	kind operandKind
+	reg  register
+	imm  int64
+	mem  memory
+	sym  string
+}
+
+var registers = map[string]register{}
+
+func init() {
+	names := [][]string{
+		{"rax", "rcx", "rdx", "rbx", "rsp", "rbp", "rsi", "rdi"},
+		{"eax", "ecx", "edx", "ebx", "esp", "ebp", "esi", "edi"},
+		{"ax", "cx", "dx", "bx", "sp", "bp", "si", "di"},
+		// ah, ch, dh, bhは使わないので、4-7はREX付きのspl, bpl, sil, dil
+		{"al", "cl", "dl", "bl", "spl", "bpl", "sil", "dil"},
+	}
+	sizes := []int{8, 4, 2, 1}
+	suffixes := []string{"", "d", "w", "b"}
+
+	for i, size := range sizes {
+		for num, name := range names[i] {
+			registers[name] = register{num: num, size: size}
+		}
+		for num := 8; num < 16; num++ {
+			registers["r"+strconv.Itoa(num)+suffixes[i]] = register{num: num, size: size}
+		}
+	}
+	for num := 0; num < 16; num++ {
+		registers["xmm"+strconv.Itoa(num)] = register{num: num, size: 16, xmm: true}
+	}
+}
+
+var ptrSizes = map[string]int{
+	"byte":  1,
+	"word":  2,
+	"dword": 4,
+	"qword": 8,
+}
+
+func (a *assembler) parseOperand(s string) (operand, error) {
+	size := 0
+	if fields := strings.Fields(s); len(fields) >= 3 && fields[1] == "ptr" {
+		n, ok := ptrSizes[fields[0]]
+		if !ok {
+			return operand{}, a.errorf("unknown size %s", fields[0])
+		}
+		size = n
+		s = strings.Join(fields[2:], " ")
+	}
+
+	if i := strings.IndexByte(s, '['); i >= 0 {
+		m, err := a.parseMemory(s[:i], s[i:])
+		if err != nil {
+			return operand{}, err
+		}
+		m.size = size
+		return operand{kind: memOperand, mem: m}, nil
+	}
+	if size != 0 {
+		return operand{}, a.errorf("%s is not a memory operand", s)
+	}
+
+	if r, ok := registers[s]; ok {
+		return operand{kind: regOperand, reg: r}, nil
+	}
+	if n, ok := parseNumber(s); ok {
+		return operand{kind: immOperand, imm: n}, nil
+	}
+	if isSymbol(s) {
+		return operand{kind: symOperand, sym: s}, nil
+	}
+	return operand{}, a.errorf("bad operand %q", s)
+}
+
+// parseMemory parses sym[rip] or [base+index*scale+disp].
+func (a *assembler) parseMemory(sym, s string) (memory, error) {
+	m := memory{base: -1, index: -1, scale: 1}
+	if !strings.HasSuffix(s, "]") {
+		return m, a.errorf("bad memory operand %s%s", sym, s)
+	}
+	inner := strings.ReplaceAll(s[1:len(s)-1], " ", "")
+
+	if sym != "" {
+		// symbolはRIP相対でしか使わない
+		if inner != "rip" || !isSymbol(sym) {
+			return m, a.errorf("memory operand with a symbol must be %s[rip]", sym)
+		}
+		m.rip = true
+		m.sym = sym
+		return m, nil
+	}
+
+	// 符号を残したまま項に分ける: rbp+r13*8-24 -> rbp, +r13*8, -24
+	var terms []string
+	start := 0
+	for i := 1; i < len(inner); i++ {
+		if inner[i] == '+' || inner[i] == '-' {
+			terms = append(terms, inner[start:i])
+			start = i
+		}
+	}
+	terms = append(terms, inner[start:])
+
+	for _, term := range terms {
+		sign := int64(1)
+		switch term[0] {
+		case '-':
+			sign = -1
+			term = term[1:]
+		case '+':
+			term = term[1:]
+		}
+
+		if n, ok := parseNumber(term); ok {
+			m.disp += sign * n
+			continue
+		}
+
+		name, scale := term, 1
+		if i := strings.IndexByte(term, '*'); i >= 0 {
+			n, ok := parseNumber(term[i+1:])
+			if !ok || (n != 1 && n != 2 && n != 4 && n != 8) {
+				return m, a.errorf("bad scale in %s", s)
+			}
+			name, scale = term[:i], int(n)
+		}
+		r, ok := registers[name]
+		if !ok || r.size != 8 || r.xmm || sign < 0 {
+			return m, a.errorf("bad address %s", s)
+		}
+		switch {
+		case scale == 1 && m.base < 0:
+			m.base = r.num
+		case m.index < 0:
+			m.index = r.num
+			m.scale = scale
+		default:
+			return m, a.errorf("too many registers in %s", s)
+		}
+	}
+
+	// rspはindexにできないので、baseにする
+	if m.index == 4 && m.scale == 1 && m.base != 4 {
+		m.base, m.index = m.index, m.base
+	}
+	if m.index == 4 {
+		return m, a.errorf("rsp can't be an index in %s", s)
+	}
+	if m.disp < -1<<31 || m.disp >= 1<<31 {
+		return m, a.errorf("displacement of %s doesn't fit in 32 bits", s)
+	}
+	return m, nil
+}
@@ -0,0 +1,357 @@
+// Package x64asm assembles the Intel syntax written by gen_x64 and links it into a
+// static ELF64 executable for Linux, without the system assembler and linker.
+//
+//	obj, err := x64asm.Assemble(asm)
+//	exe, err := obj.Executable("_start")
+//
+// It knows only the instructions and the directives gen_x64 and its runtime use.
+// Jumps and calls to labels are always encoded with 32-bit displacements, and memory
+// operands with a symbol are RIP-relative, so the size of an instruction doesn't depend
+// on where its labels are and one pass is enough.
+package x64asm
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+type section int
+
+const (
+	text section = iota
+	rodata
+	data
+	bss
+	// .note.GNU-stack only marks the stack as not executable; nothing is written in it
+	note
+	numSections
+)
+
+var sectionNames = map[string]section{
+	".text":           text,
+	".rodata":         rodata,
+	".data":           data,
+	".bss":            bss,
+	".note.GNU-stack": note,
+}
+
+type symbol struct {
+	section section
+	offset  int
+}
+
+type fixupKind int
+
+const (
+	// the 32-bit distance from the end of the instruction to the symbol
+	rel32 fixupKind = iota
+	// the 64-bit address of the symbol
+	abs64
+)
+
+// fixup is a symbol whose address is written when the sections are laid out.
+type fixup struct {
+	kind    fixupKind
+	section section
+	offset  int
+	// end of the instruction, for rel32
+	end    int
+	symbol string
+	line   int
+}
+
+// Object is an assembled program.
+type Object struct {
+	sections [numSections][]byte
+	// .bss has no bytes, only a size
+	bssSize int
+	symbols map[string]symbol
+	fixups  []fixup
+}
+
+type assembler struct {
+	obj     *Object
+	current section
+	line    int
+}
+
+// Assemble assembles src. Every label is visible to Executable, as if it were .global.
+func Assemble(src string) (*Object, error) {
+	a := &assembler{
+		obj:     &Object{symbols: make(map[string]symbol)},
+		current: text,
+	}
+
+	for i, line := range strings.Split(src, "\n") {
+		a.line = i + 1
+		err := a.assembleLine(line)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, f := range a.obj.fixups {
+		if _, ok := a.obj.symbols[f.symbol]; !ok {
+			return nil, fmt.Errorf("x64asm: line %d: undefined symbol %s", f.line, f.symbol)
+		}
+	}
+	return a.obj, nil
+}
+
+func (a *assembler) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("x64asm: line %d: %s", a.line, fmt.Sprintf(format, args...))
+}
+
+func (a *assembler) assembleLine(line string) error {
+	line = strings.TrimSpace(stripComment(line))
+	if line == "" {
+		return nil
+	}
+
+	// label
+	if i := strings.IndexByte(line, ':'); i > 0 && isSymbol(line[:i]) {
+		err := a.define(line[:i])
+		if err != nil {
+			return err
+		}
+		line = strings.TrimSpace(line[i+1:])
+		if line == "" {
+			return nil
+		}
+	}
+
+	name, args := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		name, args = line[:i], strings.TrimSpace(line[i+1:])
+	}
+	if name[0] == '.' {
+		return a.directive(name, args)
+	}
+
+	// rep stosq などのprefixは命令の一部として扱う
+	if name == "rep" {
+		return a.instruction(name+" "+args, nil)
+	}
+	var operands []operand
+	if args != "" {
+		for _, s := range strings.Split(args, ",") {
+			op, err := a.parseOperand(strings.TrimSpace(s))
+			if err != nil {
+				return err
+			}
+			operands = append(operands, op)
+		}
+	}
+	return a.instruction(name, operands)
+}
+
+// stripComment removes a comment from # to the end of line, except in a string.
+func stripComment(line string) string {
+	quoted := false
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quoted && line[i] == '\\':
+			i++
+		case line[i] == '"':
+			quoted = !quoted
+		case !quoted && line[i] == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func isSymbol(s string) bool {
+	if s == "" || ('0' <= s[0] && s[0] <= '9') {
+		return false
+	}
+	for _, c := range s {
+		if !(c == '_' || c == '.' || c == '$' || ('0' <= c && c <= '9') ||
+			('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')) {
+			return false
+		}
+	}
+	return true
+}
+
+func (a *assembler) define(name string) error {
+	if _, ok := a.obj.symbols[name]; ok {
+		return a.errorf("symbol %s is already defined", name)
+	}
+	offset := len(a.obj.sections[a.current])
+	if a.current == bss {
+		offset = a.obj.bssSize
+	}
+	a.obj.symbols[name] = symbol{section: a.current, offset: offset}
+	return nil
+}
+
+func (a *assembler) directive(name, args string) error {
+	switch name {
+	case ".intel_syntax", ".global", ".globl":
+		// すべてのsymbolはglobalとして扱う
+		return nil
+	case ".text", ".data", ".bss":
+		a.current = sectionNames[name]
+		return nil
+	case ".section":
+		s := strings.TrimSpace(strings.Split(args, ",")[0])
+		sec, ok := sectionNames[s]
+		if !ok {
+			return a.errorf("unknown section %s", s)
+		}
+		a.current = sec
+		return nil
+	case ".zero":
+		n, err := a.parseCount(args)
+		if err != nil {
+			return err
+		}
+		return a.zero(n)
+	case ".align":
+		n, err := a.parseCount(args)
+		if err != nil {
+			return err
+		}
+		if n == 0 || n&(n-1) != 0 {
+			return a.errorf("alignment %d is not a power of 2", n)
+		}
+		size := len(a.obj.sections[a.current])
+		if a.current == bss {
+			size = a.obj.bssSize
+		}
+		return a.zero((n - size%n) % n)
+	}
+
+	if a.current == bss {
+		return a.errorf("%s in .bss", name)
+	}
+	switch name {
+	case ".quad":
+		for _, s := range strings.Split(args, ",") {
+			s = strings.TrimSpace(s)
+			if n, ok := parseNumber(s); ok {
+				a.emit(le64(uint64(n))...)
+				continue
+			}
+			if !isSymbol(s) {
+				return a.errorf("bad .quad value %q", s)
+			}
+			a.addFixup(abs64, len(a.obj.sections[a.current]), 0, s)
+			a.emit(make([]byte, 8)...)
+		}
+		return nil
+	case ".string", ".ascii":
+		b, err := a.parseString(args)
+		if err != nil {
+			return err
+		}
+		a.emit(b...)
+		if name == ".string" {
+			a.emit(0)
+		}
+		return nil
+	}
+	return a.errorf("unknown directive %s", name)
+}
+
+func (a *assembler) parseCount(s string) (int, error) {
+	n, ok := parseNumber(s)
+	if !ok || n < 0 {
+		return 0, a.errorf("bad number %q", s)
+	}
+	return int(n), nil
+}
+
+func (a *assembler) zero(n int) error {
+	if a.current == bss {
+		a.obj.bssSize += n
+		return nil
+	}
+	a.emit(make([]byte, n)...)
+	return nil
+}
+
+// parseString parses a quoted string with the escapes of the GNU assembler:
+// \n, \t, \", \\ and octal \ooo.
+func (a *assembler) parseString(s string) ([]byte, error) {
+	if len(s) < 2 || s[0] != '"' || s[len(s)-1] != '"' {
+		return nil, a.errorf("bad string %s", s)
+	}
+	s = s[1 : len(s)-1]
+
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		if i == len(s) {
+			return nil, a.errorf("bad escape at the end of a string")
+		}
+		switch c := s[i]; {
+		case c == 'n':
+			out = append(out, '\n')
+		case c == 't':
+			out = append(out, '\t')
+		case c == '"' || c == '\\':
+			out = append(out, c)
+		case '0' <= c && c <= '7':
+			v := 0
+			for j := 0; j < 3 && i < len(s) && '0' <= s[i] && s[i] <= '7'; j++ {
+				v = v*8 + int(s[i]-'0')
+				i++
+			}
+			i--
+			out = append(out, byte(v))
+		default:
+			return nil, a.errorf("unknown escape \\%c", c)
+		}
+	}
+	return out, nil
+}
+
+// parseNumber parses a decimal or 0x hexadecimal number. Hexadecimal numbers up to 64 bits
+// are allowed, as the bits of a negative number.
+func parseNumber(s string) (int64, bool) {
+	if n, err := strconv.ParseInt(s, 0, 64); err == nil {
+		return n, true
+	}
+	if n, err := strconv.ParseUint(s, 0, 64); err == nil {
+		return int64(n), true
+	}
+	return 0, false
+}
+
+func (a *assembler) emit(b ...byte) {
+	a.obj.sections[a.current] = append(a.obj.sections[a.current], b...)
+}
+
+func (a *assembler) addFixup(kind fixupKind, offset, end int, name string) {
+	a.obj.fixups = append(a.obj.fixups, fixup{
+		kind:    kind,
+		section: a.current,
+		offset:  offset,
+		end:     end,
+		symbol:  name,
+		line:    a.line,
+	})
+}
+
+func le64(v uint64) []byte {
+	b := make([]byte, 8)
+	for i := range b {
+		b[i] = byte(v >> (8 * i))
+	}
+	return b
+}
+
+func le32(v uint32) []byte {
+	return []byte{byte(v), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+}
+
+func le16(v uint16) []byte {
+	return []byte{byte(v), byte(v >> 8)}
+}
@@ -0,0 +1,212 @@
+package x64asm
+
+import (
+	"bytes"
+	"encoding/hex"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// TestInstructions checks the encodings against GNU as.
+// monkey_heap is in .bss, so RIP-relative operands have zeros until Executable.
+func TestInstructions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"ret", "c3"},
+		{"syscall", "0f05"},
+		{"cqo", "4899"},
+		{"leave", "c9"},
+		{"rep stosq", "f348ab"},
+		{"push rbp", "55"},
+		{"push r12", "4154"},
+		{"pop r15", "415f"},
+		{"push 2", "6a02"},
+		{"mov rbp, rsp", "4889e5"},
+		{"mov rax, 42", "48c7c02a000000"},
+		{"mov rax, -1", "48c7c0ffffffff"},
+		{"mov rax, 0x123456789", "48b88967452301000000"},
+		{"mov eax, 60", "b83c000000"},
+		{"mov r10d, 1", "41ba01000000"},
+		{"mov qword ptr [rbp-8], 2", "48c745f802000000"},
+		{"mov rax, qword ptr [rbp+16]", "488b4510"},
+		{"mov qword ptr [rsp], rdi", "48893c24"},
+		{"mov rax, [r12+rcx*8+8]", "498b44cc08"},
+		{"mov byte ptr [rdi], al", "8807"},
+		{"mov rax, monkey_heap[rip]", "488b0500000000"},
+		{"mov monkey_heap[rip], rdx", "48891500000000"},
+		{"lea rdi, monkey_heap[rip]", "488d3d00000000"},
+		{"lea rax, [r13+8]", "498d4508"},
+		{"movzx eax, byte ptr [rsi+rcx]", "0fb6040e"},
+		{"movzx eax, al", "0fb6c0"},
+		{"add rax, 8", "4883c008"},
+		{"sub rsp, rbx", "4829dc"},
+		{"and rax, -8", "4883e0f8"},
+		{"cmp rax, 2", "4883f802"},
+		{"cmp qword ptr [rbp-16], 0", "48837df000"},
+		{"xor ebp, ebp", "31ed"},
+		{"test rax, rax", "4885c0"},
+		{"imul rax, rcx", "480fafc1"},
+		{"neg rax", "48f7d8"},
+		{"not rdx", "48f7d2"},
+		{"idiv rcx", "48f7f9"},
+		{"sar rax, 1", "48d1f8"},
+		{"shl rax, cl", "48d3e0"},
+		{"shr rdx, 56", "48c1ea38"},
+		{"sete al", "0f94c0"},
+		{"setl cl", "0f9cc1"},
+		{"cmovne rax, rdx", "480f45c2"},
+		{"cvtsi2sd xmm0, rax", "f2480f2ac0"},
+		{"cvttsd2si rax, xmm1", "f2480f2cc1"},
+		{"addsd xmm0, xmm1", "f20f58c1"},
+		{"ucomisd xmm0, xmm1", "660f2ec1"},
+		{"movq xmm0, rax", "66480f6ec0"},
+		{"movq rax, xmm0", "66480f7ec0"},
+		{"roundsd xmm0, xmm1, 3", "660f3a0bc103"},
+		{"call rax", "ffd0"},
+		{"jmp rcx", "ffe1"},
+		// asはraxやalに短い形を使うが、同じ命令になる
+		{"add rax, 1000", "4881c0e8030000"},
+		{"test al, 1", "f6c001"},
+		{"xchg rax, rcx", "4887c8"},
+	}
+
+	for _, tt := range tests {
+		obj, err := Assemble(".bss\nmonkey_heap: .zero 8\n.text\n" + tt.input)
+		if err != nil {
+			t.Errorf("%q: %s", tt.input, err)
+			continue
+		}
+		actual := hex.EncodeToString(obj.sections[text])
+		if actual != tt.expected {
+			t.Errorf("%q: wrong encoding. want=%s, got=%s", tt.input, tt.expected, actual)
+		}
+	}
+}
+
+func TestDirectives(t *testing.T) {
+	input := `
+.data
+a: .quad 0xffffffffffffffff
+.align 16
+b: .string "a\n\"\\\101"  # comment
+.section .rodata
+c: .ascii "x#y"
+.bss
+d: .zero 24
+`
+	obj, err := Assemble(input)
+	if err != nil {
+		t.Fatalf("assemble error: %s", err)
+	}
+
+	expected := append(le64(^uint64(0)), make([]byte, 8)...)
+	expected = append(expected, "a\n\"\\A\x00"...)
+	if !bytes.Equal(obj.sections[data], expected) {
+		t.Errorf("wrong .data. want=%q, got=%q", expected, obj.sections[data])
+	}
+	if string(obj.sections[rodata]) != "x#y" {
+		t.Errorf("wrong .rodata. got=%q", obj.sections[rodata])
+	}
+	if obj.bssSize != 24 {
+		t.Errorf("wrong .bss size. want=24, got=%d", obj.bssSize)
+	}
+	if s := obj.symbols["b"]; s.section != data || s.offset != 16 {
+		t.Errorf("wrong symbol b. got=%+v", s)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		{"bsr rax, rcx", "x64asm: line 1: unknown instruction bsr"},
+		{"jmp nowhere", "x64asm: line 1: undefined symbol nowhere"},
+		{"a:\na:", "x64asm: line 2: symbol a is already defined"},
+		{"mov rax, [rsp*2]", "x64asm: line 1: rsp can't be an index in [rsp*2]"},
+		{".weak main", "x64asm: line 1: unknown directive .weak"},
+		{".bss\n.quad 1", "x64asm: line 2: .quad in .bss"},
+	}
+
+	for _, tt := range tests {
+		_, err := Assemble(tt.input)
+		if err == nil {
+			t.Errorf("%q: expected an error", tt.input)
+			continue
+		}
+		if err.Error() != tt.expected {
+			t.Errorf("%q: wrong error. want=%q, got=%q", tt.input, tt.expected, err)
+		}
+	}
+}
+
+// TestExecutable links a program which writes a message from .rodata with a counter in .data
+// and .bss, and runs it.
+func TestExecutable(t *testing.T) {
+	input := `.intel_syntax noprefix
+.text
+.global _start
+_start:
+	mov rax, count[rip]
+	mov total[rip], rax
+loop:
+	call write
+	sub qword ptr total[rip], 1
+	cmp qword ptr total[rip], 0
+	jne loop
+	mov rax, message_ptr[rip]
+	movzx edi, byte ptr [rax]
+	mov eax, 60
+	syscall
+write:
+	mov eax, 1
+	mov edi, 1
+	lea rsi, message[rip]
+	mov edx, 6
+	syscall
+	ret
+.section .rodata
+message: .ascii "hello\n"
+.data
+count: .quad 3
+message_ptr: .quad message
+.bss
+total: .zero 8
+.section .note.GNU-stack,"",@progbits
+`
+	obj, err := Assemble(input)
+	if err != nil {
+		t.Fatalf("assemble error: %s", err)
+	}
+	exe, err := obj.Executable("_start")
+	if err != nil {
+		t.Fatalf("link error: %s", err)
+	}
+
+	err = os.WriteFile("/tmp/x64asmtmp", exe, 0755)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	defer os.Remove("/tmp/x64asmtmp")
+
+	out, err := exec.Command("/tmp/x64asmtmp").Output()
+	exit, ok := err.(*exec.ExitError)
+	if !ok {
+		t.Fatalf("expected exit status 'h'. got=%v", err)
+	}
+	if exit.ExitCode() != 'h' {
+		t.Errorf("wrong exit status. want=%d, got=%d", 'h', exit.ExitCode())
+	}
+	if string(out) != strings.Repeat("hello\n", 3) {
+		t.Errorf("wrong output. got=%q", out)
+	}
+
+	_, err = obj.Executable("main")
+	if err == nil || err.Error() != "x64asm: undefined symbol main" {
+		t.Errorf("wrong error for an undefined entry. got=%v", err)
+	}
+}